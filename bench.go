@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// bench measures the round trips of messages of each size through a
+// server's echo, over a number of connections at once, and prints their
+// throughput and latency percentiles. With -load, it load tests a server
+// run with serve -load-test instead, printing the throughput each way.
+func bench(fs *flag.FlagSet, args []string) {
+	client := clientFlags(fs)
+	sizes := sizeList{64, 1024, 16 << 10, 256 << 10}
+	fs.Var(&sizes, "sizes", "Comma-separated message sizes to measure, in bytes or with a K or M suffix")
+	concurrency := fs.Int("concurrency", 1, "Number of connections sending messages at once")
+	dur := fs.Duration("duration", 5*time.Second, "How long to measure each message size, or the load test, for")
+	load := fs.String("load", "", "Load test a server run with serve -load-test, sending data up, down or both ways, instead of echoing messages")
+	interval := fs.Duration("interval", time.Second, "How often to print the throughput of -load")
+	fs.Parse(args)
+	dir, ok := loadDirections[*load]
+	if fs.NArg() != 1 || *concurrency < 1 || *dur <= 0 || *interval <= 0 || (*load != "" && !ok) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr := fs.Arg(0)
+	if !strings.Contains(addr, ":") {
+		// A bare port, as send takes.
+		addr = "localhost:" + addr
+	}
+
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns := make([]*secure.SecureConn, *concurrency)
+	var handshakes []time.Duration
+	for i := range conns {
+		start := time.Now()
+		c, err := secure.DialWithConfig(context.Background(), addr, config)
+		if err == nil {
+			err = c.Handshake()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer c.Close()
+		handshakes = append(handshakes, time.Since(start))
+		conns[i] = c
+	}
+	slices.Sort(handshakes)
+	fmt.Printf("handshakes: %d, p50 %v, max %v\n\n", len(conns),
+		percentile(handshakes, 0.5).Round(time.Microsecond), handshakes[len(handshakes)-1].Round(time.Microsecond))
+
+	if *load != "" {
+		if err := benchLoad(conns, dir, *dur, *interval); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Each size is printed as soon as it is measured.
+	fmt.Printf("%9s %9s %9s %10s %10s %10s %10s\n", "size", "msgs/s", "MB/s", "p50", "p90", "p99", "max")
+	for _, size := range sizes {
+		r, err := benchSize(conns, size, *dur)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%9d %9.0f %9.2f %10v %10v %10v %10v\n", size, r.rate(), r.throughput()/1e6,
+			r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.percentile(1))
+	}
+}
+
+// benchInlineWrite is the largest message that bench writes before reading
+// its echo. Larger ones are written while the echo is read, or the server,
+// which echoes as it reads, could fill the socket buffers both ways.
+const benchInlineWrite = 64 << 10
+
+// benchResult holds the round trips of one message size.
+type benchResult struct {
+	size      int
+	elapsed   time.Duration
+	latencies []time.Duration // sorted
+}
+
+// benchSize sends messages of size bytes on every connection at once, each
+// after the echo of the one before, for d, and returns their round trips.
+func benchSize(conns []*secure.SecureConn, size int, d time.Duration) (*benchResult, error) {
+	latencies := make([][]time.Duration, len(conns))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(d)
+	for i, c := range conns {
+		wg.Go(func() {
+			// Random messages, so that compression doesn't flatter them.
+			msg, echo := make([]byte, size), make([]byte, size)
+			rand.Read(msg)
+			for time.Now().Before(deadline) {
+				sent := time.Now()
+				if errs[i] = roundTrip(c, msg, echo); errs[i] != nil {
+					return
+				}
+				latencies[i] = append(latencies[i], time.Since(sent))
+			}
+		})
+	}
+	wg.Wait()
+	r := &benchResult{size: size, elapsed: time.Since(start), latencies: slices.Concat(latencies...)}
+	for _, err := range errs {
+		if err != nil {
+			return r, err
+		}
+	}
+	slices.Sort(r.latencies)
+	return r, nil
+}
+
+// roundTrip writes msg to c and reads its echo into echo.
+func roundTrip(c *secure.SecureConn, msg, echo []byte) error {
+	if len(msg) <= benchInlineWrite {
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(c, echo)
+		return err
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(msg)
+		written <- err
+	}()
+	_, err := io.ReadFull(c, echo)
+	if werr := <-written; werr != nil {
+		return werr
+	}
+	return err
+}
+
+// rate returns the round trips made per second.
+func (r *benchResult) rate() float64 {
+	return float64(len(r.latencies)) / r.elapsed.Seconds()
+}
+
+// throughput returns the bytes per second sent each way.
+func (r *benchResult) throughput() float64 {
+	return r.rate() * float64(r.size)
+}
+
+// percentile returns the round trip that a fraction p of them took no
+// longer than, rounded to the microsecond.
+func (r *benchResult) percentile(p float64) time.Duration {
+	return percentile(r.latencies, p).Round(time.Microsecond)
+}
+
+// percentile returns the nearest-rank percentile p, between 0 and 1, of
+// the sorted durations, or zero if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// sizeList is a comma-separated list of sizes in bytes, each optionally
+// with a K or M suffix for KiB or MiB.
+type sizeList []int
+
+func (l *sizeList) String() string {
+	sizes := make([]string, len(*l))
+	for i, n := range *l {
+		sizes[i] = strconv.Itoa(n)
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (l *sizeList) Set(s string) error {
+	*l = nil
+	for _, arg := range strings.Split(s, ",") {
+		size, shift := arg, 0
+		switch {
+		case strings.HasSuffix(size, "K"):
+			size, shift = strings.TrimSuffix(size, "K"), 10
+		case strings.HasSuffix(size, "M"):
+			size, shift = strings.TrimSuffix(size, "M"), 20
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 || n > 1<<(30-shift) {
+			return fmt.Errorf("bad size %q", arg)
+		}
+		*l = append(*l, n<<shift)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+func TestSizeList(t *testing.T) {
+	var sizes sizeList
+	if err := sizes.Set("64,4K,1M"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (sizeList{64, 4 << 10, 1 << 20}); !slices.Equal(sizes, want) {
+		t.Fatalf("Unexpected sizes: %v != %v", sizes, want)
+	}
+	for _, bad := range []string{"", "0", "-1", "1G", "2048M", "1,x"} {
+		if err := sizes.Set(bad); err == nil {
+			t.Errorf("Set(%q) accepted %v", bad, sizes)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {0.5, 50}, {0.9, 90}, {0.99, 99}, {1, 100}} {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("percentile of nothing = %v, want 0", got)
+	}
+}
+
+func TestBenchSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &secure.SecureServer{}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	var conns []*secure.SecureConn
+	for range 2 {
+		c, err := secure.DialWithConfig(context.Background(), l.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	// Messages too large to write before reading their echo, too.
+	for _, size := range []int{100, 4 * benchInlineWrite} {
+		r, err := benchSize(conns, size, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.latencies) < len(conns) || r.rate() <= 0 || r.throughput() != r.rate()*float64(size) {
+			t.Fatalf("Unexpected result for size %d: %d round trips, %v/s", size, len(r.latencies), r.rate())
+		}
+		if !slices.IsSorted(r.latencies) || r.percentile(0.5) > r.percentile(1) {
+			t.Fatalf("Latencies of size %d are not sorted", size)
+		}
+	}
+}
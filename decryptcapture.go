@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// decryptCapture decrypts the connections in a packet capture, or in raw
+// dumps of what each end sent, with a key log or the key pair of either
+// end, and prints the messages they exchanged.
+func decryptCapture(fs *flag.FlagSet, args []string) {
+	keyLogFile := fs.String("keylog", "", "Key log, as written to GOCHAL2_KEYLOGFILE")
+	keyFile := fs.String("key", "", "Private key file of either end, for sessions missing from -keylog")
+	clientDump := fs.String("client", "", "Raw dump of what the client sent, instead of a capture. Needs -server")
+	serverDump := fs.String("server", "", "Raw dump of what the server sent, instead of a capture. Needs -client")
+	fs.Parse(args)
+	raw := *clientDump != "" || *serverDump != ""
+	if (raw && (fs.NArg() != 0 || *clientDump == "" || *serverDump == "")) || (!raw && fs.NArg() != 1) ||
+		(*keyLogFile == "" && *keyFile == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var keys secure.CaptureKeys
+	if *keyLogFile != "" {
+		f, err := os.Open(*keyLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys.KeyLog, err = secure.ParseKeyLog(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *keyLogFile, err)
+		}
+	}
+	if *keyFile != "" {
+		var err error
+		if keys.Keys, err = loadKeyPair(*keyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if raw {
+		client, err := os.ReadFile(*clientDump)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server, err := os.ReadFile(*serverDump)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fromClient, fromServer, err := secure.DecryptCapture(client, server, keys)
+		for _, m := range append(fromClient, fromServer...) {
+			printCapturedMessage(time.Time{}, m)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conns, err := readCapture(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range conns {
+		fmt.Printf("== %s -> %s\n", c.client.src, c.client.dst)
+		fromClient, fromServer, err := secure.DecryptCapture(c.client.data, c.server.data, keys)
+		type timed struct {
+			at time.Time
+			m  secure.CapturedMessage
+		}
+		var msgs []timed
+		for _, m := range fromClient {
+			msgs = append(msgs, timed{c.client.timeAt(m.End), m})
+		}
+		for _, m := range fromServer {
+			msgs = append(msgs, timed{c.server.timeAt(m.End), m})
+		}
+		slices.SortStableFunc(msgs, func(a, b timed) int { return a.at.Compare(b.at) })
+		for _, t := range msgs {
+			printCapturedMessage(t.at, t.m)
+		}
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+}
+
+// printCapturedMessage prints m, sent at t if t is known.
+func printCapturedMessage(t time.Time, m secure.CapturedMessage) {
+	from := "server"
+	if m.From == secure.ClientRole {
+		from = "client"
+	}
+	if !t.IsZero() {
+		fmt.Printf("%s ", t.Format("15:04:05.000000"))
+	}
+	fmt.Printf("%s: %q\n", from, m.Data)
+}
+
+// capturedConn is a TCP connection reassembled from a capture.
+type capturedConn struct {
+	client, server *tcpFlow
+}
+
+// tcpFlow is one direction of a captured TCP connection.
+type tcpFlow struct {
+	src, dst string
+
+	// isn is the sequence number of the SYN, if one was captured.
+	isn    uint32
+	hasSYN bool
+
+	segments []tcpSegment
+
+	// data is the reassembled stream, and ends the offset just past each
+	// segment in it, with the time the segment was captured.
+	data []byte
+	ends []segmentEnd
+}
+
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+	at   time.Time
+}
+
+type segmentEnd struct {
+	end int
+	at  time.Time
+}
+
+// packetSource reads the packets of a pcap or pcapng file.
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// pcapngMagic starts pcapng files.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// readCapture reads the TCP connections in the pcap or pcapng file at path
+// that carry the secure protocol.
+func readCapture(path string) ([]capturedConn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(pcapngMagic))
+	var src packetSource
+	if bytes.Equal(magic, pcapngMagic) {
+		src, err = pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	} else {
+		src, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	flows := map[string]*tcpFlow{}
+	var order []string
+	for {
+		data, ci, err := src.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		packet := gopacket.NewPacket(data, src.LinkType(), gopacket.NoCopy)
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok || packet.NetworkLayer() == nil {
+			continue
+		}
+		nf := packet.NetworkLayer().NetworkFlow()
+		key := fmt.Sprintf("%s:%d -> %s:%d", nf.Src(), tcp.SrcPort, nf.Dst(), tcp.DstPort)
+		flow, ok := flows[key]
+		if !ok {
+			flow = &tcpFlow{
+				src: fmt.Sprintf("%s:%d", nf.Src(), tcp.SrcPort),
+				dst: fmt.Sprintf("%s:%d", nf.Dst(), tcp.DstPort),
+			}
+			flows[key] = flow
+			order = append(order, key)
+		}
+		if tcp.SYN {
+			flow.isn, flow.hasSYN = tcp.Seq, true
+		}
+		if len(tcp.Payload) > 0 {
+			flow.segments = append(flow.segments, tcpSegment{tcp.Seq, tcp.Payload, ci.Timestamp})
+		}
+	}
+
+	var conns []capturedConn
+	for _, key := range order {
+		flow := flows[key]
+		flow.reassemble()
+		if !secure.IsClientCapture(flow.data) {
+			continue
+		}
+		server, ok := flows[fmt.Sprintf("%s -> %s", flow.dst, flow.src)]
+		if !ok {
+			continue
+		}
+		server.reassemble()
+		conns = append(conns, capturedConn{client: flow, server: server})
+	}
+	return conns, nil
+}
+
+// reassemble puts the flow's segments in order, dropping retransmissions,
+// and stops at the first gap.
+func (f *tcpFlow) reassemble() {
+	if f.data != nil || len(f.segments) == 0 {
+		return
+	}
+	base := f.segments[0].seq
+	if f.hasSYN {
+		base = f.isn + 1
+	}
+	slices.SortStableFunc(f.segments, func(a, b tcpSegment) int {
+		return int(int32(a.seq-base)) - int(int32(b.seq-base))
+	})
+	f.data = []byte{}
+	for _, s := range f.segments {
+		off := int(int32(s.seq - base))
+		if off > len(f.data) {
+			break
+		}
+		if off < 0 {
+			continue
+		}
+		if end := off + len(s.data); end > len(f.data) {
+			f.data = append(f.data, s.data[len(f.data)-off:]...)
+			f.ends = append(f.ends, segmentEnd{end, s.at})
+		}
+	}
+}
+
+// timeAt returns when the byte before offset end was captured.
+func (f *tcpFlow) timeAt(end int) time.Time {
+	for _, e := range f.ends {
+		if e.end >= end {
+			return e.at
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// discover lists the servers announcing themselves on the local network.
+func discover(fs *flag.FlagSet, args []string) {
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for servers to answer")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	peers, err := browseLAN(*timeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, peer := range peers {
+		fmt.Printf("%s\t%s\t%s\n", peer.Instance, peer.Addr, peer.Fingerprint)
+	}
+}
+
+// browseLAN returns the servers on the local network that answer within
+// timeout.
+func browseLAN(timeout time.Duration) ([]secure.LANPeer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return secure.BrowseLAN(ctx)
+}
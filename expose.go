@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// expose makes a local service reachable through a server run with
+// "serve -reverse", which forwards the connections it accepts to it.
+func expose(fs *flag.FlagSet, args []string) {
+	client := clientFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr, local := fs.Arg(0), fs.Arg(1)
+
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("exposing %s through %s", local, addr)
+	secure.ServeReverseTunnel(ctx, addr, local, config)
+}
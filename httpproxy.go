@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// httpproxy runs an HTTP CONNECT proxy on a local address that connects on
+// from a server run with "serve -socks".
+func httpproxy(fs *flag.FlagSet, args []string) {
+	client := clientFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	listenAddr, addr := fs.Arg(0), fs.Arg(1)
+
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("HTTP proxy on %s connecting through %s", l.Addr(), addr)
+	log.Fatal(secure.ServeHTTPProxy(l, addr, config))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// keygen generates a key pair and saves it, so that identities can be
+// provisioned ahead of time.
+func keygen(fs *flag.FlagSet, args []string) {
+	keyFile := fs.String("o", "gochal2.key", "Private key file to write, or keychain:NAME to save the key in the platform's keychain")
+	pubFile := fs.String("pub", "", "Public key file to write (default: -o file or keychain name + .pub)")
+	age := fs.Bool("age", false, "Write the key pair in the format of age-keygen, so that age can use it as an identity and recipient")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *age && strings.HasPrefix(*keyFile, keychainPrefix) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	keys, err := secure.GenerateKeyPair()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *age {
+		err = saveAgeKeys(keys, *keyFile, *pubFile)
+	} else {
+		err = saveKeys(keys, *keyFile, *pubFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(secure.Fingerprint(keys.Public))
+}
+
+// keyFlags defines the flags naming the key pair of serve and send.
+func keyFlags(fs *flag.FlagSet) (keyFile, pubFile *string) {
+	keyFile = fs.String("key", "", keyUsage)
+	pubFile = fs.String("pub", "", pubUsage)
+	return keyFile, pubFile
+}
+
+const (
+	keyUsage = "Private key file, an unencrypted OpenSSH Ed25519 key such as ~/.ssh/id_ed25519, an age key file, or keychain:NAME for a key in the platform's keychain. Created with a new key pair if missing"
+	pubUsage = "Public key file written with a new key pair (default: -key file or keychain name + .pub)"
+)
+
+// keychainPrefix marks a key location as the name of a key in the
+// platform's keychain rather than a file.
+const keychainPrefix = "keychain:"
+
+// loadKeyPair loads the key pair at location, a key file or a keychain key.
+func loadKeyPair(location string) (*secure.KeyPair, error) {
+	if name, ok := strings.CutPrefix(location, keychainPrefix); ok {
+		return secure.LoadKeychainKeyPair(name)
+	}
+	return secure.LoadKeyPair(location)
+}
+
+// saveKeys saves keys at location, a key file or a keychain key, and the
+// public key to pubFile, which defaults to the file or keychain name with
+// .pub appended.
+func saveKeys(keys *secure.KeyPair, location, pubFile string) error {
+	name, keychain := strings.CutPrefix(location, keychainPrefix)
+	if pubFile == "" {
+		pubFile = name + ".pub"
+	}
+	if !keychain {
+		return secure.SaveKeyPair(keys, location, pubFile)
+	}
+	if err := secure.SaveKeychainKeyPair(keys, name); err != nil {
+		return err
+	}
+	return os.WriteFile(pubFile, secure.MarshalPublicKey(keys.Public), 0644)
+}
+
+// saveAgeKeys saves keys to keyFile as an age key file, and the public key
+// to pubFile, which defaults to keyFile with .pub appended, as an age
+// recipient.
+func saveAgeKeys(keys *secure.KeyPair, keyFile, pubFile string) error {
+	if pubFile == "" {
+		pubFile = keyFile + ".pub"
+	}
+	if err := secure.SaveAgeKeyPair(keys, keyFile); err != nil {
+		return err
+	}
+	return os.WriteFile(pubFile, []byte(secure.MarshalAgeRecipient(keys.Public)+"\n"), 0644)
+}
+
+// loadKeys loads the key pair at keyFile, generating and saving one if
+// there is none. It returns nil if keyFile is empty, so that a fresh
+// key pair is used.
+func loadKeys(keyFile, pubFile string) (*secure.KeyPair, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	keys, err := loadKeyPair(keyFile)
+	if !errors.Is(err, os.ErrNotExist) {
+		return keys, err
+	}
+	if keys, err = secure.GenerateKeyPair(); err != nil {
+		return nil, err
+	}
+	return keys, saveKeys(keys, keyFile, pubFile)
+}
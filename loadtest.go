@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// Directions of a load test, which the client names in the first byte it
+// sends: data flows up from the client, down from the server or both ways
+// at once.
+const (
+	loadUp   byte = 'u'
+	loadDown byte = 'd'
+	loadBoth byte = 'b'
+)
+
+// loadDirections maps the values of bench -load to the directions.
+var loadDirections = map[string]byte{"up": loadUp, "down": loadDown, "both": loadBoth}
+
+// loadWriteSize is how much a load test writes at once.
+const loadWriteSize = 256 << 10
+
+// loadMeter counts the bytes a load test moves each way.
+type loadMeter struct {
+	recv, sent atomic.Int64
+}
+
+// Write counts p as received, for io.Copy to sink into.
+func (m *loadMeter) Write(p []byte) (int, error) {
+	m.recv.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// source writes random data to w as fast as it takes it, counting it as
+// sent, until a write fails or stop is closed.
+func (m *loadMeter) source(w io.Writer, stop <-chan struct{}) {
+	buf := make([]byte, loadWriteSize)
+	rand.Read(buf)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		n, err := w.Write(buf)
+		m.sent.Add(int64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// report calls interval with the bytes moved since the last call every
+// period until stop is closed, then returns the totals and how long the
+// meter ran.
+func (m *loadMeter) report(period time.Duration, stop <-chan struct{}, interval func(from, to time.Duration, recv, sent int64)) (recv, sent int64, elapsed time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	var last time.Duration
+	var lastRecv, lastSent int64
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Since(start)
+			recv, sent := m.recv.Load(), m.sent.Load()
+			interval(last, now, recv-lastRecv, sent-lastSent)
+			last, lastRecv, lastSent = now, recv, sent
+		case <-stop:
+			return m.recv.Load(), m.sent.Load(), time.Since(start)
+		}
+	}
+}
+
+// mbps returns n bytes over d in megabits per second, to two decimals.
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return math.Round(float64(n)*8/1e4/d.Seconds()) / 100
+}
+
+// loadHandler serves load tests: it discards what clients send and, if
+// they ask for data to flow down, sends them data as fast as they take it,
+// logging the throughput of each connection every period and once the
+// client closes it.
+func loadHandler(logger *slog.Logger, period time.Duration) secure.Handler {
+	return secure.HandlerFunc(func(conn net.Conn) {
+		defer conn.Close()
+		remote := conn.RemoteAddr().String()
+		var dir [1]byte
+		if _, err := io.ReadFull(conn, dir[:]); err != nil {
+			return
+		}
+		if dir[0] != loadUp && dir[0] != loadDown && dir[0] != loadBoth {
+			logger.Warn("load test with unknown direction", "remote", remote, "direction", dir[0])
+			return
+		}
+
+		var m loadMeter
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		if dir[0] != loadUp {
+			wg.Go(func() { m.source(conn, stop) })
+		}
+		wg.Go(func() {
+			recv, sent, elapsed := m.report(period, stop, func(from, to time.Duration, recv, sent int64) {
+				logger.Info("load test", "remote", remote, "from", from.Round(time.Millisecond), "to", to.Round(time.Millisecond),
+					"recv_mbps", mbps(recv, to-from), "sent_mbps", mbps(sent, to-from))
+			})
+			logger.Info("load test done", "remote", remote, "elapsed", elapsed.Round(time.Millisecond),
+				"recv_bytes", recv, "sent_bytes", sent, "recv_mbps", mbps(recv, elapsed), "sent_mbps", mbps(sent, elapsed))
+		})
+		// The test ends when the client closes the connection, which also
+		// fails any write in progress.
+		io.Copy(&m, conn)
+		close(stop)
+		conn.Close()
+		wg.Wait()
+	})
+}
+
+// benchLoad load tests a server run with serve -load-test over conns for
+// d, with data flowing in direction dir, and prints the throughput of
+// every period and of the whole test.
+func benchLoad(conns []*secure.SecureConn, dir byte, d, period time.Duration) error {
+	var m loadMeter
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		if _, err := c.Write([]byte{dir}); err != nil {
+			return err
+		}
+		if dir != loadDown {
+			wg.Go(func() { m.source(c, stop) })
+		}
+		wg.Go(func() { io.Copy(&m, c) })
+	}
+	time.AfterFunc(d, func() {
+		close(stop)
+		// Closing the connections ends the test at the server, and the
+		// reads and writes in progress here.
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+
+	fmt.Printf("%17s %14s %14s\n", "interval", "sent Mbit/s", "recv Mbit/s")
+	recv, sent, elapsed := m.report(period, stop, func(from, to time.Duration, recv, sent int64) {
+		fmt.Printf("%7.2f-%7.2f s %14.2f %14.2f\n", from.Seconds(), to.Seconds(), mbps(sent, to-from), mbps(recv, to-from))
+	})
+	wg.Wait()
+	fmt.Printf("%7.2f-%7.2f s %14.2f %14.2f  total\n", 0.0, elapsed.Seconds(), mbps(sent, elapsed), mbps(recv, elapsed))
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoadHandler(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &secure.SecureServer{Handler: loadHandler(logger, 20*time.Millisecond)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	for name, dir := range loadDirections {
+		conn, err := secure.DialWithConfig(context.Background(), l.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := benchLoad([]*secure.SecureConn{conn}, dir, 100*time.Millisecond, 20*time.Millisecond); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// Every test is logged once the server sees the client leave.
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(logs.String(), `msg="load test done"`) < len(loadDirections) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Load tests were not all logged:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), `msg="load test" `) {
+		t.Fatalf("No interval was logged:\n%s", logs.String())
+	}
+}
+
+func TestMbps(t *testing.T) {
+	if got := mbps(125_000_000, time.Second); got != 1000 {
+		t.Fatalf("mbps = %v, want 1000", got)
+	}
+	if got := mbps(1, 0); got != 0 {
+		t.Fatalf("mbps over no time = %v, want 0", got)
+	}
+}
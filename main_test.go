@@ -1,272 +0,0 @@
-package main
-
-import (
-	"crypto/rand"
-	"fmt"
-	"golang.org/x/crypto/nacl/box"
-	"io"
-	"io/ioutil"
-	"net"
-	"testing"
-)
-
-func TestBasicConcepts(t *testing.T) {
-	// Client key pair
-	cpub, cpri, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatal(err)
-	}
-	// Server key pair
-	spub, spri, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	cmsg := "hello server"
-	smsg := "hello client"
-
-	// buf := make([]byte, 1024)
-	nonce := [24]byte{1}
-
-	// Encrypt client message using server public key and client private key
-	encrypted := box.Seal(nil, []byte(cmsg), &nonce, spub, cpri)
-
-	// decrypt client message using client public key and server private key
-	decrypted, _ := box.Open(nil, encrypted, &nonce, cpub, spri)
-
-	if string(decrypted) != cmsg {
-		t.Fatalf("Unexpected result: %s != %s", decrypted, cmsg)
-	}
-
-	// Encrypt the server msg using client public key and server private key
-	encrypted = box.Seal(nil, []byte(smsg), &nonce, cpub, spri)
-
-	// decrypt the server msg server public key and client private key
-	decrypted, _ = box.Open(nil, encrypted, &nonce, spub, cpri)
-	if string(decrypted) != smsg {
-		t.Fatalf("Unexpected result: %s != %s", decrypted, smsg)
-	}
-}
-
-func TestReadWriterPing(t *testing.T) {
-	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
-
-	r, w := io.Pipe()
-	secureR := NewSecureReader(r, priv, pub)
-	secureW := NewSecureWriter(w, priv, pub)
-
-	// Encrypt hello world
-	go func() {
-		fmt.Fprintf(secureW, "hello world\n")
-		w.Close()
-	}()
-
-	// Decrypt message
-	buf := make([]byte, 1024)
-	n, err := secureR.Read(buf)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-	buf = buf[:n]
-
-	// Make sure we have hello world back
-	if res := string(buf); res != "hello world\n" {
-		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
-	}
-}
-
-func TestSecureWriter(t *testing.T) {
-	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
-
-	r, w := io.Pipe()
-	secureW := NewSecureWriter(w, priv, pub)
-
-	// Make sure we are secure
-	// Encrypt hello world
-	go func() {
-		fmt.Fprintf(secureW, "hello world\n")
-		w.Close()
-	}()
-
-	// Read from the underlying transport instead of the decoder
-	buf, err := ioutil.ReadAll(r)
-	if err != nil {
-		t.Fatal(err)
-	}
-	// Make sure we dont' read the plain text message.
-	if res := string(buf); res == "hello world\n" {
-		t.Fatal("Unexpected result. The message is not encrypted.")
-	}
-
-	r, w = io.Pipe()
-	secureW = NewSecureWriter(w, priv, pub)
-
-	// Make sure we are unique
-	// Encrypt hello world
-	go func() {
-		fmt.Fprintf(secureW, "hello world\n")
-		w.Close()
-	}()
-
-	// Read from the underlying transport instead of the decoder
-	buf2, err := ioutil.ReadAll(r)
-	if err != nil {
-		t.Fatal(err)
-	}
-	// Make sure we dont' read the plain text message.
-	if string(buf) == string(buf2) {
-		t.Fatal("Unexpected result. The encrypted message is not unique.")
-	}
-
-}
-
-func TestSecureEchoServer(t *testing.T) {
-	// Create a random listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer l.Close()
-
-	// Start the server
-	go Serve(l)
-
-	conn, err := Dial(l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer conn.Close()
-
-	expected := "hello world\n"
-	if _, err := fmt.Fprintf(conn, expected); err != nil {
-		t.Fatal(err)
-	}
-
-	buf := make([]byte, 2048)
-	n, err := conn.Read(buf)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-
-	if got := string(buf[:n]); got != expected {
-		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
-	}
-}
-
-func TestSecureServe(t *testing.T) {
-	// Create a random listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer l.Close()
-
-	// Start the server
-	go Serve(l)
-
-	conn, err := net.Dial("tcp", l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-	unexpected := "hello world\n"
-	if _, err := fmt.Fprintf(conn, unexpected); err != nil {
-		t.Fatal(err)
-	}
-	buf := make([]byte, 2048)
-	n, err := conn.Read(buf)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-	if got := string(buf[:n]); got == unexpected {
-		t.Fatalf("Unexpected result:\nGot raw data instead of serialized key")
-	}
-}
-
-func TestSecureDial(t *testing.T) {
-	// Create a random listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer l.Close()
-
-	// Start the server
-	go func(l net.Listener) {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				return
-			}
-			go func(c net.Conn) {
-				defer c.Close()
-				key := [32]byte{}
-				c.Write(key[:])
-				buf := make([]byte, 2048)
-				n, err := c.Read(buf)
-				if err != nil && err != io.EOF {
-					t.Fatal(err)
-				}
-				if got := string(buf[:n]); got == "hello world\n" {
-					t.Fatal("Unexpected result. Got raw data instead of encrypted")
-				}
-			}(conn)
-		}
-	}(l)
-
-	conn, err := Dial(l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer conn.Close()
-
-	expected := "hello world\n"
-	if _, err := fmt.Fprintf(conn, expected); err != nil {
-		t.Fatal(err)
-	}
-}
-
-func TestMoreThanOneExchange(t *testing.T) {
-	// Create a random listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer l.Close()
-
-	// Start the server
-	go Serve(l)
-
-	conn, err := Dial(l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer conn.Close()
-
-	expected := "hello world\n"
-	if _, err := fmt.Fprintf(conn, expected); err != nil {
-		t.Fatal(err)
-	}
-
-	buf := make([]byte, 2048)
-	n, err := conn.Read(buf)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-
-	if got := string(buf[:n]); got != expected {
-		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
-	}
-
-	expected = "hello world again!\n"
-	if _, err := fmt.Fprintf(conn, expected); err != nil {
-		t.Fatal(err)
-	}
-	n, err = conn.Read(buf)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-
-	if got := string(buf[:n]); got != expected {
-		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
-	}
-}
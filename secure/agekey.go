@@ -0,0 +1,218 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Key pairs are X25519 key pairs, as age's are, so age keys are key pairs
+// of this package and vice versa. age encodes them in bech32 (BIP 173),
+// without its length limit: the private key as an identity, such as
+// "AGE-SECRET-KEY-1QQ...", and the public key as a recipient, such as
+// "age1qq...". An age key file, as written by age-keygen, is a private key
+// file; a recipient is a public key, including in authorized keys files.
+
+// Human-readable parts of age identities and recipients.
+const (
+	ageIdentityHRP  = "AGE-SECRET-KEY-"
+	ageRecipientHRP = "age"
+)
+
+var errMalformedAgeKey = errors.New("malformed age key")
+
+// ParseAgeIdentity parses an age X25519 identity, such as
+// "AGE-SECRET-KEY-1QQ...", and returns its key pair.
+func ParseAgeIdentity(s string) (*KeyPair, error) {
+	priv, err := decodeAgeKey(s, ageIdentityHRP)
+	if err != nil {
+		return nil, err
+	}
+	pub := new([KeySize]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return &KeyPair{Public: pub, Private: priv}, nil
+}
+
+// ParseAgeRecipient parses an age X25519 recipient, such as "age1qq...",
+// and returns its public key.
+func ParseAgeRecipient(s string) (*[KeySize]byte, error) {
+	return decodeAgeKey(s, ageRecipientHRP)
+}
+
+// MarshalAgeIdentity returns the private key of kp as an age identity.
+func MarshalAgeIdentity(kp *KeyPair) string {
+	return bech32Encode(ageIdentityHRP, kp.Private[:])
+}
+
+// MarshalAgeRecipient returns pub as an age recipient.
+func MarshalAgeRecipient(pub *[KeySize]byte) string {
+	return bech32Encode(ageRecipientHRP, pub[:])
+}
+
+// SaveAgeKeyPair writes kp to path in the format of age-keygen, readable by
+// its owner only, so that age can use it as an identity. The file must not
+// already exist.
+func SaveAgeKeyPair(kp *KeyPair, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), MarshalAgeRecipient(kp.Public), MarshalAgeIdentity(kp))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// isAgeKeyFile reports whether data looks like an age key file.
+func isAgeKeyFile(data []byte) bool {
+	return bytes.Contains(data, []byte(ageIdentityHRP+"1"))
+}
+
+// parseAgeKeyFile returns the key pair of the first identity in an age key
+// file, skipping comments.
+func parseAgeKeyFile(data []byte) (*KeyPair, error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return ParseAgeIdentity(line)
+	}
+	return nil, errMalformedAgeKey
+}
+
+// decodeAgeKey decodes a bech32-encoded key with the human-readable part
+// hrp.
+func decodeAgeKey(s, hrp string) (*[KeySize]byte, error) {
+	gotHRP, data, err := bech32Decode(s)
+	if err != nil || !strings.EqualFold(gotHRP, hrp) || len(data) != KeySize {
+		return nil, errMalformedAgeKey
+	}
+	key := new([KeySize]byte)
+	copy(key[:], data)
+	zero(data)
+	return key, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Polymod returns the BCH checksum of values.
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range gen {
+			if (b>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32HRPExpand returns the values hrp contributes to the checksum.
+func bech32HRPExpand(hrp string) []byte {
+	hrp = strings.ToLower(hrp)
+	v := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+// convertBits regroups data from groups of from bits into groups of to
+// bits, padding the last group with zeros if pad is set, and otherwise
+// refusing a last group that is incomplete or not zero.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var out []byte
+	maxv := uint32(1)<<to - 1
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, errMalformedAgeKey
+		}
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errMalformedAgeKey
+	}
+	return out, nil
+}
+
+// bech32Encode encodes data under hrp, in upper case if hrp is.
+func bech32Encode(hrp string, data []byte) string {
+	values, _ := convertBits(data, 8, 5, true)
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	var b strings.Builder
+	b.WriteString(strings.ToLower(hrp))
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(bech32Charset[polymod>>(5*(5-i))&31])
+	}
+	if strings.ToUpper(hrp) == hrp {
+		return strings.ToUpper(b.String())
+	}
+	return b.String()
+}
+
+// bech32Decode decodes s, returning its human-readable part and data.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errMalformedAgeKey
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errMalformedAgeKey
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, errMalformedAgeKey
+		}
+	}
+	values := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, errMalformedAgeKey
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, errMalformedAgeKey
+	}
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
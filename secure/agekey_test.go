@@ -0,0 +1,84 @@
+package secure
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An identity and its recipient, as generated by age-keygen.
+const (
+	testAgeIdentity  = "AGE-SECRET-KEY-1L2QZHSPZVGCU82TRTP2XMQHD4U2QEUR07XQDWWSM44KG49K0WDYQC7DG4X"
+	testAgeRecipient = "age1e532nlhv4gsn7p6ryfjfpdq5pl0d89q0rk53r9dts5pxs7ynmghqwy0gqj"
+)
+
+func TestAgeKeys(t *testing.T) {
+	keys, err := ParseAgeIdentity(testAgeIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := MarshalAgeRecipient(keys.Public); got != testAgeRecipient {
+		t.Fatalf("Unexpected result. Got recipient %s, want %s", got, testAgeRecipient)
+	}
+	if got := MarshalAgeIdentity(keys); got != testAgeIdentity {
+		t.Fatalf("Unexpected result. Got identity %s, want %s", got, testAgeIdentity)
+	}
+	pub, err := ParseAgeRecipient(testAgeRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pub != *keys.Public {
+		t.Fatal("Unexpected result. The recipient is not the identity's public key.")
+	}
+
+	// A changed character breaks the checksum, and an identity is not a
+	// recipient.
+	bad := testAgeRecipient[:10] + "q" + testAgeRecipient[11:]
+	if bad == testAgeRecipient {
+		bad = testAgeRecipient[:10] + "p" + testAgeRecipient[11:]
+	}
+	for _, s := range []string{bad, strings.ToUpper(testAgeIdentity[:20]) + strings.ToLower(testAgeIdentity[20:])} {
+		if _, err := ParseAgeRecipient(s); err == nil {
+			t.Fatalf("Expected an error parsing %s", s)
+		}
+	}
+	if _, err := ParseAgeRecipient(testAgeIdentity); err == nil {
+		t.Fatal("Expected an error. An identity was parsed as a recipient.")
+	}
+}
+
+func TestAgeKeyFiles(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.txt")
+	if err := SaveAgeKeyPair(keys, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeyPair(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded.Private != *keys.Private || *loaded.Public != *keys.Public {
+		t.Fatal("Unexpected result. Loaded another key pair from the age key file.")
+	}
+
+	pubFile := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(pubFile, []byte(MarshalAgeRecipient(keys.Public)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := LoadPublicKey(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := ParseAuthorizedKeys(strings.NewReader(MarshalAgeRecipient(keys.Public) + " alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pub != *keys.Public || !ak.Contains(keys.Public) {
+		t.Fatal("Unexpected result. The age recipient is not the public key.")
+	}
+}
@@ -0,0 +1,114 @@
+package secure
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// ErrUnauthorized is returned by the handshake when the peer's public key is
+// not authorized.
+var ErrUnauthorized = errors.New("secure: peer key not authorized")
+
+// An Authorizer decides, once the key exchange is complete, whether a
+// connection may go ahead. Authorize is given the public key presented by
+// the peer and the peer's address, and returns a non-nil error, which fails
+// the handshake, to refuse the connection. It may be called concurrently.
+type Authorizer interface {
+	Authorize(peerKey [KeySize]byte, addr net.Addr) error
+}
+
+// AuthorizerFunc adapts an ordinary function to an Authorizer.
+type AuthorizerFunc func(peerKey [KeySize]byte, addr net.Addr) error
+
+// Authorize returns f(peerKey, addr).
+func (f AuthorizerFunc) Authorize(peerKey [KeySize]byte, addr net.Addr) error {
+	return f(peerKey, addr)
+}
+
+// AuthorizedKeys is a set of client public keys a server accepts. It is an
+// Authorizer.
+type AuthorizedKeys struct {
+	keys map[[KeySize]byte]struct{}
+}
+
+// NewAuthorizedKeys returns the set of the given keys.
+func NewAuthorizedKeys(keys ...*[KeySize]byte) *AuthorizedKeys {
+	ak := &AuthorizedKeys{keys: make(map[[KeySize]byte]struct{})}
+	for _, key := range keys {
+		ak.keys[*key] = struct{}{}
+	}
+	return ak
+}
+
+// LoadAuthorizedKeys reads an authorized keys file. The file holds one key
+// per line, base64-encoded and optionally followed by a comment. Blank lines
+// and lines starting with # are ignored. Lines may also hold SSH public keys
+// as in an OpenSSH authorized_keys file, so that one can be used as it is:
+// Ed25519 keys are mapped as ParseSSHPublicKey maps them, and keys of other
+// types are ignored. Keys may also be age recipients, such as "age1qq...".
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ak, err := ParseAuthorizedKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ak, nil
+}
+
+// ParseAuthorizedKeys parses keys in the format of LoadAuthorizedKeys.
+func ParseAuthorizedKeys(r io.Reader) (*AuthorizedKeys, error) {
+	ak := NewAuthorizedKeys()
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := strings.Fields(text)[0]
+		key, err := decodeKey(field)
+		if err != nil && strings.HasPrefix(field, ageRecipientHRP+"1") {
+			key, err = ParseAgeRecipient(field)
+		}
+		if err != nil {
+			var sshErr error
+			if key, sshErr = ParseSSHPublicKey([]byte(text)); sshErr == errNotEd25519 {
+				continue
+			} else if sshErr != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		ak.keys[*key] = struct{}{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// Contains reports whether key is in the set.
+func (ak *AuthorizedKeys) Contains(key *[KeySize]byte) bool {
+	_, ok := ak.keys[*key]
+	return ok
+}
+
+// Authorize returns ErrUnauthorized unless peerKey is in the set.
+func (ak *AuthorizedKeys) Authorize(peerKey [KeySize]byte, addr net.Addr) error {
+	if !ak.Contains(&peerKey) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Len returns the number of keys in the set.
+func (ak *AuthorizedKeys) Len() int {
+	return len(ak.keys)
+}
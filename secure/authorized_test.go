@@ -0,0 +1,82 @@
+package secure
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizedKeys(t *testing.T) {
+	allowed, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := "# clients\n\n" + encodeKey(allowed.Public) + " alice@example\n"
+	ak, err := ParseAuthorizedKeys(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.Len() != 1 {
+		t.Fatalf("Unexpected result: %d keys", ak.Len())
+	}
+	sconfig := &Config{AuthorizedKeys: ak}
+
+	client, _, cerr, serr := handshakePair(&Config{Keys: allowed}, sconfig)
+	client.Close()
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+
+	client, _, _, serr = handshakePair(&Config{Keys: other}, sconfig)
+	client.Close()
+	if !errors.Is(serr, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %v", serr)
+	}
+
+	if _, err := ParseAuthorizedKeys(strings.NewReader("not-a-key\n")); err == nil {
+		t.Fatal("Unexpected result. A malformed key was parsed.")
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errQuota := errors.New("quota exceeded")
+	var seen [KeySize]byte
+	sconfig := &Config{Keys: skeys, Authorizer: AuthorizerFunc(func(peerKey [KeySize]byte, addr net.Addr) error {
+		seen = peerKey
+		if addr == nil {
+			t.Error("Authorizer called without an address")
+		}
+		return errQuota
+	})}
+	client, _, _, serr := handshakePair(&Config{Keys: ckeys}, sconfig)
+	client.Close()
+	if !errors.Is(serr, errQuota) {
+		t.Fatalf("Unexpected error: %v", serr)
+	}
+	if seen != *ckeys.Public {
+		t.Fatal("Unexpected result. Authorizer saw the wrong client key.")
+	}
+
+	// Clients can refuse servers too.
+	cconfig := &Config{Authorizer: NewAuthorizedKeys(ckeys.Public)}
+	client, _, cerr, _ := handshakePair(cconfig, &Config{Keys: skeys})
+	client.Close()
+	if !errors.Is(cerr, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %v", cerr)
+	}
+}
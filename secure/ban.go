@@ -0,0 +1,175 @@
+package secure
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Defaults of a Banner's zero fields.
+const (
+	DefaultBanFailures = 5
+	DefaultBanWindow   = 10 * time.Minute
+	DefaultBanTime     = 10 * time.Minute
+)
+
+// errBanned is the reason a connection from a banned address is refused.
+var errBanned = errors.New("secure: address banned")
+
+// Banner bans the addresses of misbehaving clients for a while, as
+// fail2ban does: an address whose connections fail MaxFailures handshakes,
+// or reads that don't decrypt, within Window is refused by a
+// SecureListener for BanTime. Set its fields before it is first used. A
+// Banner is safe for concurrent use, and can be shared by the configs of
+// several listeners, or kept across reloads, to keep its bans.
+type Banner struct {
+	// MaxFailures is how many failures within Window ban an address. If
+	// zero, DefaultBanFailures is used.
+	MaxFailures int
+
+	// Window is how long failures count for. If zero, DefaultBanWindow is
+	// used.
+	Window time.Duration
+
+	// BanTime is how long a ban lasts. If zero, DefaultBanTime is used.
+	BanTime time.Duration
+
+	mu       sync.Mutex
+	failures map[netip.Addr][]time.Time
+	bans     map[netip.Addr]time.Time
+}
+
+// Banned reports whether addr is banned.
+func (b *Banner) Banned(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.bans[addr]
+	if ok && !time.Now().Before(until) {
+		delete(b.bans, addr)
+		return false
+	}
+	return ok
+}
+
+// Fail records a failure of a connection from addr, and reports whether it
+// got addr banned.
+func (b *Banner) Fail(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until, ok := b.bans[addr]; ok && now.Before(until) {
+		return false
+	}
+	if b.failures == nil {
+		b.failures = make(map[netip.Addr][]time.Time)
+		b.bans = make(map[netip.Addr]time.Time)
+	}
+	b.prune(now)
+	failures := append(b.failures[addr], now)
+	if len(failures) < b.maxFailures() {
+		b.failures[addr] = failures
+		return false
+	}
+	delete(b.failures, addr)
+	b.bans[addr] = now.Add(b.banTime())
+	return true
+}
+
+// prune forgets the failures that no longer count and the bans that are
+// over.
+func (b *Banner) prune(now time.Time) {
+	since := now.Add(-b.window())
+	for addr, failures := range b.failures {
+		i := 0
+		for i < len(failures) && failures[i].Before(since) {
+			i++
+		}
+		if i == len(failures) {
+			delete(b.failures, addr)
+		} else {
+			b.failures[addr] = failures[i:]
+		}
+	}
+	for addr, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, addr)
+		}
+	}
+}
+
+// Bans returns the banned addresses, with when each ban ends.
+func (b *Banner) Bans() map[netip.Addr]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(time.Now())
+	bans := make(map[netip.Addr]time.Time, len(b.bans))
+	for addr, until := range b.bans {
+		bans[addr] = until
+	}
+	return bans
+}
+
+// ActiveBans returns the number of addresses banned.
+func (b *Banner) ActiveBans() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(time.Now())
+	return len(b.bans)
+}
+
+func (b *Banner) maxFailures() int {
+	if b.MaxFailures <= 0 {
+		return DefaultBanFailures
+	}
+	return b.MaxFailures
+}
+
+func (b *Banner) window() time.Duration {
+	if b.Window <= 0 {
+		return DefaultBanWindow
+	}
+	return b.Window
+}
+
+func (b *Banner) banTime() time.Duration {
+	if b.BanTime <= 0 {
+		return DefaultBanTime
+	}
+	return b.BanTime
+}
+
+// addrIP returns the IP address of addr, or false if it has none.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr(), true
+}
+
+// banned reports whether the config's Banner, if any, bans the address
+// of conn.
+func (c *Config) banned(conn net.Conn) bool {
+	if c == nil || c.Banner == nil {
+		return false
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	return ok && c.Banner.Banned(ip)
+}
+
+// recordFailure records a failure of a connection from addr with the
+// config's Banner, if any, and logs the ban it may lead to.
+func (c *Config) recordFailure(addr net.Addr) {
+	if c == nil || c.Banner == nil {
+		return
+	}
+	ip, ok := addrIP(addr)
+	if ok && c.Banner.Fail(ip) {
+		c.logger().Warn("banned address", "addr", ip.String(),
+			"duration", c.Banner.banTime(), "active_bans", c.Banner.ActiveBans())
+	}
+}
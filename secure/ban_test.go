@@ -0,0 +1,73 @@
+package secure
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	b := &Banner{MaxFailures: 2, BanTime: 50 * time.Millisecond}
+	addr := netip.MustParseAddr("192.0.2.1")
+	if b.Fail(addr) || b.Banned(addr) {
+		t.Fatal("Unexpected result. Banned an address after one failure.")
+	}
+	if !b.Fail(addr) || !b.Banned(netip.MustParseAddr("::ffff:192.0.2.1")) {
+		t.Fatal("Unexpected result. The address is not banned after two failures.")
+	}
+	if b.Banned(netip.MustParseAddr("192.0.2.2")) {
+		t.Fatal("Unexpected result. Banned another address.")
+	}
+	if n := b.ActiveBans(); n != 1 {
+		t.Fatalf("Unexpected number of bans %d, want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if b.Banned(addr) || b.ActiveBans() != 0 {
+		t.Fatal("Unexpected result. The ban outlived BanTime.")
+	}
+}
+
+func TestBannerListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner := &Banner{MaxFailures: 2}
+	sl, err := NewSecureListener(l, &Config{Banner: banner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Two connections that fail the handshake get the address banned.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", sl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for banner.ActiveBans() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected result. The address was not banned.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn, err := Dial(sl.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result. Accepted a connection from a banned address.")
+	}
+}
@@ -0,0 +1,56 @@
+package secure
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Frames are read into and sealed into buffers taken from pools, one per
+// size class, the powers of two from 1<<minBufferShift bytes up to
+// 1<<maxBufferShift, which holds the largest batch of frames a writer
+// gathers, so that reading and writing frames at a high rate doesn't
+// allocate. Buffers are zeroed before they go back to a pool, as they may
+// have held plaintext. Larger buffers are not pooled.
+const (
+	minBufferShift = 10
+	maxBufferShift = 25
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the index in bufferPools of the smallest class that
+// holds n bytes, which may be past the end of bufferPools.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// getBuffer returns a buffer of length n.
+func getBuffer(n int) *[]byte {
+	class := bufferClass(n)
+	if class >= len(bufferPools) {
+		b := make([]byte, n)
+		return &b
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n, 1<<(class+minBufferShift))
+	return &b
+}
+
+// putBuffer zeroes the length of b and returns it to its pool. b must not
+// be used afterwards.
+func putBuffer(b *[]byte) {
+	clear(*b)
+	c := cap(*b)
+	class := bufferClass(c)
+	if class >= len(bufferPools) || c != 1<<(class+minBufferShift) {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPools[class].Put(b)
+}
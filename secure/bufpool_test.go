@@ -0,0 +1,37 @@
+package secure
+
+import (
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, tt := range []struct{ n, capacity int }{
+		{0, 1 << minBufferShift},
+		{1, 1 << minBufferShift},
+		{1 << minBufferShift, 1 << minBufferShift},
+		{1<<minBufferShift + 1, 2 << minBufferShift},
+		{DefaultMaxFrameSize + 17, 2 * DefaultMaxFrameSize},
+		{1 << maxBufferShift, 1 << maxBufferShift},
+		{1<<maxBufferShift + 1, 1<<maxBufferShift + 1},
+	} {
+		b := getBuffer(tt.n)
+		if len(*b) != tt.n || cap(*b) != tt.capacity {
+			t.Errorf("getBuffer(%d): unexpected length %d and capacity %d, expected capacity %d", tt.n, len(*b), cap(*b), tt.capacity)
+		}
+		putBuffer(b)
+	}
+
+	// Buffers are zeroed before they are reused.
+	b := getBuffer(100)
+	copy(*b, "plaintext")
+	putBuffer(b)
+	for i := 0; i < 10; i++ {
+		b := getBuffer(100)
+		for _, c := range *b {
+			if c != 0 {
+				t.Fatal("Unexpected result. A pooled buffer was not zeroed.")
+			}
+		}
+		putBuffer(b)
+	}
+}
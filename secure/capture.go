@@ -0,0 +1,378 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A capture of a stream connection, the bytes each end sent, can be
+// decrypted after the fact with a key log of either end (see
+// Config.KeyLogWriter), or with the key pair of either end if the session
+// was not resumed. DecryptCapture reads the handshake of each direction to
+// find where its frames start, which cipher suite seals them and, with a
+// key pair, which keys the ends derived. A direction's keys are tried in
+// the order the key log lists them, which follows its rekeys; a key pair
+// only follows the rekeys of the frames it receives. Early data, Noise
+// handshakes and obfuscated connections cannot be decrypted.
+
+var (
+	errCaptureNoise    = errors.New("secure: cannot decrypt captures of Noise handshakes")
+	errCaptureResumed  = errors.New("secure: resumed sessions can only be decrypted with a key log")
+	errCaptureKeys     = errors.New("secure: the key pair is neither end's")
+	errCaptureNoKeys   = errors.New("secure: no keys for the session")
+	errCaptureRekey    = errors.New("secure: the sender rekeyed, and no later key is known")
+	errCaptureTruncate = errors.New("secure: capture ends in the middle of a frame")
+)
+
+// KeyLog is a key log, as written to Config.KeyLogWriter.
+type KeyLog struct {
+	// keys maps a label and session, separated by a space, to the keys
+	// logged for them, in order.
+	keys map[string][][KeySize]byte
+}
+
+// ParseKeyLog parses a key log. Blank lines and lines starting with # are
+// ignored.
+func ParseKeyLog(r io.Reader) (*KeyLog, error) {
+	kl := &KeyLog{keys: make(map[string][][KeySize]byte)}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f := strings.Fields(text)
+		if len(f) != 3 || (f[0] != keyLogClientLabel && f[0] != keyLogServerLabel) {
+			return nil, fmt.Errorf("line %d: malformed key log line", line)
+		}
+		b, err := hex.DecodeString(f[2])
+		if err != nil || len(b) != KeySize {
+			return nil, fmt.Errorf("line %d: malformed key", line)
+		}
+		name := f[0] + " " + strings.ToLower(f[1])
+		kl.keys[name] = append(kl.keys[name], [KeySize]byte(b))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return kl, nil
+}
+
+// lookup returns the keys logged under label for the session id.
+func (kl *KeyLog) lookup(label string, id []byte) [][KeySize]byte {
+	if kl == nil {
+		return nil
+	}
+	return kl.keys[label+" "+hex.EncodeToString(id)]
+}
+
+// CaptureKeys are the keys DecryptCapture decrypts a capture with.
+type CaptureKeys struct {
+	// KeyLog is a key log with the session's keys.
+	KeyLog *KeyLog
+
+	// Keys is the key pair of either end, used when the key log has no
+	// keys for the session.
+	Keys *KeyPair
+}
+
+// CapturedMessage is a message decrypted from a capture.
+type CapturedMessage struct {
+	// From is the end that sent the message.
+	From Role
+
+	// Data is the message.
+	Data []byte
+
+	// End is the offset, in what From sent, just past the last frame of
+	// the message.
+	End int
+}
+
+// DecryptCapture decrypts the messages of a stream connection from the
+// bytes the client sent and those the server sent, and returns the
+// messages of each end in the order it sent them. If one of the
+// directions cannot be decrypted to its end, the messages decrypted before
+// the failure are returned along with the error.
+func DecryptCapture(client, server []byte, keys CaptureKeys) (fromClient, fromServer []CapturedMessage, err error) {
+	cs := &captureStream{data: client, from: ClientRole}
+	ss := &captureStream{data: server, from: ServerRole}
+	if err := readCapturedHandshake(cs, ss, keys); err != nil {
+		return nil, nil, err
+	}
+	fromClient, cerr := cs.messages()
+	fromServer, serr := ss.messages()
+	return fromClient, fromServer, errors.Join(cerr, serr)
+}
+
+// IsClientCapture reports whether data, what one end of a stream
+// connection sent, starts as a client's does.
+func IsClientCapture(data []byte) bool {
+	if len(data) <= len(protocolMagic)+1 || !bytes.Equal(data[:len(protocolMagic)], protocolMagic[:]) {
+		return false
+	}
+	switch data[len(protocolMagic)+1] {
+	case msgClientHello, msgClientPSKHello, msgClientNoiseHello:
+		return true
+	}
+	return false
+}
+
+// readCapturedHandshake reads the handshake at the start of both streams,
+// leaving them at their first frames with the keys to open them.
+func readCapturedHandshake(cs, ss *captureStream, keys CaptureKeys) error {
+	if len(cs.data) > len(protocolMagic)+1 && cs.data[len(protocolMagic)+1] == msgClientNoiseHello {
+		return errCaptureNoise
+	}
+	ch, chRaw, err := cs.readHello()
+	if err != nil {
+		return err
+	}
+	sh, shRaw, err := ss.readHello()
+	if err != nil {
+		return err
+	}
+	if chRaw[len(protocolMagic)+1] == msgClientPSKHello {
+		if _, _, err := cs.readMessage(msgPSKFinished); err != nil {
+			return err
+		}
+		if _, _, err := ss.readMessage(msgPSKFinished); err != nil {
+			return err
+		}
+		cs.suite, ss.suite = SuiteBox, SuiteBox
+		return setCaptureKeys(cs, ss, keys.KeyLog, ch[fieldNonce])
+	}
+	if shRaw[len(protocolMagic)+1] != msgServerHello || chRaw[len(protocolMagic)+1] != msgClientHello {
+		return errMalformedHandshake
+	}
+
+	done, doneRaw, err := ss.readMessage(msgServerDone)
+	if err != nil {
+		return err
+	}
+	transcript := append(append(append([]byte(nil), shRaw...), chRaw...), doneRaw...)
+	if _, ok := ch[fieldIdentity]; ok {
+		_, authRaw, err := cs.readMessage(msgClientAuth)
+		if err != nil {
+			return err
+		}
+		transcript = append(transcript, authRaw...)
+	}
+	_, resumed := done[fieldResumed]
+	if min(int(chRaw[len(protocolMagic)]), int(shRaw[len(protocolMagic)]), protocolVersion) >= finishedVersion {
+		if !resumed {
+			if _, _, err := cs.readMessage(msgFinished); err != nil {
+				return err
+			}
+		}
+		if _, _, err := ss.readMessage(msgFinished); err != nil {
+			return err
+		}
+	}
+	serverSuites, err := sh.cipherSuites()
+	if err != nil {
+		return err
+	}
+	clientSuites, err := ch.cipherSuites()
+	if err != nil {
+		return err
+	}
+	if cs.suite, err = negotiateSuite(serverSuites, clientSuites); err != nil {
+		return err
+	}
+	ss.suite = cs.suite
+
+	clientPub, err := ch.key(fieldPublicKey)
+	if err != nil {
+		return err
+	}
+	if err := setCaptureKeys(cs, ss, keys.KeyLog, clientPub[:]); err == nil || keys.Keys == nil {
+		return err
+	}
+	if resumed {
+		return errCaptureResumed
+	}
+	serverPub, err := sh.key(fieldPublicKey)
+	if err != nil {
+		return err
+	}
+	if pinned, err := ch.key(fieldServerKey); err == nil && capturedPreviousKey(sh, pinned) {
+		serverPub = pinned
+	}
+	sum := sha256.Sum256(transcript)
+	switch *keys.Keys.Public {
+	case *clientPub:
+		s := newSession(keys.Keys, serverPub, ClientRole, nil, sum[:])
+		cs.keys, ss.keys = [][KeySize]byte{*s.sendKey}, [][KeySize]byte{*s.recvKey}
+		ss.priv = keys.Keys.Private
+	case *serverPub:
+		s := newSession(keys.Keys, clientPub, ServerRole, nil, sum[:])
+		cs.keys, ss.keys = [][KeySize]byte{*s.recvKey}, [][KeySize]byte{*s.sendKey}
+		cs.priv = keys.Keys.Private
+	default:
+		return errCaptureKeys
+	}
+	return nil
+}
+
+// setCaptureKeys gives the streams the keys logged for the session id.
+func setCaptureKeys(cs, ss *captureStream, kl *KeyLog, id []byte) error {
+	cs.keys = kl.lookup(keyLogClientLabel, id)
+	ss.keys = kl.lookup(keyLogServerLabel, id)
+	if len(cs.keys) == 0 || len(ss.keys) == 0 {
+		return errCaptureNoKeys
+	}
+	return nil
+}
+
+// capturedPreviousKey reports whether the server hello sh lists key among
+// the server's previous keys.
+func capturedPreviousKey(sh handshakeMessage, key *[KeySize]byte) bool {
+	keys := sh[fieldPreviousKeys]
+	for ; len(keys) >= KeySize; keys = keys[KeySize:] {
+		if bytes.Equal(keys[:KeySize], key[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureStream is what one end of a captured connection sent.
+type captureStream struct {
+	data []byte
+	pos  int
+	from Role
+
+	// suite seals the frames. keys are the keys that may open them: the
+	// current key first, then any later ones from the key log. priv, if
+	// set, is the receiver's private key, which follows rekeys.
+	suite CipherSuite
+	keys  [][KeySize]byte
+	priv  *[KeySize]byte
+}
+
+// readHello reads the preamble and hello at the start of the stream.
+func (cs *captureStream) readHello() (handshakeMessage, []byte, error) {
+	r := bytes.NewReader(cs.data)
+	if len(cs.data) <= len(protocolMagic)+1 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	m, raw, _, err := readHello(r, cs.data[len(protocolMagic)+1])
+	if err != nil {
+		return nil, nil, err
+	}
+	cs.pos = len(raw)
+	return m, raw, nil
+}
+
+// readMessage reads the handshake message of type typ at the stream's
+// position.
+func (cs *captureStream) readMessage(typ byte) (handshakeMessage, []byte, error) {
+	m, raw, err := readHandshakeMessage(bytes.NewReader(cs.data[cs.pos:]), typ)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs.pos += len(raw)
+	return m, raw, nil
+}
+
+// messages decrypts the frames of the stream and returns its messages.
+func (cs *captureStream) messages() ([]CapturedMessage, error) {
+	var msgs []CapturedMessage
+	var msg []byte
+	for cs.pos < len(cs.data) {
+		plain, err := cs.openFrame()
+		if err != nil {
+			return msgs, fmt.Errorf("%s frame at offset %d: %w", roleName(cs.from), cs.pos, err)
+		}
+		kind := plain[0]
+		if kind&frameCompressed != 0 {
+			chunk, err := decompress(plain[1:], maxFrameSizeLimit)
+			if err != nil {
+				return msgs, err
+			}
+			kind, plain = kind&^frameCompressed, append([]byte{kind &^ frameCompressed}, chunk...)
+		}
+		switch kind {
+		case frameFinal, frameMore:
+			msg = append(msg, plain[1:]...)
+			if kind == frameFinal {
+				msgs = append(msgs, CapturedMessage{From: cs.from, Data: msg, End: cs.pos})
+				msg = nil
+			}
+		case frameRekey:
+			if err := cs.rekey(plain[1:]); err != nil {
+				return msgs, fmt.Errorf("%s frame at offset %d: %w", roleName(cs.from), cs.pos, err)
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// openFrame opens the frame at the stream's position, trying the keys in
+// order, and moves past it. Keys before the one that opens it are dropped.
+func (cs *captureStream) openFrame() ([]byte, error) {
+	if len(cs.data)-cs.pos < headerSize {
+		return nil, errCaptureTruncate
+	}
+	hdr := cs.data[cs.pos : cs.pos+headerSize]
+	length := binary.BigEndian.Uint32(hdr)
+	if maxSealed := uint32(1 + paddingHeaderSize + maxFrameSizeLimit + box.Overhead); length > maxSealed {
+		return nil, &FrameSizeError{Length: length, Limit: maxSealed}
+	}
+	if uint64(len(cs.data)-cs.pos-headerSize) < uint64(length) {
+		return nil, errCaptureTruncate
+	}
+	nonce := [NonceSize]byte(hdr[lengthSize:])
+	sealed := cs.data[cs.pos+headerSize : cs.pos+headerSize+int(length)]
+	for i := range cs.keys {
+		plain, ok := open(nil, sealed, &nonce, &cs.keys[i], cs.suite.newAEAD(&cs.keys[i]))
+		if !ok {
+			continue
+		}
+		cs.keys = cs.keys[i:]
+		cs.pos += headerSize + int(length)
+		plain, err := unpad(plain)
+		if err == nil && len(plain) == 0 {
+			err = &FrameError{Reason: "missing kind"}
+		}
+		return plain, err
+	}
+	return nil, &DecryptError{}
+}
+
+// rekey follows a rekey of the sender to the ephemeral key eph, if the
+// receiver's private key is known.
+func (cs *captureStream) rekey(eph []byte) error {
+	if cs.priv == nil {
+		if len(cs.keys) < 2 {
+			return errCaptureRekey
+		}
+		return nil
+	}
+	secret, err := curve25519.X25519(cs.priv[:], eph)
+	if err != nil {
+		return err
+	}
+	defer zero(secret)
+	nextKey(&cs.keys[0], secret)
+	return nil
+}
+
+// roleName names role in errors.
+func roleName(role Role) string {
+	if role == ClientRole {
+		return "client"
+	}
+	return "server"
+}
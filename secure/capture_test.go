@@ -0,0 +1,109 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDecryptCapture(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, id, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyLog bytes.Buffer
+	c1, c2 := net.Pipe()
+	crec, srec := &recordingConn{Conn: c1}, &recordingConn{Conn: c2}
+	client := Client(crec, &Config{Keys: ckeys, Identity: id, RekeyBytes: 100, Compression: true})
+	server := Server(srec, &Config{Keys: skeys, Compression: true, KeyLogWriter: &keyLog})
+
+	const count = 3
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			msg, err := server.ReadMessage()
+			if err == nil {
+				err = server.WriteMessage(msg)
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	var sent [][]byte
+	for i := 0; i < count; i++ {
+		msg := make([]byte, 80)
+		rand.Read(msg)
+		if err := client.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+
+	check := func(msgs []CapturedMessage, from Role) {
+		t.Helper()
+		if len(msgs) != count {
+			t.Fatalf("Unexpected result. Decrypted %d messages, want %d.", len(msgs), count)
+		}
+		for i, m := range msgs {
+			if m.From != from || !bytes.Equal(m.Data, sent[i]) {
+				t.Fatalf("Unexpected result on message %d: %q", i, m.Data)
+			}
+		}
+	}
+
+	// The server's key log, which follows the client's rekeys, and the
+	// server's key pair both decrypt everything.
+	kl, err := ParseKeyLog(&keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range []CaptureKeys{{KeyLog: kl}, {Keys: skeys}} {
+		fromClient, fromServer, err := DecryptCapture(crec.written.Bytes(), srec.written.Bytes(), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(fromClient, ClientRole)
+		check(fromServer, ServerRole)
+	}
+
+	// The client's key pair cannot follow its own rekeys.
+	fromClient, fromServer, err := DecryptCapture(crec.written.Bytes(), srec.written.Bytes(), CaptureKeys{Keys: ckeys})
+	if !errors.Is(err, errCaptureRekey) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check(fromServer, ServerRole)
+	if len(fromClient) == 0 || !bytes.Equal(fromClient[0].Data, sent[0]) {
+		t.Fatal("Unexpected result. The messages before the rekey were not decrypted.")
+	}
+
+	// Another key pair decrypts nothing.
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptCapture(crec.written.Bytes(), srec.written.Bytes(), CaptureKeys{Keys: other}); !errors.Is(err, errCaptureKeys) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
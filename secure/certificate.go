@@ -0,0 +1,202 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// A certificate binds a public key to a name until it expires, under the
+// signature of an offline certificate authority: an Ed25519 key whose
+// public half peers trust instead of pinning each other's keys. Peers with
+// a Certificate present it in their hello, and peers with
+// CertificateAuthorities require one, for the key the peer presents,
+// signed by one of them. A client also requires the name of the server's
+// certificate to match the host in its ServerName.
+//
+// A certificate is encoded as
+//
+//	public key (32 bytes) | expiry (8 bytes) | name length (1 byte) | name |
+//	signature (64 bytes)
+//
+// where the expiry is in big-endian Unix seconds, and the signature covers
+// certificateContext followed by everything before it.
+
+// certificateContext is prefixed to the signed contents of a certificate.
+const certificateContext = "gochal2 certificate\x00"
+
+// certificateBlock is the PEM block type of certificate files.
+const certificateBlock = "GOCHAL2 CERTIFICATE"
+
+var (
+	errNoCertificate        = errors.New("secure: peer presented no certificate")
+	errUntrustedCertificate = errors.New("secure: peer certificate not signed by a trusted authority")
+	errExpiredCertificate   = errors.New("secure: peer certificate expired")
+	errCertificateName      = errors.New("secure: peer certificate is for another name")
+	errCertificateKey       = errors.New("secure: certificate is for another key")
+	errMalformedCertificate = errors.New("secure: malformed certificate")
+)
+
+// Certificate is a public key and name, signed by a certificate authority.
+type Certificate struct {
+	PublicKey *[KeySize]byte
+	Name      string
+	Expires   time.Time
+
+	// Signature is the certificate authority's signature.
+	Signature []byte
+}
+
+// SignCertificate returns the certificate of pub, for name, until expires,
+// signed by the certificate authority ca. name may be at most 255 bytes.
+func SignCertificate(ca ed25519.PrivateKey, pub *[KeySize]byte, name string, expires time.Time) (*Certificate, error) {
+	if len(name) > 255 {
+		return nil, errors.New("secure: certificate name too long")
+	}
+	cert := &Certificate{PublicKey: pub, Name: name, Expires: expires.Truncate(time.Second)}
+	cert.Signature = ed25519.Sign(ca, cert.signed())
+	return cert, nil
+}
+
+// signed returns the contents of the certificate that are signed.
+func (c *Certificate) signed() []byte {
+	b := append([]byte(certificateContext), c.PublicKey[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(c.Expires.Unix()))
+	b = append(b, byte(len(c.Name)))
+	return append(b, c.Name...)
+}
+
+// marshal returns the encoding of the certificate.
+func (c *Certificate) marshal() []byte {
+	return append(c.signed()[len(certificateContext):], c.Signature...)
+}
+
+// parseCertificate decodes a certificate encoded by marshal.
+func parseCertificate(b []byte) (*Certificate, error) {
+	const fixed = KeySize + 8 + 1
+	if len(b) < fixed+ed25519.SignatureSize || len(b) != fixed+int(b[fixed-1])+ed25519.SignatureSize {
+		return nil, errMalformedCertificate
+	}
+	c := &Certificate{PublicKey: new([KeySize]byte)}
+	copy(c.PublicKey[:], b)
+	c.Expires = time.Unix(int64(binary.BigEndian.Uint64(b[KeySize:])), 0)
+	c.Name = string(b[fixed : len(b)-ed25519.SignatureSize])
+	c.Signature = bytes.Clone(b[len(b)-ed25519.SignatureSize:])
+	return c, nil
+}
+
+// Verify checks that the certificate is signed by one of the certificate
+// authorities cas and has not expired at now.
+func (c *Certificate) Verify(cas []ed25519.PublicKey, now time.Time) error {
+	signed := c.signed()
+	trusted := false
+	for _, ca := range cas {
+		if ed25519.Verify(ca, signed, c.Signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return errUntrustedCertificate
+	}
+	if !now.Before(c.Expires) {
+		return errExpiredCertificate
+	}
+	return nil
+}
+
+// MarshalCertificate returns the PEM encoding of cert, as in a certificate
+// file.
+func MarshalCertificate(cert *Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: certificateBlock, Bytes: cert.marshal()})
+}
+
+// ParseCertificate decodes the first PEM block in data, which must be a
+// certificate as encoded by MarshalCertificate.
+func ParseCertificate(data []byte) (*Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != certificateBlock {
+		return nil, fmt.Errorf("no %s found", certificateBlock)
+	}
+	return parseCertificate(block.Bytes)
+}
+
+// LoadCertificate reads the certificate file at path, as written with
+// MarshalCertificate.
+func LoadCertificate(path string) (*Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cert, nil
+}
+
+// presentCertificate adds the configured certificate to our hello.
+func (hs *handshakeState) presentCertificate(hello handshakeMessage) error {
+	cert := hs.config.certificate()
+	if cert == nil {
+		return nil
+	}
+	if *cert.PublicKey != *hs.keys.Public {
+		return errCertificateKey
+	}
+	hello[fieldCertificate] = cert.marshal()
+	return nil
+}
+
+// readPeerCertificate checks the certificate in the peer's hello m against
+// the configured certificate authorities, if any, and records it.
+func (hs *handshakeState) readPeerCertificate(m handshakeMessage) error {
+	cas := hs.config.certificateAuthorities()
+	if len(cas) == 0 {
+		return nil
+	}
+	v, ok := m[fieldCertificate]
+	if !ok {
+		return rejectKey(errNoCertificate)
+	}
+	cert, err := parseCertificate(v)
+	if err != nil {
+		return err
+	}
+	if *cert.PublicKey != *hs.peer {
+		return rejectKey(errCertificateKey)
+	}
+	if err := cert.Verify(cas, time.Now()); err != nil {
+		return rejectKey(err)
+	}
+	if hs.serverName != "" && cert.Name != certificateHost(hs.serverName) {
+		return rejectKey(errCertificateName)
+	}
+	hs.peerCertificate = cert
+	return nil
+}
+
+// certificateHost returns the host a server certificate must be named
+// after for a client connecting to serverName, which may carry a port.
+func certificateHost(serverName string) string {
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		return host
+	}
+	return serverName
+}
+
+// PeerCertificate returns the certificate presented by the peer, running
+// the handshake first if necessary. It is nil unless the config has
+// CertificateAuthorities, which the certificate was checked against.
+func (c *SecureConn) PeerCertificate() (*Certificate, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c.session.PeerCertificate, nil
+}
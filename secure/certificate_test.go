@@ -0,0 +1,112 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCertificates(t *testing.T) {
+	caPub, ca, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherCA, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	sign := func(ca ed25519.PrivateKey, pub *[KeySize]byte, name string, expires time.Time) *Certificate {
+		cert, err := SignCertificate(ca, pub, name, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	ccert := sign(ca, ckeys.Public, "alice", later)
+	cas := []ed25519.PublicKey{caPub}
+
+	// Each end trusts the other's certificate without pinning its key.
+	client, server, cerr, serr := handshakePair(
+		&Config{Keys: ckeys, Certificate: ccert, CertificateAuthorities: cas, ServerName: "server.example:443"},
+		&Config{Keys: skeys, Certificate: sign(ca, skeys.Public, "server.example", later), CertificateAuthorities: cas})
+	client.Close()
+	server.Close()
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	if name := client.session.PeerCertificate.Name; name != "server.example" {
+		t.Fatalf("Unexpected name: %s", name)
+	}
+	if name := server.session.PeerCertificate.Name; name != "alice" {
+		t.Fatalf("Unexpected name: %s", name)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cert *Certificate
+		want error
+	}{
+		{"none", nil, errNoCertificate},
+		{"other CA", sign(otherCA, skeys.Public, "server.example", later), errUntrustedCertificate},
+		{"expired", sign(ca, skeys.Public, "server.example", time.Now().Add(-time.Second)), errExpiredCertificate},
+		{"other name", sign(ca, skeys.Public, "evil.example", later), errCertificateName},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, cerr, _ := handshakePair(
+				&Config{CertificateAuthorities: cas, ServerName: "server.example"},
+				&Config{Keys: skeys, Certificate: tt.cert})
+			client.Close()
+			server.Close()
+			if !errors.Is(cerr, tt.want) || !errors.Is(cerr, ErrPeerKeyRejected) {
+				t.Fatalf("Unexpected error: %v", cerr)
+			}
+		})
+	}
+
+	// A certificate only vouches for its own key.
+	client, server, _, serr = handshakePair(nil, &Config{Certificate: ccert})
+	client.Close()
+	server.Close()
+	if !errors.Is(serr, errCertificateKey) {
+		t.Fatalf("Unexpected error: %v", serr)
+	}
+}
+
+func TestCertificateEncoding(t *testing.T) {
+	_, ca, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := SignCertificate(ca, keys.Public, "server.example", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseCertificate(MarshalCertificate(cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got.PublicKey != *cert.PublicKey || got.Name != cert.Name || !got.Expires.Equal(cert.Expires) || string(got.Signature) != string(cert.Signature) {
+		t.Fatalf("Unexpected result: %+v, expected %+v", got, cert)
+	}
+	if _, err := parseCertificate(cert.marshal()[:KeySize+20]); err == nil {
+		t.Fatal("Unexpected result. Parsed a truncated certificate.")
+	}
+	if _, err := SignCertificate(ca, keys.Public, string(make([]byte, 256)), time.Now()); err == nil {
+		t.Fatal("Unexpected result. Signed a name too long to encode.")
+	}
+}
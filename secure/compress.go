@@ -0,0 +1,77 @@
+package secure
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Peers that both set Config.Compression compress the chunks of the
+// messages they send with zstd, each on its own, and set frameCompressed
+// in the kind of every data frame whose chunk came out smaller. Control
+// frames are never compressed. Compression happens before padding. A
+// compressed chunk must declare its decompressed size, and the frame size
+// bounds that size before anything is allocated for it.
+const (
+	// frameCompressed is set in the kind of a data frame whose chunk is
+	// compressed.
+	frameCompressed byte = 0x40
+
+	// compressionZstd identifies zstd in the fieldCompression of a hello.
+	compressionZstd byte = 1
+)
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, err := zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxFrameSizeLimit),
+			zstd.WithDecodeAllCapLimit(true))
+		if err != nil {
+			panic(err)
+		}
+		return d
+	})
+)
+
+// compressChunk returns chunk compressed, or false if compressing doesn't
+// make it smaller.
+func compressChunk(chunk []byte) ([]byte, bool) {
+	if len(chunk) == 0 {
+		return chunk, false
+	}
+	z := zstdEncoder().EncodeAll(chunk, nil)
+	if len(z) >= len(chunk) {
+		return chunk, false
+	}
+	return z, true
+}
+
+// decompress returns the chunk compressed in z, which may be no longer
+// than limit. The size the frame header declares is checked against limit
+// before decoding, and decoding stops at that size, so a small frame can't
+// make it allocate more than limit.
+func decompress(z []byte, limit int) ([]byte, error) {
+	var h zstd.Header
+	if err := h.Decode(z); err != nil || !h.HasFCS || h.FrameContentSize > uint64(limit) {
+		return nil, &FrameError{Reason: "bad compressed chunk"}
+	}
+	chunk, err := zstdDecoder().DecodeAll(z, make([]byte, 0, h.FrameContentSize))
+	if err != nil || len(chunk) > limit {
+		return nil, &FrameError{Reason: "bad compressed chunk"}
+	}
+	return chunk, nil
+}
+
+// negotiateCompression agrees on compression with the peer's hello m.
+func (hs *handshakeState) negotiateCompression(m handshakeMessage) {
+	hs.compression = hs.config.compression() && slices.Contains(m[fieldCompression], compressionZstd)
+}
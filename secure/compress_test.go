@@ -0,0 +1,132 @@
+package secure
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// countingConn counts the writes and the bytes written to it.
+type countingConn struct {
+	net.Conn
+	writes  int
+	written int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	c.written += len(p)
+	return c.Conn.Write(p)
+}
+
+func TestCompression(t *testing.T) {
+	config := &Config{Compression: true, MaxFrameSize: 4096}
+	c1, c2 := net.Pipe()
+	counter := &countingConn{Conn: c1}
+	client, server := Client(counter, config), Server(c2, config)
+	defer client.Close()
+	defer server.Close()
+	go server.Handshake()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.session.Compression {
+		t.Fatal("Unexpected result. The peers did not agree to compress.")
+	}
+
+	// send writes msg with write and returns how many bytes went over the
+	// wire.
+	msg := bytes.Repeat([]byte("compressible "), 1000)
+	send := func(write func([]byte) error) int {
+		before := counter.written
+		errc := make(chan error, 1)
+		go func() { errc <- write(msg) }()
+		got, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("Unexpected result. The message was corrupted.")
+		}
+		return counter.written - before
+	}
+	if n := send(client.WriteMessage); n >= len(msg)/4 {
+		t.Fatalf("Unexpected result: %d bytes sent for %d compressible ones", n, len(msg))
+	}
+	if n := send(client.WriteMessageUncompressed); n < len(msg) {
+		t.Fatalf("Unexpected result: %d bytes sent uncompressed for %d", n, len(msg))
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		cconfig, sconfig *Config
+		want             bool
+	}{
+		{"both", &Config{Compression: true}, &Config{Compression: true}, true},
+		{"client", &Config{Compression: true}, nil, false},
+		{"server", nil, &Config{Compression: true}, false},
+		{"psk", &Config{Compression: true, PreSharedKey: new([KeySize]byte)}, &Config{Compression: true, PreSharedKey: new([KeySize]byte)}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, cerr, serr := handshakePair(tc.cconfig, tc.sconfig)
+			if cerr != nil || serr != nil {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+			defer client.Close()
+			defer server.Close()
+			if client.session.Compression != tc.want || server.session.Compression != tc.want {
+				t.Fatalf("Unexpected result: %v, %v, expected %v", client.session.Compression, server.session.Compression, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompressedFrameRefused(t *testing.T) {
+	// A reader that didn't agree to compression refuses compressed frames.
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	s := newSharedSession(keys.Private, keys.Public)
+	sr, sw := s.newReadWriter(&buf, &buf, nil)
+	if _, err := sw.write(bytes.Repeat([]byte("x"), 1000), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.readMessage(); err == nil {
+		t.Fatal("Unexpected result. Read a compressed frame.")
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	// A small frame that expands past the limit is refused without the
+	// reader allocating what it expands to.
+	const limit = 64 * 1024
+	z, ok := compressChunk(make([]byte, 8*1024*1024))
+	if !ok {
+		t.Fatal("Unexpected result. Zeros didn't compress.")
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := decompress(z, limit)
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Fatal("Unexpected result. Decompressed past the limit.")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > limit {
+		t.Fatalf("Unexpected result. Allocated %d bytes refusing a %d byte frame.", n, len(z))
+	}
+
+	// A chunk within the limit still decompresses.
+	z, _ = compressChunk(make([]byte, limit))
+	if chunk, err := decompress(z, limit); err != nil || len(chunk) != limit {
+		t.Fatalf("Unexpected result: %d bytes, %v", len(chunk), err)
+	}
+}
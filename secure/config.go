@@ -0,0 +1,541 @@
+package secure
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// KeyPair is an X25519 key pair used for the key exchange.
+type KeyPair struct {
+	Public  *[KeySize]byte
+	Private *[KeySize]byte
+}
+
+// GenerateKeyPair generates a new random key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: pub, Private: priv}, nil
+}
+
+// Config configures a client or server connection. A Config may be reused
+// for many connections; it must not be modified after it has been passed to
+// a function in this package.
+type Config struct {
+	// Keys is the local key pair. If nil, a fresh key pair is generated for
+	// every connection.
+	Keys *KeyPair
+
+	// PreviousKeys are key pairs a server used before Keys, while it rotates
+	// them. Clients that have one of them pinned in their KnownHosts keep
+	// completing handshakes with it until it expires, and pin Keys in its
+	// place; other clients use Keys. Clients, Noise and pre-shared key
+	// handshakes, and datagram connections ignore PreviousKeys.
+	PreviousKeys []PreviousKey
+
+	// Identity is the long-term Ed25519 key the handshake is signed with,
+	// proving to the peer who it is talking to. If nil, the handshake is
+	// anonymous.
+	Identity ed25519.PrivateKey
+
+	// IdentitySigner, if set, signs the handshake in place of Identity, for
+	// an identity key held elsewhere, such as in an ssh-agent (see
+	// AgentIdentity). Its public key must be an ed25519.PublicKey.
+	IdentitySigner crypto.Signer
+
+	// PeerIdentity, if set, is the identity key the peer must present. The
+	// handshake fails with any other identity or none.
+	PeerIdentity ed25519.PublicKey
+
+	// Certificate, if set, is presented to the peer in the handshake, so
+	// that a peer with CertificateAuthorities accepts Keys. It must be the
+	// certificate of Keys.
+	Certificate *Certificate
+
+	// CertificateAuthorities, if set, are the Ed25519 keys of the
+	// certificate authorities whose certificates this end trusts. The peer
+	// must present an unexpired Certificate of its key signed by one of
+	// them, and a server's must be named after the host in ServerName or,
+	// if that is empty, in the remote address. Noise, pre-shared key and
+	// datagram handshakes carry no certificates.
+	CertificateAuthorities []ed25519.PublicKey
+
+	// KnownHosts, if set, pins the public keys of the servers a client
+	// connects to, by ServerName or, if that is empty, by remote address.
+	KnownHosts *KnownHosts
+
+	// AuthorizedKeys, if set, lists the client public keys a server
+	// accepts. The handshake with any other client fails with
+	// ErrUnauthorized.
+	AuthorizedKeys *AuthorizedKeys
+
+	// RevocationList, if set, lists public keys that either end refuses
+	// with ErrKeyRevoked, whatever AuthorizedKeys, KnownHosts or the
+	// Authorizer say.
+	RevocationList *RevocationList
+
+	// Authorizer, if set, is consulted by either end once the key exchange
+	// is complete, after AuthorizedKeys, and can refuse the peer.
+	Authorizer Authorizer
+
+	// HandshakeTimeout bounds how long the key exchange may take. Zero
+	// means no timeout, except on a SecureListener, which then uses
+	// DefaultHandshakeTimeout. A negative value disables the timeout.
+	HandshakeTimeout time.Duration
+
+	// RekeyBytes and RekeyInterval make a connection rekey its sending
+	// direction after sending that many bytes of plaintext or after that
+	// much time, whichever comes first. Zero disables each trigger.
+	// Connections always follow rekeys started by the peer.
+	RekeyBytes    int64
+	RekeyInterval time.Duration
+
+	// KeepAliveInterval, if positive, makes a connection ping its peer
+	// whenever it has received nothing for that long, and fail with
+	// ErrPeerUnresponsive once it has received nothing for
+	// KeepAliveCount intervals. Peers answer pings while they are reading,
+	// whether or not they send pings themselves, so dead peers are detected
+	// on connections being read from.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveCount is the number of keepalive intervals without a frame
+	// from the peer after which it is considered dead. Zero means
+	// DefaultKeepAliveCount.
+	KeepAliveCount int
+
+	// IdleTimeout, if positive, closes a connection once no message has
+	// been sent or received on it for that long; reads and writes then fail
+	// with ErrIdleTimeout. Keepalive pings don't count as messages. Zero
+	// means no timeout, except on a SecureServer, which then uses
+	// DefaultIdleTimeout. A negative value disables the timeout.
+	IdleTimeout time.Duration
+
+	// MaxConnLifetime, if positive, has a SecureServer close connections
+	// that have been served for that long, whatever they are doing, so
+	// that clients reconnect and pick up reloaded settings such as
+	// rotated keys. Their reads and writes then fail with
+	// ErrConnLifetimeExceeded.
+	MaxConnLifetime time.Duration
+
+	// MaxFrameSize is the largest amount of plaintext this end accepts in
+	// one frame. The peers agree on the smaller of their sizes in the
+	// handshake, and reject larger frames. Zero means DefaultMaxFrameSize;
+	// other values are clamped to between 1 KiB and 16 MiB.
+	MaxFrameSize int
+
+	// MaxMessageSize is the largest message this end accepts. The peers
+	// agree on the smaller of their sizes in the handshake, and neither
+	// sends nor accepts a larger message: WriteMessage refuses one, Write
+	// splits one into several, and reads fail on one. Zero means
+	// DefaultMaxMessageSize; other values are clamped to at most 1 GiB.
+	// Lower it to bound the memory ReadMessage uses per connection, or
+	// raise it to exchange larger messages.
+	MaxMessageSize int
+
+	// CipherSuites are the cipher suites this end accepts, in order of
+	// preference. The peers use the first of the server's suites that the
+	// client accepts, and the handshake fails if there is none. If empty,
+	// all suites are accepted, SuiteBox first. Datagram connections always
+	// use SuiteBox.
+	CipherSuites []CipherSuite
+
+	// PaddingBuckets, if set, are the sizes in bytes that this end pads
+	// the plaintext of each frame it sends up to before sealing it, so that
+	// eavesdroppers only learn which bucket a frame fell into rather than
+	// its exact length. A frame larger than every bucket is padded to a
+	// multiple of the largest, and no frame is padded beyond the frame
+	// size. Padding costs bandwidth and five bytes of every frame, and does
+	// not hide how many frames are sent or when. Peers always accept
+	// padded frames. Datagram connections are not padded.
+	PaddingBuckets []int
+
+	// WriteBufferSize, if positive, has Write on a stream connection gather
+	// the data of small writes into messages of up to that many bytes, or
+	// of the largest message the peer accepts if smaller, rather than seal
+	// each write into frames of its own at 45 bytes of overhead apiece.
+	// Buffered data is sent once the buffer fills, when Flush is called,
+	// ahead of any other message, and WriteBufferDelay after the first of
+	// it was buffered if that is positive. Writes no smaller than the
+	// buffer skip it. Close discards data that was not sent yet.
+	WriteBufferSize  int
+	WriteBufferDelay time.Duration
+
+	// Obfuscator, if set, disguises the traffic of stream connections on
+	// the wire. Both ends must use the same one.
+	Obfuscator Obfuscator
+
+	// Compression compresses messages with zstd before sealing them, if
+	// the peer sets it too. It saves bandwidth on compressible data, but
+	// how well a message compresses shows in the size of its frames: an
+	// attacker who can get data of its choosing into messages that also
+	// carry a secret, such as a cookie or a token, and watch the traffic
+	// can recover the secret byte by byte, as the CRIME and BREACH attacks
+	// did against TLS and HTTP. Leave it off in that case, or send those
+	// messages with SecureConn.WriteMessageUncompressed.
+	Compression bool
+
+	// PreSharedKey, if set, replaces the public-key handshake of stream
+	// connections with one in which both ends prove that they hold this
+	// key, and derive the keys of the session from it. Keys, Identity,
+	// KnownHosts, AuthorizedKeys, Authorizer, CipherSuites and tickets are
+	// then unused, sessions don't rekey, and a stolen key decrypts every
+	// session recorded with it. Both ends must set the same key.
+	PreSharedKey *[KeySize]byte
+
+	// Noise, if not NoiseNone, replaces the handshake of stream
+	// connections with a Noise handshake. A client runs the given pattern,
+	// and a server whichever pattern the client asks for. Both ends must
+	// set it. Identities and session tickets are not supported with Noise.
+	Noise NoisePattern
+
+	// EarlyData lets a client resuming a session from its SessionCache
+	// send the data of its first Write or WriteMessage, up to
+	// MaxEarlyDataSize bytes, in its hello, saving a round trip, and a
+	// server accept it. Both ends must set it, and DialWithConfig then
+	// leaves the handshake to the first write. Early data is not protected
+	// against replay: an attacker who recorded a client's hello can send it
+	// again for as long as the ticket is valid, and the server reads the
+	// data again each time. Only enable it for requests that are safe to
+	// repeat.
+	EarlyData bool
+
+	// TicketKey seals the resumption tickets a server sends its clients. If
+	// nil, a server issues no tickets, except on a SecureListener, which
+	// generates a random key. Servers sharing a TicketKey can resume each
+	// other's sessions.
+	TicketKey *[KeySize]byte
+
+	// TicketLifetime is how long tickets issued by a server are valid for.
+	// Zero means DefaultTicketLifetime.
+	TicketLifetime time.Duration
+
+	// SessionTicketsDisabled stops a server from issuing tickets and
+	// accepting them.
+	SessionTicketsDisabled bool
+
+	// SessionCache is where a client stores tickets to resume sessions
+	// with. If nil, sessions are not resumed.
+	SessionCache ClientSessionCache
+
+	// ServerName identifies the server to a client's SessionCache and
+	// KnownHosts. If empty, the remote address of the connection is used.
+	ServerName string
+
+	// ProxyProtocol makes a SecureListener accept a PROXY protocol header,
+	// version 1 or 2, ahead of a client's handshake, as sent by HAProxy and
+	// many load balancers. The client address in the header then becomes
+	// the connection's remote address, as seen by the Authorizer and in
+	// logs. Connections without a header are accepted as before. Only
+	// enable it behind a trusted proxy, as any client can send a header.
+	ProxyProtocol bool
+
+	// Dialer opens the connections of DialWithConfig, for example through
+	// a proxy (see ProxyDialer). If nil, connections are dialed directly,
+	// racing the IPv6 and IPv4 addresses of host names that have both.
+	Dialer ContextDialer
+
+	// Logger receives diagnostics, such as failed handshakes, at debug,
+	// info, warn and error levels. If nil, nothing is logged.
+	Logger *slog.Logger
+
+	// TracerProvider, if not nil, records OpenTelemetry spans of dials,
+	// handshakes and message round trips, carrying the remote address and
+	// the peer's key fingerprint.
+	TracerProvider trace.TracerProvider
+
+	// KeyLogWriter, if set, receives the traffic keys of every stream
+	// session, including the keys rekeys switch to, in the key log format
+	// of keylog.go, so that captures of the sessions can be decrypted
+	// while debugging. Anyone who reads it can decrypt the sessions; never
+	// set it in production.
+	KeyLogWriter io.Writer
+
+	// TraceFrames logs every frame of stream sessions to Logger at debug
+	// level, with the start of its ciphertext and plaintext in hex, to
+	// diagnose problems on the wire. Payloads that carry key material are
+	// redacted, but the plaintext of messages is not.
+	TraceFrames bool
+
+	// Interceptors wrap the plaintext path of every stream connection,
+	// each returning the Interceptor of one connection, for middleware
+	// such as metrics, rate limits, content filters or recorders. The
+	// first is closest to the application: writes pass through them in
+	// order and reads in reverse order. Early data is disabled when there
+	// are interceptors, so that none of the data bypasses them.
+	Interceptors []InterceptorFunc
+
+	// ReadRateLimit and WriteRateLimit, if positive, limit how many bytes
+	// per second each stream connection reads and writes once its
+	// handshake completes, frame overhead included, so that one peer can't
+	// take all of the bandwidth. RateLimitBurst is how many bytes may pass
+	// at once after a quiet spell; if zero, it is a second's worth.
+	ReadRateLimit  int
+	WriteRateLimit int
+	RateLimitBurst int
+
+	// MaxConns and MaxConnsPerIP, if positive, limit how many connections
+	// a SecureListener keeps open at once, in total and from each IP
+	// address. Connections over a limit are closed as soon as they are
+	// accepted, before any handshake. Connections count until they are
+	// closed, including after Accept returns them. MaxConnsPerIP counts
+	// the addresses connections come from before any PROXY protocol
+	// header is read, so behind a proxy only MaxConns is useful.
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// IPFilter, if set, refuses connections to a SecureListener from the
+	// addresses it doesn't allow as soon as they are accepted, before any
+	// handshake. Like MaxConnsPerIP, it sees the addresses connections
+	// come from before any PROXY protocol header.
+	IPFilter *IPFilter
+
+	// Banner, if set, bans the addresses of clients whose connections to a
+	// SecureListener fail too many handshakes, or send frames that don't
+	// decrypt, and refuses their connections until the ban is over. Unlike
+	// IPFilter, it sees the client addresses of PROXY protocol headers.
+	Banner *Banner
+
+	// TarpitConns, if positive, has a SecureListener keep up to that many
+	// connections of clients whose keys it refuses open, instead of closing
+	// them, trickling a random byte to each every TarpitInterval, or
+	// DefaultTarpitInterval if zero, to waste the time of scanners. Once
+	// that many are in the tarpit, refused connections are closed again.
+	TarpitConns    int
+	TarpitInterval time.Duration
+
+	// LockMemory keeps the traffic keys of stream sessions, and the copies
+	// of private keys that follow rekeys, in memory locked into RAM, with
+	// mlock or VirtualLock, so that they are never written to swap. Lock
+	// the long-term keys with LockKeyPair. If memory can't be locked, such
+	// as under a low RLIMIT_MEMLOCK, the keys stay on the heap and a
+	// warning is logged. The AEADs of the cipher suites other than box
+	// keep copies of the keys that are not locked.
+	LockMemory bool
+}
+
+// DefaultKeepAliveCount is the number of keepalive intervals without a
+// frame from the peer after which it is considered dead, when
+// Config.KeepAliveCount is zero.
+const DefaultKeepAliveCount = 3
+
+// DefaultIdleTimeout is the idle timeout used by SecureServer when
+// Config.IdleTimeout is zero.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// DefaultHandshakeTimeout is the handshake timeout used by SecureListener
+// when Config.HandshakeTimeout is zero.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// clone returns a shallow copy of c, or an empty Config if c is nil.
+func (c *Config) clone() *Config {
+	if c == nil {
+		return &Config{}
+	}
+	cc := *c
+	return &cc
+}
+
+// handshakeTimeout returns the configured handshake timeout, zero meaning
+// none.
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil || c.HandshakeTimeout < 0 {
+		return 0
+	}
+	return c.HandshakeTimeout
+}
+
+// keys returns the configured key pair, generating one if necessary.
+func (c *Config) keys() (*KeyPair, error) {
+	if c == nil || c.Keys == nil {
+		return GenerateKeyPair()
+	}
+	return c.Keys, nil
+}
+
+// ticketKey returns the key to seal and open tickets with, or nil if tickets
+// are disabled.
+func (c *Config) ticketKey() *[KeySize]byte {
+	if c == nil || c.SessionTicketsDisabled {
+		return nil
+	}
+	return c.TicketKey
+}
+
+// ticketLifetime returns how long tickets are valid for.
+func (c *Config) ticketLifetime() time.Duration {
+	if c == nil || c.TicketLifetime <= 0 {
+		return DefaultTicketLifetime
+	}
+	return c.TicketLifetime
+}
+
+// sessionCache returns the client session cache, if any.
+func (c *Config) sessionCache() ClientSessionCache {
+	if c == nil {
+		return nil
+	}
+	return c.SessionCache
+}
+
+// identity returns the local identity key, if any.
+func (c *Config) identity() crypto.Signer {
+	switch {
+	case c == nil:
+		return nil
+	case c.IdentitySigner != nil:
+		return c.IdentitySigner
+	case c.Identity != nil:
+		return c.Identity
+	}
+	return nil
+}
+
+// peerIdentity returns the identity key the peer must present, if any.
+func (c *Config) peerIdentity() ed25519.PublicKey {
+	if c == nil {
+		return nil
+	}
+	return c.PeerIdentity
+}
+
+// knownHosts returns the client's known hosts, if any.
+func (c *Config) noise() NoisePattern {
+	if c == nil {
+		return NoiseNone
+	}
+	return c.Noise
+}
+
+func (c *Config) obfuscator() Obfuscator {
+	if c == nil {
+		return nil
+	}
+	return c.Obfuscator
+}
+
+func (c *Config) compression() bool {
+	return c != nil && c.Compression
+}
+
+func (c *Config) earlyData() bool {
+	return c != nil && c.EarlyData && len(c.Interceptors) == 0
+}
+
+func (c *Config) certificate() *Certificate {
+	if c == nil {
+		return nil
+	}
+	return c.Certificate
+}
+
+func (c *Config) certificateAuthorities() []ed25519.PublicKey {
+	if c == nil {
+		return nil
+	}
+	return c.CertificateAuthorities
+}
+
+func (c *Config) knownHosts() *KnownHosts {
+	if c == nil {
+		return nil
+	}
+	return c.KnownHosts
+}
+
+// authorize checks that we may talk to the peer with key at addr. Only a
+// server checks AuthorizedKeys.
+func (c *Config) authorize(isClient bool, key *[KeySize]byte, addr net.Addr) error {
+	if c == nil {
+		return nil
+	}
+	if c.RevocationList != nil && c.RevocationList.Revoked(key) {
+		return ErrKeyRevoked
+	}
+	if !isClient && c.AuthorizedKeys != nil {
+		if err := c.AuthorizedKeys.Authorize(*key, addr); err != nil {
+			return err
+		}
+	}
+	if c.Authorizer != nil {
+		return c.Authorizer.Authorize(*key, addr)
+	}
+	return nil
+}
+
+// keepAlive returns the keepalive interval, zero meaning none, and count.
+func (c *Config) keepAlive() (time.Duration, int) {
+	if c == nil || c.KeepAliveInterval <= 0 {
+		return 0, 0
+	}
+	if c.KeepAliveCount <= 0 {
+		return c.KeepAliveInterval, DefaultKeepAliveCount
+	}
+	return c.KeepAliveInterval, c.KeepAliveCount
+}
+
+// idleTimeout returns the configured idle timeout, zero meaning none.
+func (c *Config) idleTimeout() time.Duration {
+	if c == nil || c.IdleTimeout < 0 {
+		return 0
+	}
+	return c.IdleTimeout
+}
+
+func (c *Config) cipherSuites() []CipherSuite {
+	if c == nil || len(c.CipherSuites) == 0 {
+		return defaultCipherSuites
+	}
+	return c.CipherSuites
+}
+
+func (c *Config) preSharedKey() *[KeySize]byte {
+	if c == nil {
+		return nil
+	}
+	return c.PreSharedKey
+}
+
+// maxFrameSize returns the largest frame this end accepts.
+func (c *Config) maxFrameSize() int {
+	if c == nil || c.MaxFrameSize == 0 {
+		return DefaultMaxFrameSize
+	}
+	return min(max(c.MaxFrameSize, minFrameSize), maxFrameSizeLimit)
+}
+
+// maxMessageSize returns the largest message this end accepts.
+func (c *Config) maxMessageSize() int {
+	if c == nil || c.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return min(c.MaxMessageSize, maxMessageSizeLimit)
+}
+
+// discardLogger is the logger used when none is configured.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// dialer returns the dialer to connect to servers with.
+func (c *Config) dialer() ContextDialer {
+	if c == nil || c.Dialer == nil {
+		return &eyeballsDialer{}
+	}
+	return c.Dialer
+}
+
+// logger returns the configured logger, or one that discards everything.
+func (c *Config) logger() *slog.Logger {
+	if c == nil || c.Logger == nil {
+		return discardLogger
+	}
+	return c.Logger
+}
@@ -0,0 +1,382 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SecureConn is a secure connection over an underlying net.Conn. It
+// implements net.Conn, so it can be used anywhere a plain connection is
+// expected, as well as MessageConn. Like a net.Conn, it may be used by
+// several goroutines at once: concurrent writes never interleave within a
+// Write or WriteMessage, and concurrent reads never split a frame.
+type SecureConn struct {
+	conn     net.Conn
+	config   *Config
+	isClient bool
+
+	// wire is what frames are sent over: conn, or conn as wrapped by the
+	// config's Obfuscator. It is set by the handshake, or by setSession
+	// when there is none.
+	wire io.ReadWriter
+
+	// handshakeMu guards the handshake state below. sr and sw are set once
+	// the handshake completes.
+	handshakeMu       sync.Mutex
+	handshakeErr      error
+	handshakeComplete bool
+	session           *Session
+
+	// sessionShared is set if the session came from the caller, through
+	// Session.Conn, so that Close leaves its keys alone.
+	sessionShared bool
+
+	// early is the data a client offers to send with its hello, if any.
+	early *earlyData
+
+	sr *secureReader
+	sw *secureWriter
+
+	ka keepAliveState
+
+	// closed is set by Close, and stops the connection's timers. failure
+	// is the error the connection was closed with by one of them, if any.
+	closed  atomic.Bool
+	failure atomic.Value
+}
+
+var (
+	_ net.Conn    = (*SecureConn)(nil)
+	_ MessageConn = (*SecureConn)(nil)
+)
+
+// NewSecureConn instantiates a new SecureConn over conn using the given
+// private key and the peer's public key. No handshake is performed, and
+// both directions share one key (see the package documentation).
+func NewSecureConn(conn net.Conn, priv, pub *[KeySize]byte) *SecureConn {
+	return newSharedSession(priv, pub).Conn(conn)
+}
+
+// setSession prepares the reader and writer for the session's keys.
+func (c *SecureConn) setSession(s *Session) {
+	s.lock(c.config)
+	c.session = s
+	if c.wire == nil {
+		c.wire = c.conn
+	}
+	wire := c.config.throttle(c.wire)
+	c.sr, c.sw = s.newReadWriter(wire, wire, c.config)
+	c.logKeys()
+	c.intercept()
+	c.startKeepAlive()
+	if timeout := c.config.idleTimeout(); timeout > 0 {
+		go c.watchIdle(timeout)
+	}
+}
+
+// fail closes the underlying connection because of err, which later reads
+// and writes return.
+func (c *SecureConn) fail(err error) {
+	c.failure.Store(err)
+	c.conn.Close()
+}
+
+// failErr returns the error the connection was failed with, or
+// ErrSessionClosed if it was closed, in place of err, since closing the
+// connection is what made the read or write fail.
+func (c *SecureConn) failErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if ferr, ok := c.failure.Load().(error); ok {
+		return ferr
+	}
+	if c.closed.Load() {
+		return ErrSessionClosed
+	}
+	return err
+}
+
+// noteReadErr records a frame from the client that failed to decrypt as a
+// failure of its address, for the config's Banner.
+func (c *SecureConn) noteReadErr(err error) {
+	if err != nil && !c.isClient && errors.Is(err, ErrDecryptionFailed) {
+		c.config.recordFailure(c.conn.RemoteAddr())
+	}
+}
+
+// Handshake runs the key exchange if it has not yet been run. Most uses of
+// this package need not call Handshake explicitly: the first Read or Write
+// will call it automatically.
+func (c *SecureConn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the key exchange if it has not yet been run. If ctx
+// is done before the handshake completes, the handshake is interrupted, the
+// underlying connection is closed and the context's error is returned.
+func (c *SecureConn) HandshakeContext(ctx context.Context) (err error) {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.handshakeComplete || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	role := "server"
+	if c.isClient {
+		role = "client"
+	}
+	ctx, span := c.config.tracer().Start(ctx, "secure.Handshake", trace.WithAttributes(
+		attribute.String("gochal2.role", role),
+		attribute.String("network.peer.address", c.conn.RemoteAddr().String())))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(sessionAttributes(c.session)...)
+		}
+		endSpan(span, err)
+	}()
+
+	if timeout := c.config.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if ctx.Done() != nil {
+		// Close the connection if ctx is done mid-handshake, which unblocks
+		// any pending Read or Write.
+		done := make(chan struct{})
+		interrupted := make(chan error, 1)
+		defer func() {
+			close(done)
+			if ctxErr := <-interrupted; ctxErr != nil {
+				err = ctxErr
+				c.handshakeErr = ctxErr
+				c.handshakeComplete = false
+			}
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.conn.Close()
+				interrupted <- ctx.Err()
+			case <-done:
+				interrupted <- nil
+			}
+		}()
+	}
+
+	if err := c.handshake(); err != nil {
+		c.handshakeErr = &HandshakeError{Err: err}
+	}
+	c.handshakeComplete = c.handshakeErr == nil
+	return c.handshakeErr
+}
+
+// role returns the end of the connection c is.
+func (c *SecureConn) role() Role {
+	if c.isClient {
+		return ClientRole
+	}
+	return ServerRole
+}
+
+// serverName returns the name a client knows the server by.
+func (c *SecureConn) serverName() string {
+	if c.config != nil && c.config.ServerName != "" {
+		return c.config.ServerName
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// PeerPublicKey returns the public key presented by the peer, running the
+// handshake first if necessary. It returns ErrNoPeerKey if the peers used a
+// pre-shared key instead.
+func (c *SecureConn) PeerPublicKey() (*[KeySize]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	if c.session.PeerPublicKey == nil {
+		return nil, ErrNoPeerKey
+	}
+	return c.session.PeerPublicKey, nil
+}
+
+// Read reads and decrypts data from the connection.
+func (c *SecureConn) Read(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	n, err := c.sr.Read(p)
+	c.noteReadErr(err)
+	return n, c.failErr(err)
+}
+
+// WriteTo decrypts what the peer sends until it closes the connection or an
+// error occurs, and writes it to w, so that io.Copy from the connection
+// writes each frame straight from the buffer it was decrypted into.
+func (c *SecureConn) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	n, err := c.sr.WriteTo(w)
+	c.noteReadErr(err)
+	return n, c.failErr(err)
+}
+
+// Write encrypts and writes data to the connection. A client's first Write
+// may be sent with the handshake instead; see Config.EarlyData.
+func (c *SecureConn) Write(p []byte) (int, error) {
+	sent, err := c.handshakeEarly(p)
+	if err != nil {
+		return 0, err
+	}
+	if sent {
+		return len(p), nil
+	}
+	n, err := c.sw.Write(p)
+	return n, c.failErr(err)
+}
+
+// ReadFrom reads from r until EOF or an error and writes what it reads to
+// the connection, so that io.Copy to the connection reads a frame at a time
+// into a buffer of the connection's own. Nothing is sent as early data.
+func (c *SecureConn) ReadFrom(r io.Reader) (int64, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	n, err := c.sw.ReadFrom(r)
+	return n, c.failErr(err)
+}
+
+// ReadMessage reads the next complete message from the connection.
+func (c *SecureConn) ReadMessage() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	msg, err := c.sr.readMessage()
+	c.noteReadErr(err)
+	return msg, c.failErr(err)
+}
+
+// WriteMessage writes p to the connection as a single message.
+func (c *SecureConn) WriteMessage(p []byte) error {
+	sent, err := c.handshakeEarly(p)
+	if err != nil || sent {
+		return err
+	}
+	_, err = c.sw.writeMessage(p)
+	return c.failErr(err)
+}
+
+// WriteMessageUncompressed is like WriteMessage but never compresses p,
+// for messages that mix secrets with data an attacker may choose when the
+// session compresses messages; see Config.Compression. It doesn't send p
+// as early data.
+func (c *SecureConn) WriteMessageUncompressed(p []byte) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	_, err := c.sw.write(p, false)
+	return c.failErr(err)
+}
+
+// Flush sends the data that Write has buffered, if the config has it
+// buffer writes; see Config.WriteBufferSize.
+func (c *SecureConn) Flush() error {
+	c.handshakeMu.Lock()
+	sw := c.sw
+	c.handshakeMu.Unlock()
+	if sw == nil {
+		return nil
+	}
+	return c.failErr(sw.Flush())
+}
+
+// RoundTrip writes msg as a single message and reads the peer's reply, as
+// in a request and response protocol. If ctx carries a span, RoundTrip
+// records a child span of it when the config has a TracerProvider.
+func (c *SecureConn) RoundTrip(ctx context.Context, msg []byte) (reply []byte, err error) {
+	ctx, span := c.config.tracer().Start(ctx, "secure.RoundTrip", trace.WithAttributes(
+		attribute.String("network.peer.address", c.conn.RemoteAddr().String()),
+		attribute.Int("gochal2.message.size", len(msg))))
+	defer func() { endSpan(span, err) }()
+
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(sessionAttributes(c.session)...)
+	if err := c.WriteMessage(msg); err != nil {
+		return nil, err
+	}
+	if reply, err = c.ReadMessage(); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("gochal2.reply.size", len(reply)))
+	return reply, nil
+}
+
+// Close closes the underlying connection, then overwrites the traffic keys
+// of the connection, its copy of the private key that follows rekeys, and
+// any plaintext read but not yet returned with zeros, so that they don't
+// linger in memory. The AEADs of the cipher suites other than box keep
+// copies of the keys that can't be reached, and are dropped for the
+// garbage collector instead. Reads and writes that started before Close
+// finish first.
+func (c *SecureConn) Close() error {
+	c.closed.Store(true)
+	err := c.conn.Close()
+	c.handshakeMu.Lock()
+	sr, sw, s := c.sr, c.sw, c.session
+	c.handshakeMu.Unlock()
+	if sr != nil {
+		sr.wipe()
+		sw.wipe()
+	}
+	if s != nil && !c.sessionShared {
+		s.wipe()
+	}
+	return err
+}
+
+// LocalAddr returns the local network address.
+func (c *SecureConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *SecureConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *SecureConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *SecureConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection. A
+// Write that times out may have sent part of a frame, after which the
+// connection can no longer be used.
+func (c *SecureConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// NetConn returns the underlying connection. Writing to it directly
+// corrupts the secure stream.
+func (c *SecureConn) NetConn() net.Conn {
+	return c.conn
+}
@@ -0,0 +1,87 @@
+package secure
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSecureConnDeadline(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := NewSecureConn(c1, priv, pub)
+	defer conn.Close()
+
+	if conn.LocalAddr() != c1.LocalAddr() || conn.RemoteAddr() != c1.RemoteAddr() {
+		t.Fatal("Unexpected result. Addresses don't match the underlying connection.")
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Unexpected error: %v, expected a timeout", err)
+	}
+}
+
+func TestSecureConnConcurrentWrites(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	c1, c2 := net.Pipe()
+	a, b := NewSecureConn(c1, priv, pub), NewSecureConn(c2, priv, pub)
+	defer a.Close()
+	defer b.Close()
+
+	// Messages spanning several frames arrive whole, whatever the writers'
+	// interleaving.
+	const writers, perWriter = 4, 5
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 3*DefaultMaxFrameSize)
+			for j := 0; j < perWriter; j++ {
+				if err := a.WriteMessage(msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for n := 0; n < writers*perWriter; n++ {
+		msg, err := b.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg) != 3*DefaultMaxFrameSize || !bytes.Equal(msg, bytes.Repeat(msg[:1], len(msg))) {
+			t.Fatal("Unexpected result. Concurrent messages were interleaved.")
+		}
+	}
+}
+
+func TestCloseZeroesKeys(t *testing.T) {
+	client, server, cerr, serr := handshakePair(nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer server.Close()
+	client.sr.buf = []byte("plaintext not yet read")
+	buf := client.sr.buf
+	client.Close()
+
+	var zeroKey [KeySize]byte
+	for _, key := range []*[KeySize]byte{client.sr.key, client.sw.key, client.sr.priv, client.session.sendKey, client.session.recvKey, client.session.priv} {
+		if *key != zeroKey {
+			t.Fatal("Unexpected result. A key survived Close.")
+		}
+	}
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Fatal("Unexpected result. Buffered plaintext survived Close.")
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrSessionClosed)
+	}
+}
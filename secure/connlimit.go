@@ -0,0 +1,67 @@
+package secure
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter counts the open connections of a listener, in total and per
+// client IP address, to enforce Config.MaxConns and Config.MaxConnsPerIP.
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// acquire counts conn against the limits of config and returns it wrapped
+// so that closing it releases it, or reports false if either limit is
+// reached.
+func (l *connLimiter) acquire(conn net.Conn, config *Config) (net.Conn, bool) {
+	if config.MaxConns <= 0 && config.MaxConnsPerIP <= 0 {
+		return conn, true
+	}
+	ip := remoteIP(conn.RemoteAddr())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (config.MaxConns > 0 && l.total >= config.MaxConns) ||
+		(config.MaxConnsPerIP > 0 && l.perIP[ip] >= config.MaxConnsPerIP) {
+		return nil, false
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.total++
+	l.perIP[ip]++
+	return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, true
+}
+
+// release uncounts a connection from ip.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// remoteIP returns the IP address of addr, or addr itself if it has none.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// limitedConn is a connection counted by a connLimiter until it is closed.
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,81 @@
+package secure
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxConnsPerIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, &Config{MaxConnsPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := Dial(sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	serverConn := <-accepted
+
+	// A second connection from the same address is refused while the first
+	// is open.
+	if conn, err := Dial(sl.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result. Accepted a connection over the limit.")
+	}
+
+	// Closing the first makes room for another.
+	serverConn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := Dial(sl.Addr().String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected error once the first connection closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	var l connLimiter
+	config := &Config{MaxConns: 2}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	a, ok := l.acquire(c1, config)
+	if !ok {
+		t.Fatal("Unexpected result. Refused the first connection.")
+	}
+	if _, ok := l.acquire(c1, config); !ok {
+		t.Fatal("Unexpected result. Refused the second connection.")
+	}
+	if _, ok := l.acquire(c1, config); ok {
+		t.Fatal("Unexpected result. Accepted a third connection over MaxConns.")
+	}
+	// Closing a connection twice releases it once.
+	a.Close()
+	a.Close()
+	if l.total != 1 {
+		t.Fatalf("Unexpected count %d, want 1", l.total)
+	}
+}
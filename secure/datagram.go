@@ -0,0 +1,533 @@
+package secure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Datagram mode runs the protocol over UDP. Each packet starts with its
+// type:
+//
+//	hello: packetHello | client or server hello handshake message
+//	data:  packetData | nonce (24 bytes) | sealed message
+//
+// The client sends its hello until the server's arrives, doubling the wait
+// each time; the server answers a repeated hello with the same reply. A
+// different hello from the address of a connection is taken to be from a
+// client that restarted, and replaces the connection. The
+// first 8 bytes of each nonce are the sender's sequence number, which the
+// receiver checks against a sliding window so that replayed or very late
+// packets are dropped. Packets that don't decrypt are dropped too: unlike a
+// stream, a datagram connection doesn't fail because of a stray packet.
+const (
+	packetHello byte = 1
+	packetData  byte = 2
+)
+
+const (
+	// MaxDatagramSize is the largest message a DatagramConn sends in one
+	// packet. It keeps packets below the MTU of common paths.
+	MaxDatagramSize = 1200
+
+	// maxPacketSize is the size of the largest valid packet.
+	maxPacketSize = 1 + NonceSize + box.Overhead + MaxDatagramSize
+
+	// initialRetransmit and maxRetransmit bound the wait before the client
+	// sends its hello again.
+	initialRetransmit = 200 * time.Millisecond
+	maxRetransmit     = 2 * time.Second
+
+	// datagramBacklog is the number of packets, and of connections waiting
+	// for Accept, queued before more are dropped.
+	datagramBacklog = 64
+)
+
+// ErrDatagramTooLarge is returned by the writes of a DatagramConn given a
+// message longer than MaxDatagramSize.
+var ErrDatagramTooLarge = errors.New("secure: datagram too large")
+
+// DatagramConn is a secure connection over UDP. Each message is sent as one
+// packet, and may be lost, duplicated on the wire or reordered; duplicates
+// and replays are never delivered. It implements MessageConn, where each
+// Read or Write is one message.
+type DatagramConn struct {
+	session       *Session
+	local, remote net.Addr
+	send          func(pkt []byte) error
+
+	// packets queues received packets until they are read.
+	packets chan []byte
+
+	// recvMu guards window, the sequence numbers received so far.
+	recvMu  sync.Mutex
+	window  replayWindow
+	sendSeq atomic.Uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func() error
+
+	// clientHello and serverHello are the hellos of the handshake, kept by
+	// a server to answer retransmitted client hellos.
+	clientHello, serverHello []byte
+}
+
+var _ MessageConn = (*DatagramConn)(nil)
+
+// newDatagramConn returns a connection sending packets with send.
+func newDatagramConn(s *Session, local, remote net.Addr, send func([]byte) error) *DatagramConn {
+	return &DatagramConn{
+		session: s,
+		local:   local,
+		remote:  remote,
+		send:    send,
+		packets: make(chan []byte, datagramBacklog),
+		done:    make(chan struct{}),
+	}
+}
+
+// DialDatagram runs the handshake with the datagram server at addr and
+// returns the secured connection. The client hello is retransmitted until
+// the server answers, ctx is done or the config's HandshakeTimeout passes.
+// config may be nil.
+func DialDatagram(ctx context.Context, addr string, config *Config) (*DatagramConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := datagramHandshake(ctx, conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, &HandshakeError{Err: err}
+	}
+	if kh := config.knownHosts(); kh != nil {
+		name := addr
+		if config != nil && config.ServerName != "" {
+			name = config.ServerName
+		}
+		if err := kh.Check(name, s.PeerPublicKey); err != nil {
+			conn.Close()
+			return nil, &HandshakeError{Err: rejectKey(err)}
+		}
+	}
+	if err := config.authorize(true, s.PeerPublicKey, conn.RemoteAddr()); err != nil {
+		conn.Close()
+		return nil, &HandshakeError{Err: rejectKey(err)}
+	}
+
+	dc := newDatagramConn(s, conn.LocalAddr(), conn.RemoteAddr(), func(pkt []byte) error {
+		_, err := conn.Write(pkt)
+		return err
+	})
+	dc.onClose = conn.Close
+	go dc.readFrom(conn)
+	return dc, nil
+}
+
+// packetTransport is a path to a single peer that packets are sent and
+// received on, such as a connected UDP socket.
+type packetTransport interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// datagramHandshake sends the client hello on conn until the server hello
+// arrives, and returns the resulting session.
+func datagramHandshake(ctx context.Context, conn packetTransport, config *Config) (*Session, error) {
+	if timeout := config.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// Unblock the read below as soon as ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	defer conn.SetReadDeadline(time.Time{})
+
+	keys, err := config.keys()
+	if err != nil {
+		return nil, err
+	}
+	chRaw := append(preamble(), handshakeMessage{fieldPublicKey: keys.Public[:]}.marshal(msgClientHello)...)
+	hello := append([]byte{packetHello}, chRaw...)
+	buf := make([]byte, maxPacketSize)
+	for wait := initialRetransmit; ; wait = min(2*wait, maxRetransmit) {
+		if _, err := conn.Write(hello); err != nil {
+			return nil, err
+		}
+		retransmit := time.Now().Add(wait)
+		conn.SetReadDeadline(retransmit)
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				// Such as the ICMP error of a server that isn't up yet.
+				continue
+			}
+			if n == 0 || buf[0] != packetHello {
+				continue
+			}
+			sh, shRaw, version, err := readHello(bytes.NewReader(buf[1:n]), msgServerHello)
+			if err != nil {
+				continue
+			}
+			peer, err := sh.publicKey(fieldPublicKey)
+			if err != nil {
+				return nil, err
+			}
+			s := newSession(keys, peer, ClientRole, nil, datagramTranscript(shRaw, chRaw))
+			s.Version = version
+			return s, nil
+		}
+	}
+}
+
+// datagramTranscript hashes the hellos of a datagram handshake.
+func datagramTranscript(shRaw, chRaw []byte) []byte {
+	h := sha256.New()
+	h.Write(shRaw)
+	h.Write(chRaw)
+	return h.Sum(nil)
+}
+
+// readFrom queues the data packets read from conn until it is closed.
+func (dc *DatagramConn) readFrom(conn net.Conn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 || buf[0] != packetData {
+			// Retransmitted server hellos and ICMP errors.
+			continue
+		}
+		dc.deliver(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// deliver queues pkt to be read, dropping it if the queue is full.
+func (dc *DatagramConn) deliver(pkt []byte) {
+	select {
+	case dc.packets <- pkt:
+	default:
+	}
+}
+
+// open returns the message sealed in the data packet pkt. It reports false
+// if pkt is malformed, doesn't decrypt or was already received.
+func (dc *DatagramConn) open(pkt []byte) ([]byte, bool) {
+	if len(pkt) < 1+NonceSize+box.Overhead || pkt[0] != packetData {
+		return nil, false
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], pkt[1:])
+	seq := binary.BigEndian.Uint64(nonce[:8])
+
+	dc.recvMu.Lock()
+	defer dc.recvMu.Unlock()
+	if !dc.window.check(seq) {
+		return nil, false
+	}
+	msg, ok := box.OpenAfterPrecomputation(nil, pkt[1+NonceSize:], &nonce, dc.session.recvKey)
+	if !ok {
+		return nil, false
+	}
+	dc.window.accept(seq)
+	return msg, true
+}
+
+// ReadMessage returns the next message received from the peer.
+func (dc *DatagramConn) ReadMessage() ([]byte, error) {
+	for {
+		select {
+		case pkt := <-dc.packets:
+			if msg, ok := dc.open(pkt); ok {
+				return msg, nil
+			}
+		case <-dc.done:
+			return nil, ErrSessionClosed
+		}
+	}
+}
+
+// WriteMessage seals p into one packet and sends it to the peer.
+func (dc *DatagramConn) WriteMessage(p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	select {
+	case <-dc.done:
+		return ErrSessionClosed
+	default:
+	}
+
+	var nonce [NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[:8], dc.sendSeq.Add(1))
+	if _, err := io.ReadFull(rand.Reader, nonce[8:]); err != nil {
+		return err
+	}
+	pkt := make([]byte, 1+NonceSize, 1+NonceSize+len(p)+box.Overhead)
+	pkt[0] = packetData
+	copy(pkt[1:], nonce[:])
+	return dc.send(box.SealAfterPrecomputation(pkt, p, &nonce, dc.session.sendKey))
+}
+
+// Read reads the next message into p. If p is too short, the rest of the
+// message is discarded, as with a UDP socket.
+func (dc *DatagramConn) Read(p []byte) (int, error) {
+	msg, err := dc.ReadMessage()
+	return copy(p, msg), err
+}
+
+// Write sends p as one message.
+func (dc *DatagramConn) Write(p []byte) (int, error) {
+	if err := dc.WriteMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection. The peer is not told: it sees no more
+// messages.
+func (dc *DatagramConn) Close() error {
+	var err error
+	dc.closeOnce.Do(func() {
+		close(dc.done)
+		if dc.onClose != nil {
+			err = dc.onClose()
+		}
+	})
+	return err
+}
+
+// LocalAddr returns the local network address.
+func (dc *DatagramConn) LocalAddr() net.Addr {
+	return dc.local
+}
+
+// RemoteAddr returns the remote network address.
+func (dc *DatagramConn) RemoteAddr() net.Addr {
+	return dc.remote
+}
+
+// PeerPublicKey returns the public key presented by the peer.
+func (dc *DatagramConn) PeerPublicKey() *[KeySize]byte {
+	return dc.session.PeerPublicKey
+}
+
+// DatagramListener accepts secure datagram connections on a PacketConn,
+// telling clients apart by their address.
+type DatagramListener struct {
+	pc     net.PacketConn
+	config *Config
+
+	accepted  chan *DatagramConn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// mu guards conns, the connections by remote address.
+	mu    sync.Mutex
+	conns map[string]*DatagramConn
+}
+
+// NewDatagramListener starts accepting datagram connections on pc. config
+// may be nil, but then every connection uses a different server key.
+func NewDatagramListener(pc net.PacketConn, config *Config) *DatagramListener {
+	l := &DatagramListener{
+		pc:       pc,
+		config:   config,
+		accepted: make(chan *DatagramConn, datagramBacklog),
+		done:     make(chan struct{}),
+		conns:    make(map[string]*DatagramConn),
+	}
+	go l.readLoop()
+	return l
+}
+
+// Accept waits for the next client to complete the handshake.
+func (l *DatagramListener) Accept() (*DatagramConn, error) {
+	select {
+	case dc := <-l.accepted:
+		return dc, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the PacketConn and every connection of the listener.
+func (l *DatagramListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	err := l.pc.Close()
+	l.mu.Lock()
+	conns := l.conns
+	l.conns = nil
+	l.mu.Unlock()
+	for _, dc := range conns {
+		dc.Close()
+	}
+	return err
+}
+
+// Addr returns the local address of the listener.
+func (l *DatagramListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// readLoop hands the packets read from the PacketConn to their connection,
+// or to a new handshake.
+func (l *DatagramListener) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			l.closeOnce.Do(func() { close(l.done) })
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+
+		l.mu.Lock()
+		dc := l.conns[addr.String()]
+		l.mu.Unlock()
+		switch {
+		case dc != nil && pkt[0] == packetData:
+			dc.deliver(pkt)
+		case dc != nil && bytes.Equal(pkt, dc.clientHello):
+			// Our hello was lost; send it again.
+			l.pc.WriteTo(dc.serverHello, addr)
+		case pkt[0] == packetHello:
+			l.handshake(pkt, addr)
+		}
+	}
+}
+
+// handshake answers the client hello pkt from addr and queues the new
+// connection for Accept, closing any earlier connection from addr. Hellos
+// that are malformed, or from clients that aren't authorized, are dropped.
+func (l *DatagramListener) handshake(pkt []byte, addr net.Addr) {
+	s, serverHello, err := acceptDatagramHello(pkt, addr, l.config)
+	if err != nil {
+		l.config.logger().Warn("datagram handshake failed", "remote", addr.String(), "err", err)
+		return
+	}
+
+	key := addr.String()
+	dc := newDatagramConn(s, l.pc.LocalAddr(), addr, func(pkt []byte) error {
+		_, err := l.pc.WriteTo(pkt, addr)
+		return err
+	})
+	dc.clientHello = pkt
+	dc.serverHello = serverHello
+	dc.onClose = func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conns[key] == dc {
+			delete(l.conns, key)
+		}
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.conns == nil {
+		l.mu.Unlock()
+		return
+	}
+	old := l.conns[key]
+	l.conns[key] = dc
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	select {
+	case l.accepted <- dc:
+	default:
+		// Too many connections waiting for Accept. The client will
+		// retransmit its hello.
+		dc.Close()
+		return
+	}
+	l.pc.WriteTo(dc.serverHello, addr)
+}
+
+// acceptDatagramHello runs the server side of the handshake on the client
+// hello packet pkt from addr, and returns the session and the server hello
+// packet to answer with.
+func acceptDatagramHello(pkt []byte, addr net.Addr, config *Config) (*Session, []byte, error) {
+	ch, chRaw, version, err := readHello(bytes.NewReader(pkt[1:]), msgClientHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := ch.publicKey(fieldPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := config.authorize(false, peer, addr); err != nil {
+		return nil, nil, rejectKey(err)
+	}
+	keys, err := config.keys()
+	if err != nil {
+		return nil, nil, err
+	}
+	shRaw := append(preamble(), handshakeMessage{fieldPublicKey: keys.Public[:]}.marshal(msgServerHello)...)
+	s := newSession(keys, peer, ServerRole, nil, datagramTranscript(shRaw, chRaw))
+	s.Version = version
+	return s, append([]byte{packetHello}, shRaw...), nil
+}
+
+// replayWindow tracks the sequence numbers received in a sliding window of
+// the last 64, as IPsec does (RFC 4303, section 3.4.3). Sequence numbers
+// start at 1.
+type replayWindow struct {
+	// highest is the highest sequence number received, and bit i of seen
+	// is set if highest-i was received.
+	highest uint64
+	seen    uint64
+}
+
+// check reports whether seq is new and recent enough to be accepted.
+func (w *replayWindow) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > w.highest {
+		return true
+	}
+	diff := w.highest - seq
+	return diff < 64 && w.seen&(1<<diff) == 0
+}
+
+// accept records seq, which must have passed check, as received.
+func (w *replayWindow) accept(seq uint64) {
+	if seq <= w.highest {
+		w.seen |= 1 << (w.highest - seq)
+		return
+	}
+	if shift := seq - w.highest; shift < 64 {
+		w.seen <<= shift
+	} else {
+		w.seen = 0
+	}
+	w.seen |= 1
+	w.highest = seq
+}
@@ -0,0 +1,191 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, tc := range []struct {
+		seq  uint64
+		want bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{3, false},
+		{100, true},
+		{37, true},
+		{36, false}, // 64 behind the highest
+		{37, false},
+	} {
+		if got := w.check(tc.seq); got != tc.want {
+			t.Fatalf("Unexpected result for %d: %v", tc.seq, got)
+		}
+		if tc.want {
+			w.accept(tc.seq)
+		}
+	}
+}
+
+// lossyPacketConn drops the first packet written to it.
+type lossyPacketConn struct {
+	net.PacketConn
+	dropped atomic.Bool
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.dropped.CompareAndSwap(false, true) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestDatagram(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server's hello is lost, so the client has to retransmit its own.
+	l := NewDatagramListener(&lossyPacketConn{PacketConn: pc}, nil)
+	defer l.Close()
+	go func() {
+		dc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer dc.Close()
+		for {
+			msg, err := dc.ReadMessage()
+			if err != nil {
+				return
+			}
+			dc.WriteMessage(msg)
+		}
+	}()
+
+	dc, err := DialDatagram(context.Background(), l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	for _, msg := range []string{"hello", "world"} {
+		if err := dc.WriteMessage([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Fatalf("Unexpected result: %s != %s", got, msg)
+		}
+	}
+
+	if err := dc.WriteMessage(make([]byte, MaxDatagramSize+1)); err != ErrDatagramTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dc.Close()
+	if _, err := dc.ReadMessage(); err != ErrSessionClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDatagramClientRestart(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewDatagramListener(pc, nil)
+	defer l.Close()
+	raddr := l.Addr().(*net.UDPAddr)
+
+	// handshake runs a handshake with a fresh key from laddr, and returns
+	// the server's end of the connection.
+	handshake := func(laddr *net.UDPAddr) (*net.UDPConn, *DatagramConn) {
+		conn, err := net.DialUDP("udp", laddr, raddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s, err := datagramHandshake(ctx, conn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *dc.PeerPublicKey() != *s.LocalPublicKey {
+			t.Fatal("Unexpected result. Accepted the wrong client.")
+		}
+		return conn, dc
+	}
+
+	conn, first := handshake(nil)
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	// The client restarts on the same address with a new hello, which
+	// replaces the old connection rather than being taken for a
+	// retransmission.
+	conn, second := handshake(laddr)
+	defer conn.Close()
+	defer second.Close()
+	if _, err := first.ReadMessage(); err == nil {
+		t.Fatal("Unexpected result. The old connection is still open.")
+	}
+}
+
+func TestDatagramDropsReplays(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent [][]byte
+	client := newDatagramConn(newSession(ckeys, skeys.Public, ClientRole, nil, nil), nil, nil, func(pkt []byte) error {
+		sent = append(sent, pkt)
+		return nil
+	})
+	server := newDatagramConn(newSession(skeys, ckeys.Public, ServerRole, nil, nil), nil, nil, nil)
+
+	for _, msg := range []string{"first", "second"} {
+		if err := client.WriteMessage([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Out of order is fine, but every packet is delivered once only.
+	if msg, ok := server.open(sent[1]); !ok || string(msg) != "second" {
+		t.Fatalf("Unexpected result: %q, %v", msg, ok)
+	}
+	if msg, ok := server.open(sent[0]); !ok || string(msg) != "first" {
+		t.Fatalf("Unexpected result: %q, %v", msg, ok)
+	}
+	for _, pkt := range sent {
+		if _, ok := server.open(pkt); ok {
+			t.Fatal("Unexpected result. A replayed packet was delivered.")
+		}
+	}
+
+	// A tampered sequence number doesn't decrypt, and doesn't move the
+	// window either.
+	tampered := append([]byte(nil), sent[0]...)
+	tampered[1+7] = 0xff
+	if _, ok := server.open(tampered); ok {
+		t.Fatal("Unexpected result. A tampered packet was delivered.")
+	}
+	if server.window.highest != 2 {
+		t.Fatalf("Unexpected window %+v", server.window)
+	}
+}
@@ -0,0 +1,129 @@
+package secure
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialContextTimeout(t *testing.T) {
+	// A server that accepts connections but never sends its key.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = DialContext(ctx, l.Addr().String())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v != %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("DialContext took %v to give up", elapsed)
+	}
+}
+
+// serveSOCKS5 runs a SOCKS5 proxy without authentication on l, which only
+// supports CONNECT, and sends the address of every CONNECT to targets.
+func serveSOCKS5(l net.Listener, targets chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// Greeting: version, methods. Choose no authentication.
+			hdr := make([]byte, 2)
+			if _, err := io.ReadFull(conn, hdr); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+				return
+			}
+			conn.Write([]byte{5, 0})
+
+			// Request: version, CONNECT, reserved, a domain name and a port.
+			req := make([]byte, 5)
+			if _, err := io.ReadFull(conn, req); err != nil || req[3] != 3 {
+				return
+			}
+			host := make([]byte, req[4]+2)
+			if _, err := io.ReadFull(conn, host); err != nil {
+				return
+			}
+			port := binary.BigEndian.Uint16(host[len(host)-2:])
+			target := net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(int(port)))
+			targets <- target
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{}
+	defer srv.Close()
+	go srv.Serve(l)
+
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	targets := make(chan string, 1)
+	go serveSOCKS5(pl, targets)
+
+	d, err := ProxyDialer("socks5://" + pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proxy resolves the name.
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+	conn, err := DialWithConfig(context.Background(), addr, &Config{Dialer: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != addr {
+		t.Fatalf("Unexpected result: %s != %s", target, addr)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ProxyDialer("http://proxy:3128"); err == nil {
+		t.Fatal("Unexpected result. Accepted an HTTP proxy.")
+	}
+}
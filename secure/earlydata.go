@@ -0,0 +1,93 @@
+package secure
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A client resuming a session can send the data of its first write in its
+// hello, sealed as
+//
+//	nonce (24 bytes) | secretbox(data)
+//
+// with a key derived from the secret of the session it resumes and its
+// public key, so that the server reads it without waiting for another
+// round trip. The server answers with an empty early data field in its done
+// message if it accepted the data, and the client writes it again once the
+// handshake completes otherwise. The hello, early data included, is part of
+// the transcript the session keys are derived from.
+
+// MaxEarlyDataSize is the largest first write sent as early data. Longer
+// writes wait for the handshake.
+const MaxEarlyDataSize = 16 * 1024
+
+// earlyDataLabel is the HKDF info of the key that seals early data.
+const earlyDataLabel = "gochal2 early data"
+
+// earlyData is data a client offers to send with its hello.
+type earlyData struct {
+	data []byte
+
+	// accepted records whether the server accepted the data.
+	accepted bool
+}
+
+// earlyDataKey returns the key that seals early data sent by the client
+// with public key clientPub when resuming the session with secret.
+func earlyDataKey(secret []byte, clientPub *[KeySize]byte) *[KeySize]byte {
+	info := append([]byte(earlyDataLabel), clientPub[:]...)
+	key := new([KeySize]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key[:]); err != nil {
+		// HKDF can only fail when asked for more than 255 hashes of output.
+		panic(err)
+	}
+	return key
+}
+
+// sealEarlyData seals data to send in the hello of the client with public
+// key clientPub, resuming the session with secret.
+func sealEarlyData(secret []byte, clientPub *[KeySize]byte, data []byte) ([]byte, error) {
+	var nonce [NonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := earlyDataKey(secret, clientPub)
+	defer zero(key[:])
+	return secretbox.Seal(nonce[:], data, &nonce, key), nil
+}
+
+// openEarlyData opens early data sealed by sealEarlyData, and reports
+// whether it was authentic.
+func openEarlyData(secret []byte, clientPub *[KeySize]byte, sealed []byte) ([]byte, bool) {
+	if len(sealed) < NonceSize {
+		return nil, false
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], sealed)
+	key := earlyDataKey(secret, clientPub)
+	defer zero(key[:])
+	return secretbox.Open(nil, sealed[NonceSize:], &nonce, key)
+}
+
+// handshakeEarly runs the handshake if it has not yet been run, offering p
+// as early data when the config allows it. It reports whether the server
+// accepted p, in which case p must not be written again.
+func (c *SecureConn) handshakeEarly(p []byte) (bool, error) {
+	var e *earlyData
+	if c.isClient && c.config.earlyData() && len(p) > 0 && len(p) <= min(MaxEarlyDataSize, c.config.maxMessageSize()) {
+		c.handshakeMu.Lock()
+		if !c.handshakeComplete && c.handshakeErr == nil && c.early == nil {
+			e = &earlyData{data: p}
+			c.early = e
+		}
+		c.handshakeMu.Unlock()
+	}
+	if err := c.Handshake(); err != nil {
+		return false, err
+	}
+	return e != nil && e.accepted, nil
+}
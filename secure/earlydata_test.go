@@ -0,0 +1,108 @@
+package secure
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+// earlyDataServer starts a server with config that echoes the first five
+// bytes of every connection, and returns its address.
+func earlyDataServer(t *testing.T, config *Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sl.Close() })
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.CopyN(c, c, 5)
+			}(conn)
+		}
+	}()
+	return sl.Addr().String()
+}
+
+func TestEarlyData(t *testing.T) {
+	ticketKey := new([KeySize]byte)
+	accepting := earlyDataServer(t, &Config{TicketKey: ticketKey, EarlyData: true})
+	refusing := earlyDataServer(t, &Config{TicketKey: ticketKey})
+
+	config := &Config{SessionCache: NewLRUClientSessionCache(0), ServerName: "server", EarlyData: true}
+	// exchange sends hello to addr and reports whether the session was
+	// resumed and the hello sent as early data.
+	exchange := func(addr string) (resumed, early bool) {
+		conn, err := DialWithConfig(context.Background(), addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("Unexpected result: %s != %s", buf, "hello")
+		}
+		return conn.session.Resumed, conn.early != nil && conn.early.accepted
+	}
+
+	if resumed, early := exchange(accepting); resumed || early {
+		t.Fatalf("Unexpected result: resumed %v, early data %v on the first connection", resumed, early)
+	}
+	if resumed, early := exchange(accepting); !resumed || !early {
+		t.Fatalf("Unexpected result: resumed %v, early data %v", resumed, early)
+	}
+	// A server that doesn't accept early data still resumes the session,
+	// and the client sends the data after the handshake.
+	if resumed, early := exchange(refusing); !resumed || early {
+		t.Fatalf("Unexpected result: resumed %v, early data %v", resumed, early)
+	}
+	// So does one that can't resume the session.
+	cs, _ := config.SessionCache.Get("server")
+	cs.ticket[len(cs.ticket)-1] ^= 1
+	if resumed, early := exchange(accepting); resumed || early {
+		t.Fatalf("Unexpected result: resumed %v, early data %v", resumed, early)
+	}
+}
+
+func TestEarlyDataKey(t *testing.T) {
+	secret := []byte("resumption secret")
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealEarlyData(secret, keys.Public, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := openEarlyData(secret, keys.Public, sealed); !ok || string(data) != "hello" {
+		t.Fatalf("Unexpected result: %q, %v", data, ok)
+	}
+	// Early data is bound to the client's key and the session's secret.
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := openEarlyData(secret, other.Public, sealed); ok {
+		t.Fatal("Unexpected result. Opened early data with another client key.")
+	}
+	if _, ok := openEarlyData([]byte("another secret"), keys.Public, sealed); ok {
+		t.Fatal("Unexpected result. Opened early data with another secret.")
+	}
+}
@@ -0,0 +1,143 @@
+package secure
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The errors below let callers tell failures apart with errors.Is and
+// errors.As. They only change what the local caller sees: whatever the
+// cause, a failed handshake or a bad frame ends with the connection being
+// dropped, so the peer learns nothing about why.
+
+var (
+	// ErrHandshakeFailed matches every *HandshakeError.
+	ErrHandshakeFailed = errors.New("secure: handshake failed")
+
+	// ErrPeerKeyRejected matches the handshake errors of a peer whose key
+	// or identity was refused: by AuthorizedKeys, an Authorizer, KnownHosts
+	// or PeerIdentity.
+	ErrPeerKeyRejected = errors.New("secure: peer key rejected")
+
+	// ErrDecryptionFailed matches every *DecryptError.
+	ErrDecryptionFailed = errors.New("secure: message authentication failed")
+
+	// ErrMalformedFrame matches every *FrameError.
+	ErrMalformedFrame = errors.New("secure: malformed frame")
+
+	// ErrFrameTooLarge matches every *FrameSizeError.
+	ErrFrameTooLarge = errors.New("secure: frame too large")
+
+	// ErrMessageTooLarge matches every *MessageSizeError.
+	ErrMessageTooLarge = errors.New("secure: message too large")
+
+	// ErrSessionClosed is returned by reads and writes on a SecureConn
+	// after it has been closed.
+	ErrSessionClosed = errors.New("secure: use of closed connection")
+)
+
+// HandshakeError is returned by Handshake and by the first Read, Write or
+// Handshake of a SecureConn when the key exchange fails. Err is the cause,
+// such as ErrUnauthorized or an error of the underlying connection.
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "secure: handshake failed: " + strings.TrimPrefix(e.Err.Error(), "secure: ")
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrHandshakeFailed
+}
+
+// keyRejectedError wraps the reason a peer's key was refused so that it
+// matches ErrPeerKeyRejected.
+type keyRejectedError struct {
+	err error
+}
+
+// rejectKey returns err, the reason the peer's key was refused, as an
+// error matching ErrPeerKeyRejected.
+func rejectKey(err error) error {
+	return &keyRejectedError{err}
+}
+
+func (e *keyRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *keyRejectedError) Unwrap() error {
+	return e.err
+}
+
+func (e *keyRejectedError) Is(target error) bool {
+	return target == ErrPeerKeyRejected
+}
+
+// DecryptError is returned by reads when a frame fails to decrypt, because
+// it was corrupted, forged, replayed or sealed with another key. It carries
+// no more detail than that on purpose.
+type DecryptError struct{}
+
+func (e *DecryptError) Error() string {
+	return ErrDecryptionFailed.Error()
+}
+
+func (e *DecryptError) Is(target error) bool {
+	return target == ErrDecryptionFailed
+}
+
+// FrameError is returned by reads when a frame decrypts but makes no sense,
+// for example because its kind is unknown.
+type FrameError struct {
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	return ErrMalformedFrame.Error() + ": " + e.Reason
+}
+
+func (e *FrameError) Is(target error) bool {
+	return target == ErrMalformedFrame
+}
+
+// FrameSizeError is returned by reads when the peer declares a frame longer
+// than the negotiated maximum frame size allows. The connection can't be
+// used after that.
+type FrameSizeError struct {
+	// Length is the length of the sealed box the peer declared, and Limit
+	// the longest one allowed.
+	Length, Limit uint32
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("secure: frame length %d exceeds %d", e.Length, e.Limit)
+}
+
+func (e *FrameSizeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
+
+// MessageSizeError is returned by writes of a message longer than the peer
+// accepts, which are not sent, and by reads when the peer sends a message
+// longer than the negotiated maximum message size allows. The connection
+// can't be used after a failed read.
+type MessageSizeError struct {
+	// Length is the length of the message, or of its part read before it
+	// grew too long, and Limit the longest one allowed.
+	Length, Limit int
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("secure: message length %d exceeds %d", e.Length, e.Limit)
+}
+
+func (e *MessageSizeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
@@ -0,0 +1,68 @@
+package secure
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFrameErrors(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// A frame sealed under another key doesn't decrypt.
+	var buf bytes.Buffer
+	NewSecureWriter(&buf, &[32]byte{'o', 't', 'h', 'e', 'r'}, pub).Write([]byte("hello"))
+	_, err := NewSecureReader(&buf, priv, pub).Read(make([]byte, 16))
+	var decryptErr *DecryptError
+	if !errors.As(err, &decryptErr) || !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Unexpected error: %v, expected a DecryptError", err)
+	}
+
+	// A frame of an unknown kind decrypts but is still refused.
+	buf.Reset()
+	sr, sw := newSharedSession(priv, pub).newReadWriter(&buf, &buf, nil)
+	if err := sw.writeControl(0xff, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = sr.Read(make([]byte, 16))
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) || !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("Unexpected error: %v, expected a FrameError", err)
+	}
+}
+
+func TestSessionClosed(t *testing.T) {
+	client, server, cerr, serr := handshakePair(nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer server.Close()
+	client.Close()
+	if _, err := client.Write([]byte("hello")); err != ErrSessionClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := client.ReadMessage(); err != ErrSessionClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestHandshakeError(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, _, serr := handshakePair(&Config{Keys: ckeys}, &Config{AuthorizedKeys: NewAuthorizedKeys()})
+	client.Close()
+	var hsErr *HandshakeError
+	if !errors.As(serr, &hsErr) || !errors.Is(hsErr.Err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %v", serr)
+	}
+	for _, target := range []error{ErrHandshakeFailed, ErrPeerKeyRejected} {
+		if !errors.Is(serr, target) {
+			t.Fatalf("Unexpected result. %v does not match %v", serr, target)
+		}
+	}
+	if got, want := serr.Error(), "secure: handshake failed: peer key not authorized"; got != want {
+		t.Fatalf("Unexpected result: %q != %q", got, want)
+	}
+}
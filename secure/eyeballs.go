@@ -0,0 +1,138 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is how long a dial waits for a connection attempt
+// before starting the next one in parallel, as recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// eyeballsDialer is the default dialer. It dials host names that resolve to
+// several addresses the Happy Eyeballs way of RFC 8305: addresses are tried
+// alternating between IPv6 and IPv4, starting the next attempt as soon as
+// one fails or connectionAttemptDelay after it started, and the first
+// connection made wins. A dual-stack server with a broken address family is
+// then reached after a short delay rather than a connect timeout.
+type eyeballsDialer struct {
+	net.Dialer
+}
+
+func (d *eyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range interleaveFamilies(ips) {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return dialParallel(ctx, addrs, connectionAttemptDelay, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.Dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4,
+// starting with IPv6, and otherwise keeping the order of the resolver.
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ordered = append(ordered, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered = append(ordered, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return ordered
+}
+
+// dialParallel dials addrs in order, starting the next attempt when one
+// fails or delay after the last one started, and returns the first
+// connection made. The other attempts are canceled, and connections they
+// still make are closed. If every attempt fails, the first error is
+// returned.
+func dialParallel(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered so that attempts finishing after the winner don't block.
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, err}
+		}()
+	}
+	// closeLosers closes the connections of the attempts still pending
+	// once they finish.
+	closeLosers := func() {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLosers()
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			closeLosers()
+			return nil, ctx.Err()
+		}
+	}
+}
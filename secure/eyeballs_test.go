@@ -0,0 +1,89 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IPAddr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2"} {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	got := interleaveFamilies(ips)
+	if len(got) != len(want) {
+		t.Fatalf("Unexpected result: %v", got)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("Unexpected result: %v", got)
+		}
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	// The IPv6 address blackholes connection attempts, the first IPv4 one
+	// refuses them and the second one accepts them.
+	canceled := make(chan struct{})
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case "[2001:db8::1]:80":
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		case "192.0.2.1:80":
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	start := time.Now()
+	conn, err := dialParallel(context.Background(), []string{"[2001:db8::1]:80", "192.0.2.1:80", "192.0.2.2:80"}, 50*time.Millisecond, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dialParallel took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("The losing attempt was not canceled")
+	}
+
+	// Every attempt failing returns the first error.
+	refused := errors.New("connection refused")
+	_, err = dialParallel(context.Background(), []string{"192.0.2.1:80", "192.0.2.2:80"}, time.Hour,
+		func(ctx context.Context, addr string) (net.Conn, error) {
+			if addr == "192.0.2.1:80" {
+				return nil, refused
+			}
+			return nil, errors.New("network unreachable")
+		})
+	if err != refused {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDialHostName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := Dial(net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,36 @@
+package secure
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a public key, in the
+// format OpenSSH uses: "SHA256:" followed by the unpadded base64 encoding of
+// the hash.
+func Fingerprint(pub *[KeySize]byte) string {
+	sum := sha256.Sum256(pub[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ErrFingerprintMismatch is returned by the handshake when the peer's key
+// does not have the expected fingerprint.
+var ErrFingerprintMismatch = errors.New("secure: peer key fingerprint mismatch")
+
+// ExpectFingerprint returns an Authorizer that refuses peers whose public
+// key does not have the given fingerprint, as returned by Fingerprint. The
+// "SHA256:" prefix may be omitted.
+func ExpectFingerprint(fingerprint string) Authorizer {
+	want := strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256:")
+	return AuthorizerFunc(func(peerKey [KeySize]byte, addr net.Addr) error {
+		got := strings.TrimPrefix(Fingerprint(&peerKey), "SHA256:")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			return ErrFingerprintMismatch
+		}
+		return nil
+	})
+}
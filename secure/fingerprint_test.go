@@ -0,0 +1,38 @@
+package secure
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	var pub [KeySize]byte
+	// sha256 of 32 zero bytes.
+	want := "SHA256:Zmh6rfhivXdsj8GLjp+OIAiXFIVu4jOzkCpZHQ1fKSU"
+	if got := Fingerprint(&pub); got != want {
+		t.Fatalf("Unexpected result: %s != %s", got, want)
+	}
+}
+
+func TestExpectFingerprint(t *testing.T) {
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconfig := &Config{Keys: skeys}
+
+	fp := Fingerprint(skeys.Public)
+	for _, want := range []string{fp, fp[len("SHA256:"):]} {
+		client, _, cerr, _ := handshakePair(&Config{Authorizer: ExpectFingerprint(want)}, sconfig)
+		client.Close()
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+	}
+
+	client, _, cerr, _ := handshakePair(&Config{Authorizer: ExpectFingerprint(fp)}, nil)
+	client.Close()
+	if !errors.Is(cerr, ErrFingerprintMismatch) {
+		t.Fatalf("Unexpected error: %v", cerr)
+	}
+}
@@ -0,0 +1,80 @@
+package secure
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+)
+
+// With Config.TraceFrames, stream sessions log every frame they send or
+// receive to Config.Logger at debug level: its direction, sealed length,
+// nonce and kind, and the first traceDumpSize bytes of its ciphertext and
+// plaintext in hex. The payloads of rekey and ticket frames, which carry
+// key material, are redacted, and padding is left out.
+
+// traceDumpSize is how many bytes of a frame's ciphertext and plaintext
+// are logged.
+const traceDumpSize = 32
+
+// frameTracer logs a frame of the given kind, sent with nonce as sealed,
+// whose payload is plain.
+type frameTracer func(kind byte, nonce *[NonceSize]byte, sealed, plain []byte)
+
+// frameTracer returns the tracer of the frames sent, if dir is "send", or
+// received, if it is "recv", or nil if frames are not traced.
+func (c *Config) frameTracer(dir string) frameTracer {
+	if c == nil || !c.TraceFrames {
+		return nil
+	}
+	logger := c.logger()
+	return func(kind byte, nonce *[NonceSize]byte, sealed, plain []byte) {
+		if !logger.Enabled(context.Background(), slog.LevelDebug) {
+			return
+		}
+		payload := traceDump(plain)
+		if k := kind &^ frameCompressed; k == frameRekey || k == frameTicket {
+			payload = "[redacted]"
+		}
+		logger.Debug("frame",
+			"dir", dir,
+			"length", len(sealed),
+			"nonce", hex.EncodeToString(nonce[:]),
+			"kind", frameKindName(kind),
+			"ciphertext", traceDump(sealed),
+			"plaintext", payload)
+	}
+}
+
+// traceDump returns the start of b in hex, marking where it was cut.
+func traceDump(b []byte) string {
+	if len(b) <= traceDumpSize {
+		return hex.EncodeToString(b)
+	}
+	return fmt.Sprintf("%x... (%d bytes)", b[:traceDumpSize], len(b))
+}
+
+// frameKindName returns the name of a frame kind, for traces.
+func frameKindName(kind byte) string {
+	var name string
+	switch kind &^ frameCompressed {
+	case frameFinal:
+		name = "final"
+	case frameMore:
+		name = "more"
+	case frameRekey:
+		name = "rekey"
+	case frameTicket:
+		name = "ticket"
+	case framePing:
+		name = "ping"
+	case framePong:
+		name = "pong"
+	default:
+		name = fmt.Sprintf("unknown(%d)", kind&^frameCompressed)
+	}
+	if kind&frameCompressed != 0 {
+		name += "+zstd"
+	}
+	return name
+}
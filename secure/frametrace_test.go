@@ -0,0 +1,75 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTraceFrames(t *testing.T) {
+	var trace bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&trace, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{RekeyBytes: 10, TraceFrames: true, Logger: logger})
+	server := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	msgs := [][]byte{[]byte("first message"), []byte("second message")}
+	errc := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := client.WriteMessage(msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for range msgs {
+		if _, err := server.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	var sent, rekeys int
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		if !strings.Contains(line, "msg=frame") {
+			continue
+		}
+		if !strings.Contains(line, "dir=send") {
+			t.Fatalf("Unexpected trace of a frame the client did not send: %q", line)
+		}
+		switch {
+		case strings.Contains(line, "kind=final"):
+			if !strings.Contains(line, "plaintext="+hex.EncodeToString(msgs[sent])) {
+				t.Fatalf("Unexpected trace of message %d: %q", sent, line)
+			}
+			sent++
+		case strings.Contains(line, "kind=rekey"):
+			if !strings.Contains(line, "plaintext=[redacted]") {
+				t.Fatalf("Unexpected trace of a rekey: %q", line)
+			}
+			rekeys++
+		}
+	}
+	if sent != len(msgs) || rekeys == 0 {
+		t.Fatalf("Unexpected result. Traced %d messages and %d rekeys.", sent, rekeys)
+	}
+}
+
+func TestTraceDump(t *testing.T) {
+	if got := traceDump([]byte{1, 2}); got != "0102" {
+		t.Fatalf("Unexpected dump %q", got)
+	}
+	got := traceDump(make([]byte, 40))
+	if want := strings.Repeat("00", traceDumpSize) + "... (40 bytes)"; got != want {
+		t.Fatalf("Unexpected dump %q, want %q", got, want)
+	}
+}
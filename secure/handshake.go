@@ -0,0 +1,517 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+)
+
+// handshakeState is the state of one run of the handshake.
+type handshakeState struct {
+	rw     io.ReadWriter
+	keys   *KeyPair
+	role   Role
+	config *Config
+
+	// offered is the session the client tries to resume, if any.
+	offered *ClientSessionState
+
+	// early is the early data a client sends or a server accepted, and
+	// earlyAccepted whether the server accepted it.
+	early         []byte
+	earlyAccepted bool
+
+	// transcript hashes the server hello, the client hello and the server
+	// done message, in that order whichever order they were sent in.
+	transcript hash.Hash
+
+	// previous are the unexpired previous key pairs of a server. expected
+	// is the server key a client has pinned, and rotated the server's
+	// current key when the peers used expected instead.
+	previous []*KeyPair
+	expected *[KeySize]byte
+	rotated  *[KeySize]byte
+
+	// serverName is the name a client expects in the server's certificate.
+	serverName string
+
+	peer            *[KeySize]byte
+	peerIdentity    ed25519.PublicKey
+	peerCertificate *Certificate
+	maxFrame        int
+	maxMessage      int
+	version         int
+	suite           CipherSuite
+	compression     bool
+	resumed         bool
+	psk             []byte
+}
+
+// Handshake runs the key exchange with the peer over rw and returns the
+// resulting session. role says which end of the connection the caller is;
+// the peer must use the other role. The hellos of both peers are sent and
+// read concurrently, so the exchange works over synchronous transports such
+// as net.Pipe.
+//
+// If reading the peer's hello fails while our own is still being written,
+// Handshake closes rw when it implements io.Closer, so that the write cannot
+// block forever. Otherwise Handshake waits for the write to finish, and the
+// caller must arrange for it to fail, for example with a deadline.
+func Handshake(rw io.ReadWriter, localKeys *KeyPair, role Role) (*Session, error) {
+	hs := &handshakeState{rw: rw, keys: localKeys, role: role}
+	s, err := hs.run()
+	if err != nil {
+		return nil, &HandshakeError{Err: err}
+	}
+	return s, nil
+}
+
+// run runs the handshake for the configured role.
+func (hs *handshakeState) run() (*Session, error) {
+	hs.transcript = sha256.New()
+	var err error
+	if hs.role == ClientRole {
+		err = hs.client()
+	} else {
+		err = hs.server()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Key exchange complete
+	s := newSession(hs.keys, hs.peer, hs.role, hs.psk, hs.transcript.Sum(nil))
+	if err := hs.finish(s); err != nil {
+		s.wipe()
+		return nil, err
+	}
+	s.Resumed = hs.resumed
+	s.PeerIdentity = hs.peerIdentity
+	s.PeerCertificate = hs.peerCertificate
+	s.MaxFrameSize = hs.maxFrame
+	s.MaxMessageSize = hs.maxMessage
+	s.Version = hs.version
+	s.CipherSuite = hs.suite
+	s.Compression = hs.compression
+	s.keyLogID = hs.peer[:]
+	if hs.role == ClientRole {
+		s.keyLogID = hs.keys.Public[:]
+	}
+	return s, nil
+}
+
+// client sends the client hello and reads the server's hello and done
+// messages.
+func (hs *handshakeState) client() error {
+	hello := hs.hello()
+	identity := hs.config.identity()
+	if identity != nil {
+		hello[fieldIdentity] = identity.Public().(ed25519.PublicKey)
+	}
+	if hs.expected != nil {
+		hello[fieldServerKey] = hs.expected[:]
+	}
+	if err := hs.presentCertificate(hello); err != nil {
+		return err
+	}
+	if hs.offered != nil {
+		hello[fieldTicket] = hs.offered.ticket
+		if hs.early != nil {
+			sealed, err := sealEarlyData(hs.offered.secret, hs.keys.Public, hs.early)
+			if err != nil {
+				return err
+			}
+			hello[fieldEarlyData] = sealed
+		}
+	}
+	chRaw := append(preamble(), hello.marshal(msgClientHello)...)
+	sh, shRaw, err := hs.exchange(chRaw, msgServerHello)
+	if err != nil {
+		return err
+	}
+	hs.transcript.Write(shRaw)
+	hs.transcript.Write(chRaw)
+	if hs.peer, err = sh.publicKey(fieldPublicKey); err != nil {
+		return err
+	}
+	usePrevious := hs.choosePreviousKey(sh)
+	if err := hs.readPeerIdentity(sh); err != nil {
+		return err
+	}
+	if err := hs.readPeerCertificate(sh); err != nil {
+		return err
+	}
+	if err := hs.negotiateMaxFrame(sh); err != nil {
+		return err
+	}
+	hs.negotiateCompression(sh)
+	if err := hs.negotiateSuite(sh); err != nil {
+		return err
+	}
+	signed := hs.transcript.Sum(nil)
+
+	done, doneRaw, err := readHandshakeMessage(hs.rw, msgServerDone)
+	if err != nil {
+		return err
+	}
+	hs.transcript.Write(doneRaw)
+	if hs.peerIdentity != nil &&
+		!verifyTranscript(hs.peerIdentity, serverSignatureContext, signed, done[fieldSignature]) {
+		return errBadSignature
+	}
+	if usePrevious && !hmac.Equal(done[fieldMAC], rotationMAC(hs.keys.Private, hs.peer, signed)) {
+		return errBadRotationMAC
+	}
+	if _, hs.resumed = done[fieldResumed]; hs.resumed {
+		if hs.offered == nil {
+			return errors.New("secure: server resumed a session that was not offered")
+		}
+		hs.psk = hs.offered.secret
+	}
+	if _, hs.earlyAccepted = done[fieldEarlyData]; hs.earlyAccepted && (!hs.resumed || hs.early == nil) {
+		return errors.New("secure: server accepted early data that was not sent")
+	}
+
+	if identity == nil {
+		return nil
+	}
+	sig, err := signTranscript(identity, clientSignatureContext, hs.transcript.Sum(nil))
+	if err != nil {
+		return err
+	}
+	authRaw := handshakeMessage{fieldSignature: sig}.marshal(msgClientAuth)
+	hs.transcript.Write(authRaw)
+	return writeFull(hs.rw, authRaw)
+}
+
+// server sends the server hello, reads the client hello and answers it with
+// the server done message.
+func (hs *handshakeState) server() error {
+	hello := hs.hello()
+	identity := hs.config.identity()
+	if identity != nil {
+		hello[fieldIdentity] = identity.Public().(ed25519.PublicKey)
+	}
+	hs.offerPreviousKeys(hello)
+	if err := hs.presentCertificate(hello); err != nil {
+		return err
+	}
+	shRaw := append(preamble(), hello.marshal(msgServerHello)...)
+	ch, chRaw, err := hs.exchange(shRaw, msgClientHello)
+	if err != nil {
+		return err
+	}
+	hs.transcript.Write(shRaw)
+	hs.transcript.Write(chRaw)
+	if hs.peer, err = ch.publicKey(fieldPublicKey); err != nil {
+		return err
+	}
+	if err := hs.readPeerIdentity(ch); err != nil {
+		return err
+	}
+	if err := hs.readPeerCertificate(ch); err != nil {
+		return err
+	}
+	if err := hs.negotiateMaxFrame(ch); err != nil {
+		return err
+	}
+	hs.negotiateCompression(ch)
+	if err := hs.negotiateSuite(ch); err != nil {
+		return err
+	}
+
+	done := handshakeMessage{}
+	if identity != nil {
+		sig, err := signTranscript(identity, serverSignatureContext, hs.transcript.Sum(nil))
+		if err != nil {
+			return err
+		}
+		done[fieldSignature] = sig
+	}
+	if hs.usePreviousKey(ch) {
+		done[fieldMAC] = rotationMAC(hs.keys.Private, hs.peer, hs.transcript.Sum(nil))
+	}
+	if ticket, ok := ch[fieldTicket]; ok {
+		// A ticket that cannot be opened just means a full handshake.
+		if hs.psk, hs.resumed = hs.config.openTicket(ticket); hs.resumed {
+			done[fieldResumed] = nil
+			hs.acceptEarlyData(ch, done)
+		}
+	}
+	doneRaw := done.marshal(msgServerDone)
+	hs.transcript.Write(doneRaw)
+	if err := writeFull(hs.rw, doneRaw); err != nil {
+		return err
+	}
+
+	if hs.peerIdentity == nil {
+		return nil
+	}
+	auth, authRaw, err := readHandshakeMessage(hs.rw, msgClientAuth)
+	if err != nil {
+		return err
+	}
+	if !verifyTranscript(hs.peerIdentity, clientSignatureContext, hs.transcript.Sum(nil), auth[fieldSignature]) {
+		return errBadSignature
+	}
+	hs.transcript.Write(authRaw)
+	return nil
+}
+
+// finish exchanges the finished messages of the session s with the peer,
+// if the protocol version has them, and checks the peer's MAC of the
+// transcript. In a resumed session only the server sends one, so the
+// server is done as soon as it has answered the client hello.
+func (hs *handshakeState) finish(s *Session) error {
+	defer func() { s.finished, s.peerFinished = nil, nil }()
+	if hs.version < finishedVersion {
+		return nil
+	}
+	fin := handshakeMessage{fieldMAC: s.finished}.marshal(msgFinished)
+	var peerFin handshakeMessage
+	var err error
+	switch {
+	case !hs.resumed:
+		peerFin, _, err = hs.exchangeMessage(fin, msgFinished)
+	case hs.role == ServerRole:
+		return writeFull(hs.rw, fin)
+	default:
+		peerFin, _, err = readHandshakeMessage(hs.rw, msgFinished)
+	}
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(peerFin[fieldMAC], s.peerFinished) {
+		return errBadFinished
+	}
+	return nil
+}
+
+// acceptEarlyData opens the early data of the client hello ch, if the
+// config accepts it, and tells the client so in done. Early data that
+// can't be opened or is longer than a message may be is ignored, and the
+// client sends it again.
+func (hs *handshakeState) acceptEarlyData(ch, done handshakeMessage) {
+	sealed, ok := ch[fieldEarlyData]
+	if !ok || !hs.config.earlyData() {
+		return
+	}
+	if data, ok := openEarlyData(hs.psk, hs.peer, sealed); ok && len(data) > 0 && len(data) <= hs.maxMessage {
+		hs.early = data
+		hs.earlyAccepted = true
+		done[fieldEarlyData] = nil
+	}
+}
+
+// hello returns the fields common to the hellos of both ends.
+func (hs *handshakeState) hello() handshakeMessage {
+	maxFrame := binary.BigEndian.AppendUint32(nil, uint32(hs.config.maxFrameSize()))
+	var suites []byte
+	for _, s := range hs.config.cipherSuites() {
+		suites = append(suites, byte(s))
+	}
+	hello := handshakeMessage{
+		fieldPublicKey:    hs.keys.Public[:],
+		fieldMaxFrame:     maxFrame,
+		fieldMaxMessage:   binary.BigEndian.AppendUint32(nil, uint32(hs.config.maxMessageSize())),
+		fieldCipherSuites: suites,
+	}
+	if hs.config.compression() {
+		hello[fieldCompression] = []byte{compressionZstd}
+	}
+	return hello
+}
+
+// negotiateMaxFrame agrees on the frame and message sizes with the peer's
+// hello m.
+func (hs *handshakeState) negotiateMaxFrame(m handshakeMessage) error {
+	peerMax, err := m.maxFrame()
+	if err != nil {
+		return err
+	}
+	peerMaxMessage, err := m.maxMessage()
+	if err != nil {
+		return err
+	}
+	hs.maxFrame = min(hs.config.maxFrameSize(), peerMax)
+	hs.maxMessage = min(hs.config.maxMessageSize(), peerMaxMessage)
+	return nil
+}
+
+// negotiateSuite agrees on the cipher suite with the peer's hello m.
+func (hs *handshakeState) negotiateSuite(m handshakeMessage) error {
+	peer, err := m.cipherSuites()
+	if err != nil {
+		return err
+	}
+	server, client := hs.config.cipherSuites(), peer
+	if hs.role == ClientRole {
+		server, client = client, server
+	}
+	if hs.suite, err = negotiateSuite(server, client); err != nil {
+		return err
+	}
+	if hs.suite > SuiteAES256GCM {
+		return fmt.Errorf("secure: unknown cipher suite %d", hs.suite)
+	}
+	return nil
+}
+
+// exchange writes out, our preamble and hello, while reading the peer's
+// hello of type typ, and agrees on the protocol version.
+func (hs *handshakeState) exchange(out []byte, typ byte) (handshakeMessage, []byte, error) {
+	var version int
+	m, raw, err := hs.concurrently(out, func() (m handshakeMessage, raw []byte, err error) {
+		m, raw, version, err = readHello(hs.rw, typ)
+		return m, raw, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.version = version
+	return m, raw, nil
+}
+
+// exchangeMessage writes out while reading a message of type typ from the
+// peer.
+func (hs *handshakeState) exchangeMessage(out []byte, typ byte) (handshakeMessage, []byte, error) {
+	return hs.concurrently(out, func() (handshakeMessage, []byte, error) {
+		return readHandshakeMessage(hs.rw, typ)
+	})
+}
+
+// concurrently writes out while reading from the peer with read.
+func (hs *handshakeState) concurrently(out []byte, read func() (handshakeMessage, []byte, error)) (handshakeMessage, []byte, error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- writeFull(hs.rw, out)
+	}()
+
+	m, raw, rerr := read()
+	if rerr != nil {
+		if c, ok := hs.rw.(io.Closer); ok {
+			c.Close()
+		}
+		<-errc
+		return nil, nil, rerr
+	}
+
+	// Always wait for the write so no goroutine outlives the handshake.
+	if werr := <-errc; werr != nil {
+		return nil, nil, werr
+	}
+	return m, raw, nil
+}
+
+// writeFull writes all of p to w, turning a short write without an error
+// into io.ErrShortWrite.
+func writeFull(w io.Writer, p []byte) error {
+	n, err := w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// Client returns a new client side secure connection using conn as the
+// underlying transport. The handshake is run on the first Read or Write, or
+// by calling Handshake, in the ClientRole; the peer must be a Server.
+// config may be nil.
+func Client(conn net.Conn, config *Config) *SecureConn {
+	return &SecureConn{conn: conn, config: config, isClient: true}
+}
+
+// Server returns a new server side secure connection using conn as the
+// underlying transport. The handshake is run on the first Read or Write, or
+// by calling Handshake, in the ServerRole; the peer must be a Client.
+// config may be nil, but then every connection uses a different server key.
+func Server(conn net.Conn, config *Config) *SecureConn {
+	return &SecureConn{conn: conn, config: config}
+}
+
+// handshake runs the key exchange using the configured keys, or the
+// handshake with the configured pre-shared key.
+func (c *SecureConn) handshake() error {
+	c.wire = c.conn
+	if o := c.config.obfuscator(); o != nil {
+		wire, err := o.Obfuscate(c.conn, c.role())
+		if err != nil {
+			return err
+		}
+		c.wire = wire
+	}
+	if psk := c.config.preSharedKey(); psk != nil {
+		hs := &handshakeState{rw: c.wire, role: c.role(), config: c.config}
+		s, err := hs.runPSK(psk)
+		if err != nil {
+			return err
+		}
+		c.setSession(s)
+		return nil
+	}
+	keys, err := c.config.keys()
+	if err != nil {
+		return err
+	}
+	hs := &handshakeState{rw: c.wire, keys: keys, role: c.role(), config: c.config}
+	noise := c.config.noise() != NoiseNone
+	var s *Session
+	if noise {
+		var serverKey *[KeySize]byte
+		if kh := c.config.knownHosts(); c.isClient && kh != nil {
+			serverKey = kh.lookup(c.serverName())
+		}
+		s, err = hs.runNoise(serverKey)
+	} else {
+		if c.isClient {
+			hs.offered = c.loadSession()
+			if c.early != nil && hs.offered != nil {
+				hs.early = c.early.data
+			}
+			if kh := c.config.knownHosts(); kh != nil {
+				hs.expected = kh.lookup(c.serverName())
+			}
+			hs.serverName = c.serverName()
+		}
+		s, err = hs.run()
+	}
+	if err != nil {
+		return err
+	}
+	if c.isClient && c.config.knownHosts() != nil {
+		if err := c.config.KnownHosts.Check(c.serverName(), s.PeerPublicKey); err != nil {
+			return rejectKey(err)
+		}
+		if hs.rotated != nil {
+			if err := c.config.KnownHosts.rotate(c.serverName(), s.PeerPublicKey, hs.rotated); err != nil {
+				c.config.logger().Warn("recording the server's new key failed", "err", err)
+			}
+		}
+	}
+	if err := c.config.authorize(c.isClient, s.PeerPublicKey, c.conn.RemoteAddr()); err != nil {
+		return rejectKey(err)
+	}
+	c.setSession(s)
+	if noise {
+		return nil
+	}
+	if hs.earlyAccepted {
+		if c.isClient {
+			c.early.accepted = true
+		} else {
+			// The early data is the first message from the client.
+			c.sr.buf = hs.early
+		}
+	}
+	if c.isClient {
+		c.handleTickets(hs.offered)
+		return nil
+	}
+	return c.issueTicket()
+}
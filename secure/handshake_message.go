@@ -0,0 +1,353 @@
+package secure
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The handshake is made of three or four messages. The server sends its
+// hello as soon as the connection is accepted, while the client sends its
+// own. Once the server has read the client's hello it answers with a done
+// message carrying its decisions, such as whether a resumption ticket was
+// accepted. A client that presented an identity in its hello then sends a
+// client auth message proving it holds the identity's private key. From
+// protocol version 2, both ends then send a finished message with a MAC of
+// the transcript under a key derived along with the session keys, so that
+// an attacker who tampered with the handshake is caught before any frame
+// is sent, rather than by the first frame failing to decrypt. When the
+// server resumes a session only it sends a finished message, right after
+// the done message, and the client doesn't. That saves the server waiting
+// a round trip for the client: the keys are bound to the transcript and to
+// a secret only the ticket's holder knows, so a tampered handshake still
+// fails at the first frame from the client.
+//
+// Each message is encoded as
+//
+//	type(1) | length(2) | field | field | ...
+//
+// where length is the big-endian length of the fields that follow and each
+// field is
+//
+//	type(1) | length(2) | value
+//
+// Fields are sent in increasing order of type and each type appears at most
+// once. Unknown fields are ignored, so fields can be added without breaking
+// older peers.
+//
+// Each hello is preceded by a preamble,
+//
+//	magic(4) | version(1)
+//
+// where version is the highest protocol version the sender speaks. Both
+// ends use the lower of the two versions, and give up if that is below
+// minProtocolVersion. The preambles are part of the transcript the session
+// keys are derived from, so if an attacker lowers the version one end
+// offers, the ends derive different keys and can't talk to each other.
+const (
+	msgServerHello byte = 1
+	msgClientHello byte = 2
+	msgServerDone  byte = 3
+	msgClientAuth  byte = 4
+	msgFinished    byte = 11
+
+	// The messages of the handshake with a pre-shared key; see psk.go.
+	msgServerPSKHello byte = 5
+	msgClientPSKHello byte = 6
+	msgPSKFinished    byte = 7
+
+	// The messages of Noise handshakes; see noise.go.
+	msgServerNoiseHello byte = 8
+	msgClientNoiseHello byte = 9
+	msgNoise            byte = 10
+)
+
+// Handshake message fields.
+const (
+	// fieldPublicKey is the sender's public key, in both hellos.
+	fieldPublicKey byte = 1
+
+	// fieldTicket is a resumption ticket offered in the client hello.
+	fieldTicket byte = 2
+
+	// fieldResumed is an empty field in the server done message, present
+	// when the server accepted the client's ticket.
+	fieldResumed byte = 3
+
+	// fieldIdentity is the sender's Ed25519 identity key, in either hello.
+	fieldIdentity byte = 4
+
+	// fieldSignature is the signature of the transcript by the sender's
+	// identity key, in the server done or client auth message.
+	fieldSignature byte = 5
+
+	// fieldMaxFrame is the largest frame the sender accepts, as a 4-byte
+	// big-endian count of plaintext bytes, in either hello. Both ends use
+	// the smaller of the two, or DefaultMaxFrameSize for a peer that sends
+	// none.
+	fieldMaxFrame byte = 6
+
+	// fieldCipherSuites lists the cipher suites the sender accepts, one
+	// byte each in order of preference, in either hello. Both ends use the
+	// first of the server's suites that the client lists, and SuiteBox for
+	// a peer that sends none.
+	fieldCipherSuites byte = 7
+
+	// fieldNonce is the random nonce of a PSK hello.
+	fieldNonce byte = 8
+
+	// fieldMAC is the MAC of the transcript in a finished or PSK finished
+	// message, or in the server done message of a server using a previous
+	// key.
+	fieldMAC byte = 9
+
+	// fieldNoisePattern is the NoisePattern, as one byte, in the client's
+	// Noise hello.
+	fieldNoisePattern byte = 10
+
+	// fieldNoise is a message of the Noise handshake.
+	fieldNoise byte = 11
+
+	// fieldEarlyData is the sealed early data of a client resuming a
+	// session, in the client hello, and an empty field in the server done
+	// message when the server accepted it. See earlydata.go.
+	fieldEarlyData byte = 12
+
+	// fieldCompression lists the compression algorithms the sender
+	// accepts, one byte each, in any hello. See compress.go.
+	fieldCompression byte = 13
+
+	// fieldMaxMessage is the largest message the sender accepts, as a
+	// 4-byte big-endian count of bytes, in any hello. Both ends use the
+	// smaller of the two, or DefaultMaxMessageSize for a peer that sends
+	// none.
+	fieldMaxMessage byte = 14
+
+	// fieldServerKey is the server public key a client has pinned, in the
+	// client hello, and fieldPreviousKeys the public keys of a server's
+	// previous key pairs, 32 bytes each, in the server hello. See
+	// rotation.go.
+	fieldServerKey    byte = 15
+	fieldPreviousKeys byte = 16
+
+	// fieldCertificate is the sender's certificate, in either hello. See
+	// certificate.go.
+	fieldCertificate byte = 17
+)
+
+// protocolVersion is the highest protocol version this package speaks,
+// and minProtocolVersion the lowest. finishedVersion is the first version
+// whose handshakes end with finished messages.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 1
+	finishedVersion    = 2
+)
+
+// protocolMagic starts the preamble.
+var protocolMagic = [4]byte{'G', 'C', 'H', '2'}
+
+// maxHandshakeMessageSize is the largest total length of the fields of a
+// handshake message.
+const maxHandshakeMessageSize = 1<<16 - 1
+
+var (
+	errMalformedHandshake = errors.New("secure: malformed handshake message")
+	errNotProtocol        = errors.New("secure: peer does not speak this protocol")
+	errLowOrderKey        = errors.New("secure: peer public key has low order")
+	errBadFinished        = errors.New("secure: handshake transcript does not match the peer's")
+)
+
+// handshakeMessage is a decoded handshake message, mapping field types to
+// values.
+type handshakeMessage map[byte][]byte
+
+// marshal encodes m as a message of type typ.
+func (m handshakeMessage) marshal(typ byte) []byte {
+	fields := make([]int, 0, len(m))
+	for f := range m {
+		fields = append(fields, int(f))
+	}
+	sort.Ints(fields)
+
+	b := make([]byte, 3, 64)
+	b[0] = typ
+	for _, f := range fields {
+		v := m[byte(f)]
+		b = append(b, byte(f))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		b = append(b, v...)
+	}
+	if len(b)-3 > maxHandshakeMessageSize {
+		panic("secure: handshake message too large")
+	}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(b)-3))
+	return b
+}
+
+// readHandshakeMessage reads a message of type typ from r. It also returns
+// the encoded message, for the handshake transcript.
+func readHandshakeMessage(r io.Reader, typ byte) (handshakeMessage, []byte, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[0] != typ {
+		return nil, nil, fmt.Errorf("secure: unexpected handshake message type %d, want %d", hdr[0], typ)
+	}
+	raw := make([]byte, 3+int(binary.BigEndian.Uint16(hdr[1:])))
+	copy(raw, hdr[:])
+	if _, err := io.ReadFull(r, raw[3:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+
+	m := make(handshakeMessage)
+	prev := -1
+	for b := raw[3:]; len(b) > 0; {
+		if len(b) < 3 {
+			return nil, nil, errMalformedHandshake
+		}
+		f, n := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if int(f) <= prev || n > len(b) {
+			return nil, nil, errMalformedHandshake
+		}
+		m[f], b = b[:n:n], b[n:]
+		prev = int(f)
+	}
+	return m, raw, nil
+}
+
+// preamble returns the preamble of our hellos.
+func preamble() []byte {
+	return append(protocolMagic[:], protocolVersion)
+}
+
+// readHello reads the preamble and the hello message of type typ from r,
+// and returns the hello, the encoded preamble and hello for the
+// transcript, and the protocol version to use with the peer.
+func readHello(r io.Reader, typ byte) (handshakeMessage, []byte, int, error) {
+	var pre [len(protocolMagic) + 1]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil {
+		return nil, nil, 0, err
+	}
+	if [len(protocolMagic)]byte(pre[:len(protocolMagic)]) != protocolMagic {
+		return nil, nil, 0, errNotProtocol
+	}
+	version := min(protocolVersion, int(pre[len(protocolMagic)]))
+	if version < minProtocolVersion {
+		return nil, nil, 0, fmt.Errorf("secure: peer protocol version %d unsupported", pre[len(protocolMagic)])
+	}
+	m, raw, err := readHandshakeMessage(r, typ)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, 0, err
+	}
+	return m, append(pre[:], raw...), version, nil
+}
+
+// maxFrame returns the frame size carried in m.
+func (m handshakeMessage) maxFrame() (int, error) {
+	v, ok := m[fieldMaxFrame]
+	if !ok {
+		return DefaultMaxFrameSize, nil
+	}
+	if len(v) != 4 {
+		return 0, errMalformedHandshake
+	}
+	n := binary.BigEndian.Uint32(v)
+	if n < minFrameSize || n > maxFrameSizeLimit {
+		return 0, fmt.Errorf("secure: peer frame size %d out of range", n)
+	}
+	return int(n), nil
+}
+
+// maxMessage returns the message size carried in m.
+func (m handshakeMessage) maxMessage() (int, error) {
+	v, ok := m[fieldMaxMessage]
+	if !ok {
+		return DefaultMaxMessageSize, nil
+	}
+	if len(v) != 4 {
+		return 0, errMalformedHandshake
+	}
+	n := binary.BigEndian.Uint32(v)
+	if n == 0 || n > maxMessageSizeLimit {
+		return 0, fmt.Errorf("secure: peer message size %d out of range", n)
+	}
+	return int(n), nil
+}
+
+// cipherSuites returns the cipher suites carried in m.
+func (m handshakeMessage) cipherSuites() ([]CipherSuite, error) {
+	v, ok := m[fieldCipherSuites]
+	if !ok {
+		return []CipherSuite{SuiteBox}, nil
+	}
+	if len(v) == 0 {
+		return nil, errMalformedHandshake
+	}
+	suites := make([]CipherSuite, len(v))
+	for i, b := range v {
+		suites[i] = CipherSuite(b)
+	}
+	return suites, nil
+}
+
+// key returns the key carried in field f of m.
+func (m handshakeMessage) key(f byte) (*[KeySize]byte, error) {
+	v, ok := m[f]
+	if !ok || len(v) != KeySize {
+		return nil, errMalformedHandshake
+	}
+	key := new([KeySize]byte)
+	copy(key[:], v)
+	return key, nil
+}
+
+// publicKey returns the peer's public key carried in field f of m, refusing
+// the points of low order, with which the shared secret would not depend
+// on our private key.
+func (m handshakeMessage) publicKey(f byte) (*[KeySize]byte, error) {
+	key, err := m.key(f)
+	if err != nil {
+		return nil, err
+	}
+	if lowOrder(key) {
+		return nil, errLowOrderKey
+	}
+	return key, nil
+}
+
+// lowOrderPoints are the encodings of the points of Curve25519 of order 1,
+// 2, 4 and 8, and their non-canonical encodings as values of p or more,
+// with the unused top bit clear, as listed by libsodium.
+var lowOrderPoints = [][KeySize]byte{
+	{},
+	{1},
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a, 0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b, 0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
+// lowOrder reports whether key is a point of low order, whatever its top
+// bit, which X25519 ignores. It takes the same time for every key.
+func lowOrder(key *[KeySize]byte) bool {
+	k := *key
+	k[KeySize-1] &= 0x7f
+	var found int
+	for i := range lowOrderPoints {
+		found |= subtle.ConstantTimeCompare(k[:], lowOrderPoints[i][:])
+	}
+	return found == 1
+}
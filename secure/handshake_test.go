@@ -0,0 +1,426 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"slices"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestClientServer(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{Keys: ckeys})
+	server := Server(c2, &Config{Keys: skeys})
+	defer client.Close()
+	defer server.Close()
+
+	// The handshake runs implicitly on the first Write and Read.
+	go func() {
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Error(err)
+		}
+	}()
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Fatalf("Unexpected result: %s != %s", got, "hello")
+	}
+
+	spub, err := client.PeerPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *spub != *skeys.Public {
+		t.Fatal("Unexpected result. Client saw the wrong server key.")
+	}
+	cpub, err := server.PeerPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cpub != *ckeys.Public {
+		t.Fatal("Unexpected result. Server saw the wrong client key.")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	akeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		s   *Session
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		s, err := Handshake(c2, bkeys, ServerRole)
+		done <- result{s, err}
+	}()
+	as, err := Handshake(c1, akeys, ClientRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-done
+	if b.err != nil {
+		t.Fatal(b.err)
+	}
+
+	if *as.PeerPublicKey != *bkeys.Public || *b.s.PeerPublicKey != *akeys.Public {
+		t.Fatal("Unexpected result. Peers saw the wrong public keys.")
+	}
+
+	// Both ends derive the same session and can talk over it.
+	a, bc := as.Conn(c1), b.s.Conn(c2)
+	go a.WriteMessage([]byte("hello"))
+	msg, err := bc.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("Unexpected result: %s != %s", msg, "hello")
+	}
+}
+
+func TestHandshakeShortReads(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's messages arrive one byte at a time.
+	shRaw := append(preamble(), handshakeMessage{fieldPublicKey: peer.Public[:]}.marshal(msgServerHello)...)
+	chRaw := append(preamble(), (&handshakeState{keys: keys}).hello().marshal(msgClientHello)...)
+	doneRaw := handshakeMessage{}.marshal(msgServerDone)
+	transcript := sha256.Sum256(slices.Concat(shRaw, chRaw, doneRaw))
+	server := newSession(peer, keys.Public, ServerRole, nil, transcript[:])
+	in := slices.Concat(shRaw, doneRaw, handshakeMessage{fieldMAC: server.finished}.marshal(msgFinished))
+	rw := pipeConn{iotest.OneByteReader(bytes.NewReader(in)), ioutil.Discard}
+	s, err := Handshake(rw, keys, ClientRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s.PeerPublicKey != *peer.Public {
+		t.Fatal("Unexpected result. Handshake saw the wrong peer key.")
+	}
+
+	// A server whose transcript differs sends a MAC the client refuses.
+	server.finished[0] ^= 1
+	in = slices.Concat(shRaw, doneRaw, handshakeMessage{fieldMAC: server.finished}.marshal(msgFinished))
+	rw = pipeConn{bytes.NewReader(in), ioutil.Discard}
+	if _, err := Handshake(rw, keys, ClientRole); !errors.Is(err, errBadFinished) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, errBadFinished)
+	}
+
+	// The client's messages may arrive one byte at a time too.
+	shRaw = append(preamble(), (&handshakeState{keys: peer}).hello().marshal(msgServerHello)...)
+	chRaw = append(preamble(), handshakeMessage{fieldPublicKey: keys.Public[:]}.marshal(msgClientHello)...)
+	transcript = sha256.Sum256(slices.Concat(shRaw, chRaw, doneRaw))
+	client := newSession(keys, peer.Public, ClientRole, nil, transcript[:])
+	in = slices.Concat(chRaw, handshakeMessage{fieldMAC: client.finished}.marshal(msgFinished))
+	rw = pipeConn{iotest.OneByteReader(bytes.NewReader(in)), ioutil.Discard}
+	if s, err = Handshake(rw, peer, ServerRole); err != nil {
+		t.Fatal(err)
+	}
+	if *s.PeerPublicKey != *keys.Public {
+		t.Fatal("Unexpected result. Handshake saw the wrong peer key.")
+	}
+}
+
+// stuckConn fails every Read and blocks every Write until it is closed.
+type stuckConn struct {
+	closed chan struct{}
+}
+
+func (c stuckConn) Read(p []byte) (int, error) { return 0, errors.New("read failed") }
+
+func (c stuckConn) Write(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c stuckConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHandshakeReadFailureUnblocksWrite(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := Handshake(stuckConn{make(chan struct{})}, keys, ClientRole)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Unexpected result. The handshake succeeded.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handshake blocked on the write after the read failed")
+	}
+}
+
+func TestClientServerRoles(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Keys: keys}
+
+	// exchange sends hello from a to b and returns what b received.
+	exchange := func(a, b *SecureConn) ([]byte, error) {
+		defer a.Close()
+		defer b.Close()
+		go b.Handshake()
+		if err := a.Handshake(); err != nil {
+			return nil, err
+		}
+		go a.WriteMessage([]byte("hello"))
+		return b.ReadMessage()
+	}
+
+	// A Client and a Server may share one Config, and so one key pair.
+	c1, c2 := net.Pipe()
+	msg, err := exchange(Client(c1, config), Server(c2, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("Unexpected result: %s != %s", msg, "hello")
+	}
+
+	// Two Clients derive mismatched keys and cannot talk.
+	c1, c2 = net.Pipe()
+	if _, err := exchange(Client(c1, config), Client(c2, config)); err == nil {
+		t.Fatal("Unexpected result. Two clients understood each other.")
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	// Both ends use the smaller of the two sizes.
+	client, server, cerr, serr := handshakePair(&Config{MaxFrameSize: 4096}, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+	for _, c := range []*SecureConn{client, server} {
+		if got := c.session.MaxFrameSize; got != 4096 {
+			t.Fatalf("Unexpected frame size %d, expected 4096", got)
+		}
+	}
+
+	// Messages larger than a frame still arrive whole.
+	msg := bytes.Repeat([]byte("x"), 10000)
+	go server.WriteMessage(msg)
+	got, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("Unexpected result. The message was not reassembled.")
+	}
+
+	// Configured sizes are clamped, but a peer asking for frames below the
+	// minimum is refused.
+	client, server, cerr, serr = handshakePair(nil, &Config{MaxFrameSize: 1})
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	client.Close()
+	server.Close()
+	if got := client.session.MaxFrameSize; got != minFrameSize {
+		t.Fatalf("Unexpected frame size %d, expected %d", got, minFrameSize)
+	}
+	hello := handshakeMessage{fieldMaxFrame: []byte{0, 0, 0, 1}}
+	if _, err := hello.maxFrame(); err == nil {
+		t.Fatal("Unexpected result. Accepted a 1 byte frame size.")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// Both ends use the smaller of the two sizes.
+	client, server, cerr, serr := handshakePair(&Config{MaxMessageSize: 2000}, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+	for _, c := range []*SecureConn{client, server} {
+		if got := c.session.MaxMessageSize; got != 2000 {
+			t.Fatalf("Unexpected message size %d, expected 2000", got)
+		}
+	}
+
+	// Longer messages are refused, but longer writes are split.
+	if err := server.WriteMessage(make([]byte, 2001)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := bytes.Repeat([]byte("x"), 5000)
+	go server.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("Unexpected result. The write was corrupted.")
+	}
+
+	// A peer that sends a longer message anyway is caught by the reader.
+	server.sw.maxMessage = len(msg)
+	go server.WriteMessage(msg)
+	var sizeErr *MessageSizeError
+	if _, err := client.ReadMessage(); !errors.As(err, &sizeErr) || sizeErr.Limit != 2000 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	hello := handshakeMessage{fieldMaxMessage: []byte{0, 0, 0, 0}}
+	if _, err := hello.maxMessage(); err == nil {
+		t.Fatal("Unexpected result. Accepted an empty message size.")
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	client, server, cerr, serr := handshakePair(nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	client.Close()
+	server.Close()
+	for _, c := range []*SecureConn{client, server} {
+		if got := c.session.Version; got != protocolVersion {
+			t.Fatalf("Unexpected version %d, expected %d", got, protocolVersion)
+		}
+	}
+
+	// A newer peer settles for our version, but one that is too old or
+	// doesn't speak the protocol at all is refused.
+	hello := handshakeMessage{fieldPublicKey: make([]byte, KeySize)}.marshal(msgServerHello)
+	for _, tt := range []struct {
+		preamble []byte
+		version  int
+		ok       bool
+	}{
+		{append(protocolMagic[:], protocolVersion+1), protocolVersion, true},
+		{append(protocolMagic[:], minProtocolVersion-1), 0, false},
+		{[]byte("HTTP/"), 0, false},
+	} {
+		_, _, version, err := readHello(bytes.NewReader(append(tt.preamble, hello...)), msgServerHello)
+		if (err == nil) != tt.ok || version != tt.version {
+			t.Errorf("%q: unexpected result: %d, %v", tt.preamble, version, err)
+		}
+	}
+}
+
+func TestProtocolVersionDowngrade(t *testing.T) {
+	// An attacker rewrites the version the client offers. The server
+	// agrees on the version all the same, but the two ends derive
+	// different keys, which the finished messages catch.
+	c1, m1 := net.Pipe()
+	m2, c2 := net.Pipe()
+	go func() {
+		buf := make([]byte, 4096)
+		first := true
+		for {
+			n, err := m1.Read(buf)
+			if err != nil {
+				m2.Close()
+				return
+			}
+			if first && n > len(protocolMagic) {
+				buf[len(protocolMagic)]++
+				first = false
+			}
+			if _, err := m2.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(m1, m2)
+
+	client, server := Client(c1, nil), Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+	go client.WriteMessage([]byte("hello"))
+	msg, err := server.ReadMessage()
+	if err == nil {
+		t.Fatalf("Unexpected result. The server read %q.", msg)
+	}
+	if !errors.Is(err, errBadFinished) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestLowOrderPeerKey(t *testing.T) {
+	for i, point := range lowOrderPoints {
+		for _, top := range []byte{0, 0x80} {
+			key := point
+			key[KeySize-1] |= top
+			if !lowOrder(&key) {
+				t.Errorf("Unexpected result. Point %d (top bit %#x) is not of low order.", i, top)
+			}
+			priv, err := GenerateKeyPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := curve25519.X25519(priv.Private[:], key[:]); err == nil {
+				t.Errorf("Unexpected result. X25519 accepted point %d (top bit %#x).", i, top)
+			}
+
+			c1, c2 := net.Pipe()
+			go io.Copy(io.Discard, c1)
+			go c1.Write(append(preamble(), handshakeMessage{fieldPublicKey: key[:]}.marshal(msgClientHello)...))
+			server := Server(c2, nil)
+			if err := server.Handshake(); !errors.Is(err, errLowOrderKey) {
+				t.Errorf("Unexpected error for point %d (top bit %#x): %v", i, top, err)
+			}
+			server.Close()
+			c1.Close()
+		}
+	}
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lowOrder(kp.Public) {
+		t.Fatal("Unexpected result. A generated key is of low order.")
+	}
+}
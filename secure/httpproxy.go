@@ -0,0 +1,88 @@
+package secure
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/proxy"
+)
+
+// ServeHTTPProxy runs an HTTP proxy on l that connects on from the server
+// at addr, which serves a SOCKSHandler, so that browsers and other HTTP
+// clients reach any destination through secure connections. It only
+// supports the CONNECT method, which HTTP clients use for https URLs and
+// which tunnels any TCP protocol. config configures the secure connections
+// as DialWithConfig takes it. ServeHTTPProxy returns once Accept fails,
+// such as when l is closed.
+func ServeHTTPProxy(l net.Listener, addr string, config *Config) error {
+	d, err := proxy.SOCKS5("tcp", addr, nil, tunnelDialer{config})
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:  &connectHandler{dial: d.(proxy.ContextDialer).DialContext},
+		ErrorLog: slog.NewLogLogger(config.logger().Handler(), slog.LevelWarn),
+	}
+	return srv.Serve(l)
+}
+
+// tunnelDialer dials tunnels to a server.
+type tunnelDialer struct {
+	config *Config
+}
+
+// Dial returns the stream of a new tunnel to the server at addr.
+func (d tunnelDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but gives up once ctx is done.
+func (d tunnelDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	sc, err := DialWithConfig(ctx, addr, d.config)
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelConn{SecureConn: sc}, nil
+}
+
+// connectHandler serves the CONNECT requests of an HTTP proxy.
+type connectHandler struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (h *connectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	dst, err := h.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+	c, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer c.Close()
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	// Send on what the client sent after the request without waiting for
+	// the answer.
+	if n := rw.Reader.Buffered(); n > 0 {
+		early, _ := rw.Reader.Peek(n)
+		if _, err := dst.Write(early); err != nil {
+			return
+		}
+	}
+	splice(dst, c)
+}
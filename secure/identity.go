@@ -0,0 +1,64 @@
+package secure
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+)
+
+// The keys exchanged by the handshake are usually ephemeral, so on their own
+// they say nothing about who the peer is. A peer with an Ed25519 identity
+// key presents its public half in its hello and signs the handshake
+// transcript, which covers the keys of both ends: the server signs both
+// hellos in its done message and the client the whole transcript in its
+// client auth message. A man in the middle can therefore not substitute its
+// own keys without the private key of the identity it impersonates.
+
+// Contexts prefixed to the transcript hash before it is signed, so that a
+// signature by one end can never pass for one by the other.
+const (
+	serverSignatureContext = "gochal2 server signature\x00"
+	clientSignatureContext = "gochal2 client signature\x00"
+)
+
+var (
+	errIdentityMismatch = errors.New("secure: peer identity does not match")
+	errBadSignature     = errors.New("secure: bad identity signature")
+)
+
+// signTranscript signs the transcript hash with key under context.
+func signTranscript(key crypto.Signer, context string, transcript []byte) ([]byte, error) {
+	return key.Sign(nil, append([]byte(context), transcript...), crypto.Hash(0))
+}
+
+// verifyTranscript reports whether sig is a signature of the transcript hash
+// by pub under context.
+func verifyTranscript(pub ed25519.PublicKey, context string, transcript, sig []byte) bool {
+	return len(sig) == ed25519.SignatureSize &&
+		ed25519.Verify(pub, append([]byte(context), transcript...), sig)
+}
+
+// readPeerIdentity records the identity presented in the peer's hello m, if
+// any, and checks it against the configured PeerIdentity.
+func (hs *handshakeState) readPeerIdentity(m handshakeMessage) error {
+	if v, ok := m[fieldIdentity]; ok {
+		if len(v) != ed25519.PublicKeySize {
+			return errMalformedHandshake
+		}
+		hs.peerIdentity = ed25519.PublicKey(v)
+	}
+	if want := hs.config.peerIdentity(); want != nil && !bytes.Equal(want, hs.peerIdentity) {
+		return rejectKey(errIdentityMismatch)
+	}
+	return nil
+}
+
+// PeerIdentity returns the identity key presented by the peer, running the
+// handshake first if necessary. It is nil if the peer presented none.
+func (c *SecureConn) PeerIdentity() (ed25519.PublicKey, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c.session.PeerIdentity, nil
+}
@@ -0,0 +1,114 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+)
+
+// handshakePair runs the handshake between a Client and a Server with the
+// given configs over a pipe and returns both ends and their errors.
+func handshakePair(cconfig, sconfig *Config) (client, server *SecureConn, cerr, serr error) {
+	c1, c2 := net.Pipe()
+	client, server = Client(c1, cconfig), Server(c2, sconfig)
+	done := make(chan error)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			c2.Close()
+		}
+		done <- err
+	}()
+	cerr = client.Handshake()
+	if cerr != nil {
+		c1.Close()
+	}
+	serr = <-done
+	return client, server, cerr, serr
+}
+
+func TestIdentity(t *testing.T) {
+	cpub, cpriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spub, spriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both ends see the other's identity.
+	client, server, cerr, serr := handshakePair(
+		&Config{Identity: cpriv, PeerIdentity: spub},
+		&Config{Identity: spriv},
+	)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	if id, _ := client.PeerIdentity(); !bytes.Equal(id, spub) {
+		t.Fatal("Unexpected result. Client saw the wrong server identity.")
+	}
+	if id, _ := server.PeerIdentity(); !bytes.Equal(id, cpub) {
+		t.Fatal("Unexpected result. Server saw the wrong client identity.")
+	}
+
+	// A server with another identity, or none, is rejected.
+	for _, sconfig := range []*Config{{Identity: cpriv}, nil} {
+		client, _, cerr, _ := handshakePair(&Config{PeerIdentity: spub}, sconfig)
+		client.Close()
+		if !errors.Is(cerr, errIdentityMismatch) {
+			t.Fatalf("Unexpected error: %v", cerr)
+		}
+	}
+
+	// An anonymous client is allowed unless the server requires one.
+	client, _, cerr, serr = handshakePair(nil, &Config{Identity: spriv})
+	client.Close()
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	_, server, _, serr = handshakePair(nil, &Config{Identity: spriv, PeerIdentity: cpub})
+	server.Close()
+	if !errors.Is(serr, errIdentityMismatch) {
+		t.Fatalf("Unexpected error: %v", serr)
+	}
+}
+
+func TestIdentityBadSignature(t *testing.T) {
+	spub, spriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A man in the middle replays the server's identity with its own
+	// ephemeral key, but cannot sign the transcript.
+	hello := handshakeMessage{fieldPublicKey: keys.Public[:], fieldIdentity: spub}
+	in := append(preamble(), hello.marshal(msgServerHello)...)
+	sig, err := signTranscript(spriv, serverSignatureContext, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in = append(in, handshakeMessage{fieldSignature: sig}.marshal(msgServerDone)...)
+
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &handshakeState{
+		rw:     pipeConn{bytes.NewReader(in), &bytes.Buffer{}},
+		keys:   ckeys,
+		role:   ClientRole,
+		config: &Config{PeerIdentity: spub},
+	}
+	if _, err := hs.run(); err != errBadSignature {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package secure
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIdleTimeout is returned by the reads and writes of a connection that
+// was closed because no message was sent or received for its IdleTimeout.
+var ErrIdleTimeout = errors.New("secure: connection idle for too long")
+
+// watchIdle closes the connection once no message has been sent or received
+// for timeout.
+func (c *SecureConn) watchIdle(timeout time.Duration) {
+	start := time.Now().UnixNano()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for range timer.C {
+		if c.closed.Load() {
+			return
+		}
+		last := max(start, c.sr.lastData.Load(), c.sw.lastData.Load())
+		idle := time.Since(time.Unix(0, last))
+		if idle >= timeout {
+			c.fail(ErrIdleTimeout)
+			return
+		}
+		timer.Reset(timeout - idle)
+	}
+}
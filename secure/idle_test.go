@@ -0,0 +1,38 @@
+package secure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	config := &Config{IdleTimeout: 50 * time.Millisecond}
+	client, server, cerr, serr := handshakePair(nil, config)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Messages keep the connection open past the timeout.
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			client.WriteMessage([]byte("tick"))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, err := server.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Then the idle connection is closed.
+	start := time.Now()
+	if _, err := server.ReadMessage(); err != ErrIdleTimeout {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Idle connection closed after %v", elapsed)
+	}
+}
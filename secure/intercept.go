@@ -0,0 +1,68 @@
+package secure
+
+// Interceptor handles the plaintext of one connection on its way between
+// the application and the frames, to measure, limit, filter or record it.
+// Either function may be nil to leave that direction alone. Each returns
+// the plaintext to pass on, which may be p itself or a modified copy, or
+// an error that fails the read or write. They run while the connection
+// holds its read or write lock, so they must not read from or write to the
+// connection themselves.
+type Interceptor struct {
+	// Read is called with the plaintext of every data frame read, before
+	// the application reads any of it. Messages longer than the frame
+	// size come in several pieces.
+	Read func(p []byte) ([]byte, error)
+
+	// Write is called with every message written, before it is sealed.
+	// A Write larger than the peer's message size comes in several
+	// messages.
+	Write func(p []byte) ([]byte, error)
+}
+
+// InterceptorFunc returns the Interceptor of a connection whose handshake
+// has just completed, so that interceptors may keep state of their own
+// for each connection and look at its peer.
+type InterceptorFunc func(c *SecureConn) Interceptor
+
+// intercept sets up the interceptors of the config on c. Writes pass
+// through them in order and reads in reverse order, so that the first is
+// closest to the application and the last to the wire.
+func (c *SecureConn) intercept() {
+	var reads, writes []func([]byte) ([]byte, error)
+	for _, f := range c.config.interceptors() {
+		i := f(c)
+		if i.Read != nil {
+			reads = append([]func([]byte) ([]byte, error){i.Read}, reads...)
+		}
+		if i.Write != nil {
+			writes = append(writes, i.Write)
+		}
+	}
+	c.sr.intercept = chainInterceptors(reads)
+	c.sw.intercept = chainInterceptors(writes)
+}
+
+// chainInterceptors returns a function that passes plaintext through fs in
+// order, or nil if there are none.
+func chainInterceptors(fs []func([]byte) ([]byte, error)) func([]byte) ([]byte, error) {
+	if len(fs) == 0 {
+		return nil
+	}
+	return func(p []byte) ([]byte, error) {
+		for _, f := range fs {
+			var err error
+			if p, err = f(p); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+}
+
+// interceptors returns the configured interceptors, if any.
+func (c *Config) interceptors() []InterceptorFunc {
+	if c == nil {
+		return nil
+	}
+	return c.Interceptors
+}
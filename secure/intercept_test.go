@@ -0,0 +1,87 @@
+package secure
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// appendInterceptor returns an InterceptorFunc that appends s to what is
+// read and written.
+func appendInterceptor(s string) InterceptorFunc {
+	f := func(p []byte) ([]byte, error) {
+		return append(append([]byte(nil), p...), s...), nil
+	}
+	return func(*SecureConn) Interceptor { return Interceptor{Read: f, Write: f} }
+}
+
+func TestInterceptors(t *testing.T) {
+	var recorded []byte
+	record := func(c *SecureConn) Interceptor {
+		if c.role() != ClientRole {
+			t.Errorf("Unexpected result. The interceptor got the %v end.", c.role())
+		}
+		return Interceptor{Write: func(p []byte) ([]byte, error) {
+			recorded = append(recorded, p...)
+			return p, nil
+		}}
+	}
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{Interceptors: []InterceptorFunc{appendInterceptor("1"), record, appendInterceptor("2")}})
+	server := Server(c2, &Config{Interceptors: []InterceptorFunc{appendInterceptor("a"), appendInterceptor("b")}})
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		n, err := client.Write([]byte("msg"))
+		if err == nil && n != 3 {
+			err = errors.New("short write")
+		}
+		errc <- err
+	}()
+	msg, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// Writes pass through the interceptors in order, and reads in reverse
+	// order.
+	if want := "msg12ba"; string(msg) != want {
+		t.Fatalf("Unexpected message %q, want %q", msg, want)
+	}
+	if want := "msg1"; string(recorded) != want {
+		t.Fatalf("Unexpected recording %q, want %q", recorded, want)
+	}
+}
+
+func TestInterceptorError(t *testing.T) {
+	errFiltered := errors.New("filtered")
+	filter := func(*SecureConn) Interceptor {
+		return Interceptor{Read: func(p []byte) ([]byte, error) {
+			if bytes.Contains(p, []byte("forbidden")) {
+				return nil, errFiltered
+			}
+			return p, nil
+		}}
+	}
+	c1, c2 := net.Pipe()
+	client := Client(c1, nil)
+	server := Server(c2, &Config{Interceptors: []InterceptorFunc{filter}})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.WriteMessage([]byte("allowed"))
+		client.WriteMessage([]byte("forbidden"))
+	}()
+	if msg, err := server.ReadMessage(); err != nil || string(msg) != "allowed" {
+		t.Fatalf("Unexpected result: %q, %v", msg, err)
+	}
+	if _, err := server.ReadMessage(); !errors.Is(err, errFiltered) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, errFiltered)
+	}
+}
@@ -0,0 +1,154 @@
+package secure
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// IPFilter decides which client addresses a SecureListener accepts
+// connections from, as a coarse first line of defense in front of the
+// handshake. It has a list of networks to allow and one to deny: an
+// address in a denied network is refused, and so is one outside every
+// allowed network unless none are listed. An IPFilter is safe for
+// concurrent use.
+//
+// The file of LoadIPFilter has a rule per line:
+//
+//	# Office and VPN, except the guest network.
+//	allow 192.0.2.0/24
+//	allow 2001:db8::/32
+//	deny 192.0.2.128/25
+//	deny 198.51.100.7
+//
+// where a bare address stands for itself alone. Blank lines and lines
+// starting with # are ignored.
+type IPFilter struct {
+	path string
+
+	mu          sync.RWMutex
+	allow, deny []netip.Prefix
+}
+
+// NewIPFilter returns a filter of the given networks, which Reload leaves
+// unchanged.
+func NewIPFilter(allow, deny []netip.Prefix) *IPFilter {
+	return &IPFilter{allow: allow, deny: deny}
+}
+
+// LoadIPFilter reads the filter in the file at path.
+func LoadIPFilter(path string) (*IPFilter, error) {
+	f := &IPFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParseIPFilter parses a filter in the format of LoadIPFilter.
+func ParseIPFilter(r io.Reader) (*IPFilter, error) {
+	allow, deny, err := parseIPFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewIPFilter(allow, deny), nil
+}
+
+// Reload reads the filter from its file again. If that fails, the filter
+// keeps the rules it had.
+func (f *IPFilter) Reload() error {
+	if f.path == "" {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	allow, deny, err := parseIPFilter(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.mu.Lock()
+	f.allow, f.deny = allow, deny
+	f.mu.Unlock()
+	return nil
+}
+
+// parseIPFilter returns the allowed and denied networks of a filter.
+func parseIPFilter(r io.Reader) (allow, deny []netip.Prefix, err error) {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: want allow or deny and a network", n)
+		}
+		prefix, err := parsePrefix(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, prefix)
+		case "deny":
+			deny = append(deny, prefix)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown rule %q", n, fields[0])
+		}
+	}
+	return allow, deny, s.Err()
+}
+
+// parsePrefix parses a network in CIDR notation, or a bare address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Allowed reports whether the filter accepts connections from addr.
+func (f *IPFilter) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowConn reports whether the config's IPFilter, if any, accepts conn.
+// Connections without an IP address, such as over Unix sockets, are
+// always accepted.
+func (c *Config) allowConn(conn net.Conn) bool {
+	if c == nil || c.IPFilter == nil {
+		return true
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	return !ok || c.IPFilter.Allowed(ip)
+}
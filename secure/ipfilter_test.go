@@ -0,0 +1,95 @@
+package secure
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := ParseIPFilter(strings.NewReader(`
+# Office, except the guest network.
+allow 192.0.2.0/24
+allow 2001:db8::/32
+deny 192.0.2.128/25
+deny 192.0.2.7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.1": true,
+		"192.0.2.7":        false,
+		"192.0.2.200":      false,
+		"198.51.100.1":     false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+	} {
+		if got := f.Allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	// Without allow rules, everything not denied is allowed.
+	f = NewIPFilter(nil, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	if !f.Allowed(netip.MustParseAddr("192.0.2.1")) || f.Allowed(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatal("Unexpected result of a filter with deny rules only.")
+	}
+
+	for _, bad := range []string{"allow", "permit 10.0.0.0/8", "deny 10.0.0.0/33", "allow example.com"} {
+		if _, err := ParseIPFilter(strings.NewReader(bad)); err == nil {
+			t.Errorf("Unexpected result. Parsed %q.", bad)
+		}
+	}
+}
+
+func TestIPFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_filter")
+	if err := os.WriteFile(path, []byte("deny 127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadIPFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, &Config{IPFilter: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if conn, err := Dial(sl.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result. Accepted a connection from a denied address.")
+	}
+
+	// Reloading the filter takes effect for the next connection.
+	if err := os.WriteFile(path, []byte("allow 127.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial(sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
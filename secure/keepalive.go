@@ -0,0 +1,164 @@
+package secure
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPeerUnresponsive is returned by the reads and writes of a connection
+// whose peer stopped answering keepalive pings.
+var ErrPeerUnresponsive = errors.New("secure: peer stopped answering keepalives")
+
+// keepAliveState is the state of a connection's keepalives and pings. Pings
+// and pongs are written from their own goroutine, so that neither the
+// reader nor the keepalive timer ever blocks on the writer, and at most one
+// keepalive ping and one pong are in flight at a time.
+type keepAliveState struct {
+	pinging atomic.Bool
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// ponging is set while a goroutine writes pongs. pongDue is set, and
+	// pong holds the payload to echo, while a ping awaits its pong.
+	ponging bool
+	pongDue bool
+	pong    []byte
+
+	// lastPing numbers the pings sent by Ping, and pings holds the channel
+	// each of them waits on for its pong.
+	lastPing uint64
+	pings    map[uint64]chan struct{}
+}
+
+// startKeepAlive arranges for pings to be answered and, if the config asks
+// for keepalives, starts pinging the peer.
+func (c *SecureConn) startKeepAlive() {
+	c.sr.onPing = c.answerPing
+	c.sr.onPong = c.handlePong
+	if interval, count := c.config.keepAlive(); interval > 0 {
+		c.sr.lastRecv.Store(time.Now().UnixNano())
+		go c.keepAlive(interval, count)
+	}
+}
+
+// keepAlive pings the peer whenever nothing was received for an interval,
+// and closes the connection once nothing was received for count intervals.
+func (c *SecureConn) keepAlive(interval time.Duration, count int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.closed.Load() {
+			return
+		}
+		idle := time.Since(time.Unix(0, c.sr.lastRecv.Load()))
+		if idle >= time.Duration(count)*interval {
+			c.fail(ErrPeerUnresponsive)
+			return
+		}
+		if idle >= interval && c.ka.pinging.CompareAndSwap(false, true) {
+			go func() {
+				defer c.ka.pinging.Store(false)
+				c.sw.writeControl(framePing, nil)
+			}()
+		}
+	}
+}
+
+// answerPing arranges for the peer's ping to be answered. If pongs are
+// already being written, only the latest ping is answered; that is enough,
+// since a pong answers every ping up to the one it echoes.
+func (c *SecureConn) answerPing(payload []byte) {
+	c.ka.mu.Lock()
+	defer c.ka.mu.Unlock()
+	c.ka.pong = append(c.ka.pong[:0], payload...)
+	c.ka.pongDue = true
+	if c.ka.ponging {
+		return
+	}
+	c.ka.ponging = true
+	go c.writePongs()
+}
+
+// writePongs writes pongs until no ping awaits an answer.
+func (c *SecureConn) writePongs() {
+	for {
+		c.ka.mu.Lock()
+		if !c.ka.pongDue {
+			c.ka.ponging = false
+			c.ka.mu.Unlock()
+			return
+		}
+		payload := append([]byte(nil), c.ka.pong...)
+		c.ka.pongDue = false
+		c.ka.mu.Unlock()
+		c.sw.writeControl(framePong, payload)
+	}
+}
+
+// handlePong wakes up the calls to Ping answered by a pong.
+func (c *SecureConn) handlePong(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	c.ka.mu.Lock()
+	defer c.ka.mu.Unlock()
+	for s, answered := range c.ka.pings {
+		if s <= seq {
+			close(answered)
+			delete(c.ka.pings, s)
+		}
+	}
+}
+
+// Ping sends a ping to the peer and returns the time until its answer
+// arrived. Answers are only noticed while the connection is being read, so
+// another goroutine must be reading from it, as a server's Handler or a
+// client waiting for messages does. If ctx is done first, Ping returns the
+// context's error.
+func (c *SecureConn) Ping(ctx context.Context) (time.Duration, error) {
+	if err := c.HandshakeContext(ctx); err != nil {
+		return 0, err
+	}
+
+	c.ka.mu.Lock()
+	c.ka.lastPing++
+	seq := c.ka.lastPing
+	answered := make(chan struct{})
+	if c.ka.pings == nil {
+		c.ka.pings = make(map[uint64]chan struct{})
+	}
+	c.ka.pings[seq] = answered
+	c.ka.mu.Unlock()
+	defer func() {
+		c.ka.mu.Lock()
+		delete(c.ka.pings, seq)
+		c.ka.mu.Unlock()
+	}()
+
+	// The write may block behind other writes, so it must not hold up
+	// ctx either.
+	start := time.Now()
+	written := make(chan error, 1)
+	go func() {
+		written <- c.sw.writeControl(framePing, binary.BigEndian.AppendUint64(nil, seq))
+	}()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				return 0, c.failErr(err)
+			}
+			written = nil
+		case <-answered:
+			return time.Since(start), nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
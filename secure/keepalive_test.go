@@ -0,0 +1,91 @@
+package secure
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	// Pings go out after an interval of silence and the peer is given up on
+	// after ten, so a pong has far longer than any scheduling delay to
+	// arrive.
+	config := &Config{KeepAliveInterval: 50 * time.Millisecond, KeepAliveCount: 10}
+	detection := 10 * config.KeepAliveInterval
+
+	// A peer that is reading answers pings, so an idle connection stays up
+	// for well past the time it takes to detect a dead one.
+	client, server, cerr, serr := handshakePair(config, nil)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	go func() {
+		for {
+			if _, err := server.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.ReadMessage()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(2 * detection):
+	}
+	server.Close()
+	<-read
+
+	// A peer that has gone silent is detected.
+	client, server, cerr, serr = handshakePair(config, nil)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_, err := client.ReadMessage()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != ErrPeerUnresponsive {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(20 * detection):
+		t.Fatal("The dead peer was not detected")
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, server, cerr, serr := handshakePair(nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Nobody reads on the server, so the ping goes unanswered.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go client.ReadMessage()
+	if _, err := client.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Once both ends read, pings are answered.
+	go server.ReadMessage()
+	for i := 0; i < 3; i++ {
+		rtt, err := client.Ping(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("Unexpected round-trip time %v", rtt)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package secure
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Private keys can be kept in the platform's keychain instead of in files:
+// the macOS Keychain, the Windows Credential Manager, which protects them
+// with DPAPI, or a freedesktop Secret Service such as GNOME Keyring or
+// KWallet. A key is stored as the secret of an item of the keychainService
+// service, named after the key, in the PEM encoding of a private key file.
+
+// keychainService is the service the keychain items of keys belong to.
+const keychainService = "gochal2"
+
+// LoadKeychainKeyPair reads the private key named name from the platform's
+// keychain, as saved by SaveKeychainKeyPair, and returns the key pair it
+// belongs to. If there is no such key, the error matches os.ErrNotExist.
+func LoadKeychainKeyPair(name string) (*KeyPair, error) {
+	secret, err := keyring.Get(keychainService, name)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, fmt.Errorf("keychain key %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keychain key %s: %v", name, err)
+	}
+	priv, err := decodeKeyBlock([]byte(secret), privateKeyBlock)
+	if err != nil {
+		return nil, fmt.Errorf("keychain key %s: %v", name, err)
+	}
+	pub := new([KeySize]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return &KeyPair{Public: pub, Private: priv}, nil
+}
+
+// SaveKeychainKeyPair saves the private key of kp in the platform's
+// keychain under name, which must not already be taken.
+func SaveKeychainKeyPair(kp *KeyPair, name string) error {
+	_, err := keyring.Get(keychainService, name)
+	if err == nil {
+		return fmt.Errorf("keychain key %s: %w", name, os.ErrExist)
+	}
+	if !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("keychain key %s: %v", name, err)
+	}
+	secret := pem.EncodeToMemory(&pem.Block{Type: privateKeyBlock, Bytes: kp.Private[:]})
+	defer zero(secret)
+	if err := keyring.Set(keychainService, name, string(secret)); err != nil {
+		return fmt.Errorf("keychain key %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package secure
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestKeychainKeyPair(t *testing.T) {
+	keyring.MockInit()
+	if _, err := LoadKeychainKeyPair("server"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeychainKeyPair(keys, "server"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeychainKeyPair("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded.Public != *keys.Public || *loaded.Private != *keys.Private {
+		t.Fatal("Unexpected result. The keychain returned another key pair.")
+	}
+
+	// A saved key is never overwritten.
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeychainKeyPair(other, "server"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// PEM block types of key files.
+const (
+	privateKeyBlock = "GOCHAL2 PRIVATE KEY"
+	publicKeyBlock  = "GOCHAL2 PUBLIC KEY"
+)
+
+// LoadKeyPair reads the private key file at path, as written by
+// SaveKeyPair, and returns the key pair it belongs to. The file may also be
+// an unencrypted OpenSSH Ed25519 private key, such as ~/.ssh/id_ed25519,
+// which is mapped to the key pair KeyPairFromEd25519 returns; see
+// LoadSSHIdentity for encrypted ones. It may also be an age key file, as
+// written by age-keygen or SaveAgeKeyPair.
+func LoadKeyPair(path string) (*KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == openSSHKeyBlock {
+		id, err := LoadSSHIdentity(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		return KeyPairFromEd25519(id), nil
+	}
+	if isAgeKeyFile(data) {
+		kp, err := parseAgeKeyFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return kp, nil
+	}
+	priv, err := decodeKeyBlock(data, privateKeyBlock)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub := new([KeySize]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return &KeyPair{Public: pub, Private: priv}, nil
+}
+
+// SaveKeyPair writes the private key of kp to privPath, readable by its
+// owner only, and, if pubPath is not empty, the public key to pubPath. The
+// private key file must not already exist.
+func SaveKeyPair(kp *KeyPair, privPath, pubPath string) error {
+	f, err := os.OpenFile(privPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: privateKeyBlock, Bytes: kp.Private[:]}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if pubPath == "" {
+		return nil
+	}
+	return os.WriteFile(pubPath, MarshalPublicKey(kp.Public), 0644)
+}
+
+// LoadPublicKey reads a public key file, as written by SaveKeyPair, an
+// OpenSSH Ed25519 public key file, such as ~/.ssh/id_ed25519.pub, which is
+// mapped as ParseSSHPublicKey maps it, or a file holding an age recipient.
+func LoadPublicKey(path string) (*[KeySize]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if text := strings.TrimSpace(string(data)); strings.HasPrefix(text, ageRecipientHRP+"1") {
+		pub, err := ParseAgeRecipient(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return pub, nil
+	}
+	if bytes.HasPrefix(data, []byte("ssh-")) {
+		pub, err := ParseSSHPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return pub, nil
+	}
+	pub, err := decodeKeyBlock(data, publicKeyBlock)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pub, nil
+}
+
+// MarshalPublicKey returns the PEM encoding of pub, as in a public key file.
+func MarshalPublicKey(pub *[KeySize]byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: publicKeyBlock, Bytes: pub[:]})
+}
+
+// decodeKeyBlock decodes the first PEM block in data, which must be a key
+// of the given type.
+func decodeKeyBlock(data []byte, typ string) (*[KeySize]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("no %s found", typ)
+	}
+	if len(block.Bytes) != KeySize {
+		return nil, errors.New("malformed key")
+	}
+	key := new([KeySize]byte)
+	copy(key[:], block.Bytes)
+	return key, nil
+}
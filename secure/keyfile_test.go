@@ -0,0 +1,51 @@
+package secure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoadKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "key"), filepath.Join(dir, "key.pub")
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeyPair(kp, privPath, pubPath); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(privPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("Unexpected private key permissions %v", perm)
+	}
+
+	loaded, err := LoadKeyPair(privPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded.Private != *kp.Private || *loaded.Public != *kp.Public {
+		t.Fatal("Unexpected result. Loaded the wrong key pair.")
+	}
+	pub, err := LoadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pub != *kp.Public {
+		t.Fatal("Unexpected result. Loaded the wrong public key.")
+	}
+
+	// Existing keys are never overwritten, and files of the wrong kind are
+	// refused.
+	if err := SaveKeyPair(kp, privPath, ""); err == nil {
+		t.Fatal("Unexpected result. Overwrote a private key.")
+	}
+	if _, err := LoadKeyPair(pubPath); err == nil {
+		t.Fatal("Unexpected result. Loaded a public key as a key pair.")
+	}
+}
@@ -0,0 +1,63 @@
+package secure
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A key log, written to Config.KeyLogWriter, records the traffic keys of
+// sessions, in the manner of the SSLKEYLOGFILE of TLS, so that a capture of
+// the sessions can be decrypted later. It has a line per key:
+//
+//	<label> <session> <key>
+//
+// where label is CLIENT_TRAFFIC_KEY for the key of frames the client sends
+// and SERVER_TRAFFIC_KEY for those the server sends, session is the public
+// key in the client's hello, or its nonce with a pre-shared key, and key is
+// the traffic key, both in hex. A session that rekeys gets another line
+// with the same label and session for each new key. Sessions of Noise
+// handshakes are not logged.
+
+// Labels of key log lines.
+const (
+	keyLogClientLabel = "CLIENT_TRAFFIC_KEY"
+	keyLogServerLabel = "SERVER_TRAFFIC_KEY"
+)
+
+// keyLogMu serializes writes to key logs, which connections share.
+var keyLogMu sync.Mutex
+
+// keyLogWriter returns the configured key log, if any.
+func (c *Config) keyLogWriter() io.Writer {
+	if c == nil {
+		return nil
+	}
+	return c.KeyLogWriter
+}
+
+// logKeys writes the traffic keys of the connection's session to the key
+// log, if the config has one, and has the reader and writer log the keys
+// they rekey to.
+func (c *SecureConn) logKeys() {
+	w := c.config.keyLogWriter()
+	if w == nil || c.session.keyLogID == nil {
+		return
+	}
+	sendLabel, recvLabel := keyLogServerLabel, keyLogClientLabel
+	if c.role() == ClientRole {
+		sendLabel, recvLabel = recvLabel, sendLabel
+	}
+	id := c.session.keyLogID
+	c.sw.logKey = func(key *[KeySize]byte) { writeKeyLog(w, sendLabel, id, key) }
+	c.sr.logKey = func(key *[KeySize]byte) { writeKeyLog(w, recvLabel, id, key) }
+	c.sw.logKey(c.sw.key)
+	c.sr.logKey(c.sr.key)
+}
+
+// writeKeyLog writes a line of the key log to w.
+func writeKeyLog(w io.Writer, label string, id []byte, key *[KeySize]byte) {
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	fmt.Fprintf(w, "%s %x %x\n", label, id, key[:])
+}
@@ -0,0 +1,61 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	var keyLog bytes.Buffer
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{RekeyBytes: 100, KeyLogWriter: &keyLog})
+	server := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	msg := bytes.Repeat([]byte("x"), 60)
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := client.WriteMessage(msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := server.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// The log names the session after the client's public key, and its
+	// last key of each direction is the one in use.
+	id := hex.EncodeToString(client.session.LocalPublicKey[:])
+	last := map[string]string{}
+	clientKeys := 0
+	for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[1] != id {
+			t.Fatalf("Unexpected key log line: %q", line)
+		}
+		last[f[0]] = f[2]
+		if f[0] == keyLogClientLabel {
+			clientKeys++
+		}
+	}
+	if clientKeys < 2 {
+		t.Fatalf("Unexpected result. Logged %d client keys despite rekeys.", clientKeys)
+	}
+	if last[keyLogClientLabel] != hex.EncodeToString(server.sr.key[:]) ||
+		last[keyLogServerLabel] != hex.EncodeToString(server.sw.key[:]) {
+		t.Fatal("Unexpected result. The logged keys are not the session's.")
+	}
+}
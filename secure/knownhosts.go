@@ -0,0 +1,158 @@
+package secure
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KnownHosts pins the public keys of the servers a client has talked to, in
+// the manner of OpenSSH's known_hosts file. The first connection to a host
+// records its key, unless Strict is set, and later connections fail if the
+// host presents a different key.
+//
+// The file holds one host per line, as the host name followed by the
+// base64-encoded public key. A later line for a host replaces the earlier
+// ones. Blank lines and lines starting with # are ignored.
+type KnownHosts struct {
+	// Strict refuses hosts that are not yet known instead of recording them.
+	Strict bool
+
+	path  string
+	mu    sync.Mutex
+	hosts map[string][KeySize]byte
+}
+
+// HostKeyError is returned when a host's key does not match the known hosts.
+type HostKeyError struct {
+	Host string
+
+	// Want is the recorded key, or nil if the host is unknown.
+	Want *[KeySize]byte
+
+	// Got is the key the host presented.
+	Got *[KeySize]byte
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Want == nil {
+		return fmt.Sprintf("secure: unknown host %s", e.Host)
+	}
+	return fmt.Sprintf("secure: key for host %s has changed", e.Host)
+}
+
+// LoadKnownHosts reads the known hosts file at path. A missing file is
+// treated as empty, and is created when the first host is recorded.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{path: path, hosts: make(map[string][KeySize]byte)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed line", path, line)
+		}
+		key, err := decodeKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		kh.hosts[fields[0]] = *key
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return kh, nil
+}
+
+// Check verifies key against the key recorded for host. An unknown host is
+// recorded and accepted, unless Strict is set. A mismatch is reported as a
+// *HostKeyError.
+func (kh *KnownHosts) Check(host string, key *[KeySize]byte) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if want, ok := kh.hosts[host]; ok {
+		if want != *key {
+			return &HostKeyError{Host: host, Want: &want, Got: key}
+		}
+		return nil
+	}
+	if kh.Strict {
+		return &HostKeyError{Host: host, Got: key}
+	}
+	if err := kh.append(host, key); err != nil {
+		return err
+	}
+	kh.hosts[host] = *key
+	return nil
+}
+
+// lookup returns the key recorded for host, if any.
+func (kh *KnownHosts) lookup(host string) *[KeySize]byte {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	key, ok := kh.hosts[host]
+	if !ok {
+		return nil
+	}
+	return &key
+}
+
+// rotate records next as the key of host, if prev is still its key, after
+// the host proved that it holds prev and presented next as its new key.
+func (kh *KnownHosts) rotate(host string, prev, next *[KeySize]byte) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if kh.hosts[host] != *prev {
+		return nil
+	}
+	if err := kh.append(host, next); err != nil {
+		return err
+	}
+	kh.hosts[host] = *next
+	return nil
+}
+
+// append records host in the file.
+func (kh *KnownHosts) append(host string, key *[KeySize]byte) error {
+	f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, encodeKey(key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodeKey returns the base64 encoding of key.
+func encodeKey(key *[KeySize]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// decodeKey parses a base64-encoded key.
+func decodeKey(s string) (*[KeySize]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != KeySize {
+		return nil, errors.New("malformed key")
+	}
+	key := new([KeySize]byte)
+	copy(key[:], b)
+	return key, nil
+}
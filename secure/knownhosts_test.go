@@ -0,0 +1,55 @@
+package secure
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sconfig := &Config{Keys: skeys}
+	cconfig := &Config{KnownHosts: kh, ServerName: "example"}
+
+	// The first connection records the server's key.
+	client, _, cerr, serr := handshakePair(cconfig, sconfig)
+	client.Close()
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+
+	// The key is read back from the file, and an impostor is refused.
+	kh, err = LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh.Strict = true
+	cconfig.KnownHosts = kh
+	client, _, cerr, _ = handshakePair(cconfig, sconfig)
+	client.Close()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	client, _, cerr, _ = handshakePair(cconfig, nil)
+	client.Close()
+	var hke *HostKeyError
+	if !errors.As(cerr, &hke) || hke.Want == nil {
+		t.Fatalf("Unexpected error: %v", cerr)
+	}
+
+	// Strict checking refuses unknown hosts.
+	cconfig.ServerName = "other"
+	client, _, cerr, _ = handshakePair(cconfig, sconfig)
+	client.Close()
+	if !errors.As(cerr, &hke) || hke.Want != nil {
+		t.Fatalf("Unexpected error: %v", cerr)
+	}
+}
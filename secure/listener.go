@@ -0,0 +1,257 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SecureListener is a net.Listener whose Accept performs the server side of
+// the key exchange and returns secured connections.
+//
+// Handshakes run concurrently in the background, so a client that stalls
+// during the key exchange does not hold up other clients. A stalled handshake
+// is torn down after the configured HandshakeTimeout.
+type SecureListener struct {
+	net.Listener
+
+	// config is the config of new connections, replaced by SetConfig.
+	config atomic.Pointer[Config]
+
+	// configMu serializes SetConfig and guards the key pair and ticket key
+	// generated for configs without them.
+	configMu     sync.Mutex
+	genKeys      *KeyPair
+	genTicketKey *[KeySize]byte
+
+	start     sync.Once
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// acceptErr is set before failed is closed, once the underlying
+	// listener fails.
+	acceptErr error
+	failed    chan struct{}
+
+	// mu guards pending, the connections still handshaking, and closed.
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+	closed  bool
+
+	// limiter counts the connections open for Config.MaxConns and
+	// Config.MaxConnsPerIP.
+	limiter connLimiter
+
+	// tarpitted counts the connections in the tarpit.
+	tarpitted atomic.Int64
+}
+
+// NewSecureListener wraps l in a SecureListener. If config is nil or has no
+// key pair, a fresh key pair is generated and shared by all connections, and
+// likewise for the ticket key unless session tickets are disabled.
+func NewSecureListener(l net.Listener, config *Config) (*SecureListener, error) {
+	sl := &SecureListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+		pending:  make(map[net.Conn]struct{}),
+	}
+	if err := sl.SetConfig(config); err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// SetConfig replaces the config of the connections the listener accepts
+// from now on, for example to rotate the server's keys or change its
+// AuthorizedKeys. Connections already accepted, or handshaking, keep the
+// config they started with. A key pair or ticket key that the listener
+// generated is kept if config has none, so that clients see the same key
+// and can still resume their sessions.
+func (sl *SecureListener) SetConfig(config *Config) error {
+	sl.configMu.Lock()
+	defer sl.configMu.Unlock()
+	config = config.clone()
+	if config.Keys == nil {
+		if sl.genKeys == nil {
+			// Generate key-pair for public key exchange (handshake)
+			keys, err := GenerateKeyPair()
+			if err != nil {
+				return err
+			}
+			sl.genKeys = keys
+		}
+		config.Keys = sl.genKeys
+	}
+	if config.TicketKey == nil && !config.SessionTicketsDisabled {
+		if sl.genTicketKey == nil {
+			key := new([KeySize]byte)
+			if _, err := rand.Read(key[:]); err != nil {
+				return err
+			}
+			sl.genTicketKey = key
+		}
+		config.TicketKey = sl.genTicketKey
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	sl.config.Store(config)
+	return nil
+}
+
+// Accept waits for the next connection whose key exchange succeeded and
+// returns it as a *SecureConn. Connections whose key exchange fails are
+// closed and skipped.
+func (sl *SecureListener) Accept() (net.Conn, error) {
+	sl.start.Do(func() { go sl.acceptLoop() })
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case <-sl.failed:
+		return nil, sl.acceptErr
+	case <-sl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// acceptLoop accepts connections from the underlying listener and runs a
+// handshake for each of them. Temporary errors, such as running out of file
+// descriptors, are retried with an exponential backoff as net/http does.
+func (sl *SecureListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			if te, ok := err.(interface{ Temporary() bool }); ok && te.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				sl.config.Load().logger().Warn("accept failed, retrying", "err", err, "delay", delay)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-sl.done:
+				}
+			}
+			sl.acceptErr = err
+			close(sl.failed)
+			return
+		}
+		delay = 0
+		config := sl.config.Load()
+		if !config.allowConn(conn) {
+			conn.Close()
+			config.logger().Debug("connection refused by the IP filter", "remote", conn.RemoteAddr().String())
+			continue
+		}
+		limited, ok := sl.limiter.acquire(conn, config)
+		if !ok {
+			conn.Close()
+			config.logger().Debug("connection refused, too many connections", "remote", conn.RemoteAddr().String())
+			continue
+		}
+		go sl.handshake(limited)
+	}
+}
+
+// track records conn as handshaking, or reports false if the listener has
+// already been closed.
+func (sl *SecureListener) track(conn net.Conn) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.closed {
+		return false
+	}
+	sl.pending[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets conn once its handshake is over.
+func (sl *SecureListener) untrack(conn net.Conn) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	delete(sl.pending, conn)
+}
+
+// handshake runs the server side of the key exchange on conn and hands the
+// secured connection to Accept.
+func (sl *SecureListener) handshake(conn net.Conn) {
+	if !sl.track(conn) {
+		conn.Close()
+		return
+	}
+	remote := conn.RemoteAddr()
+	sc, err := sl.secure(conn)
+	if sc != nil {
+		remote = sc.RemoteAddr()
+	}
+	sl.untrack(conn)
+	if errors.Is(err, errBanned) {
+		conn.Close()
+		sl.config.Load().logger().Debug("connection refused, address banned", "remote", remote.String())
+		return
+	}
+	if err != nil {
+		config := sl.config.Load()
+		config.logger().Warn("handshake failed", "remote", remote.String(), "err", err)
+		config.recordFailure(remote)
+		if !errors.Is(err, ErrPeerKeyRejected) || !sl.tarpit(conn, config) {
+			conn.Close()
+		}
+		return
+	}
+	select {
+	case sl.conns <- sc:
+	case <-sl.done:
+		sc.Close()
+	}
+}
+
+// secure reads the PROXY protocol header of conn, if enabled, and runs the
+// server side of the key exchange on it. The returned connection, if not
+// nil, carries the client address of the header even if the key exchange
+// failed.
+func (sl *SecureListener) secure(conn net.Conn) (*SecureConn, error) {
+	config := sl.config.Load()
+	if config.ProxyProtocol {
+		var err error
+		if conn, err = readProxyHeader(conn, config.handshakeTimeout()); err != nil {
+			return nil, err
+		}
+	}
+	sc := Server(conn, config)
+	if config.banned(conn) {
+		return sc, errBanned
+	}
+	return sc, sc.HandshakeContext(context.Background())
+}
+
+// Close closes the underlying listener and any connections still
+// handshaking. Connections already returned by Accept are left open.
+func (sl *SecureListener) Close() error {
+	sl.closeOnce.Do(func() { close(sl.done) })
+
+	sl.mu.Lock()
+	sl.closed = true
+	for conn := range sl.pending {
+		conn.Close()
+	}
+	sl.pending = nil
+	sl.mu.Unlock()
+
+	return sl.Listener.Close()
+}
+
+// PublicKey returns the public key the listener presents to clients.
+func (sl *SecureListener) PublicKey() *[KeySize]byte {
+	return sl.config.Load().Keys.Public
+}
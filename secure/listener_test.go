@@ -0,0 +1,213 @@
+package secure
+
+import (
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecureListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	// A custom server: reply with the message reversed.
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, ok := conn.(*SecureConn); !ok {
+			t.Errorf("Unexpected connection type %T", conn)
+			return
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			buf[i], buf[j] = buf[j], buf[i]
+		}
+		conn.Write(buf[:n])
+	}()
+
+	conn, err := Dial(sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "olleh" {
+		t.Fatalf("Unexpected result: %s != %s", got, "olleh")
+	}
+}
+
+func TestSecureListenerHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, &Config{HandshakeTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Connect but never send our key; the server must hang up on us.
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A stalled client must not hold up others.
+	sc, err := Dial(sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("Unexpected error: %v, expected the server to close the connection", err)
+	}
+}
+
+// temporaryError is a net.Error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestSecureListenerRetriesTemporaryErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(&flakyListener{Listener: l}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go Dial(sl.Addr().String())
+
+	conn, err := sl.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSecureListenerCloseAbortsHandshakes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, &Config{HandshakeTimeout: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sl.Accept()
+
+	// Stall in the handshake, then close the listener under us.
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(conn, key); err != nil {
+		t.Fatal(err)
+	}
+	sl.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("Unexpected error: %v, expected the server to close the connection", err)
+	}
+}
+
+// logLines is an io.Writer that sends each write, one log record, to the
+// channel.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func TestSecureListenerLogsFailedHandshakes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(logLines, 1)
+	logger := slog.New(slog.NewTextHandler(lines, nil))
+	sl, err := NewSecureListener(l, &Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go sl.Accept()
+
+	// A client that hangs up without a hello.
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "level=WARN") || !strings.Contains(line, `msg="handshake failed"`) {
+			t.Fatalf("Unexpected log record: %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unexpected result. The failed handshake was not logged.")
+	}
+}
@@ -0,0 +1,326 @@
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Servers on the local network announce themselves with multicast DNS
+// (RFC 6762) as instances of a DNS-SD service (RFC 6763). Only IPv4 is
+// supported.
+const (
+	mdnsService = "_gochal._tcp.local."
+	mdnsTTL     = 120
+)
+
+// mdnsGroup is the multicast address mDNS queries are sent to.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// LANPeer is a server found on the local network by BrowseLAN.
+type LANPeer struct {
+	// Instance is the name the server announces itself as.
+	Instance string
+
+	// Addr is the address to dial the server at.
+	Addr string
+
+	// Fingerprint is the fingerprint of the public key the server
+	// announces. Anyone on the network can announce anything, so pass it to
+	// ExpectFingerprint only once it is known to be the right one.
+	Fingerprint string
+}
+
+// LANAnnouncer answers the mDNS queries of BrowseLAN for a server.
+type LANAnnouncer struct {
+	pc net.PacketConn
+
+	// instance, service and host are the names of the instance, of the
+	// service it is an instance of and of its host.
+	instance, service, host dnsmessage.Name
+	port                    uint16
+	fingerprint             string
+}
+
+// AnnounceLAN announces a server listening on port, with the public key pub,
+// on the local network as instance until the returned announcer is closed.
+// If instance is empty, the host name is used.
+func AnnounceLAN(instance string, port int, pub *[KeySize]byte) (*LANAnnouncer, error) {
+	pc, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newLANAnnouncer(pc, instance, port, pub)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go a.serve()
+	return a, nil
+}
+
+func newLANAnnouncer(pc net.PacketConn, instance string, port int, pub *[KeySize]byte) (*LANAnnouncer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	// The first label of the host name, as the host is reached as
+	// <label>.local.
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if instance == "" {
+		instance = hostname
+	}
+	a := &LANAnnouncer{pc: pc, port: uint16(port), fingerprint: Fingerprint(pub)}
+	// Dots would split the instance name into several labels.
+	instance = strings.ReplaceAll(instance, ".", "-")
+	if a.instance, err = dnsmessage.NewName(instance + "." + mdnsService); err != nil {
+		return nil, err
+	}
+	if a.service, err = dnsmessage.NewName(mdnsService); err != nil {
+		return nil, err
+	}
+	if a.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close stops answering queries.
+func (a *LANAnnouncer) Close() error {
+	return a.pc.Close()
+}
+
+// serve answers queries until the announcer is closed. Queries from port
+// 5353 come from other mDNS responders and are answered to the multicast
+// group. Others, such as those of BrowseLAN, are answered straight back to
+// the querier, whose source address then tells it the address of the server
+// (RFC 6762, section 6.7).
+func (a *LANAnnouncer) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := a.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var dst net.Addr = src
+		if udp, ok := src.(*net.UDPAddr); ok && udp.Port == mdnsGroup.Port {
+			dst = mdnsGroup
+		}
+		if resp := a.answer(buf[:n], dst != mdnsGroup); resp != nil {
+			a.pc.WriteTo(resp, dst)
+		}
+	}
+}
+
+// answer returns the response to query, or nil if the query is not about
+// the announced instance. A unicast response repeats the questions, as a
+// plain DNS response does.
+func (a *LANAnnouncer) answer(query []byte, unicast bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	asked := false
+	for _, q := range questions {
+		switch {
+		case q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL:
+			asked = asked || strings.EqualFold(q.Name.String(), a.service.String())
+		case q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT:
+			asked = asked || strings.EqualFold(q.Name.String(), a.instance.String())
+		}
+	}
+	if !asked {
+		return nil
+	}
+
+	rhdr := dnsmessage.Header{Response: true, Authoritative: true}
+	if unicast {
+		rhdr.ID = h.ID
+	}
+	b := dnsmessage.NewBuilder(nil, rhdr)
+	b.EnableCompression()
+	b.StartQuestions()
+	if unicast {
+		for _, q := range questions {
+			b.Question(q)
+		}
+	}
+	b.StartAnswers()
+	rh := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+	b.PTRResource(rh(a.service), dnsmessage.PTRResource{PTR: a.instance})
+	b.SRVResource(rh(a.instance), dnsmessage.SRVResource{Target: a.host, Port: a.port})
+	b.TXTResource(rh(a.instance), dnsmessage.TXTResource{TXT: []string{"fp=" + a.fingerprint}})
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+				continue
+			}
+			b.AResource(rh(a.host), dnsmessage.AResource{A: [4]byte(ipnet.IP.To4())})
+		}
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// BrowseLAN queries the local network for the servers announced with
+// AnnounceLAN, and returns those that answered by the time ctx is done,
+// sorted by instance. ctx should have a deadline; a second or two is
+// usually enough.
+func BrowseLAN(ctx context.Context) ([]LANPeer, error) {
+	return browseMDNS(ctx, mdnsGroup)
+}
+
+// browseMDNS sends a query for the service to dst and collects the answers
+// until ctx is done.
+func browseMDNS(ctx context.Context, dst *net.UDPAddr) ([]LANPeer, error) {
+	pc, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	var id [2]byte
+	rand.Read(id[:])
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:])})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.WriteTo(query, dst); err != nil {
+		return nil, err
+	}
+
+	found := make(map[LANPeer]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				return nil, err
+			}
+			break
+		}
+		for _, peer := range parseMDNSResponse(buf[:n], src.IP) {
+			found[peer] = true
+		}
+	}
+	peers := make([]LANPeer, 0, len(found))
+	for peer := range found {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Instance != peers[j].Instance {
+			return peers[i].Instance < peers[j].Instance
+		}
+		return peers[i].Addr < peers[j].Addr
+	})
+	return peers, nil
+}
+
+// parseMDNSResponse returns the instances of the service in resp, sent from
+// ip.
+func parseMDNSResponse(resp []byte, ip net.IP) []LANPeer {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || !h.Response {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	var instances []string
+	ports := make(map[string]uint16)
+	fingerprints := make(map[string]string)
+	// Answers, then authorities and additionals alike.
+	sections := []struct {
+		header func() (dnsmessage.ResourceHeader, error)
+		skip   func() error
+	}{
+		{p.AnswerHeader, p.SkipAnswer},
+		{p.AuthorityHeader, p.SkipAuthority},
+		{p.AdditionalHeader, p.SkipAdditional},
+	}
+	for _, section := range sections {
+		for {
+			rh, err := section.header()
+			if err == dnsmessage.ErrSectionDone {
+				break
+			}
+			if err != nil {
+				return nil
+			}
+			name := strings.ToLower(rh.Name.String())
+			switch rh.Type {
+			case dnsmessage.TypePTR:
+				r, err := p.PTRResource()
+				if err != nil {
+					return nil
+				}
+				if name == mdnsService {
+					instances = append(instances, r.PTR.String())
+				}
+			case dnsmessage.TypeSRV:
+				r, err := p.SRVResource()
+				if err != nil {
+					return nil
+				}
+				ports[name] = r.Port
+			case dnsmessage.TypeTXT:
+				r, err := p.TXTResource()
+				if err != nil {
+					return nil
+				}
+				for _, txt := range r.TXT {
+					if fp, ok := strings.CutPrefix(txt, "fp="); ok {
+						fingerprints[name] = fp
+					}
+				}
+			default:
+				if err := section.skip(); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	var peers []LANPeer
+	for _, instance := range instances {
+		port, ok := ports[strings.ToLower(instance)]
+		if !ok {
+			continue
+		}
+		peers = append(peers, LANPeer{
+			Instance:    strings.TrimSuffix(instance, "."+mdnsService),
+			Addr:        net.JoinHostPort(ip.String(), strconv.Itoa(int(port))),
+			Fingerprint: fingerprints[strings.ToLower(instance)],
+		})
+	}
+	return peers
+}
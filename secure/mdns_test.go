@@ -0,0 +1,65 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBrowseLAN(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Answer on loopback rather than on the multicast group, which the
+	// test machine may not route.
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newLANAnnouncer(pc, "test.server", 4242, keys.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.serve()
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	peers, err := browseMDNS(ctx, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LANPeer{Instance: "test-server", Addr: "127.0.0.1:4242", Fingerprint: Fingerprint(keys.Public)}
+	if len(peers) != 1 || peers[0] != want {
+		t.Fatalf("Unexpected result: %+v", peers)
+	}
+}
+
+func TestLANAnnouncerIgnoresOtherServices(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newLANAnnouncer(nil, "", 4242, keys.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("_http._tcp.local."),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := a.answer(query, true); resp != nil {
+		t.Fatal("Unexpected answer to a query for another service")
+	}
+}
@@ -0,0 +1,118 @@
+package secure
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// lockedKeys hands out keys in memory locked into RAM, so that they are
+// never written to swap. Pages are locked as they are needed and kept for
+// the life of the process, as the keys they hold are reused.
+var lockedKeys keyArena
+
+// lockWarned is set once a failure to lock memory has been logged.
+var lockWarned atomic.Bool
+
+// keyArena carves keys out of locked pages.
+type keyArena struct {
+	mu    sync.Mutex
+	free  []*[KeySize]byte
+	owned map[*[KeySize]byte]bool
+}
+
+// alloc returns a zeroed key in locked memory.
+func (a *keyArena) alloc() (*[KeySize]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.free) == 0 {
+		page, err := lockPages(os.Getpagesize())
+		if err != nil {
+			return nil, err
+		}
+		if a.owned == nil {
+			a.owned = make(map[*[KeySize]byte]bool)
+		}
+		for i := 0; i+KeySize <= len(page); i += KeySize {
+			key := (*[KeySize]byte)(page[i : i+KeySize])
+			a.free = append(a.free, key)
+			a.owned[key] = true
+		}
+	}
+	key := a.free[len(a.free)-1]
+	a.free = a.free[:len(a.free)-1]
+	return key, nil
+}
+
+// release zeroes key and, if it came from the arena, hands it out again.
+// It reports whether it did.
+func (a *keyArena) release(key *[KeySize]byte) bool {
+	zero(key[:])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.owned[key] {
+		return false
+	}
+	a.free = append(a.free, key)
+	return true
+}
+
+// owns reports whether key came from the arena.
+func (a *keyArena) owns(key *[KeySize]byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.owned[key]
+}
+
+// LockKeyPair moves the private key of kp into memory locked into RAM, so
+// that it is never written to swap, and zeroes the copy it was in. Use it
+// for the long-term keys of Config.Keys and Config.PreviousKeys along with
+// Config.LockMemory. The locked memory is never released, and a key pair
+// already locked is left alone. It fails where the platform can't lock
+// memory, or the process may not lock more, as with a low RLIMIT_MEMLOCK,
+// leaving kp as it was.
+func LockKeyPair(kp *KeyPair) error {
+	if lockedKeys.owns(kp.Private) {
+		return nil
+	}
+	key, err := lockedKeys.alloc()
+	if err != nil {
+		return err
+	}
+	*key = *kp.Private
+	zero(kp.Private[:])
+	kp.Private = key
+	return nil
+}
+
+// lockMemory reports whether the config asks for keys in locked memory.
+func (c *Config) lockMemory() bool {
+	return c != nil && c.LockMemory
+}
+
+// copyKey returns a copy of key, in locked memory if the config asks for
+// it. If memory can't be locked, the copy is on the heap, and the first
+// failure is logged.
+func (c *Config) copyKey(key *[KeySize]byte) *[KeySize]byte {
+	if c.lockMemory() {
+		locked, err := lockedKeys.alloc()
+		if err == nil {
+			*locked = *key
+			return locked
+		}
+		if !lockWarned.Swap(true) {
+			c.logger().Warn("keys are not locked in memory", "err", err)
+		}
+	}
+	k := *key
+	return &k
+}
+
+// releaseKey zeroes *key and, if it is in locked memory, returns it to be
+// reused and points *key at zeros on the heap, so that the connection that
+// gets it next can't be reached through *key.
+func releaseKey(key **[KeySize]byte) {
+	if *key != nil && lockedKeys.release(*key) {
+		*key = new([KeySize]byte)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package secure
+
+import "errors"
+
+var errMemLockUnsupported = errors.New("secure: locking memory is not supported on this platform")
+
+// lockPages fails, as the platform can't lock memory.
+func lockPages(n int) ([]byte, error) {
+	return nil, errMemLockUnsupported
+}
@@ -0,0 +1,63 @@
+package secure
+
+import (
+	"testing"
+)
+
+func TestLockKeyPair(t *testing.T) {
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, want := kp.Private, *kp.Private
+	if err := LockKeyPair(kp); err != nil {
+		t.Skipf("Cannot lock memory: %v", err)
+	}
+	if *kp.Private != want {
+		t.Fatal("Unexpected result. The locked key differs.")
+	}
+	if *old != ([KeySize]byte{}) {
+		t.Fatal("Unexpected result. The unlocked copy was not zeroed.")
+	}
+	locked := kp.Private
+	if err := LockKeyPair(kp); err != nil || kp.Private != locked {
+		t.Fatalf("Unexpected result. Locking again moved the key: %v", err)
+	}
+}
+
+func TestLockMemory(t *testing.T) {
+	probe, err := lockedKeys.alloc()
+	if err != nil {
+		t.Skipf("Cannot lock memory: %v", err)
+	}
+	lockedKeys.release(probe)
+	config := &Config{LockMemory: true}
+	client, server, cerr, serr := handshakePair(config, config)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer server.Close()
+	keys := []*[KeySize]byte{client.sr.key, client.sw.key, client.sr.priv, client.session.sendKey, client.session.recvKey}
+	lockedKeys.mu.Lock()
+	for _, key := range keys {
+		if !lockedKeys.owned[key] {
+			t.Error("Unexpected result. A key is not in locked memory.")
+		}
+	}
+	lockedKeys.mu.Unlock()
+
+	go server.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := client.Read(buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Unexpected result: %q, %v", buf, err)
+	}
+	client.Close()
+	for _, key := range keys {
+		if *key != ([KeySize]byte{}) {
+			t.Fatal("Unexpected result. A locked key survived Close.")
+		}
+	}
+	if lockedKeys.owned[client.sr.key] {
+		t.Fatal("Unexpected result. The reader still points at a released key.")
+	}
+}
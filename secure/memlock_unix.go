@@ -0,0 +1,22 @@
+//go:build unix
+
+package secure
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPages maps n bytes of anonymous memory and locks them into RAM.
+func lockPages(n int) ([]byte, error) {
+	b, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("secure: mmap: %v", err)
+	}
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		return nil, fmt.Errorf("secure: mlock: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package secure
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockPages locks n bytes of page-aligned memory into RAM. The memory is
+// on the Go heap, which doesn't move it, and is never freed, as the arena
+// keeps it.
+func lockPages(n int) ([]byte, error) {
+	b := make([]byte, 2*n)
+	off := n - int(uintptr(unsafe.Pointer(&b[0]))%uintptr(n))
+	page := b[off : off+n]
+	if err := windows.VirtualLock(uintptr(unsafe.Pointer(&page[0])), uintptr(n)); err != nil {
+		return nil, fmt.Errorf("secure: VirtualLock: %v", err)
+	}
+	return page, nil
+}
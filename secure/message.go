@@ -0,0 +1,29 @@
+package secure
+
+import (
+	"io"
+)
+
+// MessageConn is a secure connection that, in addition to the stream-oriented
+// io.ReadWriteCloser methods, preserves message boundaries end to end.
+//
+// Each WriteMessage call is delivered by exactly one ReadMessage call on the
+// peer, however the message was split into frames on the wire. Mixing Read
+// and ReadMessage is allowed: ReadMessage then returns the unread remainder
+// of the current message.
+type MessageConn interface {
+	io.ReadWriteCloser
+
+	// ReadMessage reads the next complete message.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage writes p as a single message. An empty p is delivered
+	// to the peer as an empty message.
+	WriteMessage(p []byte) error
+}
+
+// NewMessageConn instantiates a new MessageConn over rwc using the given
+// private key and the peer's public key. Both directions share one key.
+func NewMessageConn(rwc io.ReadWriteCloser, priv, pub *[KeySize]byte) MessageConn {
+	return newSharedSession(priv, pub).MessageConn(rwc)
+}
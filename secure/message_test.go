@@ -0,0 +1,80 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// pipeConn joins a reader and writer into an io.ReadWriteCloser.
+type pipeConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeConn) Close() error { return nil }
+
+// messagePair returns two MessageConns, a writing to b through buf.
+func messagePair(t *testing.T, buf *bytes.Buffer) (a, b MessageConn) {
+	akeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = NewMessageConn(pipeConn{buf, buf}, akeys.Private, bkeys.Public)
+	b = NewMessageConn(pipeConn{buf, buf}, bkeys.Private, akeys.Public)
+	return a, b
+}
+
+func TestMessageBoundaries(t *testing.T) {
+	var buf bytes.Buffer
+	mc, peer := messagePair(t, &buf)
+
+	large := make([]byte, 2*DefaultMaxFrameSize+1)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	msgs := [][]byte{[]byte("hello"), {}, large, []byte("world")}
+	for _, m := range msgs {
+		if err := mc.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range msgs {
+		got, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Unexpected message %d: got %d bytes, expected %d", i, len(got), len(want))
+		}
+	}
+	if _, err := peer.ReadMessage(); err != io.EOF {
+		t.Fatalf("Unexpected error: %v != %v", err, io.EOF)
+	}
+}
+
+func TestMessageAfterPartialRead(t *testing.T) {
+	var buf bytes.Buffer
+	mc, peer := messagePair(t, &buf)
+	if err := mc.WriteMessage([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 6)
+	if _, err := io.ReadFull(peer, p); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "world" {
+		t.Fatalf("Unexpected result: %q != %q", rest, "world")
+	}
+}
@@ -0,0 +1,193 @@
+package secure
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+// With Config.Noise set, the ends authenticate each other with a handshake
+// of the Noise protocol framework (https://noiseprotocol.org) instead of
+// swapping their public keys in the clear. Each first sends a Noise hello,
+// after the preamble, carrying what the ends must agree on besides keys:
+// the frame size, the cipher suites and, from the client, the Noise
+// pattern. The transcript of the hellos is the prologue of the Noise
+// handshake, so an attacker who alters them makes it fail. The messages of
+// the Noise handshake follow, each carried in a Noise message, and the
+// keys it ends with are the session keys, used to seal frames as usual.
+
+// NoisePattern is a handshake pattern of the Noise protocol framework, run
+// with X25519, ChaCha20-Poly1305 and SHA-256.
+type NoisePattern uint8
+
+const (
+	// NoiseNone runs the package's own handshake.
+	NoiseNone NoisePattern = iota
+
+	// NoiseXX authenticates both ends without either knowing the other's
+	// key beforehand, and hides both public keys from eavesdroppers.
+	NoiseXX
+
+	// NoiseIK is for clients that already know the server's public key,
+	// from their KnownHosts: it takes one round trip less than NoiseXX and
+	// only the server can learn the client's key. Clients that don't know
+	// the server's key use NoiseXX.
+	NoiseIK
+)
+
+// noiseCipherSuite is the cipher suite of the Noise handshakes.
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+var errNoiseIdentity = errors.New("secure: identities are not supported with Noise handshakes")
+
+func (p NoisePattern) String() string {
+	switch p {
+	case NoiseNone:
+		return "none"
+	case NoiseXX:
+		return "XX"
+	case NoiseIK:
+		return "IK"
+	}
+	return fmt.Sprintf("NoisePattern(%d)", uint8(p))
+}
+
+// MarshalText returns the name of the pattern, as String does.
+func (p NoisePattern) MarshalText() ([]byte, error) {
+	if p > NoiseIK {
+		return nil, fmt.Errorf("secure: unknown Noise pattern %d", uint8(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText sets p to the pattern named by text, as String names it.
+func (p *NoisePattern) UnmarshalText(text []byte) error {
+	for _, pattern := range []NoisePattern{NoiseNone, NoiseXX, NoiseIK} {
+		if string(text) == pattern.String() {
+			*p = pattern
+			return nil
+		}
+	}
+	return fmt.Errorf("secure: unknown Noise pattern %q", text)
+}
+
+// handshakePattern returns the Noise handshake pattern of p.
+func (p NoisePattern) handshakePattern() noise.HandshakePattern {
+	if p == NoiseIK {
+		return noise.HandshakeIK
+	}
+	return noise.HandshakeXX
+}
+
+// runNoise runs a Noise handshake, with the pattern the client asks for.
+// serverKey is the key the client expects the server to have, if it knows
+// one.
+func (hs *handshakeState) runNoise(serverKey *[KeySize]byte) (*Session, error) {
+	if hs.config.identity() != nil || hs.config.PeerIdentity != nil {
+		return nil, errNoiseIdentity
+	}
+	hello := hs.hello()
+	delete(hello, fieldPublicKey)
+	helloType, peerHelloType := msgServerNoiseHello, msgClientNoiseHello
+	pattern := hs.config.noise()
+	if hs.role == ClientRole {
+		helloType, peerHelloType = peerHelloType, helloType
+		if pattern == NoiseIK && serverKey == nil {
+			pattern = NoiseXX
+		}
+		hello[fieldNoisePattern] = []byte{byte(pattern)}
+	}
+	raw := append(preamble(), hello.marshal(helloType)...)
+	peerHello, peerRaw, err := hs.exchange(raw, peerHelloType)
+	if err != nil {
+		return nil, err
+	}
+	if hs.role == ServerRole {
+		v := peerHello[fieldNoisePattern]
+		if len(v) != 1 || (NoisePattern(v[0]) != NoiseXX && NoisePattern(v[0]) != NoiseIK) {
+			return nil, errMalformedHandshake
+		}
+		pattern = NoisePattern(v[0])
+	}
+	if err := hs.negotiateMaxFrame(peerHello); err != nil {
+		return nil, err
+	}
+	hs.negotiateCompression(peerHello)
+	if err := hs.negotiateSuite(peerHello); err != nil {
+		return nil, err
+	}
+	transcript := sha256.New()
+	if hs.role == ClientRole {
+		transcript.Write(peerRaw)
+		transcript.Write(raw)
+	} else {
+		transcript.Write(raw)
+		transcript.Write(peerRaw)
+	}
+
+	nc := noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Pattern:       pattern.handshakePattern(),
+		Initiator:     hs.role == ClientRole,
+		Prologue:      transcript.Sum(nil),
+		StaticKeypair: noise.DHKey{Private: hs.keys.Private[:], Public: hs.keys.Public[:]},
+	}
+	if hs.role == ClientRole && pattern == NoiseIK {
+		nc.PeerStatic = serverKey[:]
+	}
+	ns, err := noise.NewHandshakeState(nc)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c, err := hs.noiseMessages(ns, len(nc.Pattern.Messages))
+	if err != nil {
+		return nil, err
+	}
+
+	peer := new([KeySize]byte)
+	copy(peer[:], ns.PeerStatic())
+	priv := *hs.keys.Private
+	sendKey, recvKey := c2s.UnsafeKey(), s2c.UnsafeKey()
+	if hs.role == ServerRole {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	return &Session{
+		LocalPublicKey: hs.keys.Public,
+		PeerPublicKey:  peer,
+		MaxFrameSize:   hs.maxFrame,
+		MaxMessageSize: hs.maxMessage,
+		Version:        hs.version,
+		CipherSuite:    hs.suite,
+		Compression:    hs.compression,
+		sendKey:        &sendKey,
+		recvKey:        &recvKey,
+		priv:           &priv,
+	}, nil
+}
+
+// noiseMessages sends and reads the n messages of the Noise handshake ns,
+// which starts with the client, and returns the cipher states it ends with.
+func (hs *handshakeState) noiseMessages(ns *noise.HandshakeState, n int) (c2s, s2c *noise.CipherState, err error) {
+	for i := range n {
+		if (i%2 == 0) == (hs.role == ClientRole) {
+			var msg []byte
+			if msg, c2s, s2c, err = ns.WriteMessage(nil, nil); err != nil {
+				return nil, nil, err
+			}
+			if err := writeFull(hs.rw, handshakeMessage{fieldNoise: msg}.marshal(msgNoise)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		m, _, err := readHandshakeMessage(hs.rw, msgNoise)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, c2s, s2c, err = ns.ReadMessage(nil, m[fieldNoise]); err != nil {
+			return nil, nil, fmt.Errorf("secure: Noise handshake failed: %w", err)
+		}
+	}
+	return c2s, s2c, nil
+}
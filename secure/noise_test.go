@@ -0,0 +1,165 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// noisePair runs a Noise handshake between a client knowing the hosts in kh
+// and a server with keys, and returns the client's session along with the
+// errors of both ends.
+func noisePair(t *testing.T, pattern NoisePattern, kh *KnownHosts, keys *KeyPair) (*SecureConn, error, error) {
+	t.Helper()
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server, cerr, serr := handshakePair(
+		&Config{Keys: ckeys, Noise: pattern, KnownHosts: kh, ServerName: "server", RekeyBytes: 1000},
+		&Config{Keys: keys, Noise: NoiseXX})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	if cerr != nil || serr != nil {
+		return client, cerr, serr
+	}
+	if *server.session.PeerPublicKey != *ckeys.Public || *client.session.PeerPublicKey != *keys.Public {
+		t.Fatal("Unexpected result. The peers learnt the wrong keys.")
+	}
+	// Messages make it across rekeys.
+	msg := bytes.Repeat([]byte("x"), 3000)
+	for range 3 {
+		go client.WriteMessage(msg)
+		got, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("Unexpected result. The message was corrupted.")
+		}
+	}
+	return client, nil, nil
+}
+
+func TestNoise(t *testing.T) {
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []NoisePattern{NoiseXX, NoiseIK} {
+		t.Run(pattern.String(), func(t *testing.T) {
+			kh, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := kh.Check("server", skeys.Public); err != nil {
+				t.Fatal(err)
+			}
+			if _, cerr, serr := noisePair(t, pattern, kh, skeys); cerr != nil || serr != nil {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+		})
+	}
+}
+
+func TestNoiseIKUnknownServer(t *testing.T) {
+	// A client that doesn't know the server's key falls back to XX, and
+	// learns the key.
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, cerr, serr := noisePair(t, NoiseIK, kh, skeys); cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	if key := kh.lookup("server"); key == nil || *key != *skeys.Public {
+		t.Fatal("Unexpected result. The server's key was not recorded.")
+	}
+}
+
+func TestNoiseIKWrongServerKey(t *testing.T) {
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Check("server", other.Public); err != nil {
+		t.Fatal(err)
+	}
+	// The server can't read the IK message sealed to another key, so the
+	// handshake fails before the client's key is revealed to it.
+	_, cerr, serr := noisePair(t, NoiseIK, kh, skeys)
+	var hkErr *HostKeyError
+	if cerr == nil || serr == nil || errors.As(cerr, &hkErr) {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+}
+
+func TestNoiseWithoutNoisePeer(t *testing.T) {
+	noise := &Config{Noise: NoiseXX}
+	for _, tc := range []struct {
+		name             string
+		cconfig, sconfig *Config
+	}{
+		{"client", noise, nil},
+		{"server", nil, noise},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, cerr, serr := handshakePair(tc.cconfig, tc.sconfig)
+			defer client.Close()
+			defer server.Close()
+			if cerr == nil || serr == nil {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+		})
+	}
+}
+
+func TestNoiseIdentity(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server, cerr, _ := handshakePair(&Config{Noise: NoiseXX, Identity: priv}, &Config{Noise: NoiseXX})
+	defer client.Close()
+	defer server.Close()
+	if !errors.Is(cerr, errNoiseIdentity) {
+		t.Fatalf("Unexpected error: %v", cerr)
+	}
+}
+
+func TestNoisePatternText(t *testing.T) {
+	for _, pattern := range []NoisePattern{NoiseNone, NoiseXX, NoiseIK} {
+		text, err := pattern.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got NoisePattern
+		if err := got.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if got != pattern {
+			t.Fatalf("Unexpected result: %v, expected %v", got, pattern)
+		}
+	}
+	var p NoisePattern
+	if err := p.UnmarshalText([]byte("NN")); err == nil {
+		t.Fatal("Unexpected result. Parsed an unknown pattern.")
+	}
+}
@@ -0,0 +1,108 @@
+package secure
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// Obfuscator disguises the traffic of secure connections, so that networks
+// that block protocols by recognizing their bytes on the wire can't tell
+// this one apart. It wraps the underlying connection before the handshake,
+// and everything the connection sends, handshake and frames alike, goes
+// through the wrapper, as it would through a pluggable transport such as
+// obfs4. Both ends must use the same Obfuscator.
+//
+// The secure connection does not rely on the Obfuscator for secrecy or
+// integrity, so an Obfuscator only needs to make the traffic look like
+// something else.
+type Obfuscator interface {
+	// Obfuscate returns a connection that carries data over conn in
+	// disguise, for the end of the connection given by role. Closing conn
+	// must stop the returned connection's reads and writes.
+	Obfuscate(conn net.Conn, role Role) (net.Conn, error)
+}
+
+// NewKeyedObfuscator returns an Obfuscator that XORs everything sent over
+// the connection with an XChaCha20 key stream under key and a random nonce
+// sent ahead of it, so that the traffic is indistinguishable from random
+// bytes to anyone who doesn't hold key: the preamble and the clear-text
+// frame lengths no longer show. Keep key secret, for example by
+// distributing it along with the server's address, as obfs4 bridges do.
+// The sizes and timing of packets are not disguised; PaddingBuckets hides
+// the former.
+func NewKeyedObfuscator(key *[KeySize]byte) Obfuscator {
+	return &keyedObfuscator{key: *key}
+}
+
+type keyedObfuscator struct {
+	key [KeySize]byte
+}
+
+func (o *keyedObfuscator) Obfuscate(conn net.Conn, role Role) (net.Conn, error) {
+	return &keyedConn{Conn: conn, key: &o.key}, nil
+}
+
+// keyedConn is a connection obfuscated by a keyedObfuscator. Each direction
+// starts with the nonce of its key stream.
+type keyedConn struct {
+	net.Conn
+	key *[KeySize]byte
+
+	rmu sync.Mutex
+	r   *chacha20.Cipher
+
+	wmu sync.Mutex
+	w   *chacha20.Cipher
+}
+
+func (c *keyedConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.r == nil {
+		nonce := make([]byte, chacha20.NonceSizeX)
+		if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+			return 0, err
+		}
+		c.r = c.cipher(nonce)
+	}
+	n, err := c.Conn.Read(p)
+	c.r.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *keyedConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var out []byte
+	if c.w == nil {
+		nonce := make([]byte, chacha20.NonceSizeX, chacha20.NonceSizeX+len(p))
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return 0, err
+		}
+		c.w = c.cipher(nonce)
+		out = nonce
+	}
+	start := len(out)
+	out = append(out, p...)
+	c.w.XORKeyStream(out[start:], out[start:])
+	if err := writeFull(c.Conn, out); err != nil {
+		// The key stream has moved on past bytes the peer may not have
+		// received, so the connection can't be used any more.
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// cipher returns the XChaCha20 cipher with the key and nonce.
+func (c *keyedConn) cipher(nonce []byte) *chacha20.Cipher {
+	s, err := chacha20.NewUnauthenticatedCipher(c.key[:], nonce)
+	if err != nil {
+		// Only possible with a key or nonce of the wrong size.
+		panic(err)
+	}
+	return s
+}
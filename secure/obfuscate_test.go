@@ -0,0 +1,51 @@
+package secure
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// recordingConn records what is written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+func TestKeyedObfuscator(t *testing.T) {
+	key := new([KeySize]byte)
+	key[0] = 1
+	config := &Config{Obfuscator: NewKeyedObfuscator(key)}
+	c1, c2 := net.Pipe()
+	rec := &recordingConn{Conn: c1}
+	client, server := Client(rec, config), Server(c2, config)
+	defer client.Close()
+	defer server.Close()
+
+	msg := []byte("hello, world")
+	go client.WriteMessage(msg)
+	got, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+	if bytes.Contains(rec.written.Bytes(), protocolMagic[:]) {
+		t.Fatal("Unexpected result. The preamble shows on the wire.")
+	}
+
+	// Peers with another key can't complete the handshake.
+	other := new([KeySize]byte)
+	client, server, cerr, serr := handshakePair(config, &Config{Obfuscator: NewKeyedObfuscator(other)})
+	defer client.Close()
+	defer server.Close()
+	if cerr == nil || serr == nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+}
@@ -0,0 +1,76 @@
+package secure
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// A writer with Config.PaddingBuckets pads the plaintext of every frame it
+// seals, data and control frames alike, as
+//
+//	kind | framePadded (1 byte) | length (4 bytes, big-endian) | payload | zeros
+//
+// where length is that of the payload, so that the sealed frame has one of
+// a few sizes. Readers always remove padding, so only the sender needs to
+// ask for it.
+const (
+	// framePadded is set in the kind of a padded frame.
+	framePadded byte = 0x80
+
+	// paddingHeaderSize is the size of the payload length of a padded
+	// frame.
+	paddingHeaderSize = 4
+)
+
+// paddingBuckets returns the padding buckets of the config, in increasing
+// order, without the ones that are not positive.
+func (c *Config) paddingBuckets() []int {
+	if c == nil || len(c.PaddingBuckets) == 0 {
+		return nil
+	}
+	buckets := slices.DeleteFunc(slices.Clone(c.PaddingBuckets), func(b int) bool { return b <= 0 })
+	if len(buckets) == 0 {
+		return nil
+	}
+	slices.Sort(buckets)
+	return buckets
+}
+
+// paddedSize returns the size a plaintext of n bytes is padded to: the
+// smallest bucket it fits in, or else the next multiple of the largest
+// bucket, but no more than limit.
+func paddedSize(n int, buckets []int, limit int) int {
+	for _, b := range buckets {
+		if b >= n {
+			return max(min(b, limit), n)
+		}
+	}
+	largest := buckets[len(buckets)-1]
+	return max(min((n+largest-1)/largest*largest, limit), n)
+}
+
+// pad fills plain, of the size paddedSize gives, with the plaintext of a
+// frame of the given kind carrying p, padded with zeros.
+func pad(plain []byte, kind byte, p []byte) {
+	plain[0] = kind | framePadded
+	binary.BigEndian.PutUint32(plain[1:], uint32(len(p)))
+	n := copy(plain[1+paddingHeaderSize:], p)
+	clear(plain[1+paddingHeaderSize+n:])
+}
+
+// unpad returns the plaintext of a frame without its padding, if any.
+func unpad(plain []byte) ([]byte, error) {
+	if len(plain) == 0 || plain[0]&framePadded == 0 {
+		return plain, nil
+	}
+	if len(plain) < 1+paddingHeaderSize {
+		return nil, &FrameError{Reason: "bad padding"}
+	}
+	n := binary.BigEndian.Uint32(plain[1:])
+	if uint64(n) > uint64(len(plain)-1-paddingHeaderSize) {
+		return nil, &FrameError{Reason: "bad padding"}
+	}
+	// Move the kind next to the payload.
+	plain[paddingHeaderSize] = plain[0] &^ framePadded
+	return plain[paddingHeaderSize : 1+paddingHeaderSize+int(n)], nil
+}
@@ -0,0 +1,78 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestPadding(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	config := &Config{PaddingBuckets: []int{1024, 0, 256}, MaxFrameSize: 4096}
+	s := newSharedSession(keys.Private, keys.Public)
+	s.MaxFrameSize = config.maxFrameSize()
+	sr, sw := s.newReadWriter(&buf, &buf, config)
+
+	msgs := [][]byte{nil, []byte("x"), bytes.Repeat([]byte("y"), 300), bytes.Repeat([]byte("z"), 10000)}
+	for _, msg := range msgs {
+		if _, err := sw.writeMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every frame is padded to a bucket, a multiple of the largest, or the
+	// frame size.
+	sizes := map[int]bool{256: true, 1024: true, 2048: true, 3072: true, 4096: true, 1 + 4096: true}
+	for b := buf.Bytes(); len(b) > 0; {
+		length := int(binary.BigEndian.Uint32(b))
+		if !sizes[length-box.Overhead] {
+			t.Fatalf("Unexpected frame of %d bytes of plaintext", length-box.Overhead)
+		}
+		b = b[headerSize+length:]
+	}
+
+	for _, want := range msgs {
+		got, err := sr.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Unexpected result: %d bytes, expected %d", len(got), len(want))
+		}
+	}
+}
+
+func TestPaddedSize(t *testing.T) {
+	buckets := []int{100, 500}
+	for _, tc := range []struct{ n, want int }{
+		{1, 100},
+		{100, 100},
+		{101, 500},
+		{501, 1000},
+		{1200, 1500},
+		{1900, 2000},
+		{1999, 2000},
+		{2001, 2048},
+	} {
+		if got := paddedSize(tc.n, buckets, 2048); got != tc.want {
+			t.Errorf("paddedSize(%d) = %d, expected %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestUnpadMalformed(t *testing.T) {
+	for _, plain := range [][]byte{
+		{frameFinal | framePadded, 0, 0},
+		{frameFinal | framePadded, 0, 0, 0, 2, 'x'},
+	} {
+		if _, err := unpad(plain); err == nil {
+			t.Fatalf("Unexpected result. Unpadded %x.", plain)
+		}
+	}
+}
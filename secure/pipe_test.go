@@ -0,0 +1,33 @@
+package secure
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	client, server := Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.WriteMessage([]byte("ping"))
+	msg, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.WriteMessage(append(msg, '!'))
+	if msg, err = client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "ping!" {
+		t.Fatalf("Unexpected result: %s != %s", msg, "ping!")
+	}
+
+	// Either end may refuse the other.
+	if _, _, err := PipeWithConfig(nil, &Config{AuthorizedKeys: NewAuthorizedKeys()}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := PipeWithConfig(&Config{Authorizer: ExpectFingerprint("nope")}, nil); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPoolSize is the number of connections a Pool keeps ready when
+	// Pool.Size is zero.
+	DefaultPoolSize = 2
+
+	// DefaultPoolMaxIdle is how long a Pool keeps a connection unused when
+	// Pool.MaxIdle is zero. It is well below DefaultIdleTimeout, after which
+	// a SecureServer closes the connection.
+	DefaultPoolMaxIdle = time.Minute
+
+	// poolCheckAfter is how long a connection may have been idle before Get
+	// pings it to make sure it still works.
+	poolCheckAfter = time.Second
+
+	// poolPingTimeout bounds the wait for that ping's answer.
+	poolPingTimeout = 5 * time.Second
+)
+
+// Pool keeps connections to a server handshaken and ready to use, so that
+// short exchanges don't each pay for a handshake. It dials Size connections
+// in the background as soon as it is first used, and again whenever Get
+// takes one, and replaces those left unused for MaxIdle. Connections that
+// have been idle for a while are pinged before Get returns them, and
+// dropped if they don't answer.
+//
+// Return connections with Put once the exchange is over, with no reply left
+// unread. The server must be reading from its connections to answer the
+// pings, as a Handler waiting for the next request is. A Pool is safe for
+// concurrent use, and must not be copied after first use.
+type Pool struct {
+	// Addr is the address of the server, and Config the config its
+	// connections are dialed with, as DialWithConfig takes them.
+	Addr   string
+	Config *Config
+
+	// Size is the number of idle connections kept ready. Zero means
+	// DefaultPoolSize.
+	Size int
+
+	// MaxIdle is how long an idle connection is kept before it is closed
+	// and replaced. Zero means DefaultPoolMaxIdle.
+	MaxIdle time.Duration
+
+	start  sync.Once
+	refill chan struct{}
+
+	// ctx is canceled, with cancel, once the pool is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards idle, the connections ready to be handed out with the time
+	// they became idle, and closed.
+	mu     sync.Mutex
+	idle   []pooledConn
+	closed bool
+}
+
+// pooledConn is an idle connection of a Pool.
+type pooledConn struct {
+	conn  *SecureConn
+	since time.Time
+}
+
+func (p *Pool) size() int {
+	if p.Size <= 0 {
+		return DefaultPoolSize
+	}
+	return p.Size
+}
+
+func (p *Pool) maxIdle() time.Duration {
+	if p.MaxIdle <= 0 {
+		return DefaultPoolMaxIdle
+	}
+	return p.MaxIdle
+}
+
+// init starts filling the pool.
+func (p *Pool) init() {
+	p.start.Do(func() {
+		p.refill = make(chan struct{}, 1)
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+		go p.maintain()
+	})
+}
+
+// Get returns a connection to the server, an idle one if any still works,
+// or else a new one.
+func (p *Pool) Get(ctx context.Context) (*SecureConn, error) {
+	p.init()
+	defer p.wake()
+	for {
+		pc, ok := p.take()
+		if !ok {
+			break
+		}
+		if time.Since(pc.since) < poolCheckAfter || ping(ctx, pc.conn) {
+			return pc.conn, nil
+		}
+		pc.conn.Close()
+	}
+	if p.isClosed() {
+		return nil, net.ErrClosed
+	}
+	return DialWithConfig(ctx, p.Addr, p.Config)
+}
+
+// Put returns conn to the pool once it is no longer used. If the pool
+// already has Size idle connections, or is closed, conn is closed instead.
+// Close connections that failed rather than putting them back.
+func (p *Pool) Put(conn *SecureConn) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.size() {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledConn{conn: conn, since: time.Now()})
+}
+
+// Close closes the idle connections and stops dialing new ones.
+// Connections handed out by Get are left open; Put closes them.
+func (p *Pool) Close() error {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	p.cancel()
+	for _, pc := range p.idle {
+		pc.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+// take removes and returns the connection that became idle last.
+func (p *Pool) take() (pooledConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return pooledConn{}, false
+	}
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return pc, true
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// wake makes maintain fill the pool again.
+func (p *Pool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// maintain keeps the pool filled and replaces the connections idle for
+// longer than MaxIdle, until the pool is closed. After a failed dial it
+// waits for the next tick or Get before trying again.
+func (p *Pool) maintain() {
+	tick := time.NewTicker(p.maxIdle() / 2)
+	defer tick.Stop()
+	for {
+		p.evict()
+		p.fill()
+		select {
+		case <-tick.C:
+		case <-p.refill:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// evict closes the connections idle for longer than MaxIdle.
+func (p *Pool) evict() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if time.Since(pc.since) > p.maxIdle() {
+			pc.conn.Close()
+			continue
+		}
+		kept = append(kept, pc)
+	}
+	clear(p.idle[len(kept):])
+	p.idle = kept
+}
+
+// fill dials connections until Size are idle.
+func (p *Pool) fill() {
+	for {
+		p.mu.Lock()
+		full := p.closed || len(p.idle) >= p.size()
+		p.mu.Unlock()
+		if full {
+			return
+		}
+		conn, err := DialWithConfig(p.ctx, p.Addr, p.Config)
+		if err != nil {
+			if p.ctx.Err() == nil {
+				p.Config.logger().Warn("pool dial failed", "addr", p.Addr, "err", err)
+			}
+			return
+		}
+		p.Put(conn)
+	}
+}
+
+// ping reports whether conn answers a ping. An idle connection receives no
+// messages, so one arriving means conn is out of step and can't be used.
+func ping(ctx context.Context, conn *SecureConn) bool {
+	ctx, cancel := context.WithTimeout(ctx, poolPingTimeout)
+	defer cancel()
+
+	// The answer is only noticed while reading.
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		read <- err
+	}()
+	_, err := conn.Ping(ctx)
+	conn.SetReadDeadline(time.Unix(1, 0))
+	readErr := <-read
+	conn.SetReadDeadline(time.Time{})
+	ne, ok := readErr.(net.Error)
+	return err == nil && ok && ne.Timeout()
+}
@@ -0,0 +1,112 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// idleConns returns the idle connections of p once it has n of them.
+func idleConns(t *testing.T, p *Pool, n int) []*SecureConn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		var conns []*SecureConn
+		for _, pc := range p.idle {
+			conns = append(conns, pc.conn)
+		}
+		p.mu.Unlock()
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The pool has %d idle connections, not %d", len(conns), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	p := &Pool{Addr: l.Addr().String(), Size: 2}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RoundTrip(context.Background(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("Unexpected result: %s", reply)
+	}
+	p.Put(conn)
+
+	// The pool keeps two connections, and Get hands out a warm one.
+	warm := idleConns(t, p, 2)
+	conn, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != warm[0] && conn != warm[1] {
+		t.Fatal("Get dialed a new connection")
+	}
+	p.Put(conn)
+
+	// Broken connections fail the health check, and are replaced.
+	warm = idleConns(t, p, 2)
+	p.mu.Lock()
+	for i := range p.idle {
+		p.idle[i].conn.NetConn().Close()
+		p.idle[i].since = time.Now().Add(-poolCheckAfter)
+	}
+	p.mu.Unlock()
+	conn, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == warm[0] || conn == warm[1] {
+		t.Fatal("Get returned a dead connection")
+	}
+	if _, err := conn.RoundTrip(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(conn)
+
+	p.Close()
+	if _, err := p.Get(context.Background()); err != net.ErrClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPoolEvictsIdleConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	p := &Pool{Addr: l.Addr().String(), Size: 1, MaxIdle: 50 * time.Millisecond}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	first := idleConns(t, p, 1)[0]
+	time.Sleep(200 * time.Millisecond)
+	if idleConns(t, p, 1)[0] == first {
+		t.Fatal("The idle connection was not replaced")
+	}
+}
@@ -0,0 +1,150 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+// lets a load balancer pass on the address of the client it accepted a
+// connection from, in a header sent ahead of the client's bytes.
+const (
+	// proxyV1Prefix starts a version 1 header, a line of text at most
+	// maxProxyV1Line bytes long.
+	proxyV1Prefix  = "PROXY "
+	maxProxyV1Line = 107
+
+	// proxyV2Signature starts a version 2 header, which is binary.
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+var errMalformedProxyHeader = errors.New("secure: malformed PROXY protocol header")
+
+// proxyConn is a connection whose remote address is the client address of
+// its PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY protocol header of either version that
+// conn may start with. It returns conn, with the client address of the
+// header as its remote address if there is one. timeout, if not zero, bounds
+// the time to read the header.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr()}
+
+	// The first byte of a client hello is neither 'P' nor '\r', so a
+	// client speaking directly is told apart without waiting for more.
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		remote, err = readProxyV1(pc.r)
+	case proxyV2Signature[0]:
+		remote, err = readProxyV2(pc.r)
+	default:
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		pc.remote = remote
+	}
+	return pc, nil
+}
+
+// readProxyV1 reads a version 1 header and returns the client address it
+// names, or nil for an UNKNOWN connection.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Line {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok || !strings.HasPrefix(s, proxyV1Prefix) {
+		return nil, errMalformedProxyHeader
+	}
+	fields := strings.Fields(s)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errMalformedProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errMalformedProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a version 2 header and returns the client address it
+// names, or nil for a LOCAL connection or an address family other than
+// TCP over IPv4 or IPv6.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], []byte(proxyV2Signature)) || hdr[12]>>4 != 2 {
+		return nil, errMalformedProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 {
+		// LOCAL: the proxy's own connection, such as a health check.
+		return nil, nil
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// Source and destination addresses, then source and destination ports.
+	if len(body) < 2*ipLen+4 {
+		return nil, errMalformedProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,105 @@
+package secure
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, body ...byte) string {
+		return proxyV2Signature + string([]byte{0x20 | cmd, family, 0, byte(len(body))}) + string(body)
+	}
+	for _, tc := range []struct {
+		name, header, remote string
+		wantErr              bool
+	}{
+		{name: "none", remote: "pipe"},
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 4242 443\r\n", remote: "192.0.2.1:4242"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 4242 443\r\n", remote: "[2001:db8::1]:4242"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n", remote: "pipe"},
+		{name: "v1 malformed", header: "PROXY TCP4 192.0.2.1\r\n", wantErr: true},
+		{name: "v2 tcp4", header: v2(1, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0x10, 0x92, 1, 0xbb), remote: "192.0.2.1:4242"},
+		{name: "v2 local", header: v2(0, 0), remote: "pipe"},
+		{name: "v2 short", header: v2(1, 0x11, 192, 0, 2, 1), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				io.WriteString(client, tc.header+"\x02hello")
+			}()
+
+			conn, err := readProxyHeader(server, 0)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Unexpected success")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := conn.RemoteAddr().String(); got != tc.remote {
+				t.Fatalf("Unexpected remote address: %s != %s", got, tc.remote)
+			}
+			// The bytes after the header are left for the handshake.
+			rest, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != "\x02hello" {
+				t.Fatalf("Unexpected result: %q", rest)
+			}
+		})
+	}
+}
+
+func TestSecureListenerProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make(chan string, 1)
+	sl, err := NewSecureListener(l, &Config{
+		ProxyProtocol: true,
+		Authorizer: AuthorizerFunc(func(_ [KeySize]byte, addr net.Addr) error {
+			addrs <- addr.String()
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := sl.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 4242 443\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	sc := Client(conn, nil)
+	defer sc.Close()
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-addrs; got != "192.0.2.1:4242" {
+		t.Fatalf("Unexpected address given to the Authorizer: %s", got)
+	}
+	server := <-accepted
+	defer server.Close()
+	if got := server.RemoteAddr().String(); got != "192.0.2.1:4242" {
+		t.Fatalf("Unexpected remote address: %s", got)
+	}
+}
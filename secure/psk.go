@@ -0,0 +1,128 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// With a pre-shared key (see Config.PreSharedKey) the ends skip the
+// exchange of public keys. Each sends a PSK hello with a random nonce,
+// after the preamble, and both derive the session keys from the pre-shared
+// key and the transcript of the hellos, so that every connection has keys
+// of its own and frames recorded on one can't be replayed on another. Each
+// end then proves that it holds the key with a PSK finished message,
+// carrying a MAC of the transcript, so that a wrong key fails the
+// handshake rather than the first frame.
+
+// HKDF infos of the keys derived from a pre-shared key.
+const (
+	pskClientToServerLabel = "gochal2 psk c2s"
+	pskServerToClientLabel = "gochal2 psk s2c"
+	pskClientFinishedLabel = "gochal2 psk client finished"
+	pskServerFinishedLabel = "gochal2 psk server finished"
+)
+
+// pskNonceSize is the size of the nonce of a PSK hello.
+const pskNonceSize = 32
+
+var (
+	// ErrNoPeerKey is returned by SecureConn.PeerPublicKey when the peers
+	// authenticated each other with a pre-shared key instead.
+	ErrNoPeerKey = errors.New("secure: the peer authenticated with a pre-shared key")
+
+	errBadPSKFinished = errors.New("secure: peer does not hold the pre-shared key")
+)
+
+// runPSK runs the handshake with the pre-shared key psk.
+func (hs *handshakeState) runPSK(psk *[KeySize]byte) (*Session, error) {
+	nonce := make([]byte, pskNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	helloType, peerHelloType := msgServerPSKHello, msgClientPSKHello
+	if hs.role == ClientRole {
+		helloType, peerHelloType = peerHelloType, helloType
+	}
+	hello := handshakeMessage{
+		fieldNonce:      nonce,
+		fieldMaxFrame:   binary.BigEndian.AppendUint32(nil, uint32(hs.config.maxFrameSize())),
+		fieldMaxMessage: binary.BigEndian.AppendUint32(nil, uint32(hs.config.maxMessageSize())),
+	}
+	if hs.config.compression() {
+		hello[fieldCompression] = []byte{compressionZstd}
+	}
+	raw := append(preamble(), hello.marshal(helloType)...)
+	peerHello, peerRaw, err := hs.exchange(raw, peerHelloType)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := peerHello[fieldNonce]; !ok || len(v) != pskNonceSize {
+		return nil, errMalformedHandshake
+	}
+	if err := hs.negotiateMaxFrame(peerHello); err != nil {
+		return nil, err
+	}
+	hs.negotiateCompression(peerHello)
+	transcript := sha256.New()
+	if hs.role == ClientRole {
+		transcript.Write(peerRaw)
+		transcript.Write(raw)
+	} else {
+		transcript.Write(raw)
+		transcript.Write(peerRaw)
+	}
+	sum := transcript.Sum(nil)
+
+	prk := hkdf.Extract(sha256.New, psk[:], sum)
+	defer zero(prk)
+	finished, peerFinished := pskClientFinishedLabel, pskServerFinishedLabel
+	if hs.role == ServerRole {
+		finished, peerFinished = peerFinished, finished
+	}
+	mac := pskMAC(prk, finished, sum)
+	fin := handshakeMessage{fieldMAC: mac}.marshal(msgPSKFinished)
+	peerFin, _, err := hs.exchangeMessage(fin, msgPSKFinished)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(peerFin[fieldMAC], pskMAC(prk, peerFinished, sum)) {
+		return nil, errBadPSKFinished
+	}
+
+	c2s, s2c := pskKey(prk, pskClientToServerLabel), pskKey(prk, pskServerToClientLabel)
+	s := &Session{MaxFrameSize: hs.maxFrame, MaxMessageSize: hs.maxMessage, Version: hs.version, CipherSuite: SuiteBox, Compression: hs.compression}
+	if hs.role == ClientRole {
+		s.sendKey, s.recvKey = c2s, s2c
+		s.keyLogID = nonce
+	} else {
+		s.sendKey, s.recvKey = s2c, c2s
+		s.keyLogID = peerHello[fieldNonce]
+	}
+	return s, nil
+}
+
+// pskKey derives the key with HKDF info label from prk.
+func pskKey(prk []byte, label string) *[KeySize]byte {
+	key := new([KeySize]byte)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(label)), key[:]); err != nil {
+		// HKDF can only fail when asked for more than 255 hashes of output.
+		panic(err)
+	}
+	return key
+}
+
+// pskMAC returns the MAC of the transcript hash sum with the finished key
+// derived from prk with label.
+func pskMAC(prk []byte, label string, sum []byte) []byte {
+	key := pskKey(prk, label)
+	defer zero(key[:])
+	h := hmac.New(sha256.New, key[:])
+	h.Write(sum)
+	return h.Sum(nil)
+}
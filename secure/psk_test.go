@@ -0,0 +1,103 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// newPSK returns a random pre-shared key.
+func newPSK(t *testing.T) *[KeySize]byte {
+	t.Helper()
+	psk := new([KeySize]byte)
+	if _, err := rand.Read(psk[:]); err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+func TestPreSharedKey(t *testing.T) {
+	config := &Config{PreSharedKey: newPSK(t)}
+	client, server, cerr, serr := handshakePair(config, config)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	msg := []byte("hello, world")
+	go client.WriteMessage(msg)
+	got, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+	go server.WriteMessage(got)
+	if got, err = client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+
+	if _, err := client.PeerPublicKey(); !errors.Is(err, ErrNoPeerKey) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPreSharedKeySessionKeys(t *testing.T) {
+	// Every connection derives keys of its own from the same key.
+	config := &Config{PreSharedKey: newPSK(t)}
+	var keys [][KeySize]byte
+	for range 2 {
+		client, server, cerr, serr := handshakePair(config, config)
+		if cerr != nil || serr != nil {
+			t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+		}
+		if *client.session.sendKey != *server.session.recvKey || *client.session.recvKey != *server.session.sendKey {
+			t.Fatal("Unexpected result. The peers derived different keys.")
+		}
+		if *client.session.sendKey == *client.session.recvKey {
+			t.Fatal("Unexpected result. Both directions use the same key.")
+		}
+		keys = append(keys, *client.session.sendKey)
+		client.Close()
+		server.Close()
+	}
+	if keys[0] == keys[1] {
+		t.Fatal("Unexpected result. Two connections use the same key.")
+	}
+}
+
+func TestPreSharedKeyMismatch(t *testing.T) {
+	client, server, cerr, serr := handshakePair(
+		&Config{PreSharedKey: newPSK(t)}, &Config{PreSharedKey: newPSK(t)})
+	defer client.Close()
+	defer server.Close()
+	if !errors.Is(cerr, errBadPSKFinished) || !errors.Is(serr, errBadPSKFinished) {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+}
+
+func TestPreSharedKeyWithPublicKeyPeer(t *testing.T) {
+	psk := &Config{PreSharedKey: newPSK(t)}
+	for _, tc := range []struct {
+		name             string
+		cconfig, sconfig *Config
+	}{
+		{"client", psk, nil},
+		{"server", nil, psk},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, cerr, serr := handshakePair(tc.cconfig, tc.sconfig)
+			defer client.Close()
+			defer server.Close()
+			if cerr == nil || serr == nil {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package secure
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Rekeying gives a session forward secrecy. Every so often the sender of a
+// direction generates an ephemeral X25519 key pair and sends its public key
+// in a frameRekey, still sealed with the old key. Both ends then derive the
+// direction's next key from the old key and the X25519 shared secret of the
+// ephemeral key and the receiver's key pair, and erase the old key. A
+// compromised traffic key therefore reveals neither the traffic sent before
+// the last rekey nor, without the receiver's private key, the traffic sent
+// after the next one.
+//
+// The sender switches keys right after the frameRekey and the receiver right
+// after reading it, so a rekey needs no reply and never waits on the peer.
+
+// rekeyLabel is the HKDF info used to derive a key during a rekey.
+const rekeyLabel = "gochal2 rekey"
+
+// rekeyDue reports whether the writer should rekey before its next frame.
+func (sw *secureWriter) rekeyDue() bool {
+	if sw.peer == nil {
+		return false
+	}
+	return (sw.rekeyBytes > 0 && sw.sent >= sw.rekeyBytes) ||
+		(sw.rekeyInterval > 0 && time.Since(sw.rekeyedAt) >= sw.rekeyInterval)
+}
+
+// rekey sends a fresh ephemeral public key to the peer and switches to the
+// key derived from it.
+func (sw *secureWriter) rekey() error {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	defer zero(priv[:])
+	secret, err := curve25519.X25519(priv[:], sw.peer[:])
+	if err != nil {
+		return err
+	}
+	defer zero(secret)
+
+	if err := sw.sealFrame(frameRekey, pub[:]); err != nil {
+		return err
+	}
+	nextKey(sw.key, secret)
+	sw.aead = sw.suite.newAEAD(sw.key)
+	if sw.logKey != nil {
+		sw.logKey(sw.key)
+	}
+	sw.sent = 0
+	sw.rekeyedAt = time.Now()
+	return nil
+}
+
+// rekey switches the reader to the key derived from the peer's ephemeral
+// public key.
+func (sr *secureReader) rekey(peerEphemeral []byte) error {
+	if sr.priv == nil || len(peerEphemeral) != KeySize {
+		return &FrameError{Reason: "bad rekey"}
+	}
+	secret, err := curve25519.X25519(sr.priv[:], peerEphemeral)
+	if err != nil {
+		return err
+	}
+	defer zero(secret)
+	nextKey(sr.key, secret)
+	sr.aead = sr.suite.newAEAD(sr.key)
+	if sr.logKey != nil {
+		sr.logKey(sr.key)
+	}
+	return nil
+}
+
+// nextKey replaces key, in place, with the next key of its direction,
+// derived from key and the shared secret of a rekey.
+func nextKey(key *[KeySize]byte, secret []byte) {
+	var next [KeySize]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, key[:], []byte(rekeyLabel)), next[:]); err != nil {
+		// HKDF can only fail when asked for more than 255 hashes of output.
+		panic(err)
+	}
+	*key = next
+	zero(next[:])
+}
@@ -0,0 +1,80 @@
+package secure
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{RekeyBytes: 100})
+	server := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// The client only ever writes; rekeying must not wait on it to read.
+	const count = 10
+	msg := bytes.Repeat([]byte("x"), 60)
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := client.WriteMessage(msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	initial := *server.sr.key
+	for i := 0; i < count; i++ {
+		got, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("Unexpected result on message %d: %q", i, got)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if *server.sr.key == initial {
+		t.Fatal("Unexpected result. The client never rekeyed.")
+	}
+	if *client.sw.key != *server.sr.key {
+		t.Fatal("Unexpected result. The client and server disagree on the key.")
+	}
+}
+
+func TestRekeyLeavesSessionIntact(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := newSession(ckeys, skeys.Public, ClientRole, nil, nil)
+	sendKey := *cs.sendKey
+
+	var buf bytes.Buffer
+	_, sw := cs.newReadWriter(&buf, &buf, &Config{RekeyBytes: 1})
+	for i := 0; i < 3; i++ {
+		if _, err := sw.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *sw.key == sendKey {
+		t.Fatal("Unexpected result. The writer never rekeyed.")
+	}
+	if *cs.sendKey != sendKey {
+		t.Fatal("Unexpected result. Rekeying overwrote the session's key.")
+	}
+}
@@ -0,0 +1,427 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A relay connects clients that can't reach each other. Each client makes
+// a secure connection, a hop, to the relay, and sends a request message on
+// it:
+//
+//	listen: relayListen
+//	dial:   relayDial | public key of the listening client
+//
+// The relay answers a dial at once with relayOK or relayNoPeer, and a
+// listen with relayOK once a dial pairs it up. From then on it copies the
+// bytes of either hop to the other, and the two clients run a handshake of
+// their own over them, so that the relay only ever sees their ciphertext.
+const (
+	relayListen byte = 1
+	relayDial   byte = 2
+
+	relayOK     byte = 0
+	relayNoPeer byte = 1
+)
+
+const (
+	// relayRetryMin and relayRetryMax bound the wait before a RelayListener
+	// registers again after failing to.
+	relayRetryMin = 100 * time.Millisecond
+	relayRetryMax = 10 * time.Second
+)
+
+var (
+	// ErrRelayNoPeer is returned by DialRelay when no client listens at the
+	// relay with the requested key.
+	ErrRelayNoPeer = errors.New("secure: no such peer at the relay")
+
+	errRelayPeerMismatch = errors.New("secure: relayed peer presented another key")
+)
+
+// Relay is a Handler that pairs up the clients listening at it with
+// ListenRelay and those dialing them with DialRelay, and forwards their
+// connections. The clients are authenticated to the relay by their key
+// pairs, so serve it with a SecureServer whose Config only accepts known
+// clients, for example with AuthorizedKeys.
+type Relay struct {
+	// mu guards waiting, the listening clients not paired yet by key.
+	mu      sync.Mutex
+	waiting map[[KeySize]byte][]*relayWaiter
+}
+
+// relayWaiter is a listening client waiting to be paired.
+type relayWaiter struct {
+	conn   *SecureConn
+	paired chan *SecureConn
+}
+
+// Handle serves one hop.
+func (r *Relay) Handle(conn net.Conn) {
+	sc, ok := conn.(*SecureConn)
+	if !ok {
+		return
+	}
+	req, err := sc.ReadMessage()
+	if err != nil {
+		return
+	}
+	switch {
+	case len(req) == 1 && req[0] == relayListen:
+		r.listen(sc)
+	case len(req) == 1+KeySize && req[0] == relayDial:
+		var key [KeySize]byte
+		copy(key[:], req[1:])
+		r.dial(sc, key)
+	}
+}
+
+// listen makes conn wait for a dial, then copies what it sends to the
+// dialing client.
+func (r *Relay) listen(conn *SecureConn) {
+	key, err := conn.PeerPublicKey()
+	if err != nil {
+		return
+	}
+	w := &relayWaiter{conn: conn, paired: make(chan *SecureConn, 1)}
+	r.mu.Lock()
+	if r.waiting == nil {
+		r.waiting = make(map[[KeySize]byte][]*relayWaiter)
+	}
+	r.waiting[*key] = append(r.waiting[*key], w)
+	r.mu.Unlock()
+
+	// The client sends nothing before it is paired, but reading meanwhile
+	// notices it leaving. What the read returns once it is paired is the
+	// start of the copy.
+	type result struct {
+		data []byte
+		err  error
+	}
+	first := make(chan result, 1)
+	go func() {
+		buf := make([]byte, 32<<10)
+		n, err := conn.Read(buf)
+		first <- result{buf[:n], err}
+	}()
+
+	var peer *SecureConn
+	select {
+	case peer = <-w.paired:
+	case <-first:
+		r.remove(*key, w)
+		return
+	}
+	defer peer.Close()
+	res := <-first
+	if len(res.data) > 0 {
+		if _, err := peer.Write(res.data); err != nil {
+			return
+		}
+	}
+	if res.err == nil {
+		io.Copy(peer, conn)
+	}
+}
+
+// dial pairs conn with a client listening with key, and copies what conn
+// sends to it.
+func (r *Relay) dial(conn *SecureConn, key [KeySize]byte) {
+	for {
+		w := r.take(key)
+		if w == nil {
+			conn.WriteMessage([]byte{relayNoPeer})
+			return
+		}
+		if err := w.conn.WriteMessage([]byte{relayOK}); err != nil {
+			// It left while waiting; try the next one.
+			w.conn.Close()
+			continue
+		}
+		defer w.conn.Close()
+		if err := conn.WriteMessage([]byte{relayOK}); err != nil {
+			return
+		}
+		w.paired <- conn
+		io.Copy(w.conn, conn)
+		return
+	}
+}
+
+// take removes and returns the longest waiting client listening with key.
+func (r *Relay) take(key [KeySize]byte) *relayWaiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ws := r.waiting[key]
+	if len(ws) == 0 {
+		return nil
+	}
+	w := ws[0]
+	if len(ws) == 1 {
+		delete(r.waiting, key)
+	} else {
+		r.waiting[key] = ws[1:]
+	}
+	return w
+}
+
+// remove forgets w if it is still waiting.
+func (r *Relay) remove(key [KeySize]byte, w *relayWaiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ws := r.waiting[key]
+	for i := range ws {
+		if ws[i] == w {
+			ws = append(ws[:i:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(r.waiting, key)
+	} else {
+		r.waiting[key] = ws
+	}
+}
+
+// relayHopConfig returns the config of a hop to the relay: the key pair
+// that authenticates the client to the relay, and what dials and checks the
+// relay, but none of the settings about peers.
+func relayHopConfig(config *Config) *Config {
+	if config == nil {
+		return nil
+	}
+	return &Config{
+		Keys:             config.Keys,
+		Identity:         config.Identity,
+		IdentitySigner:   config.IdentitySigner,
+		KnownHosts:       config.KnownHosts,
+		RevocationList:   config.RevocationList,
+		HandshakeTimeout: config.HandshakeTimeout,
+		Dialer:           config.Dialer,
+		Logger:           config.Logger,
+		TracerProvider:   config.TracerProvider,
+	}
+}
+
+// relayPeerConfig returns the config of a connection to a peer through a
+// relay. The peer is named by serverName rather than by the address of the
+// relay, and the known hosts, which hold servers by address, don't apply.
+func relayPeerConfig(config *Config, serverName string) *Config {
+	config = config.clone()
+	config.KnownHosts = nil
+	config.ServerName = serverName
+	return config
+}
+
+// relayRequest sends req on hop and returns the relay's answer, closing
+// hop if ctx is done first.
+func relayRequest(ctx context.Context, hop *SecureConn, req []byte) (byte, error) {
+	stop := context.AfterFunc(ctx, func() { hop.Close() })
+	defer stop()
+	if err := hop.WriteMessage(req); err != nil {
+		return 0, err
+	}
+	resp, err := hop.ReadMessage()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) != 1 {
+		return 0, &FrameError{Reason: "bad relay response"}
+	}
+	return resp[0], nil
+}
+
+// DialRelay connects to the client listening with the public key peer at
+// the relay at relayAddr, and runs a handshake with it through the relay.
+// config authenticates this client to the relay with its Keys, and
+// configures the connection to the peer, which is named by its fingerprint
+// rather than by address.
+func DialRelay(ctx context.Context, relayAddr string, peer *[KeySize]byte, config *Config) (*SecureConn, error) {
+	hop, err := DialWithConfig(ctx, relayAddr, relayHopConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := relayRequest(ctx, hop, append([]byte{relayDial}, peer[:]...))
+	if err == nil && resp != relayOK {
+		err = ErrRelayNoPeer
+	}
+	if err != nil {
+		hop.Close()
+		return nil, err
+	}
+
+	sc := Client(hop, relayPeerConfig(config, Fingerprint(peer)))
+	if err := sc.HandshakeContext(ctx); err != nil {
+		hop.Close()
+		return nil, err
+	}
+	if got, err := sc.PeerPublicKey(); err != nil || *got != *peer {
+		sc.Close()
+		return nil, &HandshakeError{Err: rejectKey(errRelayPeerMismatch)}
+	}
+	return sc, nil
+}
+
+// RelayListener accepts the connections that clients make through a relay
+// with DialRelay. It keeps a hop waiting at the relay, and registers a new
+// one whenever that one is paired or dropped.
+type RelayListener struct {
+	relayAddr string
+	config    *Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  chan net.Conn
+
+	// mu guards hop, the hop waiting at the relay.
+	mu  sync.Mutex
+	hop *SecureConn
+}
+
+// ListenRelay listens at the relay at relayAddr for the clients that dial
+// the public key of config with DialRelay. If config is nil or has no key
+// pair, a fresh one is generated; see PublicKey. The Authorizer or
+// AuthorizedKeys of config decide which clients are accepted.
+func ListenRelay(relayAddr string, config *Config) (*RelayListener, error) {
+	config = config.clone()
+	if config.Keys == nil {
+		keys, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		config.Keys = keys
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &RelayListener{
+		relayAddr: relayAddr,
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		conns:     make(chan net.Conn),
+	}
+	go l.loop()
+	return l, nil
+}
+
+// Accept waits for the next client to connect and complete the handshake,
+// and returns the connection as a *SecureConn.
+func (l *RelayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening at the relay. Connections already returned by
+// Accept are left open.
+func (l *RelayListener) Close() error {
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hop != nil {
+		l.hop.Close()
+	}
+	return nil
+}
+
+// Addr returns the address of the relay.
+func (l *RelayListener) Addr() net.Addr {
+	return relayAddr(l.relayAddr)
+}
+
+// PublicKey returns the public key clients dial the listener with.
+func (l *RelayListener) PublicKey() *[KeySize]byte {
+	return l.config.Keys.Public
+}
+
+// relayAddr is the address of a relay.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return string(a) }
+
+// loop keeps a hop waiting at the relay until the listener is closed.
+func (l *RelayListener) loop() {
+	var delay time.Duration
+	for {
+		hop, registered, err := l.register()
+		if err == nil {
+			delay = 0
+			go l.handshake(hop)
+			continue
+		}
+		if l.ctx.Err() != nil {
+			return
+		}
+		if registered {
+			// The relay dropped the waiting hop, such as for being idle.
+			delay = relayRetryMin
+			l.config.logger().Debug("relay dropped waiting connection", "relay", l.relayAddr, "err", err)
+		} else {
+			delay = min(max(2*delay, relayRetryMin), relayRetryMax)
+			l.config.logger().Warn("relay registration failed, retrying", "relay", l.relayAddr, "err", err, "delay", delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// register connects a hop to the relay and waits for it to be paired. It
+// reports whether the relay had accepted the hop, so that a hop dropped
+// while waiting isn't taken for the relay failing.
+func (l *RelayListener) register() (*SecureConn, bool, error) {
+	hop, err := DialWithConfig(l.ctx, l.relayAddr, relayHopConfig(l.config))
+	if err != nil {
+		return nil, false, err
+	}
+	l.mu.Lock()
+	l.hop = hop
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.hop = nil
+		l.mu.Unlock()
+	}()
+
+	resp, err := relayRequest(l.ctx, hop, []byte{relayListen})
+	if err != nil {
+		hop.Close()
+		return nil, true, err
+	}
+	if resp != relayOK {
+		hop.Close()
+		return nil, false, &FrameError{Reason: "bad relay response"}
+	}
+	return hop, true, nil
+}
+
+// handshake runs the server side of the handshake with the client paired
+// with hop, and hands the connection to Accept.
+func (l *RelayListener) handshake(hop *SecureConn) {
+	sc := Server(hop, relayPeerConfig(l.config, ""))
+	if err := sc.HandshakeContext(l.ctx); err != nil {
+		hop.Close()
+		l.config.logger().Warn("handshake failed", "relay", l.relayAddr, "err", err)
+		return
+	}
+	select {
+	case l.conns <- sc:
+	case <-l.ctx.Done():
+		sc.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Handler: &Relay{}}
+	go srv.Serve(l)
+	defer srv.Close()
+	relayAddr := l.Addr().String()
+
+	rl, err := ListenRelay(relayAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	go func() {
+		conn, err := rl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := conn.(*SecureConn).ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.(*SecureConn).WriteMessage(msg)
+	}()
+
+	// The listener may not be waiting at the relay yet.
+	var conn *SecureConn
+	for {
+		conn, err = DialRelay(context.Background(), relayAddr, rl.PublicKey(), nil)
+		if !errors.Is(err, ErrRelayNoPeer) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("Unexpected result: %s", got)
+	}
+	// The connection is end to end: the peer is the listener, not the
+	// relay.
+	if pub, _ := conn.PeerPublicKey(); *pub != *rl.PublicKey() {
+		t.Fatal("Unexpected peer key")
+	}
+
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialRelay(context.Background(), relayAddr, other.Public, nil); !errors.Is(err, ErrRelayNoPeer) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
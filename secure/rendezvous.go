@@ -0,0 +1,435 @@
+package secure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Rendezvous connects two peers that can't accept connections, such as
+// peers behind NATs, in datagram mode. Both send the rendezvous name they
+// agreed on to an Introducer, a server both can reach, which tells each the
+// address it sees the other's packets come from and the role it takes in
+// the handshake:
+//
+//	register: packetRegister | name
+//	peer:     packetPeer | role (0 client, 1 server) | address of the peer
+//
+// The peers then send packets to each other, which opens a path through
+// NATs that map a socket to the same public address whatever the
+// destination: the client its hellos, the server punch packets until the
+// client's hello arrives. If the handshake doesn't complete within
+// punchTimeout, the client sends its hello again through the introducer,
+// wrapped as
+//
+//	relay: packetRelay | packet
+//
+// and the introducer forwards it unwrapped to the other peer, which answers
+// and goes on the same way. The packets are encrypted end to end; the
+// introducer can't read them.
+const (
+	packetRegister byte = 3
+	packetPeer     byte = 4
+	packetPunch    byte = 5
+	packetRelay    byte = 6
+)
+
+const (
+	// registerInterval is how often a peer registers again until the
+	// introducer answers, and punchInterval how often a server sends punch
+	// packets.
+	registerInterval = 500 * time.Millisecond
+	punchInterval    = 100 * time.Millisecond
+
+	// rendezvousIdle is how long an introducer remembers a peer it hears
+	// nothing from.
+	rendezvousIdle = 2 * time.Minute
+)
+
+// punchTimeout is how long a client tries to reach its peer directly
+// before going through the introducer. Tests shorten it.
+var punchTimeout = 3 * time.Second
+
+// Rendezvous connects to the peer that registers the same name with the
+// introducer at introducerAddr, directly if their NATs let it or else
+// through the introducer. It waits for the peer until ctx is done. Anyone
+// who knows name can take the place of the peer, so have config
+// authenticate it, for example with an Authorizer from ExpectFingerprint.
+func Rendezvous(ctx context.Context, introducerAddr, name string, config *Config) (*DatagramConn, error) {
+	introducer, err := net.ResolveUDPAddr("udp", introducerAddr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := rendezvous(ctx, pc, introducer, name, config)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+// rendezvous is Rendezvous on pc.
+func rendezvous(ctx context.Context, pc net.PacketConn, introducer net.Addr, name string, config *Config) (*DatagramConn, error) {
+	// The client sends the same hello on both paths, so that a server
+	// whose answer was lost on the direct one answers it again.
+	config = config.clone()
+	if config.Keys == nil {
+		keys, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		config.Keys = keys
+	}
+	peer, role, err := register(ctx, pc, introducer, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &punchConn{pc: pc, peer: peer, introducer: introducer}
+	var s *Session
+	var clientHello, serverHello []byte
+	if role == ClientRole {
+		s, err = punchClient(ctx, c, config)
+	} else {
+		s, clientHello, serverHello, err = punchServer(ctx, c, config)
+	}
+	if err != nil {
+		return nil, &HandshakeError{Err: err}
+	}
+	if role == ClientRole {
+		if err := config.authorize(true, s.PeerPublicKey, c.remote()); err != nil {
+			return nil, &HandshakeError{Err: rejectKey(err)}
+		}
+	}
+
+	dc := newDatagramConn(s, pc.LocalAddr(), c.remote(), c.send)
+	dc.clientHello, dc.serverHello = clientHello, serverHello
+	dc.onClose = pc.Close
+	go c.readLoop(dc)
+	return dc, nil
+}
+
+// register registers name with the introducer until it answers with the
+// address of the peer and the role to take.
+func register(ctx context.Context, pc net.PacketConn, introducer net.Addr, name string) (net.Addr, Role, error) {
+	stop := context.AfterFunc(ctx, func() { pc.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	defer pc.SetReadDeadline(time.Time{})
+
+	req := append([]byte{packetRegister}, name...)
+	buf := make([]byte, maxPacketSize)
+	for {
+		if _, err := pc.WriteTo(req, introducer); err != nil {
+			return nil, 0, err
+		}
+		pc.SetReadDeadline(time.Now().Add(registerInterval))
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			if from.String() != introducer.String() || n < 2 || buf[0] != packetPeer {
+				continue
+			}
+			peer, err := net.ResolveUDPAddr("udp", string(buf[2:n]))
+			if err != nil {
+				continue
+			}
+			if buf[1] == 1 {
+				return peer, ServerRole, nil
+			}
+			return peer, ClientRole, nil
+		}
+	}
+}
+
+// punchClient runs the client side of the handshake, directly for
+// punchTimeout and then through the introducer.
+func punchClient(ctx context.Context, c *punchConn, config *Config) (*Session, error) {
+	punchCtx, cancel := context.WithTimeout(ctx, punchTimeout)
+	s, err := datagramHandshake(punchCtx, c, config)
+	cancel()
+	if err == nil || ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+		return s, err
+	}
+	c.relayed.Store(true)
+	return datagramHandshake(ctx, c, config)
+}
+
+// punchServer sends punch packets to the peer until its hello arrives, on
+// either path, and answers it on the same path.
+func punchServer(ctx context.Context, c *punchConn, config *Config) (s *Session, clientHello, serverHello []byte, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(punchInterval)
+		defer t.Stop()
+		for {
+			c.pc.WriteTo([]byte{packetPunch}, c.peer)
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { c.pc.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	defer c.pc.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := c.Read(buf)
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if n == 0 || buf[0] != packetHello {
+			continue
+		}
+		c.relayed.Store(c.lastRelayed)
+		clientHello = append([]byte(nil), buf[:n]...)
+		s, serverHello, err = acceptDatagramHello(clientHello, c.remote(), config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := c.send(serverHello); err != nil {
+			return nil, nil, nil, err
+		}
+		return s, clientHello, serverHello, nil
+	}
+}
+
+// punchConn is the path to the peer of a rendezvous, directly or through
+// the introducer. It is a packetTransport.
+type punchConn struct {
+	pc               net.PacketConn
+	peer, introducer net.Addr
+
+	// relayed is set once packets are sent through the introducer, and
+	// lastRelayed once the last packet read came through it.
+	relayed     atomic.Bool
+	lastRelayed bool
+}
+
+// Read reads the next packet from the peer, directly or through the
+// introducer.
+func (c *punchConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.pc.ReadFrom(p)
+		if err != nil {
+			return 0, err
+		}
+		switch from.String() {
+		case c.peer.String():
+			c.lastRelayed = false
+			return n, nil
+		case c.introducer.String():
+			// Packets the introducer relays, rather than its own.
+			if n > 0 && (p[0] == packetHello || p[0] == packetData) {
+				c.lastRelayed = true
+				return n, nil
+			}
+		}
+	}
+}
+
+// Write sends p to the peer.
+func (c *punchConn) Write(p []byte) (int, error) {
+	if err := c.send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *punchConn) SetReadDeadline(t time.Time) error {
+	return c.pc.SetReadDeadline(t)
+}
+
+// send sends pkt to the peer on the current path.
+func (c *punchConn) send(pkt []byte) error {
+	if c.relayed.Load() {
+		_, err := c.pc.WriteTo(append([]byte{packetRelay}, pkt...), c.introducer)
+		return err
+	}
+	_, err := c.pc.WriteTo(pkt, c.peer)
+	return err
+}
+
+// remote returns the address packets are sent to.
+func (c *punchConn) remote() net.Addr {
+	if c.relayed.Load() {
+		return c.introducer
+	}
+	return c.peer
+}
+
+// readLoop queues the data packets of the peer for dc until it is closed.
+// A server whose answer to the client hello was lost answers it again, and
+// goes on on the path the hello came on.
+func (c *punchConn) readLoop(dc *DatagramConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := c.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+		switch {
+		case buf[0] == packetData:
+			dc.deliver(append([]byte(nil), buf[:n]...))
+		case buf[0] == packetHello && dc.serverHello != nil && bytes.Equal(buf[:n], dc.clientHello):
+			c.relayed.Store(c.lastRelayed)
+			c.send(dc.serverHello)
+		}
+	}
+}
+
+// Introducer is the server peers meet at with Rendezvous. It pairs up the
+// two peers that register the same name, tells each the address of the
+// other, and relays their packets if they can't reach each other directly.
+// It only ever sees encrypted packets.
+type Introducer struct {
+	pc net.PacketConn
+
+	// waiting holds the peers waiting for another to register their name,
+	// by name, and paired those already introduced, by address. Only the
+	// goroutine of serve uses them.
+	waiting map[string]waitingPeer
+	paired  map[string]*pairedPeer
+}
+
+// waitingPeer is a peer waiting for another to register the same name.
+type waitingPeer struct {
+	addr net.Addr
+	last time.Time
+}
+
+// pairedPeer is a peer introduced to another: the name it registered, the
+// address of its peer and the role it takes.
+type pairedPeer struct {
+	name string
+	peer net.Addr
+	role Role
+	last time.Time
+}
+
+// NewIntroducer starts introducing peers on pc.
+func NewIntroducer(pc net.PacketConn) *Introducer {
+	i := &Introducer{
+		pc:      pc,
+		waiting: make(map[string]waitingPeer),
+		paired:  make(map[string]*pairedPeer),
+	}
+	go i.serve()
+	return i
+}
+
+// Close closes the PacketConn, which stops relaying as well.
+func (i *Introducer) Close() error {
+	return i.pc.Close()
+}
+
+// Addr returns the local address of the introducer.
+func (i *Introducer) Addr() net.Addr {
+	return i.pc.LocalAddr()
+}
+
+// serve answers registrations and relays packets until the introducer is
+// closed.
+func (i *Introducer) serve() {
+	buf := make([]byte, 1+maxPacketSize)
+	lastSweep := time.Now()
+	for {
+		n, from, err := i.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+		now := time.Now()
+		if now.Sub(lastSweep) > rendezvousIdle {
+			i.sweep(now)
+			lastSweep = now
+		}
+		switch buf[0] {
+		case packetRegister:
+			i.register(string(buf[1:n]), from, now)
+		case packetRelay:
+			p := i.paired[from.String()]
+			if p == nil {
+				continue
+			}
+			p.last = now
+			if q := i.paired[p.peer.String()]; q != nil {
+				q.last = now
+			}
+			i.pc.WriteTo(buf[1:n], p.peer)
+		}
+	}
+}
+
+// register pairs the peer at addr with the one waiting for name, if any.
+// The peer that waited takes the server side of the handshake.
+func (i *Introducer) register(name string, addr net.Addr, now time.Time) {
+	key := addr.String()
+	if p := i.paired[key]; p != nil && p.name == name {
+		// Our answer was lost.
+		p.last = now
+		i.introduce(addr, p)
+		return
+	}
+	w, ok := i.waiting[name]
+	if !ok || w.addr.String() == key {
+		i.waiting[name] = waitingPeer{addr: addr, last: now}
+		return
+	}
+	delete(i.waiting, name)
+	server := &pairedPeer{name: name, peer: addr, role: ServerRole, last: now}
+	client := &pairedPeer{name: name, peer: w.addr, role: ClientRole, last: now}
+	i.paired[w.addr.String()] = server
+	i.paired[key] = client
+	i.introduce(w.addr, server)
+	i.introduce(addr, client)
+}
+
+// introduce tells the peer at addr about its peer p.
+func (i *Introducer) introduce(addr net.Addr, p *pairedPeer) {
+	role := byte(0)
+	if p.role == ServerRole {
+		role = 1
+	}
+	i.pc.WriteTo(append([]byte{packetPeer, role}, p.peer.String()...), addr)
+}
+
+// sweep forgets the peers not heard from for rendezvousIdle.
+func (i *Introducer) sweep(now time.Time) {
+	for name, w := range i.waiting {
+		if now.Sub(w.last) > rendezvousIdle {
+			delete(i.waiting, name)
+		}
+	}
+	for key, p := range i.paired {
+		if now.Sub(p.last) > rendezvousIdle {
+			delete(i.paired, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// directlessPacketConn only sends packets to the introducer, as if a NAT
+// dropped the others.
+type directlessPacketConn struct {
+	net.PacketConn
+	introducer net.Addr
+}
+
+func (c *directlessPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr.String() != c.introducer.String() {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// rendezvousPair runs a rendezvous between two peers through intro. If
+// direct is false, the second peer can't send packets to the first.
+func rendezvousPair(t *testing.T, intro *Introducer, direct bool) (a, b *DatagramConn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type result struct {
+		dc  *DatagramConn
+		err error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && !direct {
+			pc = &directlessPacketConn{PacketConn: pc, introducer: intro.Addr()}
+		}
+		go func() {
+			dc, err := rendezvous(ctx, pc, intro.Addr(), "test", nil)
+			results <- result{dc, err}
+		}()
+		// Make the first peer register first.
+		time.Sleep(50 * time.Millisecond)
+	}
+	var dcs [2]*DatagramConn
+	for i := range dcs {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		dcs[i] = r.dc
+	}
+	return dcs[0], dcs[1]
+}
+
+func TestRendezvous(t *testing.T) {
+	defer func(d time.Duration) { punchTimeout = d }(punchTimeout)
+	punchTimeout = 300 * time.Millisecond
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intro := NewIntroducer(pc)
+	defer intro.Close()
+
+	for _, direct := range []bool{true, false} {
+		a, b := rendezvousPair(t, intro, direct)
+		for _, dc := range []*DatagramConn{a, b} {
+			relayed := dc.RemoteAddr().String() == intro.Addr().String()
+			if relayed == direct {
+				t.Fatalf("Unexpected remote address %v with direct %v", dc.RemoteAddr(), direct)
+			}
+		}
+		// Whichever peer got the server side, the other one writes first.
+		for _, pair := range [][2]*DatagramConn{{a, b}, {b, a}} {
+			if err := pair[0].WriteMessage([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			got, err := pair[1].ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello" {
+				t.Fatalf("Unexpected result: %s", got)
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+}
@@ -0,0 +1,207 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A reverse tunnel carries the connections a server accepts to a service
+// on the client's side, as SSH -R does, for services behind a NAT. The
+// client keeps a secure connection waiting at the server. When a plaintext
+// connection arrives, the server sends reverseOpen on the waiting
+// connection, the client answers reverseReady, and both ends then forward
+// the traffic as a tunnel does, while the client connects again to wait
+// for the next one.
+const (
+	reverseOpen  byte = 1
+	reverseReady byte = 2
+)
+
+const (
+	// reverseWaitTimeout bounds the wait of a plaintext connection for a
+	// client to take it, and of the server for the client to answer.
+	reverseWaitTimeout = 10 * time.Second
+
+	// reverseRetryMin and reverseRetryMax bound the wait before
+	// ServeReverseTunnel connects again after failing to.
+	reverseRetryMin = 100 * time.Millisecond
+	reverseRetryMax = 10 * time.Second
+)
+
+// ReverseTunnel is a Handler that serves the server end of reverse
+// tunnels. Its Serve method accepts plaintext connections and forwards
+// each to a client connected with ServeReverseTunnel, which forwards it on
+// to its service. Every connection the handler serves is taken for such a
+// client, so serve it with a SecureServer whose Config only accepts the
+// clients allowed to receive the traffic, for example with AuthorizedKeys.
+type ReverseTunnel struct {
+	start   sync.Once
+	waiting chan *reverseWaiter
+}
+
+// reverseWaiter is a client connection waiting for a plaintext connection.
+type reverseWaiter struct {
+	conn *SecureConn
+
+	// ready receives the result of reading the client's answer, and done
+	// is closed once the connection is no longer used.
+	ready chan error
+	done  chan struct{}
+}
+
+func (r *ReverseTunnel) init() {
+	r.start.Do(func() {
+		r.waiting = make(chan *reverseWaiter)
+	})
+}
+
+// Handle makes a client connection wait for a plaintext connection to
+// forward.
+func (r *ReverseTunnel) Handle(conn net.Conn) {
+	sc, ok := conn.(*SecureConn)
+	if !ok {
+		return
+	}
+	r.init()
+	w := &reverseWaiter{conn: sc, ready: make(chan error, 1), done: make(chan struct{})}
+	// The client sends nothing but its answer, and reading it meanwhile
+	// notices the client leaving.
+	go func() {
+		msg, err := sc.ReadMessage()
+		if err == nil && (len(msg) != 1 || msg[0] != reverseReady) {
+			err = &FrameError{Reason: "bad reverse tunnel answer"}
+		}
+		w.ready <- err
+	}()
+	select {
+	case r.waiting <- w:
+		<-w.done
+	case <-w.ready:
+	}
+}
+
+// Serve accepts plaintext connections on l and forwards each to a waiting
+// client. It returns once Accept fails, such as when l is closed.
+// Connections for which no client is waiting are closed after a while.
+func (r *ReverseTunnel) Serve(l net.Listener) error {
+	r.init()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.forward(c)
+	}
+}
+
+// forward hands c to the first waiting client that answers.
+func (r *ReverseTunnel) forward(c net.Conn) {
+	defer c.Close()
+	timeout := time.NewTimer(reverseWaitTimeout)
+	defer timeout.Stop()
+	for {
+		var w *reverseWaiter
+		select {
+		case w = <-r.waiting:
+		case <-timeout.C:
+			return
+		}
+		if r.open(w, timeout.C) {
+			splice(&tunnelConn{SecureConn: w.conn}, c)
+			close(w.done)
+			return
+		}
+		w.conn.Close()
+		close(w.done)
+	}
+}
+
+// open asks the client of w to take a connection, and reports whether it
+// answered before timeout.
+func (r *ReverseTunnel) open(w *reverseWaiter, timeout <-chan time.Time) bool {
+	if err := w.conn.WriteMessage([]byte{reverseOpen}); err != nil {
+		return false
+	}
+	select {
+	case err := <-w.ready:
+		return err == nil
+	case <-timeout:
+		return false
+	}
+}
+
+// ServeReverseTunnel serves the client end of a reverse tunnel: it keeps a
+// connection waiting at the server at addr, which serves it with a
+// ReverseTunnel, and forwards the plaintext connections the server hands
+// over to the TCP service at target, such as "127.0.0.1:8080". config
+// configures the secure connections as DialWithConfig takes it.
+// ServeReverseTunnel returns ctx's error once ctx is done; it retries
+// failed connections until then.
+func ServeReverseTunnel(ctx context.Context, addr, target string, config *Config) error {
+	var delay time.Duration
+	for {
+		sc, waited, err := waitReverse(ctx, addr, config)
+		if err == nil {
+			delay = 0
+			go forwardReverse(sc, target)
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if waited {
+			// The server dropped the waiting connection, such as for
+			// being idle.
+			delay = reverseRetryMin
+			config.logger().Debug("reverse tunnel connection dropped", "addr", addr, "err", err)
+		} else {
+			delay = min(max(2*delay, reverseRetryMin), reverseRetryMax)
+			config.logger().Warn("reverse tunnel connection failed, retrying", "addr", addr, "err", err, "delay", delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitReverse connects to the server and waits for it to hand over a
+// plaintext connection. It reports whether the connection was made, so
+// that one dropped while waiting isn't taken for the server failing.
+func waitReverse(ctx context.Context, addr string, config *Config) (*SecureConn, bool, error) {
+	sc, err := DialWithConfig(ctx, addr, config)
+	if err != nil {
+		return nil, false, err
+	}
+	stop := context.AfterFunc(ctx, func() { sc.Close() })
+	defer stop()
+	msg, err := sc.ReadMessage()
+	if err == nil && (len(msg) != 1 || msg[0] != reverseOpen) {
+		sc.Close()
+		return nil, false, &FrameError{Reason: "bad reverse tunnel request"}
+	}
+	if err == nil {
+		err = sc.WriteMessage([]byte{reverseReady})
+	}
+	if err != nil {
+		sc.Close()
+		return nil, true, err
+	}
+	return sc, true, nil
+}
+
+// forwardReverse forwards the traffic of sc to the service at target.
+func forwardReverse(sc *SecureConn, target string) {
+	defer sc.Close()
+	d := net.Dialer{Timeout: tunnelDialTimeout}
+	tc, err := d.Dial("tcp", target)
+	if err != nil {
+		sc.config.logger().Warn("tunnel target unreachable", "target", target, "err", err)
+		return
+	}
+	defer tc.Close()
+	splice(&tunnelConn{SecureConn: sc}, tc)
+}
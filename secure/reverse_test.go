@@ -0,0 +1,102 @@
+package secure
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	// The service behind the client, which answers once the other end is
+	// done sending.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := io.ReadAll(c)
+				if err != nil {
+					return
+				}
+				c.Write(bytes.ToUpper(req))
+			}()
+		}
+	}()
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &ReverseTunnel{}
+	srv := &SecureServer{Handler: rt}
+	go srv.Serve(sl)
+	defer srv.Close()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go rt.Serve(pl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeReverseTunnel(ctx, sl.Addr().String(), target.Addr().String(), nil)
+
+	// One after the other, each plaintext connection taking the client
+	// connection that waits after the previous one.
+	for _, req := range []string{"hello", "again"} {
+		c, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		c.(*net.TCPConn).CloseWrite()
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(bytes.ToUpper([]byte(req))) {
+			t.Fatalf("Unexpected result: %q", got)
+		}
+	}
+}
+
+func TestReverseTunnelClientLeaves(t *testing.T) {
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &ReverseTunnel{}
+	srv := &SecureServer{Handler: rt}
+	go srv.Serve(sl)
+	defer srv.Close()
+
+	// A client that leaves while waiting is no longer offered connections.
+	conn, err := Dial(sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srv.Shutdown(context.Background())
+	select {
+	case w := <-rt.waiting:
+		t.Fatalf("Client %v still waiting", w.conn.RemoteAddr())
+	default:
+	}
+}
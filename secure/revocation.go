@@ -0,0 +1,126 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKeyRevoked is returned by the handshake when the peer's public key is
+// in the RevocationList of the config. It matches ErrPeerKeyRejected.
+var ErrKeyRevoked = errors.New("secure: peer key revoked")
+
+// maxRevocationListSize bounds the size of a revocation list fetched from a
+// URL.
+const maxRevocationListSize = 16 * 1024 * 1024
+
+// RevocationList is a set of compromised public keys that neither end of a
+// connection accepts, whatever its AuthorizedKeys, KnownHosts or
+// Authorizer say. It is read from a file, or fetched from a URL so that a
+// key can be cut off everywhere at once, and can be refreshed while in use.
+// A RevocationList is safe for concurrent use.
+type RevocationList struct {
+	source string
+
+	mu   sync.RWMutex
+	keys *AuthorizedKeys
+}
+
+// LoadRevocationList reads the revocation list at source, an http or https
+// URL or else a file path. The list is in the format of
+// LoadAuthorizedKeys.
+func LoadRevocationList(ctx context.Context, source string) (*RevocationList, error) {
+	rl := &RevocationList{source: source}
+	if err := rl.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// NewRevocationList returns a revocation list of the given keys, which
+// Refresh leaves unchanged.
+func NewRevocationList(keys ...*[KeySize]byte) *RevocationList {
+	return &RevocationList{keys: NewAuthorizedKeys(keys...)}
+}
+
+// Refresh reads the list from its source again. If that fails, the list
+// keeps the keys it had.
+func (rl *RevocationList) Refresh(ctx context.Context) error {
+	if rl.source == "" {
+		return nil
+	}
+	keys, err := rl.read(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %v", rl.source, err)
+	}
+	rl.mu.Lock()
+	rl.keys = keys
+	rl.mu.Unlock()
+	return nil
+}
+
+// RefreshEvery refreshes the list every interval until ctx is done, logging
+// failed refreshes to logger, which may be nil.
+func (rl *RevocationList) RefreshEvery(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := rl.Refresh(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("revocation list refresh failed, keeping the previous list", "err", err)
+		}
+	}
+}
+
+// read reads the keys at the list's source.
+func (rl *RevocationList) read(ctx context.Context) (*AuthorizedKeys, error) {
+	if !strings.HasPrefix(rl.source, "http://") && !strings.HasPrefix(rl.source, "https://") {
+		f, err := os.Open(rl.source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseAuthorizedKeys(f)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rl.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ParseAuthorizedKeys(io.LimitReader(resp.Body, maxRevocationListSize))
+}
+
+// Revoked reports whether key is in the list.
+func (rl *RevocationList) Revoked(key *[KeySize]byte) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.keys.Contains(key)
+}
+
+// Len returns the number of keys in the list.
+func (rl *RevocationList) Len() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.keys.Len()
+}
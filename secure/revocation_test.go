@@ -0,0 +1,99 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevocationList(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		revoked *[KeySize]byte
+		server  bool
+	}{
+		{"client", ckeys.Public, true},
+		{"server", skeys.Public, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := NewRevocationList(tc.revoked)
+			client, server, cerr, serr := handshakePair(
+				&Config{Keys: ckeys, RevocationList: rl},
+				&Config{Keys: skeys, RevocationList: rl})
+			defer client.Close()
+			defer server.Close()
+			err := cerr
+			if tc.server {
+				err = serr
+			}
+			if !errors.Is(err, ErrKeyRevoked) || !errors.Is(err, ErrPeerKeyRejected) {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+		})
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := fmt.Sprintf("# stolen laptop\n%s alice\n", encodeKey(keys.Public))
+
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	served := list
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served == "" {
+			http.Error(w, "gone", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, served)
+	}))
+	defer ts.Close()
+
+	for _, source := range []string{path, ts.URL} {
+		rl, err := LoadRevocationList(context.Background(), source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rl.Revoked(keys.Public) || rl.Len() != 1 {
+			t.Fatalf("%s: Unexpected result. The key was not revoked.", source)
+		}
+	}
+
+	// A refresh picks up changes, and a failed one keeps the list.
+	rl, err := LoadRevocationList(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served = ""
+	if err := rl.Refresh(context.Background()); err == nil {
+		t.Fatal("Unexpected result. The refresh succeeded.")
+	}
+	if !rl.Revoked(keys.Public) {
+		t.Fatal("Unexpected result. A failed refresh emptied the list.")
+	}
+	served = "\n"
+	if err := rl.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Revoked(keys.Public) {
+		t.Fatal("Unexpected result. The refresh was ignored.")
+	}
+}
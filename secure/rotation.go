@@ -0,0 +1,115 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A server rotating its key pair lists the public keys of its previous key
+// pairs in its hello, after the key of Config.Keys. A client that has a key
+// pinned for the server in its KnownHosts names that key in its hello, and
+// both ends use it for the key exchange instead of the server's current key
+// if the server lists it. The server then proves that it holds the
+// previous key with a MAC of the transcript in its done message, and the
+// client pins the server's current key in place of the previous one, so
+// that it no longer needs the previous key once that has been retired.
+
+// rotationLabel is the HKDF info of the key that MACs the transcript when
+// the server uses a previous key.
+const rotationLabel = "gochal2 key rotation"
+
+var errBadRotationMAC = errors.New("secure: server does not hold its previous key")
+
+// PreviousKey is a key pair a server used before its current one, which it
+// keeps completing handshakes with, for clients that pinned it, until
+// Expires. See Config.PreviousKeys.
+type PreviousKey struct {
+	Keys *KeyPair
+
+	// Expires is when the server stops using the key. The zero time means
+	// never.
+	Expires time.Time
+}
+
+// previousKeys returns the previous key pairs that have not yet expired.
+func (c *Config) previousKeys() []*KeyPair {
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	var keys []*KeyPair
+	for _, p := range c.PreviousKeys {
+		if p.Expires.IsZero() || now.Before(p.Expires) {
+			keys = append(keys, p.Keys)
+		}
+	}
+	return keys
+}
+
+// offerPreviousKeys lists the server's previous keys in its hello.
+func (hs *handshakeState) offerPreviousKeys(hello handshakeMessage) {
+	hs.previous = hs.config.previousKeys()
+	if len(hs.previous) == 0 {
+		return
+	}
+	var keys []byte
+	for _, p := range hs.previous {
+		keys = append(keys, p.Public[:]...)
+	}
+	hello[fieldPreviousKeys] = keys
+}
+
+// usePreviousKey switches the server to the previous key the client hello
+// ch names, if any, and reports whether it did.
+func (hs *handshakeState) usePreviousKey(ch handshakeMessage) bool {
+	want := ch[fieldServerKey]
+	for _, p := range hs.previous {
+		if bytes.Equal(p.Public[:], want) {
+			hs.keys = p
+			return true
+		}
+	}
+	return false
+}
+
+// choosePreviousKey makes the client use the key it expects instead of the
+// one the server hello sh presents, if the server lists it among its
+// previous keys, and reports whether it did.
+func (hs *handshakeState) choosePreviousKey(sh handshakeMessage) bool {
+	if hs.expected == nil || *hs.expected == *hs.peer {
+		return false
+	}
+	keys := sh[fieldPreviousKeys]
+	if len(keys)%KeySize != 0 {
+		return false
+	}
+	for ; len(keys) > 0; keys = keys[KeySize:] {
+		if bytes.Equal(keys[:KeySize], hs.expected[:]) {
+			hs.rotated = hs.peer
+			hs.peer = hs.expected
+			return true
+		}
+	}
+	return false
+}
+
+// rotationMAC returns the MAC of the transcript hash sum with the key
+// derived from the key exchange between priv and peer.
+func rotationMAC(priv, peer *[KeySize]byte, sum []byte) []byte {
+	var shared [KeySize]byte
+	box.Precompute(&shared, peer, priv)
+	prk := hkdf.Extract(sha256.New, shared[:], nil)
+	zero(shared[:])
+	defer zero(prk)
+	key := pskKey(prk, rotationLabel)
+	defer zero(key[:])
+	h := hmac.New(sha256.New, key[:])
+	h.Write(sum)
+	return h.Sum(nil)
+}
@@ -0,0 +1,89 @@
+package secure
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rotationPair runs a handshake between a client that has pinned pinned
+// for the server and a server with keys and previous.
+func rotationPair(t *testing.T, pinned *[KeySize]byte, keys *KeyPair, previous ...PreviousKey) (*KnownHosts, *SecureConn, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Check("server", pinned); err != nil {
+		t.Fatal(err)
+	}
+	client, server, cerr, _ := handshakePair(
+		&Config{KnownHosts: kh, ServerName: "server"},
+		&Config{Keys: keys, PreviousKeys: previous})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return kh, client, cerr
+}
+
+func TestPreviousKeys(t *testing.T) {
+	old, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that pinned the old key still completes the handshake with
+	// it, and pins the current key from then on.
+	kh, client, err := rotationPair(t, old.Public, current, PreviousKey{Keys: old, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *client.session.PeerPublicKey != *old.Public {
+		t.Fatal("Unexpected result. The client didn't use the old key.")
+	}
+	if key := kh.lookup("server"); *key != *current.Public {
+		t.Fatal("Unexpected result. The current key was not pinned.")
+	}
+	reloaded, err := LoadKnownHosts(kh.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := reloaded.lookup("server"); *key != *current.Public {
+		t.Fatal("Unexpected result. The current key was not saved.")
+	}
+
+	// Once the old key has expired, the client is refused.
+	_, _, err = rotationPair(t, old.Public, current, PreviousKey{Keys: old, Expires: time.Now().Add(-time.Second)})
+	var hkErr *HostKeyError
+	if !errors.As(err, &hkErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPreviousKeysNotHeld(t *testing.T) {
+	// A server that lists a key it doesn't hold can't prove it, so the
+	// client doesn't pin its current key.
+	old, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := &KeyPair{Public: old.Public, Private: other.Private}
+	kh, _, err := rotationPair(t, old.Public, other, PreviousKey{Keys: forged})
+	if !errors.Is(err, errBadRotationMAC) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if key := kh.lookup("server"); *key != *old.Public {
+		t.Fatal("Unexpected result. The server's key was replaced.")
+	}
+}
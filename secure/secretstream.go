@@ -0,0 +1,296 @@
+package secure
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/poly1305"
+)
+
+// The secret stream writer and reader seal data as libsodium's
+// crypto_secretstream_xchacha20poly1305 does, so that programs using
+// libsodium can talk to them. The stream starts with the 24-byte header of
+// crypto_secretstream_xchacha20poly1305_init_push, after which each message
+// is
+//
+//	length (4 bytes, big-endian) | ciphertext (length bytes)
+//
+// where ciphertext is the output of crypto_secretstream_xchacha20poly1305_push,
+// 17 bytes longer than the message, with no additional data. The last
+// message is an empty one tagged TAG_FINAL. A libsodium peer reads the
+// header, passes it to init_pull, then pulls each message after reading
+// its length, and writes the same way.
+const (
+	// SecretStreamHeaderSize is the size of the header that starts a secret
+	// stream.
+	SecretStreamHeaderSize = 24
+
+	// secretStreamOverhead is how much longer a pushed message is than its
+	// plaintext: the encrypted tag and the Poly1305 MAC.
+	secretStreamOverhead = 1 + poly1305.TagSize
+)
+
+// The tags of secretstream messages.
+const (
+	secretStreamTagMessage byte = 0
+	secretStreamTagRekey   byte = 2
+	secretStreamTagFinal   byte = 3
+)
+
+var errSecretStreamClosed = errors.New("secure: write to closed secret stream")
+
+// secretStream is the state of one direction of a secretstream: its key,
+// and its nonce, a little-endian 32-bit counter followed by 8 bytes of
+// internal nonce.
+type secretStream struct {
+	key   [KeySize]byte
+	nonce [chacha20.NonceSize]byte
+}
+
+// newSecretStream returns the state of the stream with key and header.
+func newSecretStream(key *[KeySize]byte, header []byte) *secretStream {
+	k, err := chacha20.HChaCha20(key[:], header[:16])
+	if err != nil {
+		// Only possible with arguments of the wrong size.
+		panic(err)
+	}
+	s := &secretStream{}
+	copy(s.key[:], k)
+	copy(s.nonce[4:], header[16:])
+	binary.LittleEndian.PutUint32(s.nonce[:4], 1)
+	return s
+}
+
+// start returns the stream cipher for the next message, along with its
+// Poly1305 key, taken from the first block of the key stream.
+func (s *secretStream) start() (*chacha20.Cipher, *[32]byte) {
+	c, err := chacha20.NewUnauthenticatedCipher(s.key[:], s.nonce[:])
+	if err != nil {
+		panic(err)
+	}
+	var block [64]byte
+	c.XORKeyStream(block[:], block[:])
+	polyKey := new([32]byte)
+	copy(polyKey[:], block[:])
+	return c, polyKey
+}
+
+// secretStreamMAC returns the MAC of a message whose encrypted tag block
+// is block and encrypted contents c.
+func secretStreamMAC(polyKey *[32]byte, block *[64]byte, c []byte) []byte {
+	var pad [16]byte
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(block)+len(c)))
+	m := poly1305.New(polyKey)
+	m.Write(block[:])
+	m.Write(c)
+	// libsodium pads by the length of the message modulo 16, which is not
+	// what aligns it to 16 bytes, and so must be copied as it is.
+	m.Write(pad[:len(c)%16])
+	m.Write(lengths[:])
+	return m.Sum(nil)
+}
+
+// push appends msg, sealed with tag, to dst.
+func (s *secretStream) push(dst, msg []byte, tag byte) []byte {
+	c, polyKey := s.start()
+	var block [64]byte
+	block[0] = tag
+	c.XORKeyStream(block[:], block[:])
+	dst = append(dst, block[0])
+	start := len(dst)
+	dst = append(dst, msg...)
+	c.XORKeyStream(dst[start:], dst[start:])
+	mac := secretStreamMAC(polyKey, &block, dst[start:])
+	s.next(mac, tag)
+	return append(dst, mac...)
+}
+
+// pull opens sealed, which push sealed, and returns the message and its
+// tag, or false if sealed is not authentic.
+func (s *secretStream) pull(sealed []byte) ([]byte, byte, bool) {
+	if len(sealed) < secretStreamOverhead {
+		return nil, 0, false
+	}
+	c, polyKey := s.start()
+	var block [64]byte
+	block[0] = sealed[0]
+	c.XORKeyStream(block[:], block[:])
+	tag := block[0]
+	block[0] = sealed[0]
+	body, mac := sealed[1:len(sealed)-poly1305.TagSize], sealed[len(sealed)-poly1305.TagSize:]
+	want := secretStreamMAC(polyKey, &block, body)
+	if subtle.ConstantTimeCompare(want, mac) != 1 {
+		return nil, 0, false
+	}
+	msg := make([]byte, len(body))
+	c.XORKeyStream(msg, body)
+	s.next(mac, tag)
+	return msg, tag, true
+}
+
+// next moves the stream on past a message with mac and tag.
+func (s *secretStream) next(mac []byte, tag byte) {
+	for i := range 8 {
+		s.nonce[4+i] ^= mac[i]
+	}
+	counter := binary.LittleEndian.Uint32(s.nonce[:4]) + 1
+	binary.LittleEndian.PutUint32(s.nonce[:4], counter)
+	if tag&secretStreamTagRekey != 0 || counter == 0 {
+		s.rekey()
+	}
+}
+
+// rekey replaces the key and internal nonce with ones derived from them,
+// as crypto_secretstream_xchacha20poly1305_rekey does.
+func (s *secretStream) rekey() {
+	var next [KeySize + 8]byte
+	copy(next[:], s.key[:])
+	copy(next[KeySize:], s.nonce[4:])
+	c, err := chacha20.NewUnauthenticatedCipher(s.key[:], s.nonce[:])
+	if err != nil {
+		panic(err)
+	}
+	c.XORKeyStream(next[:], next[:])
+	copy(s.key[:], next[:KeySize])
+	copy(s.nonce[4:], next[KeySize:])
+	binary.LittleEndian.PutUint32(s.nonce[:4], 1)
+	zero(next[:])
+}
+
+// secretStreamWriter seals what is written to it into a secret stream.
+type secretStreamWriter struct {
+	w      io.Writer
+	s      *secretStream
+	closed bool
+}
+
+// NewSecretStreamWriter writes the header of a new secret stream sealed
+// with key to w, and returns a writer that seals data into the stream, as
+// libsodium's crypto_secretstream_xchacha20poly1305 does. Each Write sends
+// one message, or several of up to DefaultMaxFrameSize bytes for longer
+// writes. Close ends the stream, so that the reader can tell it wasn't
+// truncated; it doesn't close w. The writer is not safe for concurrent use.
+func NewSecretStreamWriter(w io.Writer, key *[KeySize]byte) (io.WriteCloser, error) {
+	header := make([]byte, SecretStreamHeaderSize)
+	if _, err := io.ReadFull(rand.Reader, header); err != nil {
+		return nil, err
+	}
+	if err := writeFull(w, header); err != nil {
+		return nil, err
+	}
+	return &secretStreamWriter{w: w, s: newSecretStream(key, header)}, nil
+}
+
+func (sw *secretStreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errSecretStreamClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), DefaultMaxFrameSize)]
+		if err := sw.push(chunk, secretStreamTagMessage); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close sends the final message of the stream.
+func (sw *secretStreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.push(nil, secretStreamTagFinal)
+}
+
+// push sends msg with tag.
+func (sw *secretStreamWriter) push(msg []byte, tag byte) error {
+	frame := make([]byte, lengthSize, lengthSize+len(msg)+secretStreamOverhead)
+	frame = sw.s.push(frame, msg, tag)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-lengthSize))
+	return writeFull(sw.w, frame)
+}
+
+// secretStreamReader opens the messages of a secret stream.
+type secretStreamReader struct {
+	r   io.Reader
+	key *[KeySize]byte
+	s   *secretStream
+
+	// buf holds opened bytes not yet returned to the caller, and final
+	// records whether the final message has been read.
+	buf   []byte
+	final bool
+}
+
+// NewSecretStreamReader returns a reader that opens the secret stream read
+// from r, which starts with its header, with key, as libsodium's
+// crypto_secretstream_xchacha20poly1305 does. It returns io.EOF once it
+// has read the final message, and io.ErrUnexpectedEOF if r ends before it.
+// Messages longer than DefaultMaxFrameSize are rejected. The reader is not
+// safe for concurrent use.
+func NewSecretStreamReader(r io.Reader, key *[KeySize]byte) io.Reader {
+	return &secretStreamReader{r: r, key: key}
+}
+
+func (sr *secretStreamReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(sr.buf) == 0 {
+		if sr.final {
+			return 0, io.EOF
+		}
+		if err := sr.pull(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// pull reads and opens the next message, first reading the header if it
+// hasn't been yet.
+func (sr *secretStreamReader) pull() error {
+	if sr.s == nil {
+		header := make([]byte, SecretStreamHeaderSize)
+		if _, err := io.ReadFull(sr.r, header); err != nil {
+			return err
+		}
+		sr.s = newSecretStream(sr.key, header)
+	}
+	var hdr [lengthSize]byte
+	if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(hdr[:])
+	if maxSealed := uint32(DefaultMaxFrameSize + secretStreamOverhead); length > maxSealed {
+		return &FrameSizeError{Length: length, Limit: maxSealed}
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(sr.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	msg, tag, ok := sr.s.pull(sealed)
+	if !ok {
+		return &DecryptError{}
+	}
+	sr.buf = msg
+	sr.final = tag == secretStreamTagFinal
+	return nil
+}
@@ -0,0 +1,126 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// libsodiumStream is a stream pushed by libsodium 1.0.18 with the key 0, 1,
+// ..., 31: its header, then each message with its tag and ciphertext.
+var libsodiumStream = struct {
+	header   string
+	messages []struct {
+		tag       byte
+		msg       string
+		encrypted string
+	}
+}{
+	header: "f305831e76ee7c8c5d1d0ca47c608799a38d8a089f5f6ef9",
+	messages: []struct {
+		tag       byte
+		msg       string
+		encrypted string
+	}{
+		{0, "hello", "94f4d7a628a10f0f5c348a5110c67376aa4979cc9e84"},
+		{0, "", "d77aaa92b99450d9b9d7355ba04cb4c13d"},
+		{2, "rekeyed next", "462fe6495352defe3b8c58d274f441aa584f31e766e585bbb13cff3074"},
+		{0, string(bytes.Repeat([]byte("x"), 100)), "9744b6668ea645cfe91e549530fe59fcc67fe6c0c7799700adac22cdcb4c2911df56d57a8d829d0e1d9bcb644edc1d7df2b62a9d87cf34a3af50653e118d7db5dd9bc58d41230d536fad95a717fc4ace35e49f579ea625c4799d2103751e83c4f370d20b11380f71c47a82672748c6a0294cc8ba37"},
+		{3, "bye", "8a20e2b35c968c382b928e72d6539040bcd486af"},
+	},
+}
+
+func secretStreamTestKey() *[KeySize]byte {
+	key := new([KeySize]byte)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestSecretStreamLibsodium(t *testing.T) {
+	header, err := hex.DecodeString(libsodiumStream.header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := secretStreamTestKey()
+
+	// Pulling libsodium's messages gives back what it pushed, and pushing
+	// the same messages from the same header gives what it sent.
+	pull, push := newSecretStream(key, header), newSecretStream(key, header)
+	for i, m := range libsodiumStream.messages {
+		want, err := hex.DecodeString(m.encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, tag, ok := pull.pull(want)
+		if !ok || tag != m.tag || string(msg) != m.msg {
+			t.Fatalf("Message %d: unexpected result %q, tag %d, %v", i, msg, tag, ok)
+		}
+		if got := push.push(nil, []byte(m.msg), m.tag); !bytes.Equal(got, want) {
+			t.Fatalf("Message %d: unexpected result %x, expected %x", i, got, want)
+		}
+	}
+
+	// The reader reads the stream framed with lengths.
+	stream := append([]byte(nil), header...)
+	var want []byte
+	for _, m := range libsodiumStream.messages {
+		encrypted, _ := hex.DecodeString(m.encrypted)
+		stream = binary.BigEndian.AppendUint32(stream, uint32(len(encrypted)))
+		stream = append(stream, encrypted...)
+		want = append(want, m.msg...)
+	}
+	got, err := io.ReadAll(NewSecretStreamReader(bytes.NewReader(stream), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+}
+
+func TestSecretStream(t *testing.T) {
+	key := secretStreamTestKey()
+	var buf bytes.Buffer
+	w, err := NewSecretStreamWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("0123456789"), DefaultMaxFrameSize/5)
+	if _, err := w.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(msg); !errors.Is(err, errSecretStreamClosed) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	stream := buf.Bytes()
+
+	got, err := io.ReadAll(NewSecretStreamReader(bytes.NewReader(stream), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("Unexpected result. The message was corrupted.")
+	}
+
+	// A stream cut short before its final message is an error, not EOF.
+	short := stream[:len(stream)-lengthSize-secretStreamOverhead]
+	if _, err := io.ReadAll(NewSecretStreamReader(bytes.NewReader(short), key)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// So is a tampered one.
+	tampered := append([]byte(nil), stream...)
+	tampered[SecretStreamHeaderSize+lengthSize+5] ^= 1
+	var decryptErr *DecryptError
+	if _, err := io.ReadAll(NewSecretStreamReader(bytes.NewReader(tampered), key)); !errors.As(err, &decryptErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,950 @@
+// Package secure implements an encrypted transport built on NaCl box.
+//
+// Peers exchange X25519 public keys in a short handshake, optionally signed
+// with long-term Ed25519 identity keys (see Config.Identity), derive a
+// separate key for each direction (see Session) and then exchange frames
+// sealed with box.SealAfterPrecomputation, or another CipherSuite the peers
+// agree on. Each frame on the wire is
+//
+//	length (4 bytes, big-endian) | nonce (24 bytes) | sealed box (length bytes)
+//
+// The first byte of every sealed plaintext is the frame kind, which marks
+// whether the frame ends a message or more frames of the same message follow,
+// or carries a control payload such as a rekey or a resumption ticket.
+//
+// The constructors that take raw keys (NewSecureReader, NewSecureWriter,
+// NewSecureReadWriter, NewMessageConn and NewSecureConn) do not know which
+// end of the connection they are, so they use the single box key shared by
+// the two key pairs for both directions. They interoperate with each other
+// but not with connections set up by Handshake, Client or Server, and they
+// don't protect against frames being reflected back at their sender.
+//
+// The package provides the reader and writer primitives, a client Dial
+// function, and a SecureServer that serves connections with any Handler.
+// Serve runs one as a secure echo server. DialDatagram and DatagramListener
+// run the protocol over UDP instead, Rendezvous connects peers behind NATs
+// that way through an Introducer, and DialWebSocket and
+// SecureServer.ServeHTTP tunnel it through WebSockets. Peers that can't
+// accept connections at all reach each other through a Relay with
+// ListenRelay and DialRelay. ServeTunnel and ForwardHandler carry plaintext
+// TCP connections through secure ones, to protect existing services, and
+// ReverseTunnel and ServeReverseTunnel do so the other way round. A tunnel
+// to a SOCKSHandler is a SOCKS5 proxy, and ServeHTTPProxy an HTTP proxy in
+// front of one. NewTransport carries HTTP requests to servers serving HTTP
+// on a SecureListener, and package securegrpc runs gRPC over the transport.
+// Upgrade switches a connection that started out in plaintext to it.
+// Config.PreSharedKey replaces the public keys with a symmetric key shared
+// by the peers, and Config.Noise runs a Noise handshake instead of the
+// package's own. Config.CertificateAuthorities trusts peers whose keys a
+// certificate authority certified with SignCertificate, instead of pinning
+// each key. NewSecretStreamWriter and NewSecretStreamReader seal
+// streams as libsodium's crypto_secretstream_xchacha20poly1305 does, for
+// peers that aren't written in Go, and a Config.Obfuscator disguises the
+// traffic from networks that block the protocol. Config.Interceptors
+// run middleware over the plaintext of connections.
+package secure
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// NonceSize is the size, in bytes, of the nonce that prefixes every
+	// encrypted message.
+	NonceSize = 24
+
+	// KeySize is the size, in bytes, of public, private and shared keys.
+	KeySize = 32
+
+	// lengthSize is the size of the big-endian length that prefixes every
+	// frame. The length counts the sealed box only, not the nonce.
+	lengthSize = 4
+
+	// headerSize is the size of the clear-text frame header.
+	headerSize = lengthSize + NonceSize
+
+	// DefaultMaxFrameSize is the largest amount of plaintext sealed into
+	// one frame, unless the peers negotiate another size in the handshake.
+	DefaultMaxFrameSize = 64 * 1024
+
+	// minFrameSize and maxFrameSizeLimit bound the frame sizes peers may
+	// negotiate.
+	minFrameSize      = 1024
+	maxFrameSizeLimit = 16 * 1024 * 1024
+
+	// DefaultMaxMessageSize is the largest message either end sends or
+	// accepts, unless the peers negotiate another size in the handshake.
+	DefaultMaxMessageSize = 16 * 1024 * 1024
+
+	// maxMessageSizeLimit bounds the message sizes peers may negotiate.
+	maxMessageSizeLimit = 1024 * 1024 * 1024
+
+	// maxWriteBatch is how many bytes of sealed frames a writer gathers
+	// before writing them, so that larger messages are written a part at
+	// a time instead of all being held at once.
+	maxWriteBatch = 1024 * 1024
+)
+
+// Frame kinds, carried in the first byte of every sealed plaintext.
+const (
+	// frameFinal carries the last (or only) chunk of a message.
+	frameFinal byte = iota
+
+	// frameMore carries a chunk of a message that continues in the next frame.
+	frameMore
+
+	// frameRekey carries the sender's ephemeral public key. Every later
+	// frame in the same direction is sealed with the key derived from it.
+	frameRekey
+
+	// frameTicket carries a resumption ticket from the server to the
+	// client. It is ignored by readers that don't resume sessions.
+	frameTicket
+
+	// framePing asks the peer to answer with a framePong, and framePong
+	// answers it, echoing the ping's payload. Keepalive pings carry none;
+	// those of Ping carry an 8-byte sequence number.
+	framePing
+	framePong
+)
+
+// secureReader implements the io.Reader interface to read and decrypt messages.
+// It is safe for concurrent use: each Read or readMessage call runs alone.
+type secureReader struct {
+	mu sync.Mutex
+
+	r   io.Reader
+	key *[KeySize]byte
+
+	// suite is the cipher suite frames are opened with, and aead its AEAD
+	// with key, rebuilt whenever key changes.
+	suite CipherSuite
+	aead  cipher.AEAD
+
+	// maxFrame is the largest plaintext chunk a frame may carry. Longer
+	// frames are rejected before anything is allocated for them.
+	maxFrame int
+
+	// maxMessage is the largest message the peer may send, and msgSize the
+	// size of the message being read so far.
+	maxMessage int
+	msgSize    int
+
+	// compression records whether the peer may send compressed chunks.
+	compression bool
+
+	// priv is our private key, used to follow rekeys started by the peer.
+	// It is nil if the reader cannot follow rekeys.
+	priv *[KeySize]byte
+
+	// onTicket, if set, is called with the payload of every frameTicket.
+	onTicket func([]byte)
+
+	// onPing and onPong, if set, are called with the payload of every
+	// framePing and framePong. They must not block.
+	onPing func([]byte)
+	onPong func([]byte)
+
+	// logKey, if set, is called with every key rekeys switch to, for the
+	// key log.
+	logKey func(*[KeySize]byte)
+
+	// trace, if set, logs every frame read.
+	trace frameTracer
+
+	// intercept, if set, passes the plaintext of every data frame through
+	// the connection's interceptors.
+	intercept func([]byte) ([]byte, error)
+
+	// lastRecv is when the last frame was read and lastData when the last
+	// data frame was, in Unix nanoseconds.
+	lastRecv atomic.Int64
+	lastData atomic.Int64
+
+	// buf holds decrypted bytes not yet returned to the caller and more
+	// records whether the message they belong to continues in the next frame.
+	buf  []byte
+	more bool
+
+	// frame is the pooled buffer the last frame was read and decrypted
+	// into, which buf may point into, or nil.
+	frame *[]byte
+
+	// wiped is set once wipe has zeroed the keys.
+	wiped bool
+}
+
+// Read decrypts the next frame from the Reader and copies the decrypted bytes
+// to p. Bytes that don't fit in p are kept and returned by subsequent calls
+// before another frame is read. Message boundaries are not preserved.
+func (sr *secureReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	// Empty messages carry no stream data, so skip over them. Frames that
+	// fit in p are decrypted straight into it, leaving only the frame kind
+	// to be dropped from the front.
+	for len(sr.buf) == 0 {
+		if err := sr.fill(p); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// errInvalidWrite is returned by WriteTo if the Writer claims to have
+// written more than it was given, or less than nothing.
+var errInvalidWrite = errors.New("secure: invalid write result")
+
+// WriteTo decrypts frames until EOF or an error and writes their plaintext
+// to w, straight from the buffer each was decrypted into. Like Read, it
+// takes no account of message boundaries.
+func (sr *secureReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		n, eof, err := sr.writeBufferTo(w)
+		written += int64(n)
+		if eof {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeBufferTo writes the buffered plaintext, or that of the next data
+// frame if none is buffered, to w. It reports whether the Reader is at EOF
+// instead of returning io.EOF, which w may return too.
+func (sr *secureReader) writeBufferTo(w io.Writer) (int, bool, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for len(sr.buf) == 0 {
+		if err := sr.fill(nil); err == io.EOF {
+			return 0, true, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+	}
+	n, err := w.Write(sr.buf)
+	if n < 0 || n > len(sr.buf) {
+		n, err = 0, errInvalidWrite
+	}
+	sr.buf = sr.buf[n:]
+	if err == nil && len(sr.buf) > 0 {
+		err = io.ErrShortWrite
+	}
+	return n, false, err
+}
+
+// readMessage returns the rest of the current message, reading frames until
+// one marks the end of the message.
+func (sr *secureReader) readMessage() ([]byte, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if len(sr.buf) == 0 && !sr.more {
+		if err := sr.fill(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := append([]byte(nil), sr.buf...)
+	for sr.more {
+		if err := sr.fill(nil); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		msg = append(msg, sr.buf...)
+	}
+	sr.buf = nil
+	return msg, nil
+}
+
+// fill replaces the buffered plaintext with the contents of the next data
+// frame, handling any control frames that precede it. Frames are decrypted
+// into dst if they fit, and into a pooled buffer otherwise.
+func (sr *secureReader) fill(dst []byte) error {
+	for {
+		decrypted, err := sr.readFrame(dst)
+		if err != nil {
+			return err
+		}
+		if len(decrypted) == 0 {
+			return &FrameError{Reason: "missing kind"}
+		}
+		if kind := decrypted[0]; kind&frameCompressed != 0 {
+			if !sr.compression || (kind&^frameCompressed != frameFinal && kind&^frameCompressed != frameMore) {
+				return &FrameError{Reason: fmt.Sprintf("unexpected compressed frame of kind %d", kind&^frameCompressed)}
+			}
+			chunk, err := decompress(decrypted[1:], sr.maxFrame)
+			if err != nil {
+				return err
+			}
+			decrypted = append([]byte{kind &^ frameCompressed}, chunk...)
+		}
+		switch decrypted[0] {
+		case frameFinal, frameMore:
+			if err := sr.countChunk(len(decrypted) - 1); err != nil {
+				return err
+			}
+			sr.more = decrypted[0] == frameMore
+			sr.lastData.Store(time.Now().UnixNano())
+		case frameRekey:
+			if err := sr.rekey(decrypted[1:]); err != nil {
+				return err
+			}
+			continue
+		case frameTicket:
+			if sr.onTicket != nil {
+				sr.onTicket(decrypted[1:])
+			}
+			continue
+		case framePing:
+			if sr.onPing != nil {
+				sr.onPing(decrypted[1:])
+			}
+			continue
+		case framePong:
+			if sr.onPong != nil {
+				sr.onPong(decrypted[1:])
+			}
+			continue
+		default:
+			return &FrameError{Reason: fmt.Sprintf("unknown kind %d", decrypted[0])}
+		}
+		sr.buf = decrypted[1:]
+		if sr.intercept != nil {
+			if sr.buf, err = sr.intercept(sr.buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// countChunk adds a chunk of n bytes to the size of the message being read,
+// and fails if the message grows larger than the peer may send.
+func (sr *secureReader) countChunk(n int) error {
+	if !sr.more {
+		sr.msgSize = 0
+	}
+	sr.msgSize += n
+	if sr.msgSize > sr.maxMessage {
+		return &MessageSizeError{Length: sr.msgSize, Limit: sr.maxMessage}
+	}
+	return nil
+}
+
+// readFrame reads a single encrypted frame from the Reader and returns the
+// decrypted contents, in dst if they fit there. Frames may arrive split
+// across any number of underlying reads.
+func (sr *secureReader) readFrame(dst []byte) ([]byte, error) {
+	if sr.wiped {
+		return nil, net.ErrClosed
+	}
+	sr.releaseFrame()
+	// Every frame starts with the length of the sealed box followed by the
+	// nonce.
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], hdr[lengthSize:])
+
+	// The sealed box holds the frame kind, the chunk and the box overhead.
+	// The declared length is checked before anything is allocated for it.
+	length := binary.BigEndian.Uint32(hdr[:lengthSize])
+	if maxSealed := uint32(1 + sr.maxFrame + box.Overhead); length > maxSealed {
+		return nil, &FrameSizeError{Length: length, Limit: maxSealed}
+	}
+	sealed := getBuffer(int(length))
+	defer putBuffer(sealed)
+	encrptd := *sealed
+	if _, err := io.ReadFull(sr.r, encrptd); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	// Interceptors may hand back plaintext that outlives the call, which
+	// must not point into the caller's buffer.
+	size := max(len(encrptd)-box.Overhead, 0)
+	if len(dst) < size || sr.intercept != nil {
+		sr.frame = getBuffer(size)
+		dst = *sr.frame
+	}
+	decrypted, ok := open(dst[:0:size], encrptd, &nonce, sr.key, sr.aead)
+	if !ok {
+		return nil, &DecryptError{}
+	}
+	sr.lastRecv.Store(time.Now().UnixNano())
+	plain, err := unpad(decrypted)
+	if err == nil && sr.trace != nil && len(plain) > 0 {
+		sr.trace(plain[0], &nonce, encrptd, plain[1:])
+	}
+	return plain, err
+}
+
+// releaseFrame returns the buffer of the last frame read to its pool. The
+// plaintext in it must all have been returned.
+func (sr *secureReader) releaseFrame() {
+	if sr.frame != nil {
+		putBuffer(sr.frame)
+		sr.frame = nil
+	}
+}
+
+// wipe overwrites the reader's keys and buffered plaintext with zeros, and
+// makes later reads fail.
+func (sr *secureReader) wipe() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	releaseKey(&sr.key)
+	releaseKey(&sr.priv)
+	zero(sr.buf)
+	sr.releaseFrame()
+	sr.buf, sr.more = nil, false
+	sr.aead = nil
+	sr.wiped = true
+}
+
+// NewSecureReader instantiates a new SecureReader. Unlike a Session, the
+// reader uses the box key shared by priv and pub for both directions.
+func NewSecureReader(r io.Reader, priv, pub *[KeySize]byte) io.Reader {
+	sr, _ := newSharedSession(priv, pub).newReadWriter(r, nil, nil)
+	return sr
+}
+
+// secureWriter implements the io.Writer interface to write encrypted messages.
+// It is safe for concurrent use: the frames of one Write or writeMessage
+// call are never interleaved with those of another. The frames of each
+// message, and any control frames sent ahead of it, are sealed into one
+// buffer and written to the underlying Writer in a single call, unless they
+// add up to more than maxWriteBatch.
+type secureWriter struct {
+	mu sync.Mutex
+
+	w   io.Writer
+	key *[KeySize]byte
+
+	// suite is the cipher suite frames are sealed with, and aead its AEAD
+	// with key, rebuilt whenever key changes.
+	suite CipherSuite
+	aead  cipher.AEAD
+
+	// maxFrame is the largest plaintext chunk sealed into one frame.
+	maxFrame int
+
+	// maxMessage is the largest message the peer accepts.
+	maxMessage int
+
+	// padding are the sizes frame plaintexts are padded to, in increasing
+	// order, or nil to send frames unpadded.
+	padding []int
+
+	// compression records whether chunks of messages may be compressed.
+	compression bool
+
+	// peer is the peer's public key, which the ephemeral key of a rekey is
+	// combined with.
+	peer *[KeySize]byte
+
+	// rekeyBytes and rekeyInterval trigger a rekey once that much plaintext
+	// has been sent or that much time has passed since the last one; zero
+	// disables each.
+	rekeyBytes    int64
+	rekeyInterval time.Duration
+	sent          int64
+	rekeyedAt     time.Time
+
+	// lastData is when the last message was written, in Unix nanoseconds.
+	lastData atomic.Int64
+
+	// queued holds control frames to send ahead of the next frame.
+	queued []queuedFrame
+
+	// bufSize, if positive, has Write gather data in pending, a pooled
+	// buffer of that size, until it fills, Flush is called or bufDelay,
+	// if positive, has passed since pending was started, when flushTimer
+	// fires. flushErr is the error of a flush the timer made, for the next
+	// write or Flush to return.
+	bufSize    int
+	bufDelay   time.Duration
+	pending    []byte
+	pendingBuf *[]byte
+	flushTimer *time.Timer
+	flushErr   error
+
+	// out holds the frames sealed but not yet written, in the pooled
+	// buffer outBuf, and outEnds the offset in out just past each of them.
+	out     []byte
+	outBuf  *[]byte
+	outEnds []int
+
+	// logKey, if set, is called with every key rekeys switch to, for the
+	// key log.
+	logKey func(*[KeySize]byte)
+
+	// trace, if set, logs every frame written.
+	trace frameTracer
+
+	// wiped is set once wipe has zeroed the keys.
+	wiped bool
+
+	// intercept, if set, passes every message through the connection's
+	// interceptors before it is sealed.
+	intercept func([]byte) ([]byte, error)
+}
+
+// queuedFrame is a control frame waiting to be sent.
+type queuedFrame struct {
+	kind    byte
+	payload []byte
+}
+
+// Write encrypts the bytes in p then writes the encrypted frames to the
+// Writer. Large writes are split into messages of at most maxMessage bytes,
+// and those into frames of at most maxFrame bytes of plaintext, so the peer
+// never has to buffer an unbounded frame or message. If the writer buffers,
+// smaller writes are gathered into messages of bufSize bytes instead.
+func (sw *secureWriter) Write(p []byte) (int, error) {
+	if sw.bufSize > 0 {
+		return sw.bufferWrite(p)
+	}
+	var written int
+	for len(p) > 0 {
+		msg := p[:min(len(p), sw.maxMessage)]
+		n, err := sw.write(msg, sw.compression)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(msg):]
+	}
+	return written, nil
+}
+
+// writeMessage writes p as a single message, which may span several frames.
+// An empty p is sent as an empty message. A p longer than the peer accepts
+// is not sent.
+func (sw *secureWriter) writeMessage(p []byte) (int, error) {
+	return sw.write(p, sw.compression)
+}
+
+// bufferWrite adds p to the pending data, sending the pending data as a
+// message whenever bufSize bytes of it are gathered. If nothing is pending,
+// as much of p as fills the buffer is sent as it is, without being copied.
+// It returns how much of p was sent or buffered.
+func (sw *secureWriter) bufferWrite(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.takeFlushErr(); err != nil {
+		return 0, err
+	}
+	var written int
+	for len(p) > 0 {
+		if len(sw.pending) == 0 && len(p) >= sw.bufSize {
+			msg := p[:min(len(p), sw.maxMessage)]
+			n, err := sw.writeLocked(msg, sw.compression)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			p = p[len(msg):]
+			continue
+		}
+		if sw.pendingBuf == nil {
+			sw.pendingBuf = getBuffer(sw.bufSize)
+			sw.pending = (*sw.pendingBuf)[:0]
+			if sw.bufDelay > 0 {
+				sw.startFlushTimer()
+			}
+		}
+		n := min(len(p), sw.bufSize-len(sw.pending))
+		sw.pending = append(sw.pending, p[:n]...)
+		written += n
+		p = p[n:]
+		if len(sw.pending) == sw.bufSize {
+			if err := sw.flushPending(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// startFlushTimer arranges for the pending data to be sent bufDelay from
+// now.
+func (sw *secureWriter) startFlushTimer() {
+	if sw.flushTimer == nil {
+		sw.flushTimer = time.AfterFunc(sw.bufDelay, func() {
+			sw.mu.Lock()
+			defer sw.mu.Unlock()
+			if err := sw.flushPending(); err != nil {
+				sw.flushErr = err
+			}
+		})
+		return
+	}
+	sw.flushTimer.Reset(sw.bufDelay)
+}
+
+// Flush sends the pending data, if any, as a message.
+func (sw *secureWriter) Flush() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.takeFlushErr(); err != nil {
+		return err
+	}
+	return sw.flushPending()
+}
+
+// takeFlushErr returns the error of the last flush the timer made, if it
+// failed, and forgets it.
+func (sw *secureWriter) takeFlushErr() error {
+	err := sw.flushErr
+	sw.flushErr = nil
+	return err
+}
+
+// flushPending sends the pending data, if any, as a message, and returns
+// its buffer to the pool whether or not that succeeds.
+func (sw *secureWriter) flushPending() error {
+	if len(sw.pending) == 0 {
+		return nil
+	}
+	if sw.flushTimer != nil {
+		sw.flushTimer.Stop()
+	}
+	_, err := sw.writeLocked(sw.pending, sw.compression)
+	sw.releasePending()
+	return err
+}
+
+// releasePending returns the buffer of the pending data to its pool.
+func (sw *secureWriter) releasePending() {
+	if sw.pendingBuf != nil {
+		putBuffer(sw.pendingBuf)
+		sw.pending, sw.pendingBuf = nil, nil
+	}
+}
+
+// write writes p as a single message, compressing its chunks if compress
+// is set, after any pending data.
+func (sw *secureWriter) write(p []byte, compress bool) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.takeFlushErr(); err != nil {
+		return 0, err
+	}
+	if err := sw.flushPending(); err != nil {
+		return 0, err
+	}
+	return sw.writeLocked(p, compress)
+}
+
+// writeLocked is write without the lock and the pending data. If
+// interceptors replace p, none of it counts as written unless all of their
+// message is.
+func (sw *secureWriter) writeLocked(p []byte, compress bool) (int, error) {
+	msg := p
+	if sw.intercept != nil {
+		var err error
+		if msg, err = sw.intercept(p); err != nil {
+			return 0, err
+		}
+	}
+	if len(msg) > sw.maxMessage {
+		return 0, &MessageSizeError{Length: len(msg), Limit: sw.maxMessage}
+	}
+	sw.lastData.Store(time.Now().UnixNano())
+
+	// chunks are the plaintext lengths of the data frames not yet written,
+	// by their index in sw.out.
+	type chunk struct{ frame, size int }
+	var chunks []chunk
+	var written int
+	flush := func() error {
+		sent, err := sw.flush()
+		for _, c := range chunks {
+			if c.frame < sent {
+				written += c.size
+			}
+		}
+		chunks = chunks[:0]
+		return err
+	}
+	fail := func(err error) (int, error) {
+		if ferr := flush(); err == nil {
+			err = ferr
+		}
+		if sw.intercept != nil {
+			written = 0
+		}
+		return written, err
+	}
+
+	maxChunk := sw.maxChunk()
+	for {
+		data, kind := msg, frameFinal
+		if len(data) > maxChunk {
+			data, kind = data[:maxChunk], frameMore
+		}
+		payload, flags := data, byte(0)
+		if compress {
+			if z, ok := compressChunk(data); ok {
+				payload, flags = z, frameCompressed
+			}
+		}
+		if err := sw.writeFrame(kind|flags, payload); err != nil {
+			return fail(err)
+		}
+		chunks = append(chunks, chunk{len(sw.outEnds) - 1, len(data)})
+		msg = msg[len(data):]
+		if kind == frameFinal {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+			return len(p), nil
+		}
+		if len(sw.out) >= maxWriteBatch {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+}
+
+// maxChunk returns the most message bytes that fit in one frame.
+func (sw *secureWriter) maxChunk() int {
+	if sw.padding != nil {
+		return sw.maxFrame - paddingHeaderSize
+	}
+	return sw.maxFrame
+}
+
+// ReadFrom reads from r until EOF or an error and writes what each read
+// returns as a message, as Write would. Reads go straight into a pooled
+// buffer of one frame's worth of plaintext, so io.Copy to the writer needs
+// no buffer or copy loop of its own.
+func (sw *secureWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := getBuffer(min(sw.maxChunk(), sw.maxMessage))
+	defer putBuffer(buf)
+	var written int64
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			m, werr := sw.write((*buf)[:n], sw.compression)
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeControl sends a control frame with the given payload.
+func (sw *secureWriter) writeControl(kind byte, payload []byte) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	err := sw.writeFrame(kind, payload)
+	if _, ferr := sw.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// queue arranges for a control frame to be sent ahead of the next frame.
+func (sw *secureWriter) queue(kind byte, payload []byte) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.queued = append(sw.queued, queuedFrame{kind, payload})
+}
+
+// writeFrame seals the frame kind and p into a single frame for the next
+// flush, first sealing any queued control frames and rekeying if a rekey
+// is due.
+func (sw *secureWriter) writeFrame(kind byte, p []byte) error {
+	for len(sw.queued) > 0 {
+		f := sw.queued[0]
+		if err := sw.sealFrame(f.kind, f.payload); err != nil {
+			return err
+		}
+		sw.queued = sw.queued[1:]
+	}
+	if sw.rekeyDue() {
+		if err := sw.rekey(); err != nil {
+			return err
+		}
+	}
+	sw.sent += int64(len(p))
+	return sw.sealFrame(kind, p)
+}
+
+// sealFrame seals the frame kind and p into a single frame for the next
+// flush.
+func (sw *secureWriter) sealFrame(kind byte, p []byte) error {
+	if sw.wiped {
+		return net.ErrClosed
+	}
+	// Generate the nonce
+	var nonce [NonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return fmt.Errorf("secureWriter.Write: %v", err)
+	}
+
+	size := 1 + len(p)
+	if sw.padding != nil {
+		size = paddedSize(1+paddingHeaderSize+len(p), sw.padding, 1+sw.maxFrame)
+	}
+	plainBuf := getBuffer(size)
+	defer putBuffer(plainBuf)
+	plain := *plainBuf
+	if sw.padding != nil {
+		pad(plain, kind, p)
+	} else {
+		plain[0] = kind
+		copy(plain[1:], p)
+	}
+
+	// The frame header (length and nonce) is in the clear.
+	sw.reserve(headerSize + len(plain) + box.Overhead)
+	start := len(sw.out)
+	sw.out = binary.BigEndian.AppendUint32(sw.out, uint32(len(plain)+box.Overhead))
+	sw.out = append(sw.out, nonce[:]...)
+	sw.out = seal(sw.out, plain, &nonce, sw.key, sw.aead)
+	sw.outEnds = append(sw.outEnds, len(sw.out))
+	if sw.trace != nil {
+		sw.trace(kind, &nonce, sw.out[start+headerSize:], p)
+	}
+	return nil
+}
+
+// flush writes the sealed frames to the Writer in a single call, and
+// returns how many of them were written in full. Frames sealed after a
+// rekey can only be opened once the rekey frame has been, so the frames
+// are dropped even when the write fails: the connection is unusable then.
+func (sw *secureWriter) flush() (int, error) {
+	if len(sw.out) == 0 {
+		return 0, nil
+	}
+	n, err := sw.w.Write(sw.out)
+	if err == nil && n < len(sw.out) {
+		err = io.ErrShortWrite
+	}
+	sent := 0
+	for sent < len(sw.outEnds) && sw.outEnds[sent] <= n {
+		sent++
+	}
+	sw.releaseOut()
+	return sent, err
+}
+
+// reserve makes room for n more bytes in out, moving the frames in it to a
+// larger pooled buffer if need be.
+func (sw *secureWriter) reserve(n int) {
+	if cap(sw.out)-len(sw.out) >= n {
+		return
+	}
+	b := getBuffer(len(sw.out) + n)
+	*b = append((*b)[:0], sw.out...)
+	old := sw.outBuf
+	sw.out, sw.outBuf = *b, b
+	if old != nil {
+		putBuffer(old)
+	}
+}
+
+// releaseOut returns the buffer of out to its pool, dropping any frames
+// left in it.
+func (sw *secureWriter) releaseOut() {
+	if sw.outBuf != nil {
+		*sw.outBuf = sw.out
+		putBuffer(sw.outBuf)
+	}
+	sw.out, sw.outBuf, sw.outEnds = nil, nil, sw.outEnds[:0]
+}
+
+// wipe overwrites the writer's key and pending data with zeros, and makes
+// later writes fail.
+func (sw *secureWriter) wipe() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	releaseKey(&sw.key)
+	sw.aead = nil
+	sw.queued = nil
+	if sw.flushTimer != nil {
+		sw.flushTimer.Stop()
+	}
+	sw.releasePending()
+	sw.releaseOut()
+	sw.wiped = true
+}
+
+// NewSecureWriter instantiates a new SecureWriter. Unlike a Session, the
+// writer uses the box key shared by priv and pub for both directions.
+func NewSecureWriter(w io.Writer, priv, pub *[KeySize]byte) io.Writer {
+	_, sw := newSharedSession(priv, pub).newReadWriter(nil, w, nil)
+	return sw
+}
+
+// secureReadWriter implements the MessageConn interface to read and write
+// secure messages.
+type secureReadWriter struct {
+	rwc io.ReadWriteCloser
+	sw  *secureWriter
+	sr  *secureReader
+}
+
+// NewSecureReadWriter instantiates a new secureReadWriter
+func NewSecureReadWriter(rwc io.ReadWriteCloser, priv, pub *[KeySize]byte) io.ReadWriteCloser {
+	return NewMessageConn(rwc, priv, pub)
+}
+
+func (srw *secureReadWriter) Read(p []byte) (int, error) {
+	return srw.sr.Read(p)
+}
+
+func (srw *secureReadWriter) Write(p []byte) (int, error) {
+	return srw.sw.Write(p)
+}
+
+func (srw *secureReadWriter) ReadMessage() ([]byte, error) {
+	return srw.sr.readMessage()
+}
+
+func (srw *secureReadWriter) WriteMessage(p []byte) error {
+	_, err := srw.sw.writeMessage(p)
+	return err
+}
+
+func (srw *secureReadWriter) Close() error {
+	return srw.rwc.Close()
+}
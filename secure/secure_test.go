@@ -0,0 +1,708 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestBasicConcepts(t *testing.T) {
+	// Client key pair
+	cpub, cpri, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Server key pair
+	spub, spri, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmsg := "hello server"
+	smsg := "hello client"
+
+	// buf := make([]byte, 1024)
+	nonce := [24]byte{1}
+
+	// Encrypt client message using server public key and client private key
+	encrypted := box.Seal(nil, []byte(cmsg), &nonce, spub, cpri)
+
+	// decrypt client message using client public key and server private key
+	decrypted, _ := box.Open(nil, encrypted, &nonce, cpub, spri)
+
+	if string(decrypted) != cmsg {
+		t.Fatalf("Unexpected result: %s != %s", decrypted, cmsg)
+	}
+
+	// Encrypt the server msg using client public key and server private key
+	encrypted = box.Seal(nil, []byte(smsg), &nonce, cpub, spri)
+
+	// decrypt the server msg server public key and client private key
+	decrypted, _ = box.Open(nil, encrypted, &nonce, spub, cpri)
+	if string(decrypted) != smsg {
+		t.Fatalf("Unexpected result: %s != %s", decrypted, smsg)
+	}
+}
+
+func TestReadWriterPing(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	r, w := io.Pipe()
+	secureR := NewSecureReader(r, priv, pub)
+	secureW := NewSecureWriter(w, priv, pub)
+
+	// Encrypt hello world
+	go func() {
+		fmt.Fprintf(secureW, "hello world\n")
+		w.Close()
+	}()
+
+	// Decrypt message
+	buf := make([]byte, 1024)
+	n, err := secureR.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	buf = buf[:n]
+
+	// Make sure we have hello world back
+	if res := string(buf); res != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
+	}
+}
+
+func TestReadWriterSplitFrames(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewSecureWriter(&buf, priv, pub)
+	if _, err := fmt.Fprint(secureW, "hello world\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliver the frame one byte at a time to simulate segmentation.
+	secureR := NewSecureReader(iotest.OneByteReader(&buf), priv, pub)
+	got := make([]byte, 1024)
+	n, err := secureR.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(got[:n]); res != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
+	}
+}
+
+func TestReadWriterSmallBuffer(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewSecureWriter(&buf, priv, pub)
+	secureR := NewSecureReader(&buf, priv, pub)
+	if _, err := fmt.Fprint(secureW, "hello world\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprint(secureW, "bye\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read with a buffer smaller than the messages; nothing may be dropped.
+	got, err := ioutil.ReadAll(iotest.OneByteReader(secureR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(got); res != "hello world\nbye\n" {
+		t.Fatalf("Unexpected result: %q != %q", res, "hello world\nbye\n")
+	}
+}
+
+func TestReaderDecryptsIntoCallerBuffer(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var frames bytes.Buffer
+	_, sw := newSharedSession(priv, pub).newReadWriter(nil, &frames, &Config{PaddingBuckets: []int{256}})
+	if _, err := sw.Write([]byte("padded")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.writeControl(framePing, []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write([]byte("after ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, _ := newSharedSession(priv, pub).newReadWriter(&frames, nil, nil)
+	var pings int
+	sr.onPing = func([]byte) { pings++ }
+	p := make([]byte, 1024)
+	for _, want := range []string{"padded", "after ping"} {
+		n, err := sr.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(p[:n]); got != want {
+			t.Fatalf("Unexpected result: %q != %q", got, want)
+		}
+		if sr.frame != nil || len(sr.buf) != 0 {
+			t.Fatalf("Frame of %q was not decrypted into the caller's buffer", want)
+		}
+	}
+	if pings != 1 {
+		t.Fatalf("Handled %d pings, expected 1", pings)
+	}
+
+}
+
+func TestReadWriterLargeMessage(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	msg := make([]byte, 3*DefaultMaxFrameSize+100)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	secureW := NewSecureWriter(&buf, priv, pub)
+	n, err := secureW.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) {
+		t.Fatalf("Unexpected write count: %d != %d", n, len(msg))
+	}
+
+	// Each chunk is sealed in its own frame.
+	if want := len(msg) + 4*(headerSize+1+box.Overhead); buf.Len() != want {
+		t.Fatalf("Unexpected encrypted size: %d != %d", buf.Len(), want)
+	}
+
+	got, err := ioutil.ReadAll(NewSecureReader(&buf, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("Unexpected result. The large message was not reassembled.")
+	}
+}
+
+// countingWriter counts the calls to Write, and fails them with
+// io.ErrClosedPipe once limit bytes have been written, if limit is set.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+	limit  int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.limit > 0 && w.Len()+len(p) > w.limit {
+		n, _ := w.Buffer.Write(p[:w.limit-w.Len()])
+		return n, io.ErrClosedPipe
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestBufferedWriter(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var frames countingWriter
+	config := &Config{WriteBufferSize: 100}
+	_, sw := newSharedSession(priv, pub).newReadWriter(nil, &frames, config)
+	for range 5 {
+		if n, err := sw.Write([]byte("0123456789")); err != nil || n != 10 {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+	}
+	if frames.writes != 0 {
+		t.Fatalf("Made %d writes before the buffer filled", frames.writes)
+	}
+	if err := sw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if frames.writes != 1 {
+		t.Fatalf("Made %d writes on Flush, expected 1", frames.writes)
+	}
+
+	// A full buffer is sent as it fills, and a message goes after the data
+	// pending ahead of it.
+	for _, n := range []int{60, 90} {
+		if _, err := sw.Write(bytes.Repeat([]byte("a"), n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sw.writeMessage([]byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	if frames.writes != 4 {
+		t.Fatalf("Made %d writes, expected 4", frames.writes)
+	}
+	if err := sw.Flush(); err != nil || frames.writes != 4 {
+		t.Fatalf("Flush with nothing pending made %d writes, %v", frames.writes-4, err)
+	}
+
+	// Writes as large as the buffer skip it.
+	if _, err := sw.Write(bytes.Repeat([]byte("b"), 150)); err != nil || frames.writes != 5 {
+		t.Fatalf("Large write made %d writes, %v, expected 1", frames.writes-4, err)
+	}
+
+	sr, _ := newSharedSession(priv, pub).newReadWriter(&frames.Buffer, nil, nil)
+	for _, want := range []string{strings.Repeat("0123456789", 5), strings.Repeat("a", 100), strings.Repeat("a", 50), "message", strings.Repeat("b", 150)} {
+		msg, err := sr.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != want {
+			t.Fatalf("Unexpected message: %q != %q", msg, want)
+		}
+	}
+
+	// Pending data is sent by itself once the delay has passed.
+	config.WriteBufferDelay = 10 * time.Millisecond
+	_, sw = newSharedSession(priv, pub).newReadWriter(nil, &frames, config)
+	if _, err := sw.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sw.mu.Lock()
+		writes := frames.writes
+		sw.mu.Unlock()
+		if writes == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Pending data was not sent after the delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if msg, err := sr.readMessage(); err != nil || string(msg) != "late" {
+		t.Fatalf("Read %q, %v, expected %q", msg, err, "late")
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	msg := make([]byte, 3*DefaultMaxFrameSize+100)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	var frames countingWriter
+	_, sw := newSharedSession(priv, pub).newReadWriter(nil, &frames, nil)
+
+	// Hide the source's WriteTo, so that io.Copy has to use ReadFrom.
+	n, err := io.Copy(sw, struct{ io.Reader }{bytes.NewReader(msg)})
+	if err != nil || n != int64(len(msg)) {
+		t.Fatalf("Copied %d bytes, %v, expected %d", n, err, len(msg))
+	}
+	if frames.writes != 4 {
+		t.Fatalf("Made %d writes, expected one per frame", frames.writes)
+	}
+	sr, _ := newSharedSession(priv, pub).newReadWriter(&frames.Buffer, nil, nil)
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("Read back something other than what was copied")
+	}
+
+	// Errors of the source are returned once what was read is written.
+	n, err = sw.ReadFrom(iotest.DataErrReader(strings.NewReader("tail")))
+	if err != nil || n != 4 {
+		t.Fatalf("Copied %d bytes, %v, expected 4", n, err)
+	}
+	errSource := errors.New("source failed")
+	if _, err := sw.ReadFrom(iotest.ErrReader(errSource)); err != errSource {
+		t.Fatalf("Unexpected error: %v, expected %v", err, errSource)
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	msg := make([]byte, 3*DefaultMaxFrameSize+100)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	var frames bytes.Buffer
+	_, sw := newSharedSession(priv, pub).newReadWriter(nil, &frames, nil)
+	if _, err := sw.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	wire := frames.Bytes()
+
+	// Hide the destination's ReadFrom, so that io.Copy has to use WriteTo.
+	sr, _ := newSharedSession(priv, pub).newReadWriter(bytes.NewReader(wire), nil, nil)
+	var got countingWriter
+	n, err := io.Copy(struct{ io.Writer }{&got}, sr)
+	if err != nil || n != int64(len(msg)+4) {
+		t.Fatalf("Copied %d bytes, %v, expected %d", n, err, len(msg)+4)
+	}
+	if want := append(msg, "tail"...); !bytes.Equal(got.Bytes(), want) {
+		t.Fatal("Copied something other than what was written")
+	}
+	if got.writes != 5 {
+		t.Fatalf("Made %d writes, expected one per data frame", got.writes)
+	}
+
+	// Bytes the destination refuses stay buffered for the next read.
+	sr, _ = newSharedSession(priv, pub).newReadWriter(bytes.NewReader(wire), nil, nil)
+	short := &countingWriter{limit: 10}
+	if n, err := sr.WriteTo(short); err != io.ErrClosedPipe || n != 10 {
+		t.Fatalf("Copied %d bytes, %v, expected 10 and %v", n, err, io.ErrClosedPipe)
+	}
+	rest := make([]byte, 5)
+	if _, err := io.ReadFull(sr, rest); err != nil || !bytes.Equal(rest, msg[10:15]) {
+		t.Fatalf("Read %v, %v after a short write, expected %v", rest, err, msg[10:15])
+	}
+
+	// A truncated stream is an error, not EOF.
+	sr, _ = newSharedSession(priv, pub).newReadWriter(bytes.NewReader(wire[:len(wire)-1]), nil, nil)
+	if _, err := sr.WriteTo(io.Discard); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error: %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWriterSingleWrite(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	msg := make([]byte, 3*DefaultMaxFrameSize+100)
+
+	// A message of several frames, with a control frame queued ahead of
+	// it, is written at once.
+	var w countingWriter
+	sr, sw := newSharedSession(priv, pub).newReadWriter(&w, &w, nil)
+	sw.queue(frameTicket, []byte("ticket"))
+	if _, err := sw.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 1 {
+		t.Fatalf("Unexpected result. The message took %d writes.", w.writes)
+	}
+	if got, err := sr.readMessage(); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Unexpected result: %d bytes, %v", len(got), err)
+	}
+
+	// Messages larger than a batch are written a batch at a time.
+	w = countingWriter{}
+	_, sw = newSharedSession(priv, pub).newReadWriter(nil, &w, nil)
+	if _, err := sw.writeMessage(make([]byte, 2*maxWriteBatch)); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 2 {
+		t.Fatalf("Unexpected result. The message took %d writes, expected 2.", w.writes)
+	}
+
+	// A failed write counts the frames that made it whole.
+	w = countingWriter{limit: headerSize + 1 + DefaultMaxFrameSize + box.Overhead + 10}
+	_, sw = newSharedSession(priv, pub).newReadWriter(nil, &w, nil)
+	n, err := sw.Write(msg)
+	if !errors.Is(err, io.ErrClosedPipe) || n != DefaultMaxFrameSize {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+}
+
+// benchmarkSizes are the message sizes the reader and writer are
+// benchmarked with.
+var benchmarkSizes = []int{64, 1024, DefaultMaxFrameSize, 4 * DefaultMaxFrameSize}
+
+func BenchmarkWrite(b *testing.B) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			_, sw := newSharedSession(priv, pub).newReadWriter(nil, io.Discard, nil)
+			msg := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := sw.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			var frames bytes.Buffer
+			_, sw := newSharedSession(priv, pub).newReadWriter(nil, &frames, nil)
+			if _, err := sw.Write(make([]byte, size)); err != nil {
+				b.Fatal(err)
+			}
+			wire := bytes.NewReader(frames.Bytes())
+			sr, _ := newSharedSession(priv, pub).newReadWriter(wire, nil, nil)
+			buf := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				wire.Seek(0, io.SeekStart)
+				if _, err := io.ReadFull(sr, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderRejectsOversizedFrame(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// A header declaring a 4 GiB frame, with no frame behind it.
+	hdr := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(hdr, 0xffffffff)
+
+	secureR := NewSecureReader(bytes.NewReader(hdr), priv, pub)
+	_, err := secureR.Read(make([]byte, 1024))
+	var sizeErr *FrameSizeError
+	if !errors.As(err, &sizeErr) || sizeErr.Length != 0xffffffff || !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Unexpected error: %v, expected the frame to be rejected", err)
+	}
+}
+
+func TestSecureWriter(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	r, w := io.Pipe()
+	secureW := NewSecureWriter(w, priv, pub)
+
+	// Make sure we are secure
+	// Encrypt hello world
+	go func() {
+		fmt.Fprintf(secureW, "hello world\n")
+		w.Close()
+	}()
+
+	// Read from the underlying transport instead of the decoder
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure we dont' read the plain text message.
+	if res := string(buf); res == "hello world\n" {
+		t.Fatal("Unexpected result. The message is not encrypted.")
+	}
+
+	r, w = io.Pipe()
+	secureW = NewSecureWriter(w, priv, pub)
+
+	// Make sure we are unique
+	// Encrypt hello world
+	go func() {
+		fmt.Fprintf(secureW, "hello world\n")
+		w.Close()
+	}()
+
+	// Read from the underlying transport instead of the decoder
+	buf2, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure we dont' read the plain text message.
+	if string(buf) == string(buf2) {
+		t.Fatal("Unexpected result. The encrypted message is not unique.")
+	}
+
+}
+
+func TestSecureEchoServer(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Start the server
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestSecureServe(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Start the server
+	go Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unexpected := "hello world\n"
+	if _, err := fmt.Fprint(conn, unexpected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got == unexpected {
+		t.Fatalf("Unexpected result:\nGot raw data instead of serialized key")
+	}
+}
+
+func TestSecureDial(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Start the server
+	go func(l net.Listener) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				kp, err := GenerateKeyPair()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// A server of version 1, which sends no finished message.
+				c.Write(append(append(protocolMagic[:], 1), handshakeMessage{fieldPublicKey: kp.Public[:]}.marshal(msgServerHello)...))
+				c.Write(handshakeMessage{}.marshal(msgServerDone))
+				buf := make([]byte, 2048)
+				n, err := c.Read(buf)
+				if err != nil && err != io.EOF {
+					t.Error(err)
+					return
+				}
+				if got := string(buf[:n]); got == "hello world\n" {
+					t.Error("Unexpected result. Got raw data instead of encrypted")
+				}
+			}(conn)
+		}
+	}(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoreThanOneExchange(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Start the server
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+
+	expected = "hello world again!\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	n, err = conn.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestReaderRejectsFramesAboveNegotiatedSize(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer seals full default-sized frames, but the reader agreed to
+	// smaller ones.
+	var buf bytes.Buffer
+	sender := newSession(ckeys, skeys.Public, ClientRole, nil, nil).MessageConn(pipeConn{&buf, &buf})
+	receiver := newSession(skeys, ckeys.Public, ServerRole, nil, nil)
+	receiver.MaxFrameSize = minFrameSize
+	if err := sender.WriteMessage(make([]byte, 2*minFrameSize)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiver.MessageConn(pipeConn{&buf, &buf}).ReadMessage()
+	var sizeErr *FrameSizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("Unexpected error: %v, expected a frame above the negotiated size to be rejected", err)
+	}
+}
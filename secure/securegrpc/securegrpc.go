@@ -0,0 +1,128 @@
+// Package securegrpc runs gRPC over the secure transport instead of TLS:
+//
+//	conn, err := grpc.NewClient(addr,
+//		securegrpc.WithDialer(config),
+//		grpc.WithTransportCredentials(securegrpc.Credentials()))
+//
+// dials secure connections to a server that serves them from a Listener:
+//
+//	l, err := securegrpc.Listen(tcpListener, config)
+//	...
+//	srv := grpc.NewServer(grpc.Creds(securegrpc.Credentials()))
+//	srv.Serve(l)
+//
+// Handlers learn the public key of the client with PeerPublicKey.
+package securegrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/jppunnett/gochal2/secure"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// authType is the AuthType of AuthInfo.
+const authType = "gochal2"
+
+var errNotSecure = errors.New("securegrpc: not a secure connection; dial with WithDialer and serve from Listen")
+
+// WithDialer returns a DialOption that connects with secure.DialWithConfig
+// and config. Pass Credentials too, as gRPC otherwise insists on TLS.
+//
+// gRPC resolves the target before dialing, so the addresses dialed, which
+// known hosts are recorded by, are IP addresses unless the target uses the
+// passthrough scheme, such as "passthrough:///example.com:8080".
+func WithDialer(config *secure.Config) grpc.DialOption {
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return secure.DialWithConfig(ctx, addr, config)
+	})
+}
+
+// Listen returns a listener that accepts secure connections on l, for a
+// grpc.Server to serve with Credentials. It is a secure.SecureListener.
+func Listen(l net.Listener, config *secure.Config) (net.Listener, error) {
+	return secure.NewSecureListener(l, config)
+}
+
+// AuthInfo is the AuthInfo of gRPC peers connected through the secure
+// transport.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+
+	// PeerPublicKey is the public key the peer presented, or nil if the
+	// peers used a pre-shared key.
+	PeerPublicKey *[secure.KeySize]byte
+}
+
+// AuthType returns "gochal2".
+func (AuthInfo) AuthType() string {
+	return authType
+}
+
+// PeerPublicKey returns the public key of the peer of the RPC whose context
+// is ctx, or false if the peer didn't connect through the secure transport
+// or used a pre-shared key.
+func PeerPublicKey(ctx context.Context) (*[secure.KeySize]byte, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	if !ok {
+		return nil, false
+	}
+	return info.PeerPublicKey, info.PeerPublicKey != nil
+}
+
+// Credentials returns the TransportCredentials of connections made with
+// WithDialer and accepted by Listen. The secure transport has already run
+// its handshake on them, so the credentials only check that it did, and
+// tell gRPC that the connections are private and authenticated.
+func Credentials() credentials.TransportCredentials {
+	return transportCredentials{}
+}
+
+type transportCredentials struct{}
+
+func (transportCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return handshake(conn)
+}
+
+func (transportCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return handshake(conn)
+}
+
+// handshake returns the AuthInfo of conn.
+func handshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	sc, ok := conn.(*secure.SecureConn)
+	if !ok {
+		return nil, nil, errNotSecure
+	}
+	pub, err := sc.PeerPublicKey()
+	if err != nil && !errors.Is(err, secure.ErrNoPeerKey) {
+		return nil, nil, err
+	}
+	info := AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		PeerPublicKey:  pub,
+	}
+	return conn, info, nil
+}
+
+func (transportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: authType}
+}
+
+func (c transportCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+// OverrideServerName does nothing; name the server with Config.ServerName
+// instead.
+func (transportCredentials) OverrideServerName(string) error {
+	return nil
+}
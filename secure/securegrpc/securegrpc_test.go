@@ -0,0 +1,71 @@
+package securegrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jppunnett/gochal2/secure"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// keyHealthServer is a health server that records the key of its client.
+type keyHealthServer struct {
+	*health.Server
+	keys chan *[secure.KeySize]byte
+}
+
+func (s *keyHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	key, _ := PeerPublicKey(ctx)
+	s.keys <- key
+	return s.Server.Check(ctx, req)
+}
+
+func TestGRPC(t *testing.T) {
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen(tl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(Credentials()))
+	hs := &keyHealthServer{Server: health.NewServer(), keys: make(chan *[secure.KeySize]byte, 1)}
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	keys, err := secure.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.NewClient("passthrough:///"+tl.Addr().String(),
+		WithDialer(&secure.Config{Keys: keys}),
+		grpc.WithTransportCredentials(Credentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Unexpected status: %v", resp.Status)
+	}
+	if got := <-hs.keys; got == nil || *got != *keys.Public {
+		t.Fatal("The server saw another client key")
+	}
+}
+
+func TestCredentialsRefusePlainConnections(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, _, err := Credentials().ServerHandshake(c1); err != errNotSecure {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
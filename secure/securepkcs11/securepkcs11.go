@@ -0,0 +1,203 @@
+//go:build cgo
+
+// Package securepkcs11 keeps the identity key of the secure transport on a
+// hardware token, such as a YubiKey or an HSM, which signs the handshake
+// through its PKCS#11 module without the private key ever leaving it:
+//
+//	id, err := securepkcs11.Open("/usr/lib/libykcs11.so", "", pin, "gochal2")
+//	...
+//	defer id.Close()
+//	config := &secure.Config{IdentitySigner: id}
+//
+// The key must be an Ed25519 key, which PKCS#11 calls an Edwards curve
+// key, on a token that supports the EdDSA mechanism of PKCS#11 3.0. The
+// package needs cgo to load the module; built without cgo, Open always
+// fails.
+package securepkcs11
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 3.0 values missing from the pkcs11 package.
+const (
+	ckkECEdwards = 0x40
+	ckmEdDSA     = 0x1057
+)
+
+var (
+	errNoToken = errors.New("securepkcs11: token not found")
+	errNoKey   = errors.New("securepkcs11: Ed25519 key not found on the token")
+	errClosed  = errors.New("securepkcs11: identity closed")
+)
+
+// Identity is an Ed25519 identity key on a token. It is a crypto.Signer,
+// for secure.Config.IdentitySigner, and is safe for concurrent use.
+type Identity struct {
+	pub ed25519.PublicKey
+
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+// Open loads the PKCS#11 module at the path module, logs in to the token labelled
+// token, or the first token present if token is empty, with pin, and
+// returns the identity whose key pair is labelled label.
+func Open(module, token, pin, label string) (*Identity, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("securepkcs11: cannot load module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("securepkcs11: %v", err)
+	}
+	id := &Identity{ctx: ctx}
+	if err := id.open(token, pin, label); err != nil {
+		id.Close()
+		return nil, err
+	}
+	return id, nil
+}
+
+// open opens a session on the token, logs in and finds the key pair.
+func (id *Identity) open(token, pin, label string) error {
+	slot, err := findSlot(id.ctx, token)
+	if err != nil {
+		return err
+	}
+	if id.session, err = id.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+		return fmt.Errorf("securepkcs11: %v", err)
+	}
+	if err := id.ctx.Login(id.session, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("securepkcs11: login: %v", err)
+	}
+	if id.key, err = id.findKey(pkcs11.CKO_PRIVATE_KEY, label); err != nil {
+		return err
+	}
+	pubKey, err := id.findKey(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return err
+	}
+	attrs, err := id.ctx.GetAttributeValue(id.session, pubKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("securepkcs11: %v", err)
+	}
+	id.pub, err = parseECPoint(attrs[0].Value)
+	return err
+}
+
+// findSlot returns the slot of the token labelled token, or of the first
+// token if token is empty.
+func findSlot(ctx *pkcs11.Ctx, token string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("securepkcs11: %v", err)
+	}
+	for _, slot := range slots {
+		if token == "" {
+			return slot, nil
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err == nil && strings.TrimRight(info.Label, " \x00") == token {
+			return slot, nil
+		}
+	}
+	return 0, errNoToken
+}
+
+// findKey returns the Ed25519 key of the given class labelled label.
+func (id *Identity) findKey(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECEdwards),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := id.ctx.FindObjectsInit(id.session, template); err != nil {
+		return 0, fmt.Errorf("securepkcs11: %v", err)
+	}
+	objs, _, err := id.ctx.FindObjects(id.session, 1)
+	if ferr := id.ctx.FindObjectsFinal(id.session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("securepkcs11: %v", err)
+	}
+	if len(objs) == 0 {
+		return 0, errNoKey
+	}
+	return objs[0], nil
+}
+
+// parseECPoint decodes the CKA_EC_POINT of an Ed25519 public key: the key
+// in a DER octet string, or the bare key as some tokens return it.
+func parseECPoint(point []byte) (ed25519.PublicKey, error) {
+	if len(point) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(point), nil
+	}
+	var key []byte
+	rest, err := asn1.Unmarshal(point, &key)
+	if err != nil || len(rest) != 0 || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("securepkcs11: malformed Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Public returns the Ed25519 public key of the identity.
+func (id *Identity) Public() crypto.PublicKey {
+	return id.pub
+}
+
+// Sign has the token sign message. Like ed25519.PrivateKey.Sign, it
+// requires opts.HashFunc() to be zero, and ignores rand.
+func (id *Identity) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("securepkcs11: cannot sign hashed messages")
+	}
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.ctx == nil {
+		return nil, errClosed
+	}
+	if err := id.ctx.SignInit(id.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, nil)}, id.key); err != nil {
+		return nil, fmt.Errorf("securepkcs11: %v", err)
+	}
+	sig, err := id.ctx.Sign(id.session, message)
+	if err != nil {
+		return nil, fmt.Errorf("securepkcs11: %v", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("securepkcs11: token returned a malformed signature")
+	}
+	return sig, nil
+}
+
+// Close logs out of the token and unloads the module.
+func (id *Identity) Close() error {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.ctx == nil {
+		return nil
+	}
+	if id.session != 0 {
+		id.ctx.Logout(id.session)
+		id.ctx.CloseSession(id.session)
+	}
+	err := id.ctx.Finalize()
+	id.ctx.Destroy()
+	id.ctx = nil
+	return err
+}
@@ -0,0 +1,35 @@
+//go:build !cgo
+
+package securepkcs11
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+var errNoCgo = errors.New("securepkcs11: loading a PKCS#11 module requires cgo")
+
+// Identity is an Ed25519 identity key on a token. Without cgo no token
+// can be opened, so there are no identities.
+type Identity struct{}
+
+// Open fails, as loading the PKCS#11 module requires cgo.
+func Open(module, token, pin, label string) (*Identity, error) {
+	return nil, errNoCgo
+}
+
+// Public returns nil, as the identity has no key.
+func (id *Identity) Public() crypto.PublicKey {
+	return nil
+}
+
+// Sign fails, as the identity has no token.
+func (id *Identity) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errNoCgo
+}
+
+// Close does nothing.
+func (id *Identity) Close() error {
+	return nil
+}
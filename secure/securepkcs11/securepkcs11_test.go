@@ -0,0 +1,41 @@
+//go:build cgo
+
+package securepkcs11
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/asn1"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseECPoint(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal([]byte(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, point := range [][]byte{der, pub} {
+		got, err := parseECPoint(point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, pub) {
+			t.Fatal("Unexpected result. Parsed the wrong public key.")
+		}
+	}
+	if _, err := parseECPoint(der[:len(der)-1]); err == nil {
+		t.Fatal("Expected an error. The point is truncated.")
+	}
+}
+
+func TestOpenMissingModule(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.so"), "", "", "gochal2"); err == nil {
+		t.Fatal("Expected an error. The module does not exist.")
+	}
+}
@@ -0,0 +1,401 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by SecureServer.Serve after a call to Shutdown
+// or Close.
+var ErrServerClosed = errors.New("secure: server closed")
+
+// ErrConnLifetimeExceeded is returned by the reads and writes of a
+// connection that a SecureServer closed because it was served for longer
+// than its MaxConnLifetime.
+var ErrConnLifetimeExceeded = errors.New("secure: connection lifetime exceeded")
+
+// A Handler serves a secure connection accepted by a SecureServer. The
+// server closes the connection once Handle returns.
+type Handler interface {
+	Handle(conn net.Conn)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(conn net.Conn)
+
+// Handle calls f(conn).
+func (f HandlerFunc) Handle(conn net.Conn) {
+	f(conn)
+}
+
+// EchoHandler is the Handler of the echo server. It echoes everything the
+// client sends until the client closes the connection or the connection's
+// idle timeout fires.
+var EchoHandler Handler = HandlerFunc(handleConnection)
+
+// SecureServer serves secure connections on any number of listeners and can
+// be shut down gracefully. The zero value is a ready to use echo server.
+type SecureServer struct {
+	// Config configures the server's connections. It may be nil. Once the
+	// server is serving, change it with Reload only.
+	Config *Config
+
+	// Handler serves each connection. If nil, EchoHandler is used.
+	Handler Handler
+
+	// MaxHandlers, if positive, limits how many connections are served at
+	// once, across all listeners, so that a flood of connections can't
+	// exhaust memory. Once that many are, Serve waits for one to finish
+	// before accepting another, or, if RejectWhenBusy is set, accepts and
+	// closes new connections straight away. Set both before serving.
+	MaxHandlers    int
+	RejectWhenBusy bool
+
+	// slots holds a token for every connection being served while
+	// MaxHandlers is set.
+	slotsOnce sync.Once
+	slots     chan struct{}
+
+	// wg counts the connections being served, for Shutdown to wait for.
+	wg sync.WaitGroup
+
+	// mu guards the fields below.
+	mu         sync.Mutex
+	listeners  map[*SecureListener]struct{}
+	conns      map[net.Conn]*servedConn
+	inShutdown bool
+}
+
+// servedConn is a connection in the server's registry. start is zero
+// until its handshake completes and the handler starts serving it.
+type servedConn struct {
+	conn  *SecureConn
+	start time.Time
+
+	// expire closes the connection after its MaxConnLifetime, if any.
+	expire *time.Timer
+}
+
+// ConnInfo describes a connection a SecureServer is serving.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+
+	// Peer is the fingerprint of the client's key, or "pre-shared key".
+	Peer string
+
+	// Resumed reports whether the client resumed an earlier session.
+	Resumed bool
+
+	// Start is when the server started serving the connection.
+	Start time.Time
+}
+
+// Serve starts a secure echo server on the given listener.
+func Serve(l net.Listener) error {
+	return ServeWithConfig(l, nil)
+}
+
+// ServeWithConfig is like Serve but uses the given config, which may be
+// nil.
+func ServeWithConfig(l net.Listener, config *Config) error {
+	srv := &SecureServer{Config: config}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in a new
+// goroutine. It always returns a non-nil error; after Shutdown or Close the
+// error is ErrServerClosed.
+func (srv *SecureServer) Serve(l net.Listener) error {
+	sl, err := srv.listen(l)
+	if err != nil {
+		return err
+	}
+	defer srv.untrackListener(sl)
+
+	// Wait for and handle incoming connections.
+	slots := srv.handlerSlots()
+	for {
+		if slots != nil && !srv.RejectWhenBusy {
+			slots <- struct{}{}
+		}
+		conn, err := sl.Accept()
+		if err != nil {
+			srv.releaseSlot(slots)
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if slots != nil && srv.RejectWhenBusy {
+			select {
+			case slots <- struct{}{}:
+			default:
+				conn.(*SecureConn).config.logger().Warn("server busy, connection refused", "remote", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+		}
+		sc := conn.(*SecureConn)
+		if !srv.trackConn(sc, true) {
+			srv.releaseSlot(slots)
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer srv.releaseSlot(slots)
+			defer srv.trackConn(sc, false)
+			srv.serveConn(sc)
+		}()
+	}
+}
+
+// handlerSlots returns the channel that limits the connections served to
+// MaxHandlers, or nil if there is no limit.
+func (srv *SecureServer) handlerSlots() chan struct{} {
+	srv.slotsOnce.Do(func() {
+		if srv.MaxHandlers > 0 {
+			srv.slots = make(chan struct{}, srv.MaxHandlers)
+		}
+	})
+	return srv.slots
+}
+
+// releaseSlot frees the slot of a connection, if slots is not nil.
+func (srv *SecureServer) releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// serveConn runs the handler on conn, then closes it.
+func (srv *SecureServer) serveConn(conn *SecureConn) {
+	logger := conn.config.logger().With("remote", conn.RemoteAddr().String())
+	logger.Info("connection opened",
+		"peer", conn.session.peerName(), "resumed", conn.session.Resumed)
+	start := time.Now()
+	srv.startServing(conn)
+	defer func() {
+		conn.Close()
+		logger.Info("connection closed", "duration", time.Since(start))
+	}()
+	srv.handler().Handle(conn)
+}
+
+// Reload replaces the server's config with config, for the connections it
+// accepts from now on, without closing any listener or connection: those
+// already open keep the config they started with. Use it to rotate the
+// server's keys or change its AuthorizedKeys with no downtime. A key pair
+// or ticket key the server generated is kept if config has none.
+func (srv *SecureServer) Reload(config *Config) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.Config = config
+	connConfig := srv.connConfig()
+	for sl := range srv.listeners {
+		if err := sl.SetConfig(connConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the server: it closes all listeners, then
+// waits for the connections being served to finish. If ctx is done first,
+// Shutdown returns the context's error and leaves the remaining connections
+// open; call Close to close them.
+func (srv *SecureServer) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.inShutdown = true
+	err := srv.closeListenersLocked()
+	srv.mu.Unlock()
+
+	// No connection is added once the server is shutting down, so the
+	// wait group only goes down from here.
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Conns returns the connections being served, oldest first, for example
+// to list them in an admin interface.
+func (srv *SecureServer) Conns() []ConnInfo {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(srv.conns))
+	for _, sc := range srv.conns {
+		if sc.start.IsZero() {
+			continue
+		}
+		infos = append(infos, ConnInfo{
+			RemoteAddr: sc.conn.RemoteAddr(),
+			Peer:       sc.conn.session.peerName(),
+			Resumed:    sc.conn.session.Resumed,
+			Start:      sc.start,
+		})
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int { return a.Start.Compare(b.Start) })
+	return infos
+}
+
+// Close immediately closes all listeners and connections of the server.
+func (srv *SecureServer) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.inShutdown = true
+	err := srv.closeListenersLocked()
+	for _, sc := range srv.conns {
+		sc.conn.Close()
+	}
+	return err
+}
+
+// closeListenersLocked closes the server's listeners. srv.mu must be held.
+func (srv *SecureServer) closeListenersLocked() error {
+	var err error
+	for sl := range srv.listeners {
+		if cerr := sl.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// listen wraps l in a SecureListener with the server's config and adds it
+// to the server's listeners, so that Reload reaches it. It closes l and
+// returns ErrServerClosed if the server is shutting down.
+func (srv *SecureServer) listen(l net.Listener) (*SecureListener, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.inShutdown {
+		l.Close()
+		return nil, ErrServerClosed
+	}
+	sl, err := NewSecureListener(l, srv.connConfig())
+	if err != nil {
+		return nil, err
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[*SecureListener]struct{})
+	}
+	srv.listeners[sl] = struct{}{}
+	return sl, nil
+}
+
+// untrackListener removes sl from the server's listeners.
+func (srv *SecureServer) untrackListener(sl *SecureListener) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, sl)
+}
+
+// trackConn adds or removes conn from the connections being served. It
+// reports false, without adding conn, if the server is shutting down.
+func (srv *SecureServer) trackConn(conn *SecureConn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		if sc := srv.conns[conn]; sc != nil {
+			if sc.expire != nil {
+				sc.expire.Stop()
+			}
+			delete(srv.conns, conn)
+			srv.wg.Done()
+		}
+		return true
+	}
+	if srv.inShutdown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[net.Conn]*servedConn)
+	}
+	srv.conns[conn] = &servedConn{conn: conn}
+	srv.wg.Add(1)
+	return true
+}
+
+// startServing records that the handler starts serving conn, whose
+// handshake is complete, and arranges to close it once it exceeds its
+// MaxConnLifetime.
+func (srv *SecureServer) startServing(conn *SecureConn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sc := srv.conns[conn]
+	if sc == nil {
+		return
+	}
+	sc.start = time.Now()
+	if lifetime := conn.config.MaxConnLifetime; lifetime > 0 {
+		sc.expire = time.AfterFunc(lifetime, func() { conn.fail(ErrConnLifetimeExceeded) })
+	}
+}
+
+// connConfig returns the config of the server's connections. srv.mu must
+// be held.
+func (srv *SecureServer) connConfig() *Config {
+	config := srv.Config.clone()
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	return config
+}
+
+// handler returns the server's handler.
+func (srv *SecureServer) handler() Handler {
+	if srv.Handler == nil {
+		return EchoHandler
+	}
+	return srv.Handler
+}
+
+// shuttingDown reports whether Shutdown or Close has been called.
+func (srv *SecureServer) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.inShutdown
+}
+
+// handleConnection echoes everything the client sends until the client
+// closes the connection or it goes idle.
+func handleConnection(conn net.Conn) {
+	logger := connLogger(conn)
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err != io.EOF && err != ErrIdleTimeout {
+				logger.Warn("echo read failed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+
+		// Echo
+		if _, err := conn.Write(buf[:n]); err != nil {
+			logger.Warn("echo write failed", "remote", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+}
+
+// connLogger returns the logger configured for conn, if it is a
+// *SecureConn, so that handlers can log like the rest of the server.
+func connLogger(conn net.Conn) *slog.Logger {
+	if sc, ok := conn.(*SecureConn); ok {
+		return sc.config.logger()
+	}
+	return discardLogger
+}
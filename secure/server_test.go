@@ -0,0 +1,248 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// idle reports whether no connections are being served.
+func (srv *SecureServer) idle() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns) == 0
+}
+
+func TestSecureServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the server to pick up the connection.
+	for srv.idle() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The connection is still in flight, so Shutdown waits for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("Unexpected result. The listener is still open.")
+	}
+
+	// Once the client is done, Shutdown returns.
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecureServerHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A custom protocol: greet the client and hang up.
+	srv := &SecureServer{Handler: HandlerFunc(func(conn net.Conn) {
+		conn.Write([]byte("hi"))
+	})}
+	defer srv.Close()
+	go srv.Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hi" {
+		t.Fatalf("Unexpected result: %s != %s", msg, "hi")
+	}
+}
+
+func TestSecureServerReload(t *testing.T) {
+	var keys [3]*KeyPair
+	for i := range keys {
+		k, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+	}
+	oldServer, newServer, client := keys[0], keys[1], keys[2]
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Config: &Config{Keys: oldServer}}
+	defer srv.Close()
+	go srv.Serve(l)
+
+	dial := func() (*SecureConn, error) {
+		return DialWithConfig(context.Background(), l.Addr().String(), &Config{Keys: client})
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if peer, err := conn.PeerPublicKey(); err != nil || *peer != *oldServer.Public {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	// New connections use the new key and allowlist, while the connection
+	// already open carries on.
+	if err := srv.Reload(&Config{Keys: newServer, AuthorizedKeys: NewAuthorizedKeys(newServer.Public)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	// The client only learns it was refused when the server hangs up.
+	if rejected, err := dial(); err == nil {
+		defer rejected.Close()
+		if _, err := rejected.Read(buf); err == nil {
+			t.Fatal("Unexpected result. A client no longer authorized connected.")
+		}
+	}
+
+	if err := srv.Reload(&Config{Keys: newServer}); err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if peer, err := conn2.PeerPublicKey(); err != nil || *peer != *newServer.Public {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+}
+
+func TestSecureServerMaxHandlers(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &SecureServer{MaxHandlers: 1, RejectWhenBusy: reject}
+		go srv.Serve(l)
+
+		first, err := Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := first.Write([]byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := first.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first connection takes the only handler, so the second is
+		// refused, or waits for the first to finish.
+		second, err := Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		second.Write([]byte("2"))
+		second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = second.Read(make([]byte, 1))
+		if reject {
+			if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("Unexpected error: %v, expected the busy server to close the connection", err)
+			}
+		} else {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("Unexpected error: %v, expected the connection to wait", err)
+			}
+			first.Close()
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := second.Read(make([]byte, 1)); err != nil {
+				t.Fatalf("Unexpected error once a handler was free: %v", err)
+			}
+		}
+		first.Close()
+		second.Close()
+		srv.Close()
+	}
+}
+
+func TestSecureServerConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Config: &Config{MaxConnLifetime: 100 * time.Millisecond}}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialWithConfig(context.Background(), l.Addr().String(), &Config{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := srv.Conns()
+	if len(conns) != 1 || conns[0].Peer != Fingerprint(keys.Public) ||
+		conns[0].RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Fatalf("Unexpected connections: %+v", conns)
+	}
+
+	// The server closes the connection once its lifetime is over.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Unexpected error: %v, expected the server to close the connection", err)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if conns := srv.Conns(); len(conns) != 0 {
+		t.Fatalf("Unexpected connections after shutdown: %+v", conns)
+	}
+}
@@ -0,0 +1,275 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Labels for the HKDF info used to derive the traffic key of each direction.
+const (
+	clientToServerLabel = "gochal2 client to server"
+	serverToClientLabel = "gochal2 server to client"
+	resumptionLabel     = "gochal2 resumption"
+	clientFinishedLabel = "gochal2 client finished"
+	serverFinishedLabel = "gochal2 server finished"
+)
+
+// Role identifies the end of a connection a peer plays in the handshake.
+type Role int
+
+const (
+	// ClientRole is the end that initiated the connection.
+	ClientRole Role = iota
+
+	// ServerRole is the end that accepted the connection.
+	ServerRole
+)
+
+// Session is the result of a successful key exchange.
+//
+// Each direction of a session uses its own key, derived with HKDF-SHA256
+// from the shared secret, a label naming the direction, the public keys of
+// the client and server and a hash of the handshake transcript. A frame
+// reflected back at its sender therefore fails to decrypt, even when both
+// ends use the same key pair. A resumed session also mixes in the secret of
+// the session it resumes.
+type Session struct {
+	// LocalPublicKey is the public key presented to the peer.
+	LocalPublicKey *[KeySize]byte
+
+	// PeerPublicKey is the public key presented by the peer.
+	PeerPublicKey *[KeySize]byte
+
+	// PeerIdentity is the identity key presented by the peer, or nil if it
+	// presented none. The handshake checked that the peer holds its private
+	// key.
+	PeerIdentity ed25519.PublicKey
+
+	// PeerCertificate is the certificate presented by the peer, checked
+	// against the configured CertificateAuthorities, or nil if there are
+	// none.
+	PeerCertificate *Certificate
+
+	// MaxFrameSize is the largest amount of plaintext sealed into one
+	// frame, agreed by both peers in the handshake.
+	MaxFrameSize int
+
+	// MaxMessageSize is the largest message either peer sends, agreed by
+	// both peers in the handshake.
+	MaxMessageSize int
+
+	// Resumed reports whether the session was resumed with a ticket from an
+	// earlier session. The server of a resumed session doesn't wait for
+	// the client's finished message, saving it a round trip.
+	Resumed bool
+
+	// Version is the protocol version agreed by both peers in the
+	// handshake.
+	Version int
+
+	// CipherSuite is the suite that seals the session's frames, agreed by
+	// both peers in the handshake.
+	CipherSuite CipherSuite
+
+	// Compression reports whether the peers agreed in the handshake to
+	// compress messages.
+	Compression bool
+
+	// sendKey seals frames sent to the peer and recvKey opens frames
+	// received from it.
+	sendKey, recvKey *[KeySize]byte
+
+	// priv is a copy of our private key, needed to follow the peer's
+	// rekeys.
+	priv *[KeySize]byte
+
+	// resumptionSecret is the secret a later session resumes this one
+	// with.
+	resumptionSecret []byte
+
+	// keyLogID names the session in the key log: the public key or nonce
+	// in the client's hello. It is nil for sessions the key log skips.
+	keyLogID []byte
+
+	// finished is the MAC of the transcript this end sends in its finished
+	// message, and peerFinished the one the peer must send. They are nil
+	// once the handshake is over.
+	finished, peerFinished []byte
+}
+
+// newSession derives the traffic keys between local and peer for the end of
+// the connection given by role. psk is the secret of the session being
+// resumed, if any, and transcript the hash of the handshake messages.
+func newSession(local *KeyPair, peer *[KeySize]byte, role Role, psk, transcript []byte) *Session {
+	var shared [KeySize]byte
+	box.Precompute(&shared, peer, local.Private)
+	prk := hkdf.Extract(sha256.New, shared[:], psk)
+	zero(shared[:])
+	defer zero(prk)
+
+	clientPub, serverPub := local.Public, peer
+	if role == ServerRole {
+		clientPub, serverPub = peer, local.Public
+	}
+	c2s := trafficKey(prk, clientToServerLabel, clientPub, serverPub, transcript)
+	s2c := trafficKey(prk, serverToClientLabel, clientPub, serverPub, transcript)
+	resumption := trafficKey(prk, resumptionLabel, clientPub, serverPub, transcript)
+	clientFinished := finishedMAC(prk, clientFinishedLabel, clientPub, serverPub, transcript)
+	serverFinished := finishedMAC(prk, serverFinishedLabel, clientPub, serverPub, transcript)
+
+	priv := *local.Private
+	s := &Session{
+		LocalPublicKey:   local.Public,
+		PeerPublicKey:    peer,
+		priv:             &priv,
+		resumptionSecret: resumption[:],
+	}
+	if role == ClientRole {
+		s.sendKey, s.recvKey = c2s, s2c
+		s.finished, s.peerFinished = clientFinished, serverFinished
+	} else {
+		s.sendKey, s.recvKey = s2c, c2s
+		s.finished, s.peerFinished = serverFinished, clientFinished
+	}
+	return s
+}
+
+// newSharedSession returns a session that uses the box key shared by priv and
+// peer for both directions, as NewSecureReader and NewSecureWriter do.
+func newSharedSession(priv, peer *[KeySize]byte) *Session {
+	pub := &[KeySize]byte{}
+	curve25519.ScalarBaseMult(pub, priv)
+	privCopy := *priv
+	s := &Session{
+		LocalPublicKey: pub,
+		PeerPublicKey:  peer,
+		sendKey:        &[KeySize]byte{},
+		priv:           &privCopy,
+	}
+	box.Precompute(s.sendKey, peer, priv)
+	recvKey := *s.sendKey
+	s.recvKey = &recvKey
+	return s
+}
+
+// trafficKey derives the key named by label from the pseudorandom key prk.
+func trafficKey(prk []byte, label string, clientPub, serverPub *[KeySize]byte, transcript []byte) *[KeySize]byte {
+	info := make([]byte, 0, len(label)+2*KeySize+len(transcript))
+	info = append(info, label...)
+	info = append(info, clientPub[:]...)
+	info = append(info, serverPub[:]...)
+	info = append(info, transcript...)
+
+	key := &[KeySize]byte{}
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), key[:]); err != nil {
+		// HKDF can only fail when asked for more than 255 hashes of output.
+		panic(err)
+	}
+	return key
+}
+
+// finishedMAC returns the MAC of the transcript hash with the finished key
+// derived from prk with label.
+func finishedMAC(prk []byte, label string, clientPub, serverPub *[KeySize]byte, transcript []byte) []byte {
+	key := trafficKey(prk, label, clientPub, serverPub, transcript)
+	defer zero(key[:])
+	h := hmac.New(sha256.New, key[:])
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// Conn returns a SecureConn over conn that uses the session's keys. conn
+// should be the connection the handshake was run on.
+func (s *Session) Conn(conn net.Conn) *SecureConn {
+	c := &SecureConn{conn: conn, handshakeComplete: true, sessionShared: true}
+	c.setSession(s)
+	return c
+}
+
+// MessageConn returns a MessageConn over rwc that uses the session's keys.
+func (s *Session) MessageConn(rwc io.ReadWriteCloser) MessageConn {
+	sr, sw := s.newReadWriter(rwc, rwc, nil)
+	return &secureReadWriter{rwc, sw, sr}
+}
+
+// peerName describes the peer in logs: the fingerprint of its public key, or
+// that it used a pre-shared key.
+func (s *Session) peerName() string {
+	if s.PeerPublicKey == nil {
+		return "pre-shared key"
+	}
+	return Fingerprint(s.PeerPublicKey)
+}
+
+// newReadWriter returns a reader over r and a writer over w for the session.
+// Both get their own copies of the keys, in locked memory if config asks
+// for it, which rekeying overwrites, so the session can be used again. The
+// writer only starts rekeys if config asks for them, but the reader always
+// follows the peer's.
+func (s *Session) newReadWriter(r io.Reader, w io.Writer, config *Config) (*secureReader, *secureWriter) {
+	recvKey, sendKey := config.copyKey(s.recvKey), config.copyKey(s.sendKey)
+	var priv *[KeySize]byte
+	if s.priv != nil {
+		priv = config.copyKey(s.priv)
+	}
+	maxFrame := s.MaxFrameSize
+	if maxFrame == 0 {
+		maxFrame = DefaultMaxFrameSize
+	}
+	maxMessage := s.MaxMessageSize
+	if maxMessage == 0 {
+		maxMessage = DefaultMaxMessageSize
+	}
+	sr := &secureReader{r: r, key: recvKey, suite: s.CipherSuite, maxFrame: maxFrame, maxMessage: maxMessage, priv: priv}
+	sw := &secureWriter{w: w, key: sendKey, suite: s.CipherSuite, maxFrame: maxFrame, maxMessage: maxMessage, peer: s.PeerPublicKey, rekeyedAt: time.Now()}
+	sr.compression, sw.compression = s.Compression, s.Compression
+	sr.aead = sr.suite.newAEAD(sr.key)
+	sw.aead = sw.suite.newAEAD(sw.key)
+	if config != nil {
+		sw.rekeyBytes = config.RekeyBytes
+		sw.rekeyInterval = config.RekeyInterval
+		sw.padding = config.paddingBuckets()
+		sw.bufSize = min(max(config.WriteBufferSize, 0), maxMessage)
+		sw.bufDelay = config.WriteBufferDelay
+		sr.trace = config.frameTracer("recv")
+		sw.trace = config.frameTracer("send")
+	}
+	return sr, sw
+}
+
+// wipe overwrites the traffic keys and private key of the session with
+// zeros. The resumption secret is left alone, as cached sessions share it.
+func (s *Session) wipe() {
+	for _, key := range []**[KeySize]byte{&s.sendKey, &s.recvKey, &s.priv} {
+		releaseKey(key)
+	}
+}
+
+// lock moves the traffic keys and private key of the session into locked
+// memory, if config asks for it, zeroing the copies they were in.
+func (s *Session) lock(config *Config) {
+	if !config.lockMemory() {
+		return
+	}
+	for _, key := range []**[KeySize]byte{&s.sendKey, &s.recvKey, &s.priv} {
+		if old := *key; old != nil {
+			*key = config.copyKey(old)
+			zero(old[:])
+		}
+	}
+}
+
+// zero overwrites b with zeros.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
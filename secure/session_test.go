@@ -0,0 +1,52 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sessionPair returns the client and server ends of a session between the
+// given key pairs, each talking over buf.
+func sessionPair(ckeys, skeys *KeyPair, buf *bytes.Buffer) (client, server MessageConn) {
+	client = newSession(ckeys, skeys.Public, ClientRole, nil, nil).MessageConn(pipeConn{buf, buf})
+	server = newSession(skeys, ckeys.Public, ServerRole, nil, nil).MessageConn(pipeConn{buf, buf})
+	return client, server
+}
+
+func TestSessionRejectsReflectedFrames(t *testing.T) {
+	ckeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skeys, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		ckeys, skeys *KeyPair
+	}{
+		{"distinct keys", ckeys, skeys},
+		{"shared key pair", skeys, skeys},
+	} {
+		var buf bytes.Buffer
+		a, b := sessionPair(tc.ckeys, tc.skeys, &buf)
+
+		if err := a.WriteMessage([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		reflected := append([]byte(nil), buf.Bytes()...)
+
+		// The frame decrypts for the peer...
+		if msg, err := b.ReadMessage(); err != nil || string(msg) != "hello" {
+			t.Fatalf("%s: Unexpected result: %q, %v", tc.name, msg, err)
+		}
+
+		// ...but not when it is reflected back at its sender.
+		buf.Write(reflected)
+		if _, err := a.ReadMessage(); err == nil {
+			t.Fatalf("%s: Unexpected result. A reflected frame was accepted.", tc.name)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package secure
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// The SOCKS5 protocol (RFC 1928), as far as SOCKSHandler speaks it: no
+// authentication, since the secure connection authenticates the client,
+// and the CONNECT command only.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+var errSOCKSVersion = errors.New("secure: not a SOCKS5 request")
+
+// SOCKSHandler is a Handler that runs a SOCKS5 proxy on the stream of a
+// tunnel, so that a client reaches it through ServeTunnel and connects on
+// from the server. The proxy connects wherever clients ask, including to
+// the server's own services, so serve it with a SecureServer whose Config
+// only accepts known clients, for example with AuthorizedKeys.
+var SOCKSHandler Handler = HandlerFunc(handleSOCKS)
+
+func handleSOCKS(conn net.Conn) {
+	sc, ok := conn.(*SecureConn)
+	if !ok {
+		return
+	}
+	c := &tunnelConn{SecureConn: sc}
+	addr, err := readSOCKSRequest(c)
+	if err != nil {
+		sc.config.logger().Debug("bad SOCKS request", "err", err)
+		return
+	}
+	d := net.Dialer{Timeout: tunnelDialTimeout}
+	tc, err := d.Dial("tcp", addr)
+	if err != nil {
+		sc.config.logger().Debug("SOCKS connect failed", "addr", addr, "err", err)
+		writeSOCKSReply(c, socksReplyCode(err), nil)
+		return
+	}
+	defer tc.Close()
+	if err := writeSOCKSReply(c, socksSucceeded, tc.LocalAddr()); err != nil {
+		return
+	}
+	splice(c, tc)
+}
+
+// readSOCKSRequest negotiates the authentication method with the client on
+// c and returns the address of its CONNECT request. Requests it doesn't
+// support are answered with an error reply.
+func readSOCKSRequest(c io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("secure: SOCKS client requires authentication")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(c, socksAddressNotSupported, nil)
+		return "", errors.New("secure: unknown SOCKS address type")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		writeSOCKSReply(c, socksCommandNotSupported, nil)
+		return "", errors.New("secure: unsupported SOCKS command")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKSReply sends a reply with the given code and bound address,
+// which may be nil.
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	reply := []byte{socksVersion, code, 0, socksIPv4}
+	if len(ip) == net.IPv6len {
+		reply[3] = socksIPv6
+	}
+	reply = append(reply, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// socksReplyCode returns the reply code for a failure to connect.
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,85 @@
+package secure
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksTunnel starts a server running SOCKSHandler and a tunnel to it, and
+// returns the address of the tunnel.
+func socksTunnel(t *testing.T) string {
+	t.Helper()
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Handler: SOCKSHandler}
+	go srv.Serve(sl)
+	t.Cleanup(func() { srv.Close() })
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tl.Close() })
+	go ServeTunnel(tl, sl.Addr().String(), nil)
+	return tl.Addr().String()
+}
+
+func TestSOCKSHandler(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	d, err := proxy.SOCKS5("tcp", socksTunnel(t), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("Unexpected result: %s", buf)
+	}
+}
+
+func TestSOCKSHandlerRefused(t *testing.T) {
+	// A port nothing listens on.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	d, err := proxy.SOCKS5("tcp", socksTunnel(t), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", target.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
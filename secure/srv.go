@@ -0,0 +1,53 @@
+package secure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV resolves SRV records. Tests replace it.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// errNoSRVTargets is returned by DialSRV when the records of a name say the
+// service is not available there.
+var errNoSRVTargets = errors.New("secure: service not available")
+
+// DialSRV dials the servers the DNS SRV records of name point to, such as
+// "_gochal._tcp.example.com", so servers can move without changing their
+// clients. Targets are tried in order of priority, and at random weighted by
+// their weight among equal priorities, until one handshake succeeds. Each
+// target is dialed with DialWithConfig, so its host and port are the
+// ServerName unless config sets one. If every target fails, the error of
+// the first is returned.
+func DialSRV(ctx context.Context, name string, config *Config) (*SecureConn, error) {
+	// LookupSRV sorts the records by priority and shuffles them by weight.
+	_, records, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, srv := range records {
+		// A target of "." means the service is not available at name.
+		if srv.Target == "." {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		conn, err := DialWithConfig(ctx, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))), config)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errNoSRVTargets
+	}
+	return nil, firstErr
+}
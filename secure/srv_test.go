@@ -0,0 +1,56 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestDialSRV(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	// A port nothing listens on any more.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	port := func(l net.Listener) uint16 {
+		return uint16(l.Addr().(*net.TCPAddr).Port)
+	}
+	defer func(lookup func(context.Context, string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = lookup
+	}(lookupSRV)
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_gochal._tcp.example.com" {
+			t.Errorf("Unexpected name %q", name)
+		}
+		return name, []*net.SRV{
+			{Target: "127.0.0.1.", Port: port(dead), Priority: 1},
+			{Target: "127.0.0.1.", Port: port(l), Priority: 2},
+		}, nil
+	}
+
+	conn, err := DialSRV(context.Background(), "_gochal._tcp.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().String(), "127.0.0.1:"+strconv.Itoa(int(port(l))); got != want {
+		t.Fatalf("Unexpected result: %s != %s", got, want)
+	}
+
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{{Target: "."}}, nil
+	}
+	if _, err := DialSRV(context.Background(), "_gochal._tcp.example.com", nil); err != errNoSRVTargets {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package secure
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An identity key kept in an ssh-agent never leaves it: the handshake asks
+// the agent over its socket to sign the transcript, as ssh does. Ed25519
+// signs the message itself rather than a hash of it, so the signature the
+// agent returns for an ssh-ed25519 key is the one the peer verifies.
+
+var (
+	errNoAgentSocket = errors.New("secure: no ssh-agent socket, SSH_AUTH_SOCK is not set")
+	errNoAgentKey    = errors.New("secure: ssh-agent does not hold the Ed25519 identity key")
+)
+
+// AgentIdentity is an Ed25519 identity key held by an ssh-agent. It is a
+// crypto.Signer, for Config.IdentitySigner. Each signature is requested
+// over a new connection to the agent, so an AgentIdentity keeps working
+// across restarts of an agent that is given the key again.
+type AgentIdentity struct {
+	socket string
+	pub    ed25519.PublicKey
+}
+
+// NewAgentIdentity returns the identity held by the ssh-agent listening on
+// socket, or on $SSH_AUTH_SOCK if socket is empty. The identity is the
+// agent's key pub, or its first Ed25519 key if pub is nil.
+func NewAgentIdentity(socket string, pub ed25519.PublicKey) (*AgentIdentity, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errNoAgentSocket
+		}
+	}
+	a := &AgentIdentity{socket: socket}
+	err := a.withAgent(func(ag agent.Agent) error {
+		keys, err := ag.List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			parsed, err := ssh.ParsePublicKey(k.Marshal())
+			if err != nil {
+				continue
+			}
+			cpub, ok := parsed.(ssh.CryptoPublicKey)
+			if !ok {
+				continue
+			}
+			edPub, ok := cpub.CryptoPublicKey().(ed25519.PublicKey)
+			if ok && (pub == nil || bytes.Equal(edPub, pub)) {
+				a.pub = edPub
+				return nil
+			}
+		}
+		return errNoAgentKey
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// withAgent connects to the agent and calls f with it.
+func (a *AgentIdentity) withAgent(f func(agent.Agent) error) error {
+	conn, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return fmt.Errorf("secure: ssh-agent: %v", err)
+	}
+	defer conn.Close()
+	if err := f(agent.NewClient(conn)); err != nil {
+		if errors.Is(err, errNoAgentKey) {
+			return err
+		}
+		return fmt.Errorf("secure: ssh-agent: %v", err)
+	}
+	return nil
+}
+
+// Public returns the Ed25519 public key of the identity.
+func (a *AgentIdentity) Public() crypto.PublicKey {
+	return a.pub
+}
+
+// Sign asks the agent to sign message. Like ed25519.PrivateKey.Sign, it
+// requires opts.HashFunc() to be zero, and ignores rand.
+func (a *AgentIdentity) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("secure: ssh-agent identity cannot sign hashed messages")
+	}
+	sshPub, err := ssh.NewPublicKey(a.pub)
+	if err != nil {
+		return nil, err
+	}
+	var sig []byte
+	err = a.withAgent(func(ag agent.Agent) error {
+		s, err := ag.Sign(sshPub, message)
+		if err != nil {
+			return err
+		}
+		if s.Format != ssh.KeyAlgoED25519 || len(s.Blob) != ed25519.SignatureSize {
+			return fmt.Errorf("unexpected %s signature", s.Format)
+		}
+		sig = s.Blob
+		return nil
+	})
+	return sig, err
+}
@@ -0,0 +1,89 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves keyring as an ssh-agent on a socket in a temporary
+// directory and returns the socket's path.
+func serveAgent(t *testing.T, keyring agent.Agent) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip("unix sockets unavailable:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestAgentIdentity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	socket := serveAgent(t, keyring)
+
+	id, err := NewAgentIdentity(socket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.Public().(ed25519.PublicKey), pub) {
+		t.Fatal("Unexpected result. The agent identity has the wrong key.")
+	}
+
+	// The server sees the identity the agent signed the handshake with.
+	client, server, cerr, serr := handshakePair(
+		&Config{IdentitySigner: id},
+		&Config{PeerIdentity: pub},
+	)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	if got, _ := server.PeerIdentity(); !bytes.Equal(got, pub) {
+		t.Fatal("Unexpected result. Server saw the wrong client identity.")
+	}
+
+	// Once the agent drops the key, the handshake fails.
+	if err := keyring.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	client, _, cerr, _ = handshakePair(&Config{IdentitySigner: id}, &Config{PeerIdentity: pub})
+	client.Close()
+	if cerr == nil {
+		t.Fatal("Expected an error. The agent no longer holds the key.")
+	}
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAgentIdentity(socket, other); !errors.Is(err, errNoAgentKey) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
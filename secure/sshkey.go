@@ -0,0 +1,97 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"os"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH Ed25519 keys can stand in for the package's own keys, so that teams
+// can reuse the keys and authorized_keys files they already have for SSH.
+// An Ed25519 key maps to an X25519 key as libsodium's
+// crypto_sign_ed25519_sk_to_curve25519 and crypto_sign_ed25519_pk_to_curve25519
+// map it: the private key is the clamped first half of the SHA-512 hash of
+// the seed, and the public key the Montgomery form of the Edwards point.
+// The same Ed25519 key can also be the Identity that signs the handshake.
+
+// openSSHKeyBlock is the PEM block type of OpenSSH private key files.
+const openSSHKeyBlock = "OPENSSH PRIVATE KEY"
+
+var errNotEd25519 = errors.New("secure: not an Ed25519 key")
+
+// KeyPairFromEd25519 returns the X25519 key pair that the Ed25519 private
+// key priv maps to.
+func KeyPairFromEd25519(priv ed25519.PrivateKey) *KeyPair {
+	h := sha512.Sum512(priv.Seed())
+	defer zero(h[:])
+	kp := &KeyPair{Public: new([KeySize]byte), Private: new([KeySize]byte)}
+	copy(kp.Private[:], h[:KeySize])
+	kp.Private[0] &= 248
+	kp.Private[31] &= 127
+	kp.Private[31] |= 64
+	curve25519.ScalarBaseMult(kp.Public, kp.Private)
+	return kp
+}
+
+// PublicKeyFromEd25519 returns the X25519 public key that the Ed25519 public
+// key pub maps to.
+func PublicKeyFromEd25519(pub ed25519.PublicKey) (*[KeySize]byte, error) {
+	p, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, err
+	}
+	key := new([KeySize]byte)
+	copy(key[:], p.BytesMontgomery())
+	return key, nil
+}
+
+// LoadSSHIdentity reads the OpenSSH private key file at path, such as
+// ~/.ssh/id_ed25519, decrypting it with passphrase if it is encrypted. The
+// key must be an Ed25519 key. Use it as Config.Identity, with the key pair
+// KeyPairFromEd25519 maps it to as Config.Keys.
+func LoadSSHIdentity(path string, passphrase []byte) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	if passphrase != nil {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	} else {
+		key, err = ssh.ParseRawPrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v", path, errNotEd25519)
+	}
+	return *priv, nil
+}
+
+// ParseSSHPublicKey parses an SSH Ed25519 public key in the format of an
+// OpenSSH authorized_keys or .pub file, such as
+// "ssh-ed25519 AAAAC3Nza... alice@laptop", and returns the X25519 public
+// key it maps to.
+func ParseSSHPublicKey(line []byte) (*[KeySize]byte, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, err
+	}
+	cpub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errNotEd25519
+	}
+	edPub, ok := cpub.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, errNotEd25519
+	}
+	return PublicKeyFromEd25519(edPub)
+}
@@ -0,0 +1,106 @@
+package secure
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHKeys(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(priv, "alice@laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubLine := ssh.MarshalAuthorizedKey(sshPub)
+	pubFile := keyFile + ".pub"
+	if err := os.WriteFile(pubFile, pubLine, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The private and public keys map to the same X25519 key pair.
+	keys, err := LoadKeyPair(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var derived [KeySize]byte
+	curve25519.ScalarBaseMult(&derived, keys.Private)
+	mapped, err := LoadPublicKey(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *mapped != *keys.Public || derived != *keys.Public {
+		t.Fatal("Unexpected result. The key pair does not match the public key.")
+	}
+
+	// An OpenSSH authorized_keys file, ECDSA keys and all, authorizes the
+	// key pair.
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := string(ssh.MarshalAuthorizedKey(ecPub)) + `from="10.0.0.0/8" ` + string(pubLine)
+	ak, err := ParseAuthorizedKeys(strings.NewReader(authorized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.Len() != 1 || !ak.Contains(keys.Public) {
+		t.Fatal("Unexpected result. The SSH key was not authorized.")
+	}
+	client, server, cerr, serr := handshakePair(&Config{Keys: keys, Identity: priv}, &Config{AuthorizedKeys: ak, PeerIdentity: pub})
+	client.Close()
+	server.Close()
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+}
+
+func TestLoadSSHIdentityPassphrase(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyPair(keyFile); err == nil {
+		t.Fatal("Unexpected result. Loaded an encrypted key without its passphrase.")
+	}
+	id, err := LoadSSHIdentity(keyFile, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Equal(priv) {
+		t.Fatal("Unexpected result. The key was not decrypted.")
+	}
+}
@@ -0,0 +1,125 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// CipherSuite is the AEAD that seals the frames of a connection. Every suite
+// takes a 32-byte key and adds a 16-byte tag, so frames look the same on
+// the wire whichever suite sealed them.
+type CipherSuite uint8
+
+const (
+	// SuiteBox seals frames as NaCl box does, with XSalsa20 and Poly1305.
+	// It is the default, and the suite of peers that offer none.
+	SuiteBox CipherSuite = iota
+
+	// SuiteXChaCha20Poly1305 seals frames with XChaCha20-Poly1305.
+	SuiteXChaCha20Poly1305
+
+	// SuiteAES256GCM seals frames with AES-256-GCM, for deployments that
+	// must use a NIST cipher. It uses the first 12 bytes of the frame's
+	// random nonce, so sessions should rekey well before sending 2^32
+	// frames in a direction.
+	SuiteAES256GCM
+)
+
+// defaultCipherSuites are the suites offered when Config.CipherSuites is
+// empty, in order of preference.
+var defaultCipherSuites = []CipherSuite{SuiteBox, SuiteXChaCha20Poly1305, SuiteAES256GCM}
+
+var errNoCommonSuite = errors.New("secure: no cipher suite in common with the peer")
+
+func (s CipherSuite) String() string {
+	switch s {
+	case SuiteBox:
+		return "box"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	case SuiteAES256GCM:
+		return "aes-256-gcm"
+	}
+	return fmt.Sprintf("CipherSuite(%d)", uint8(s))
+}
+
+// MarshalText returns the name of the suite, as String does.
+func (s CipherSuite) MarshalText() ([]byte, error) {
+	if s > SuiteAES256GCM {
+		return nil, fmt.Errorf("secure: unknown cipher suite %d", uint8(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText sets s to the suite named by text, as String names it.
+func (s *CipherSuite) UnmarshalText(text []byte) error {
+	for _, suite := range defaultCipherSuites {
+		if string(text) == suite.String() {
+			*s = suite
+			return nil
+		}
+	}
+	return fmt.Errorf("secure: unknown cipher suite %q", text)
+}
+
+// newAEAD returns the AEAD of the suite with key, or nil for SuiteBox,
+// whose frames are sealed with box directly.
+func (s CipherSuite) newAEAD(key *[KeySize]byte) cipher.AEAD {
+	var aead cipher.AEAD
+	var err error
+	switch s {
+	case SuiteBox:
+		return nil
+	case SuiteXChaCha20Poly1305:
+		aead, err = chacha20poly1305.NewX(key[:])
+	case SuiteAES256GCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key[:]); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	default:
+		panic("secure: unknown cipher suite")
+	}
+	if err != nil {
+		// Only possible with a key of the wrong size.
+		panic(err)
+	}
+	return aead
+}
+
+// seal appends plain, sealed with key under nonce, to dst. aead is the
+// AEAD of the suite with key, or nil to seal with box.
+func seal(dst, plain []byte, nonce *[NonceSize]byte, key *[KeySize]byte, aead cipher.AEAD) []byte {
+	if aead == nil {
+		return box.SealAfterPrecomputation(dst, plain, nonce, key)
+	}
+	return aead.Seal(dst, nonce[:aead.NonceSize()], plain, nil)
+}
+
+// open opens sealed as seal sealed it, appending the plaintext to dst,
+// and reports whether it was authentic. dst must not overlap sealed.
+func open(dst, sealed []byte, nonce *[NonceSize]byte, key *[KeySize]byte, aead cipher.AEAD) ([]byte, bool) {
+	if aead == nil {
+		return box.OpenAfterPrecomputation(dst, sealed, nonce, key)
+	}
+	plain, err := aead.Open(dst, nonce[:aead.NonceSize()], sealed, nil)
+	return plain, err == nil
+}
+
+// negotiateSuite returns the first of the server's suites that the client
+// also offers.
+func negotiateSuite(server, client []CipherSuite) (CipherSuite, error) {
+	for _, s := range server {
+		for _, c := range client {
+			if s == c {
+				return s, nil
+			}
+		}
+	}
+	return 0, errNoCommonSuite
+}
@@ -0,0 +1,94 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestCipherSuites(t *testing.T) {
+	for _, suite := range defaultCipherSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			if aead := suite.newAEAD(new([KeySize]byte)); aead != nil && aead.Overhead() != box.Overhead {
+				t.Fatalf("Unexpected overhead %d", aead.Overhead())
+			}
+			config := &Config{CipherSuites: []CipherSuite{suite}, RekeyBytes: 1000}
+			client, server, cerr, serr := handshakePair(config, config)
+			if cerr != nil || serr != nil {
+				t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+			}
+			defer client.Close()
+			defer server.Close()
+			if client.session.CipherSuite != suite || server.session.CipherSuite != suite {
+				t.Fatalf("Unexpected suites %v, %v", client.session.CipherSuite, server.session.CipherSuite)
+			}
+			// Messages make it across rekeys.
+			msg := bytes.Repeat([]byte("x"), 3000)
+			for range 3 {
+				go client.WriteMessage(msg)
+				got, err := server.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatal("Unexpected result. The message was corrupted.")
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateSuite(t *testing.T) {
+	// The server's preference wins.
+	client, server, cerr, serr := handshakePair(
+		&Config{CipherSuites: []CipherSuite{SuiteXChaCha20Poly1305, SuiteAES256GCM}},
+		&Config{CipherSuites: []CipherSuite{SuiteAES256GCM, SuiteXChaCha20Poly1305}})
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	client.Close()
+	server.Close()
+	if client.session.CipherSuite != SuiteAES256GCM || server.session.CipherSuite != SuiteAES256GCM {
+		t.Fatalf("Unexpected suites %v, %v", client.session.CipherSuite, server.session.CipherSuite)
+	}
+
+	// The defaults settle on box.
+	client, server, cerr, serr = handshakePair(nil, nil)
+	if cerr != nil || serr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+	client.Close()
+	server.Close()
+	if client.session.CipherSuite != SuiteBox {
+		t.Fatalf("Unexpected suite %v", client.session.CipherSuite)
+	}
+
+	// Peers without a suite in common don't connect.
+	_, _, cerr, serr = handshakePair(
+		&Config{CipherSuites: []CipherSuite{SuiteBox}},
+		&Config{CipherSuites: []CipherSuite{SuiteAES256GCM}})
+	if cerr == nil || serr == nil {
+		t.Fatalf("Unexpected errors: %v, %v", cerr, serr)
+	}
+}
+
+func TestCipherSuiteText(t *testing.T) {
+	for _, suite := range defaultCipherSuites {
+		text, err := suite.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got CipherSuite
+		if err := got.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if got != suite {
+			t.Fatalf("Unexpected result: %v, expected %v", got, suite)
+		}
+	}
+	var s CipherSuite
+	if err := s.UnmarshalText([]byte("rot13")); err == nil {
+		t.Fatal("Unexpected result. Parsed an unknown suite.")
+	}
+}
@@ -0,0 +1,69 @@
+package secure
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultTarpitInterval is how often a tarpitted connection is sent a
+	// byte, when Config.TarpitInterval is zero.
+	DefaultTarpitInterval = 10 * time.Second
+
+	// tarpitTimeout is how long a connection is kept in the tarpit at
+	// most.
+	tarpitTimeout = 10 * time.Minute
+)
+
+// tarpitInterval returns how often tarpitted connections are sent a byte.
+func (c *Config) tarpitInterval() time.Duration {
+	if c == nil || c.TarpitInterval <= 0 {
+		return DefaultTarpitInterval
+	}
+	return c.TarpitInterval
+}
+
+// tarpit keeps conn, whose client's key was refused, open in the tarpit if
+// the config has one with room left, and reports whether it did. The
+// connection is closed once the client gives up, after tarpitTimeout, or
+// when the listener is closed.
+func (sl *SecureListener) tarpit(conn net.Conn, config *Config) bool {
+	if config.TarpitConns <= 0 {
+		return false
+	}
+	if n := sl.tarpitted.Add(1); n > int64(config.TarpitConns) {
+		sl.tarpitted.Add(-1)
+		return false
+	}
+	if !sl.track(conn) {
+		sl.tarpitted.Add(-1)
+		return false
+	}
+	go func() {
+		defer sl.tarpitted.Add(-1)
+		defer sl.untrack(conn)
+		defer conn.Close()
+		interval := config.tarpitInterval()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		trickle(conn, ticker.C, interval, time.Now().Add(tarpitTimeout))
+	}()
+	return true
+}
+
+// trickle writes a random byte to conn on every tick until a write fails,
+// taking longer than interval, or deadline passes.
+func trickle(conn net.Conn, ticks <-chan time.Time, interval time.Duration, deadline time.Time) {
+	var b [1]byte
+	for now := range ticks {
+		if now.After(deadline) {
+			return
+		}
+		rand.Read(b[:])
+		conn.SetWriteDeadline(time.Now().Add(interval))
+		if _, err := conn.Write(b[:]); err != nil {
+			return
+		}
+	}
+}
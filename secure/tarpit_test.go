@@ -0,0 +1,88 @@
+package secure
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTarpit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, &Config{
+		AuthorizedKeys: NewAuthorizedKeys(),
+		TarpitConns:    1,
+		TarpitInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go sl.Accept()
+
+	// dialRefused runs a handshake the server refuses, and returns the
+	// underlying connection.
+	dialRefused := func() net.Conn {
+		conn, err := net.Dial("tcp", sl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		Client(conn, nil).Handshake()
+		return conn
+	}
+
+	// The first refused client is kept in the tarpit and trickled bytes.
+	trapped := dialRefused()
+	defer trapped.Close()
+	trapped.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(trapped, make([]byte, 1)); err != nil {
+		t.Fatalf("Unexpected error reading from the tarpit: %v", err)
+	}
+
+	// The tarpit is full, so the next refused client is closed.
+	closed := dialRefused()
+	defer closed.Close()
+	closed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, closed); err != nil {
+		t.Fatalf("Unexpected error: %v, expected the connection to be closed", err)
+	}
+}
+
+func TestTrickle(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ticks := make(chan time.Time)
+	deadline := time.Now().Add(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		trickle(c1, ticks, time.Hour, deadline)
+	}()
+
+	// Every tick trickles one byte.
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+		if _, err := io.ReadFull(c2, make([]byte, 1)); err != nil {
+			t.Fatalf("Unexpected error reading byte %d: %v", i, err)
+		}
+	}
+
+	// Once the client has gone, the next write fails and trickling stops.
+	c2.Close()
+	ticks <- time.Now()
+	<-done
+
+	// A tick past the deadline stops trickling without writing.
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		trickle(c1, ticks, time.Hour, deadline)
+	}()
+	ticks <- deadline.Add(time.Second)
+	<-done
+}
@@ -0,0 +1,76 @@
+package secure
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledWire limits the rate at which frames are read from and written
+// to the wire with token buckets of bytes. Either limiter may be nil to
+// leave that direction unlimited.
+type throttledWire struct {
+	rw   io.ReadWriter
+	r, w *rate.Limiter
+}
+
+// throttle returns rw limited to the configured rates, or rw itself if the
+// config sets none.
+func (c *Config) throttle(rw io.ReadWriter) io.ReadWriter {
+	if c == nil || (c.ReadRateLimit <= 0 && c.WriteRateLimit <= 0) {
+		return rw
+	}
+	return &throttledWire{rw: rw, r: c.rateLimiter(c.ReadRateLimit), w: c.rateLimiter(c.WriteRateLimit)}
+}
+
+// rateLimiter returns a limiter of limit bytes per second with the
+// configured burst, or nil if limit is not positive.
+func (c *Config) rateLimiter(limit int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	burst := c.RateLimitBurst
+	if burst <= 0 {
+		burst = limit
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// Read reads at most a burst of bytes, then waits until the limit allows
+// them.
+func (t *throttledWire) Read(p []byte) (int, error) {
+	if t.r == nil {
+		return t.rw.Read(p)
+	}
+	n, err := t.rw.Read(p[:min(len(p), t.r.Burst())])
+	waitRate(t.r, n)
+	return n, err
+}
+
+// Write writes p a burst at a time, each once the limit allows it.
+func (t *throttledWire) Write(p []byte) (int, error) {
+	if t.w == nil {
+		return t.rw.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), t.w.Burst())]
+		waitRate(t.w, len(chunk))
+		n, err := t.rw.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// waitRate waits until l allows n bytes, which must be no more than its
+// burst.
+func waitRate(l *rate.Limiter, n int) {
+	if n > 0 {
+		time.Sleep(l.ReserveN(time.Now(), n).Delay())
+	}
+}
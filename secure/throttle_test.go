@@ -0,0 +1,35 @@
+package secure
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := Client(c1, &Config{WriteRateLimit: 100000, RateLimitBurst: 10000})
+	server := Server(c2, &Config{ReadRateLimit: 200000})
+	defer client.Close()
+	defer server.Close()
+
+	// After the first burst, the remaining 20000 bytes take at least 0.2s
+	// at 100000 bytes per second.
+	msg := make([]byte, 30000)
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- client.WriteMessage(msg) }()
+	got, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msg) {
+		t.Fatalf("Unexpected message of %d bytes, want %d", len(got), len(msg))
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("Unexpected result. Sent %d bytes in %v despite the rate limit.", len(msg), elapsed)
+	}
+}
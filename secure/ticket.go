@@ -0,0 +1,198 @@
+package secure
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Session resumption lets a client that reconnects to a server prove that
+// it is the peer of an earlier session. After every handshake a server with
+// a ticket key sends the client a ticket in a frameTicket: the new session's
+// resumption secret and an expiry time, sealed with the ticket key, so the
+// server keeps no state per client. A client with a session cache stores the
+// ticket and the secret, and offers the ticket in the hello of its next
+// handshake with the same server. If the server can open the ticket, both
+// ends mix the secret into the keys of the new session, which is marked
+// Resumed, and the client skips its finished message, so the server is
+// done with the handshake a round trip sooner. Otherwise the handshake
+// completes as a full one.
+
+// DefaultTicketLifetime is how long tickets are valid for when
+// Config.TicketLifetime is zero.
+const DefaultTicketLifetime = 24 * time.Hour
+
+// ClientSessionState is the state a client needs to resume a session.
+type ClientSessionState struct {
+	ticket  []byte
+	secret  []byte
+	expires time.Time
+}
+
+// ClientSessionCache is a cache of ClientSessionState objects that clients
+// use to resume sessions, keyed by Config.ServerName or, if that is empty,
+// the remote address of the connection. Implementations must be safe for
+// concurrent use.
+type ClientSessionCache interface {
+	// Get returns the ClientSessionState stored for sessionKey.
+	Get(sessionKey string) (session *ClientSessionState, ok bool)
+
+	// Put stores cs for sessionKey. A nil cs removes the entry.
+	Put(sessionKey string, cs *ClientSessionState)
+}
+
+// lruSessionCache is a ClientSessionCache that evicts the least recently
+// used entry once it holds capacity entries.
+type lruSessionCache struct {
+	mu       sync.Mutex
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+}
+
+type lruSessionCacheEntry struct {
+	sessionKey string
+	state      *ClientSessionState
+}
+
+// NewLRUClientSessionCache returns a ClientSessionCache holding up to
+// capacity sessions. A capacity below one means a default of 64.
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	if capacity < 1 {
+		capacity = 64
+	}
+	return &lruSessionCache{
+		m:        make(map[string]*list.Element),
+		q:        list.New(),
+		capacity: capacity,
+	}
+}
+
+func (c *lruSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.m[sessionKey]; ok {
+		c.q.MoveToFront(elem)
+		return elem.Value.(*lruSessionCacheEntry).state, true
+	}
+	return nil, false
+}
+
+func (c *lruSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.m[sessionKey]; ok {
+		if cs == nil {
+			c.q.Remove(elem)
+			delete(c.m, sessionKey)
+			return
+		}
+		elem.Value.(*lruSessionCacheEntry).state = cs
+		c.q.MoveToFront(elem)
+		return
+	}
+	if cs == nil {
+		return
+	}
+	if c.q.Len() >= c.capacity {
+		oldest := c.q.Back()
+		c.q.Remove(oldest)
+		delete(c.m, oldest.Value.(*lruSessionCacheEntry).sessionKey)
+	}
+	c.m[sessionKey] = c.q.PushFront(&lruSessionCacheEntry{sessionKey, cs})
+}
+
+// sealTicket seals secret and its expiry with key. A ticket is
+//
+//	nonce (24 bytes) | secretbox(expiry (8 bytes, Unix seconds) | secret)
+func sealTicket(key *[KeySize]byte, secret []byte, expires time.Time) ([]byte, error) {
+	var nonce [NonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	plain := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	plain = append(plain, secret...)
+	defer zero(plain)
+	return secretbox.Seal(nonce[:], plain, &nonce, key), nil
+}
+
+// openTicket returns the secret sealed in ticket, if the ticket was sealed
+// with the configured ticket key and has not expired.
+func (c *Config) openTicket(ticket []byte) ([]byte, bool) {
+	key := c.ticketKey()
+	if key == nil || len(ticket) < NonceSize {
+		return nil, false
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], ticket)
+	plain, ok := secretbox.Open(nil, ticket[NonceSize:], &nonce, key)
+	if !ok || len(plain) != 8+KeySize {
+		return nil, false
+	}
+	if time.Now().Unix() >= int64(binary.BigEndian.Uint64(plain)) {
+		return nil, false
+	}
+	return plain[8:], true
+}
+
+// issueTicket queues a ticket for the session, to be sent ahead of the
+// server's first frame. A frameTicket carries
+//
+//	lifetime (4 bytes, seconds) | ticket
+func (c *SecureConn) issueTicket() error {
+	key := c.config.ticketKey()
+	if key == nil {
+		return nil
+	}
+	lifetime := c.config.ticketLifetime()
+	ticket, err := sealTicket(key, c.session.resumptionSecret, time.Now().Add(lifetime))
+	if err != nil {
+		return err
+	}
+	payload := binary.BigEndian.AppendUint32(nil, uint32(lifetime/time.Second))
+	c.sw.queue(frameTicket, append(payload, ticket...))
+	return nil
+}
+
+// loadSession returns the cached session to offer to the server, if any.
+func (c *SecureConn) loadSession() *ClientSessionState {
+	cache := c.config.sessionCache()
+	if cache == nil {
+		return nil
+	}
+	cs, ok := cache.Get(c.serverName())
+	if !ok || cs == nil || !time.Now().Before(cs.expires) {
+		return nil
+	}
+	return cs
+}
+
+// handleTickets drops the offered session if the server did not resume it
+// and stores the tickets the server sends for this one.
+func (c *SecureConn) handleTickets(offered *ClientSessionState) {
+	cache := c.config.sessionCache()
+	if cache == nil {
+		return
+	}
+	sessionKey := c.serverName()
+	if offered != nil && !c.session.Resumed {
+		cache.Put(sessionKey, nil)
+	}
+	secret := c.session.resumptionSecret
+	c.sr.onTicket = func(payload []byte) {
+		if len(payload) < 4 {
+			return
+		}
+		lifetime := time.Duration(binary.BigEndian.Uint32(payload)) * time.Second
+		cache.Put(sessionKey, &ClientSessionState{
+			ticket:  append([]byte(nil), payload[4:]...),
+			secret:  secret,
+			expires: time.Now().Add(lifetime),
+		})
+	}
+}
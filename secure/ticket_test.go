@@ -0,0 +1,124 @@
+package secure
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSessionResumption(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := NewSecureListener(l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	// Echo every connection once.
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.CopyN(c, c, 5)
+			}(conn)
+		}
+	}()
+
+	config := &Config{SessionCache: NewLRUClientSessionCache(0)}
+	exchange := func() bool {
+		conn, err := DialWithConfig(context.Background(), sl.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("Unexpected result: %s != %s", buf, "hello")
+		}
+		return conn.session.Resumed
+	}
+
+	if exchange() {
+		t.Fatal("Unexpected result. The first session was resumed.")
+	}
+	if !exchange() {
+		t.Fatal("Unexpected result. The second session was not resumed.")
+	}
+
+	// A ticket the server cannot open falls back to a full handshake and is
+	// dropped from the cache.
+	cs, _ := config.SessionCache.Get(sl.Addr().String())
+	cs.ticket[len(cs.ticket)-1] ^= 1
+	if exchange() {
+		t.Fatal("Unexpected result. A corrupt ticket was accepted.")
+	}
+	if !exchange() {
+		t.Fatal("Unexpected result. The session after a full handshake was not resumed.")
+	}
+}
+
+func TestResumptionSavesClientFlight(t *testing.T) {
+	var ticketKey [KeySize]byte
+	serverConfig := &Config{TicketKey: &ticketKey}
+	clientConfig := &Config{SessionCache: NewLRUClientSessionCache(0)}
+
+	// handshake returns how many writes the client made during the
+	// handshake, and whether the session was resumed. The server
+	// writes one byte so that the client reads the ticket sent ahead of
+	// it.
+	handshake := func() (writes int, resumed bool) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		counter := &countingConn{Conn: c1}
+		client, server := Client(counter, clientConfig), Server(c2, serverConfig)
+		errc := make(chan error, 1)
+		go func() {
+			// The server never reads after its handshake, so it only
+			// completes if the client sends nothing after a resumed hello.
+			if err := server.Handshake(); err != nil {
+				errc <- err
+				return
+			}
+			_, err := server.Write([]byte("x"))
+			errc <- err
+		}()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		writes = counter.writes
+		if _, err := io.ReadFull(client, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		return writes, client.session.Resumed
+	}
+
+	fullWrites, resumed := handshake()
+	if resumed {
+		t.Fatal("Unexpected result. The first session was resumed.")
+	}
+	writes, resumed := handshake()
+	if !resumed {
+		t.Fatal("Unexpected result. The second session was not resumed.")
+	}
+	if writes != 1 || fullWrites != 2 {
+		t.Fatalf("Unexpected result. The client sent %d flights resuming and %d in full, want 1 and 2.", writes, fullWrites)
+	}
+}
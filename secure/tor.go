@@ -0,0 +1,217 @@
+package secure
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultTorControlAddr and DefaultTorSOCKSAddr are where Tor listens
+	// for controllers and for SOCKS clients by default.
+	DefaultTorControlAddr = "127.0.0.1:9051"
+	DefaultTorSOCKSAddr   = "127.0.0.1:9050"
+)
+
+// OnionConfig configures ListenOnion.
+type OnionConfig struct {
+	// ControlAddr is the address of Tor's control port. If empty,
+	// DefaultTorControlAddr is used.
+	ControlAddr string
+
+	// ControlPassword is the password of the control port, if Tor has a
+	// HashedControlPassword. If empty, cookie authentication is used, or
+	// none if Tor allows it.
+	ControlPassword string
+
+	// Key is the private key of the onion service, as returned by
+	// OnionListener.Key, to publish the same address again. If empty, a
+	// new address is created.
+	Key string
+
+	// Port is the port clients dial on the onion address. If zero, it is
+	// the port of the local listener.
+	Port int
+}
+
+// OnionListener is a listener published as a Tor onion service. Tor
+// forwards the connections to the onion address to the local listener, so
+// wrap it with NewSecureListener or pass it to SecureServer.Serve to secure
+// them. The service is withdrawn when the listener is closed.
+type OnionListener struct {
+	net.Listener
+
+	// ctrl is the control connection the service lives as long as.
+	ctrl net.Conn
+
+	// onionAddr is the address clients dial and key the private key of
+	// the service.
+	onionAddr, key string
+}
+
+// ListenOnion publishes l as a Tor onion service through Tor's control
+// port. Clients reach it through Tor's SOCKS port, for example with
+// TorDialer.
+func ListenOnion(l net.Listener, config *OnionConfig) (*OnionListener, error) {
+	if config == nil {
+		config = &OnionConfig{}
+	}
+	controlAddr := config.ControlAddr
+	if controlAddr == "" {
+		controlAddr = DefaultTorControlAddr
+	}
+	localHost, localPort, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(localHost); ip == nil || ip.IsUnspecified() {
+		localHost = "127.0.0.1"
+	}
+	port := config.Port
+	if port == 0 {
+		if port, err = strconv.Atoi(localPort); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		return nil, err
+	}
+	tc := &torControl{conn: conn, r: bufio.NewReader(conn)}
+	if err := tc.authenticate(config.ControlPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	key := config.Key
+	if key == "" {
+		key = "NEW:ED25519-V3"
+	}
+	target := net.JoinHostPort(localHost, localPort)
+	reply, err := tc.command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", key, port, target))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ol := &OnionListener{Listener: l, ctrl: conn, key: config.Key}
+	for _, line := range reply {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok {
+			ol.onionAddr = net.JoinHostPort(id+".onion", strconv.Itoa(port))
+		} else if k, ok := strings.CutPrefix(line, "PrivateKey="); ok {
+			ol.key = k
+		}
+	}
+	if ol.onionAddr == "" {
+		conn.Close()
+		return nil, errors.New("secure: tor did not return a service ID")
+	}
+	return ol, nil
+}
+
+// OnionAddr returns the onion address clients dial, such as
+// "xyz…xyz.onion:8080".
+func (ol *OnionListener) OnionAddr() string {
+	return ol.onionAddr
+}
+
+// Key returns the private key of the onion service, which publishes the
+// same address again as OnionConfig.Key. Keep it secret.
+func (ol *OnionListener) Key() string {
+	return ol.key
+}
+
+// Close withdraws the onion service and closes the local listener.
+func (ol *OnionListener) Close() error {
+	ol.ctrl.Close()
+	return ol.Listener.Close()
+}
+
+// TorDialer returns a dialer that connects through Tor's SOCKS port at
+// socksAddr, or DefaultTorSOCKSAddr if it is empty, and so can dial onion
+// addresses. Use it as Config.Dialer.
+func TorDialer(socksAddr string) (ContextDialer, error) {
+	if socksAddr == "" {
+		socksAddr = DefaultTorSOCKSAddr
+	}
+	return ProxyDialer("socks5h://" + socksAddr)
+}
+
+// torControl is a connection to Tor's control port, which speaks the
+// protocol of https://spec.torproject.org/control-spec.
+type torControl struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// command sends cmd and returns the lines of a successful reply, without
+// their status codes.
+func (tc *torControl) command(cmd string) ([]string, error) {
+	if _, err := fmt.Fprintf(tc.conn, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("secure: malformed tor control reply %q", line)
+		}
+		if line[:3] != "250" {
+			return nil, fmt.Errorf("secure: tor: %s", line)
+		}
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// authenticate authenticates with password, if not empty, or the way Tor
+// asks for in its PROTOCOLINFO reply.
+func (tc *torControl) authenticate(password string) error {
+	if password != "" {
+		_, err := tc.command("AUTHENTICATE " + strconv.Quote(password))
+		return err
+	}
+	reply, err := tc.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	for _, line := range reply {
+		rest, ok := strings.CutPrefix(line, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		methods, rest, _ := strings.Cut(rest, " ")
+		if strings.Contains(","+methods+",", ",NULL,") {
+			break
+		}
+		if !strings.Contains(","+methods+",", ",COOKIE,") {
+			return fmt.Errorf("secure: tor control port needs a password (methods %s)", methods)
+		}
+		file, ok := strings.CutPrefix(rest, "COOKIEFILE=")
+		if !ok {
+			return errors.New("secure: tor did not name its cookie file")
+		}
+		if file, err = strconv.Unquote(file); err != nil {
+			return err
+		}
+		cookie, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		_, err = tc.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		return err
+	}
+	_, err = tc.command("AUTHENTICATE")
+	return err
+}
@@ -0,0 +1,80 @@
+package secure
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTor answers the control port commands of one controller on l the way
+// Tor does, using cookie authentication, and sends each command to cmds.
+func fakeTor(l net.Listener, cookieFile string, cmds chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		cmds <- cmd
+		switch {
+		case cmd == "PROTOCOLINFO 1":
+			conn.Write([]byte("250-PROTOCOLINFO 1\r\n" +
+				`250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="` + cookieFile + "\"\r\n" +
+				"250-VERSION Tor=\"0.4.8.10\"\r\n250 OK\r\n"))
+		case cmd == "AUTHENTICATE 636f6f6b6965":
+			conn.Write([]byte("250 OK\r\n"))
+		case strings.HasPrefix(cmd, "ADD_ONION "):
+			conn.Write([]byte("250-ServiceID=exampleonionid\r\n" +
+				"250-PrivateKey=ED25519-V3:c2VjcmV0\r\n250 OK\r\n"))
+		default:
+			conn.Write([]byte("510 Unrecognized command\r\n"))
+		}
+	}
+}
+
+func TestListenOnion(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := os.WriteFile(cookieFile, []byte("cookie"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	cmds := make(chan string, 3)
+	go fakeTor(ctrl, cookieFile, cmds)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ol, err := ListenOnion(l, &OnionConfig{ControlAddr: ctrl.Addr().String(), Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ol.Close()
+
+	want := []string{"PROTOCOLINFO 1", "AUTHENTICATE 636f6f6b6965",
+		"ADD_ONION NEW:ED25519-V3 Port=8080," + l.Addr().String()}
+	for _, w := range want {
+		if cmd := <-cmds; cmd != w {
+			t.Fatalf("Unexpected command: %q != %q", cmd, w)
+		}
+	}
+	if got := ol.OnionAddr(); got != "exampleonionid.onion:8080" {
+		t.Fatalf("Unexpected result: %s", got)
+	}
+	if got := ol.Key(); got != "ED25519-V3:c2VjcmV0" {
+		t.Fatalf("Unexpected result: %s", got)
+	}
+}
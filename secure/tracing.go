@@ -0,0 +1,40 @@
+package secure
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the package's spans.
+const tracerName = "github.com/jppunnett/gochal2/secure"
+
+// noopTracer is the tracer used when no TracerProvider is configured.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracer returns the tracer of the configured TracerProvider, or one that
+// records nothing.
+func (c *Config) tracer() trace.Tracer {
+	if c == nil || c.TracerProvider == nil {
+		return noopTracer
+	}
+	return c.TracerProvider.Tracer(tracerName)
+}
+
+// sessionAttributes describes the peer of session s.
+func sessionAttributes(s *Session) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gochal2.peer.fingerprint", s.peerName()),
+		attribute.Bool("gochal2.resumed", s.Resumed),
+	}
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
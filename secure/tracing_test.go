@@ -0,0 +1,61 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{}
+	defer srv.Close()
+	go srv.Serve(l)
+
+	recorder := tracetest.NewSpanRecorder()
+	config := &Config{TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))}
+	conn, err := DialWithConfig(context.Background(), l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := conn.RoundTrip(context.Background(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("Unexpected result: %s != %s", reply, "hello")
+	}
+
+	// The handshake is a child of the dial, and both it and the round trip
+	// know the server's fingerprint.
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	dial, handshake, roundTrip := spans["secure.Dial"], spans["secure.Handshake"], spans["secure.RoundTrip"]
+	if dial == nil || handshake == nil || roundTrip == nil {
+		t.Fatalf("Unexpected spans: %v", spans)
+	}
+	if handshake.Parent().SpanID() != dial.SpanContext().SpanID() {
+		t.Fatal("Unexpected result. The handshake is not part of the dial.")
+	}
+	pub, _ := conn.PeerPublicKey()
+	for _, span := range []sdktrace.ReadOnlySpan{handshake, roundTrip} {
+		found := false
+		for _, kv := range span.Attributes() {
+			if kv.Key == "gochal2.peer.fingerprint" && kv.Value.AsString() == Fingerprint(pub) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Unexpected result. %s has no peer fingerprint.", span.Name())
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package secure
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// NewTransport returns an http.Transport that carries the requests of
+// http URLs over secure connections dialed with config, as DialWithConfig
+// takes it, so that net/http clients reach servers serving HTTP on a
+// SecureListener:
+//
+//	l, err := secure.NewSecureListener(tcpListener, config)
+//	...
+//	http.Serve(l, handler)
+//
+// The transport keeps idle connections for reuse, as http.DefaultTransport
+// does, but connects directly rather than through the proxy of the
+// environment, which would see the requests before they are encrypted.
+func NewTransport(config *Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return DialWithConfig(ctx, addr, config)
+	}
+	return t
+}
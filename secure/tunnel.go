@@ -0,0 +1,144 @@
+package secure
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// A tunnel carries a plaintext TCP connection through a secure connection,
+// as spiped does, to protect services that don't encrypt their traffic.
+// Each end sends what it reads from its plaintext connection as messages,
+// and an empty message once that connection reaches EOF, so that each
+// direction is closed on its own; see tunnelConn.
+const (
+	// tunnelDialTimeout bounds the wait for the target of a ForwardHandler
+	// to accept a connection.
+	tunnelDialTimeout = 10 * time.Second
+)
+
+// ForwardHandler returns a Handler that serves the far end of tunnels:
+// it connects each secure connection to the TCP service at target, such as
+// "127.0.0.1:5432", and forwards the traffic between them. The near end is
+// ServeTunnel.
+//
+// The connections are subject to the server's idle timeout like any other,
+// so raise Config.IdleTimeout for services whose connections sit idle.
+func ForwardHandler(target string) Handler {
+	return HandlerFunc(func(conn net.Conn) {
+		sc, ok := conn.(*SecureConn)
+		if !ok {
+			return
+		}
+		d := net.Dialer{Timeout: tunnelDialTimeout}
+		tc, err := d.Dial("tcp", target)
+		if err != nil {
+			sc.config.logger().Warn("tunnel target unreachable", "target", target, "err", err)
+			return
+		}
+		defer tc.Close()
+		splice(&tunnelConn{SecureConn: sc}, tc)
+	})
+}
+
+// ServeTunnel serves the near end of tunnels: it accepts plaintext
+// connections on l and forwards each through a new secure connection to
+// the server at addr, which forwards it on with ForwardHandler. config
+// configures the secure connections as DialWithConfig takes it.
+// ServeTunnel returns once Accept fails, such as when l is closed.
+func ServeTunnel(l net.Listener, addr string, config *Config) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			sc, err := DialWithConfig(context.Background(), addr, config)
+			if err != nil {
+				config.logger().Warn("tunnel dial failed", "addr", addr, "err", err)
+				return
+			}
+			defer sc.Close()
+			splice(&tunnelConn{SecureConn: sc}, c)
+		}()
+	}
+}
+
+// tunnelConn is the plaintext stream a tunnel carries over a secure
+// connection.
+type tunnelConn struct {
+	*SecureConn
+
+	// buf holds the part of the last message not read yet, and eof is set
+	// once the empty message arrived.
+	buf []byte
+	eof bool
+}
+
+// Read reads the data of the next messages, and returns io.EOF once the
+// other end closed its side of the stream.
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.buf, c.eof = msg, len(msg) == 0
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends p as a message.
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := c.WriteMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteTo stands in for that of the SecureConn, which knows nothing of the
+// empty message that ends the stream, so that io.Copy goes through Read.
+func (c *tunnelConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{c})
+}
+
+// CloseWrite closes this side of the stream.
+func (c *tunnelConn) CloseWrite() error {
+	return c.WriteMessage(nil)
+}
+
+// splice forwards the traffic between a and b until both directions are
+// closed, or either connection fails.
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyHalf(b, a)
+	}()
+	copyHalf(a, b)
+	<-done
+}
+
+// copyHalf copies src to dst, then closes dst for writing if dst supports
+// that, as a *net.TCPConn does. If the copy fails, it closes both
+// connections to stop the other direction too.
+func copyHalf(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
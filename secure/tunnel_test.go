@@ -0,0 +1,96 @@
+package secure
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTunnel(t *testing.T) {
+	// The target answers once the client is done sending, so the tunnel
+	// must carry the client's half-close through.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := io.ReadAll(c)
+		if err != nil {
+			return
+		}
+		c.Write(bytes.ToUpper(req))
+	}()
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Handler: ForwardHandler(target.Addr().String())}
+	go srv.Serve(sl)
+	defer srv.Close()
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	go ServeTunnel(tl, sl.Addr().String(), nil)
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := bytes.Repeat([]byte("hello "), 20000)
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.ToUpper(req)) {
+		t.Fatalf("Unexpected result: %d bytes", len(got))
+	}
+}
+
+func TestTunnelTargetUnreachable(t *testing.T) {
+	// A port nothing listens on.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &SecureServer{Handler: ForwardHandler(target.Addr().String())}
+	go srv.Serve(sl)
+	defer srv.Close()
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	go ServeTunnel(tl, sl.Addr().String(), nil)
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read %d bytes from a tunnel to nowhere", n)
+	}
+}
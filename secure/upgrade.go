@@ -0,0 +1,51 @@
+package secure
+
+import (
+	"bufio"
+	"context"
+	"net"
+)
+
+// Upgrade switches conn, which has carried plaintext so far, to the secure
+// transport, as an application protocol does once both ends agree to, such
+// as after a STARTTLS-like command. It runs the handshake in role, the peer
+// running it in the other role, and returns the secure connection to use
+// from then on. If the handshake fails, conn is closed.
+//
+// Nothing the peer sent after the plaintext may be left in a buffer: if
+// the plaintext was read through a bufio.Reader, upgrade
+// BufferedConn(conn, r) rather than conn.
+func Upgrade(ctx context.Context, conn net.Conn, role Role, config *Config) (*SecureConn, error) {
+	sc := Server(conn, config)
+	if role == ClientRole {
+		sc = Client(conn, config)
+	}
+	if err := sc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// BufferedConn returns a connection that reads what r has buffered from
+// conn before reading from conn again.
+func BufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+type bufferedConn struct {
+	net.Conn
+
+	// r is nil once its buffer has been read.
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(p)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(p)
+}
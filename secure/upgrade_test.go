@@ -0,0 +1,68 @@
+package secure
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type result struct {
+		msg string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		line, err := r.ReadString('\n')
+		if err != nil || line != "STARTSECURE\n" {
+			done <- result{msg: line, err: err}
+			return
+		}
+		// The client's hello may already be in r's buffer.
+		sc, err := Upgrade(context.Background(), BufferedConn(conn, r), ServerRole, nil)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		msg, err := sc.ReadMessage()
+		done <- result{string(msg), err}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The client doesn't wait for an answer before its hello.
+	if _, err := conn.Write([]byte("STARTSECURE\n")); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := Upgrade(context.Background(), conn, ClientRole, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.WriteMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.msg != "hello" {
+		t.Fatalf("Unexpected result: %q", res.msg)
+	}
+}
@@ -0,0 +1,69 @@
+package secure
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coder/websocket"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// maxWebSocketMessage bounds the WebSocket messages read. The secure stream
+// is written one frame at a time, so no message is longer than a frame of
+// the largest size peers may negotiate.
+const maxWebSocketMessage = headerSize + 1 + maxFrameSizeLimit + box.Overhead
+
+// DialWebSocket connects to the secure server behind the WebSocket URL, such
+// as "wss://example.com/tunnel", performs the handshake and returns a
+// SecureConn. The connection goes through any HTTP proxy set in the
+// environment. config may be nil; if it has no ServerName, url is used.
+func DialWebSocket(ctx context.Context, url string, config *Config) (*SecureConn, error) {
+	if config != nil && config.ServerName == "" {
+		config = config.clone()
+		config.ServerName = url
+	}
+
+	ws, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(maxWebSocketMessage)
+	sc := Client(websocket.NetConn(context.Background(), ws, websocket.MessageBinary), config)
+	if err := sc.HandshakeContext(ctx); err != nil {
+		sc.conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ServeHTTP upgrades the request to a WebSocket, runs the server side of the
+// handshake over it and serves the connection with the server's Handler, so
+// that a SecureServer can be mounted on an HTTP server:
+//
+//	http.Handle("/tunnel", srv)
+//
+// The connection counts towards Shutdown and Close like those accepted by
+// Serve.
+func (srv *SecureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		// Accept has already answered the request.
+		return
+	}
+	ws.SetReadLimit(maxWebSocketMessage)
+	srv.mu.Lock()
+	config := srv.connConfig()
+	srv.mu.Unlock()
+	conn := Server(websocket.NetConn(context.Background(), ws, websocket.MessageBinary), config)
+	if !srv.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer srv.trackConn(conn, false)
+	if err := conn.HandshakeContext(r.Context()); err != nil {
+		conn.Close()
+		config.logger().Warn("handshake failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	srv.serveConn(conn)
+}
@@ -0,0 +1,37 @@
+package secure
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocket(t *testing.T) {
+	srv := &SecureServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	conn, err := DialWebSocket(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Messages longer than a WebSocket message's default limit get through.
+	msg := strings.Repeat("hello", 20000)
+	go conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	for n := 0; n < len(msg); {
+		m, err := conn.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if string(buf) != msg {
+		t.Fatal("Unexpected result. The echo differs from the message.")
+	}
+}
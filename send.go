@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// send sends a message to a server and prints the reply.
+func send(fs *flag.FlagSet, args []string) {
+	client := clientFlags(fs)
+	printFingerprint := fs.Bool("fingerprint", false, "Print the fingerprint of the server's key")
+	lan := fs.Bool("lan", false, "Connect to the server of this name on the local network, or to any")
+	relay := fs.String("relay", "", "Connect through the relay at this address to the peer whose public key file is <addr>")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr, msg := fs.Arg(0), fs.Arg(1)
+	srv := strings.HasPrefix(addr, "_")
+	if *lan {
+		peer, err := findLANPeer(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The fingerprint is as announced, so this only catches another
+		// server having taken the address since.
+		if client.expectFingerprint == "" {
+			client.expectFingerprint = peer.Fingerprint
+		}
+		addr, srv = peer.Addr, false
+	} else if *relay == "" && !srv && !strings.Contains(addr, ":") {
+		// A bare port, as the client used to take.
+		addr = "localhost:" + addr
+	}
+
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var conn *secure.SecureConn
+	if *relay != "" {
+		var peer *[secure.KeySize]byte
+		if peer, err = secure.LoadPublicKey(addr); err != nil {
+			log.Fatal(err)
+		}
+		conn, err = secure.DialRelay(context.Background(), *relay, peer, config)
+	} else if srv {
+		// A service name, such as _gochal._tcp.example.com.
+		conn, err = secure.DialSRV(context.Background(), addr, config)
+	} else {
+		conn, err = secure.DialWithConfig(context.Background(), addr, config)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if *printFingerprint {
+		pub, err := conn.PeerPublicKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Server key fingerprint: %s\n", secure.Fingerprint(pub))
+	}
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		log.Fatal(err)
+	}
+	// The echo may come back in several frames.
+	buf := make([]byte, len(msg))
+	n, err := io.ReadFull(conn, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", buf[:n])
+}
+
+// findLANPeer returns the server of the given name on the local network, or
+// the first to answer if name is "any".
+func findLANPeer(name string) (secure.LANPeer, error) {
+	peers, err := browseLAN(2 * time.Second)
+	if err != nil {
+		return secure.LANPeer{}, err
+	}
+	for _, peer := range peers {
+		if name == "any" || peer.Instance == name {
+			return peer, nil
+		}
+	}
+	return secure.LANPeer{}, fmt.Errorf("no server %q on the local network", name)
+}
+
+// clientOptions are the flags of the commands that dial a server.
+type clientOptions struct {
+	knownHosts        string
+	strict            bool
+	revocationList    string
+	expectFingerprint string
+	proxyURL          string
+	tor               bool
+	cipherSuites      suiteList
+	noise             secure.NoisePattern
+	traceFrames       bool
+	lockMemory        bool
+	keyFile, pubFile  *string
+}
+
+// clientFlags defines the flags of a command that dials a server.
+func clientFlags(fs *flag.FlagSet) *clientOptions {
+	o := &clientOptions{}
+	fs.StringVar(&o.knownHosts, "known-hosts", "", "Pin server keys in this file")
+	fs.BoolVar(&o.strict, "strict", false, "Refuse servers missing from -known-hosts")
+	fs.StringVar(&o.revocationList, "revocation-list", "", "Refuse servers whose keys are listed in this file or at this http(s) URL")
+	fs.StringVar(&o.expectFingerprint, "expect-fingerprint", "", "Abort unless the server's key has this fingerprint")
+	fs.StringVar(&o.proxyURL, "proxy", "", "Connect through this SOCKS5 proxy, such as socks5://127.0.0.1:1080")
+	fs.BoolVar(&o.tor, "tor", false, "Connect through Tor's SOCKS port, as needed for .onion addresses")
+	fs.Var(&o.cipherSuites, "cipher-suites", suitesUsage)
+	fs.TextVar(&o.noise, "noise", secure.NoiseNone, "Run a Noise handshake: none, XX or IK. IK needs the server in -known-hosts, and falls back to XX")
+	fs.BoolVar(&o.traceFrames, "vv", false, "Log every frame to standard error, with hex dumps of its ciphertext and plaintext")
+	fs.BoolVar(&o.lockMemory, "lock-memory", false, "Lock private and session keys into RAM so they are never swapped to disk")
+	o.keyFile, o.pubFile = keyFlags(fs)
+	return o
+}
+
+// config returns the config to dial servers with, as set by the flags.
+func (o *clientOptions) config() (*secure.Config, error) {
+	keys, err := loadKeys(*o.keyFile, *o.pubFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &secure.Config{Keys: keys, CipherSuites: o.cipherSuites, Noise: o.noise, LockMemory: o.lockMemory}
+	if o.lockMemory && keys != nil {
+		if err := secure.LockKeyPair(keys); err != nil {
+			return nil, err
+		}
+	}
+	if o.traceFrames {
+		config.TraceFrames = true
+		config.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if config.KeyLogWriter, err = keyLogWriter(); err != nil {
+		return nil, err
+	}
+	if o.knownHosts != "" {
+		kh, err := secure.LoadKnownHosts(o.knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		kh.Strict = o.strict
+		config.KnownHosts = kh
+	}
+	if o.revocationList != "" {
+		rl, err := secure.LoadRevocationList(context.Background(), o.revocationList)
+		if err != nil {
+			return nil, err
+		}
+		config.RevocationList = rl
+	}
+	if o.expectFingerprint != "" {
+		config.Authorizer = secure.ExpectFingerprint(o.expectFingerprint)
+	}
+	switch {
+	case o.tor:
+		config.Dialer, err = secure.TorDialer("")
+	case o.proxyURL != "":
+		config.Dialer, err = secure.ProxyDialer(o.proxyURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
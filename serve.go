@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// serve runs a secure echo server, or a relay, the far end of tunnels or a
+// load test server.
+//
+// On SIGHUP, it reads its config file, keys and authorized keys again and
+// applies them to new connections.
+func serve(fs *flag.FlagSet, args []string) {
+	cfg, err := parseServerConfig(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var logOut io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		logOut = f
+	}
+	// The log package writes through the same logger from here on.
+	logger, err := cfg.logger(logOut)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Without a key file, the server keeps the key generated here across
+	// reloads.
+	generated, err := secure.GenerateKeyPair()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := cfg.secureConfig(generated, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The bans outlast reloads.
+	banner := cfg.banner()
+	config.Banner = banner
+	keys := config.Keys
+	stopRefresh := cfg.refreshRevocations(config, logger)
+	defer func() { stopRefresh() }()
+
+	srv := &secure.SecureServer{Config: config, MaxHandlers: cfg.MaxHandlers, RejectWhenBusy: cfg.RejectWhenBusy}
+	modes := 0
+	for _, set := range []bool{cfg.Relay, cfg.Forward != "", cfg.Reverse != "", cfg.SOCKS, cfg.LoadTest} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatal("relay, forward, reverse, socks and load_test are exclusive")
+	}
+	errc := make(chan error, len(cfg.Listen)+2)
+	switch {
+	case cfg.Relay:
+		srv.Handler = &secure.Relay{}
+	case cfg.Forward != "":
+		srv.Handler = secure.ForwardHandler(cfg.Forward)
+	case cfg.SOCKS:
+		srv.Handler = secure.SOCKSHandler
+	case cfg.LoadTest:
+		if cfg.LoadInterval.Duration <= 0 {
+			log.Fatal("load_interval must be positive")
+		}
+		srv.Handler = loadHandler(logger, cfg.LoadInterval.Duration)
+	case cfg.Reverse != "":
+		rt := &secure.ReverseTunnel{}
+		srv.Handler = rt
+		l, err := net.Listen("tcp", cfg.Reverse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		logger.Info("forwarding to reverse tunnel clients", "addr", l.Addr().String())
+		go func() { errc <- rt.Serve(l) }()
+	}
+	for i, addr := range cfg.Listen {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info("listening", "addr", l.Addr().String(), "fingerprint", secure.Fingerprint(keys.Public))
+		if i == 0 && cfg.MDNS {
+			a, err := secure.AnnounceLAN("", l.Addr().(*net.TCPAddr).Port, keys.Public)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer a.Close()
+			logger.Info("announcing on the local network")
+		}
+		if i == 0 && cfg.TorControl != "" {
+			ol, err := listenOnion(l, cfg.TorControl, cfg.OnionKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			logger.Info("published onion service", "addr", ol.OnionAddr())
+			l = ol
+		}
+		go func() { errc <- srv.Serve(l) }()
+	}
+	if cfg.Admin != "" {
+		l, err := net.Listen("tcp", cfg.Admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		logger.Info("serving the admin interface", "addr", l.Addr().String())
+		go func() { errc <- http.Serve(l, adminHandler(srv)) }()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for done := false; !done; {
+		select {
+		case err := <-errc:
+			srv.Close()
+			log.Fatal(err)
+		case <-hup:
+			stop, err := reloadServer(srv, args, generated, banner, logger)
+			if err != nil {
+				logger.Error("reload failed, keeping the current config", "err", err)
+				break
+			}
+			stopRefresh()
+			stopRefresh = stop
+		case <-ctx.Done():
+			done = true
+		}
+	}
+
+	// Drain the connections in flight. A second signal, or the timeout,
+	// closes them straight away.
+	stop()
+	logger.Info("shutting down, waiting for connections to finish", "timeout", cfg.ShutdownTimeout.Duration)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("shutdown incomplete, closing connections", "err", err)
+		srv.Close()
+	}
+}
+
+// parseServerConfig returns the serve command's config, read from the file
+// named by the -config flag in args, if any, and from the other flags in
+// args, which take precedence.
+func parseServerConfig(fs *flag.FlagSet, args []string) (*serverConfig, error) {
+	cfg := defaultServerConfig()
+	configFile := fs.String("config", "", "TOML configuration file. Flags override its values")
+	cfg.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		if err := cfg.load(*configFile); err != nil {
+			return nil, err
+		}
+		// Parse again so that flags take precedence over the file.
+		fs.Parse(args)
+	}
+	return cfg, nil
+}
+
+// reloadServer reads the config of the serve command run with args again,
+// and applies it to the new connections of srv. Settings that only take
+// effect at startup, such as the listen addresses and logging, are left as
+// they are, and so is banner, to keep its bans. It returns the function
+// that stops refreshing the new revocation list.
+func reloadServer(srv *secure.SecureServer, args []string, generated *secure.KeyPair, banner *secure.Banner, logger *slog.Logger) (func(), error) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, err := parseServerConfig(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	config, err := cfg.secureConfig(generated, logger)
+	if err != nil {
+		return nil, err
+	}
+	config.Banner = banner
+	if err := srv.Reload(config); err != nil {
+		return nil, err
+	}
+	logger.Info("reloaded config", "fingerprint", secure.Fingerprint(config.Keys.Public))
+	return cfg.refreshRevocations(config, logger), nil
+}
+
+// adminHandler serves the admin interface of srv: the list of the
+// connections it serves, as JSON, at /conns.
+func adminHandler(srv *secure.SecureServer) http.Handler {
+	type conn struct {
+		Remote  string    `json:"remote"`
+		Peer    string    `json:"peer"`
+		Resumed bool      `json:"resumed"`
+		Start   time.Time `json:"start"`
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, r *http.Request) {
+		conns := []conn{}
+		for _, c := range srv.Conns() {
+			conns = append(conns, conn{c.RemoteAddr.String(), c.Peer, c.Resumed, c.Start})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conns)
+	})
+	return mux
+}
+
+// listenOnion publishes l as an onion service through the Tor control port
+// at controlAddr. If keyFile is not empty, the service's key is read from
+// it, or written to it the first time, so the address stays the same.
+func listenOnion(l net.Listener, controlAddr, keyFile string) (*secure.OnionListener, error) {
+	config := &secure.OnionConfig{ControlAddr: controlAddr}
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		config.Key = strings.TrimSpace(string(key))
+	}
+	ol, err := secure.ListenOnion(l, config)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile != "" && config.Key == "" {
+		if err := os.WriteFile(keyFile, []byte(ol.Key()+"\n"), 0600); err != nil {
+			ol.Close()
+			return nil, err
+		}
+	}
+	return ol, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+func TestAdminHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &secure.SecureServer{}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := secure.DialWithConfig(context.Background(), l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	adminHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/conns", nil))
+	var conns []struct {
+		Remote string `json:"remote"`
+		Peer   string `json:"peer"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &conns); err != nil {
+		t.Fatalf("Unexpected error: %v, in %q", err, w.Body.String())
+	}
+	if len(conns) != 1 || conns[0].Remote != conn.LocalAddr().String() || conns[0].Peer == "" {
+		t.Fatalf("Unexpected connections: %+v", conns)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// serverConfig is the configuration of the serve command. It is read from
+// a TOML file, such as
+//
+//	listen = [":8080", "[::1]:9000"]
+//	key = "/etc/gochal2/server.key"
+//	previous_key = "/etc/gochal2/server.key.old"
+//	previous_key_expires = 2026-12-01T00:00:00Z
+//	authorized_keys = "/etc/gochal2/authorized_keys"
+//	revocation_list = "https://example.com/gochal2/revoked_keys"
+//	revocation_refresh = "1h"
+//	handshake_timeout = "10s"
+//	idle_timeout = "5m"
+//	shutdown_timeout = "30s"
+//	log_file = "/var/log/gochal2.log"
+//	log_level = "debug"
+//	log_format = "json"
+//	trace_frames = false
+//	tor_control = "127.0.0.1:9051"
+//	onion_key = "/etc/gochal2/onion.key"
+//	proxy_protocol = true
+//	mdns = true
+//	relay = false
+//	forward = "127.0.0.1:5432"
+//	reverse = ":8443"
+//	socks = false
+//	load_test = false
+//	load_interval = "1s"
+//	cipher_suites = ["aes-256-gcm"]
+//	noise = "XX"
+//	rate_limit = 1048576
+//	rate_limit_burst = 65536
+//	max_conns = 10000
+//	max_conns_per_ip = 20
+//	ip_filter = "/etc/gochal2/ip_filter"
+//	ban_failures = 5
+//	ban_window = "10m"
+//	ban_time = "1h"
+//	tarpit_conns = 100
+//	tarpit_interval = "10s"
+//	max_handlers = 1000
+//	reject_when_busy = false
+//	max_conn_lifetime = "24h"
+//	admin = "127.0.0.1:8081"
+//	lock_memory = true
+//
+// and flags given on the command line, named like the keys but with
+// hyphens for underscores, override the values in the file.
+// key and previous_key may also be keychain:NAME, to keep the private key
+// in the platform's keychain instead of a file.
+// To rotate the server's key pair, move the key file to previous_key, give
+// clients that pinned it until previous_key_expires to connect and learn
+// the new key, and reload. The keys, authorized keys, revocation list,
+// timeouts, proxy_protocol, cipher_suites, noise, rate limits, connection
+// limits, IP filter, tarpit, max_conn_lifetime and lock_memory are read
+// again on SIGHUP; the other settings need a restart.
+type serverConfig struct {
+	Listen             stringList          `toml:"listen"`
+	Key                string              `toml:"key"`
+	Pub                string              `toml:"pub"`
+	PreviousKey        string              `toml:"previous_key"`
+	PreviousKeyExpires time.Time           `toml:"previous_key_expires"`
+	AuthorizedKeys     string              `toml:"authorized_keys"`
+	RevocationList     string              `toml:"revocation_list"`
+	RevocationRefresh  duration            `toml:"revocation_refresh"`
+	HandshakeTimeout   duration            `toml:"handshake_timeout"`
+	IdleTimeout        duration            `toml:"idle_timeout"`
+	ShutdownTimeout    duration            `toml:"shutdown_timeout"`
+	LogFile            string              `toml:"log_file"`
+	LogLevel           slog.Level          `toml:"log_level"`
+	LogFormat          string              `toml:"log_format"`
+	TraceFrames        bool                `toml:"trace_frames"`
+	TorControl         string              `toml:"tor_control"`
+	OnionKey           string              `toml:"onion_key"`
+	ProxyProtocol      bool                `toml:"proxy_protocol"`
+	MDNS               bool                `toml:"mdns"`
+	Relay              bool                `toml:"relay"`
+	Forward            string              `toml:"forward"`
+	Reverse            string              `toml:"reverse"`
+	SOCKS              bool                `toml:"socks"`
+	LoadTest           bool                `toml:"load_test"`
+	LoadInterval       duration            `toml:"load_interval"`
+	CipherSuites       suiteList           `toml:"cipher_suites"`
+	Noise              secure.NoisePattern `toml:"noise"`
+	RateLimit          int                 `toml:"rate_limit"`
+	RateLimitBurst     int                 `toml:"rate_limit_burst"`
+	MaxConns           int                 `toml:"max_conns"`
+	MaxConnsPerIP      int                 `toml:"max_conns_per_ip"`
+	IPFilter           string              `toml:"ip_filter"`
+	BanFailures        int                 `toml:"ban_failures"`
+	BanWindow          duration            `toml:"ban_window"`
+	BanTime            duration            `toml:"ban_time"`
+	TarpitConns        int                 `toml:"tarpit_conns"`
+	TarpitInterval     duration            `toml:"tarpit_interval"`
+	MaxHandlers        int                 `toml:"max_handlers"`
+	RejectWhenBusy     bool                `toml:"reject_when_busy"`
+	MaxConnLifetime    duration            `toml:"max-conn-lifetime"`
+	Admin              string              `toml:"admin"`
+	LockMemory         bool                `toml:"lock_memory"`
+}
+
+// defaultServerConfig returns the configuration used when neither the file
+// nor the flags say otherwise.
+func defaultServerConfig() *serverConfig {
+	return &serverConfig{
+		Listen:            stringList{":8080"},
+		HandshakeTimeout:  duration{secure.DefaultHandshakeTimeout},
+		IdleTimeout:       duration{secure.DefaultIdleTimeout},
+		ShutdownTimeout:   duration{30 * time.Second},
+		RevocationRefresh: duration{time.Hour},
+		BanWindow:         duration{secure.DefaultBanWindow},
+		BanTime:           duration{secure.DefaultBanTime},
+		TarpitInterval:    duration{secure.DefaultTarpitInterval},
+		LoadInterval:      duration{time.Second},
+		LogFormat:         "text",
+	}
+}
+
+// flags defines flags that set the fields of c.
+func (c *serverConfig) flags(fs *flag.FlagSet) {
+	fs.Var(&c.Listen, "l", "Comma-separated addresses to listen on")
+	fs.StringVar(&c.Key, "key", c.Key, keyUsage)
+	fs.StringVar(&c.Pub, "pub", c.Pub, pubUsage)
+	fs.StringVar(&c.PreviousKey, "previous-key", c.PreviousKey, "Previous private key file or keychain:NAME, still used for clients that pinned it while rotating keys")
+	fs.TextVar(&c.PreviousKeyExpires, "previous-key-expires", c.PreviousKeyExpires, "When to stop using -previous-key, in RFC 3339 format (default: never)")
+	fs.StringVar(&c.AuthorizedKeys, "authorized-keys", c.AuthorizedKeys, "Only accept client keys listed in this file, which may be an OpenSSH authorized_keys file")
+	fs.StringVar(&c.RevocationList, "revocation-list", c.RevocationList, "Refuse the keys listed in this file or at this http(s) URL")
+	fs.Var(&c.RevocationRefresh, "revocation-refresh", "How often to read -revocation-list again")
+	fs.Var(&c.HandshakeTimeout, "handshake-timeout", "How long a client may take to complete the handshake")
+	fs.Var(&c.IdleTimeout, "idle-timeout", "Close connections without messages for this long")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "How long to wait for connections to finish on SIGINT or SIGTERM")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "Append logs to this file instead of standard error")
+	fs.TextVar(&c.LogLevel, "log-level", c.LogLevel, "Least severe level logged: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log as plain text or as one JSON object per line: text or json")
+	fs.BoolVar(&c.TraceFrames, "vv", c.TraceFrames, "Log every frame at debug level, with hex dumps of its ciphertext and plaintext")
+	fs.StringVar(&c.TorControl, "tor-control", c.TorControl, "Publish the first -l address as a Tor onion service through this control port")
+	fs.StringVar(&c.OnionKey, "onion-key", c.OnionKey, "Onion service key file, created if missing, to keep the same onion address")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Take client addresses from PROXY protocol headers. Only behind a trusted proxy")
+	fs.BoolVar(&c.MDNS, "mdns", c.MDNS, "Announce the first -l address on the local network with mDNS")
+	fs.BoolVar(&c.Relay, "relay", c.Relay, "Relay connections between clients instead of echoing")
+	fs.StringVar(&c.Forward, "forward", c.Forward, "Forward connections to this TCP address instead of echoing, for gochal2 tunnel")
+	fs.StringVar(&c.Reverse, "reverse", c.Reverse, "Accept plaintext connections on this address and forward them to gochal2 expose clients")
+	fs.BoolVar(&c.SOCKS, "socks", c.SOCKS, "Run a SOCKS5 proxy for gochal2 tunnel clients instead of echoing")
+	fs.BoolVar(&c.LoadTest, "load-test", c.LoadTest, "Sink and source data at full speed for gochal2 bench -load instead of echoing, logging each connection's throughput")
+	fs.Var(&c.LoadInterval, "load-interval", "How often to log the throughput of -load-test connections")
+	fs.Var(&c.CipherSuites, "cipher-suites", suitesUsage)
+	fs.TextVar(&c.Noise, "noise", c.Noise, "Run Noise handshakes, with the pattern clients ask for: none, XX or IK")
+	fs.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "Limit each connection's reads and writes to this many bytes per second (default: unlimited)")
+	fs.IntVar(&c.RateLimitBurst, "rate-limit-burst", c.RateLimitBurst, "How many bytes a connection may send or receive at once under -rate-limit (default: a second's worth)")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "Refuse connections while this many are open (default: unlimited)")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", c.MaxConnsPerIP, "Refuse connections from an IP address while this many from it are open (default: unlimited)")
+	fs.StringVar(&c.IPFilter, "ip-filter", c.IPFilter, "Only accept connections from the networks this file allows, with lines such as \"allow 192.0.2.0/24\" and \"deny 192.0.2.7\"")
+	fs.IntVar(&c.BanFailures, "ban-failures", c.BanFailures, "Ban addresses whose connections fail this many handshakes or decryptions within -ban-window (default: never)")
+	fs.Var(&c.BanWindow, "ban-window", "How long failures count towards -ban-failures")
+	fs.Var(&c.BanTime, "ban-time", "How long to refuse connections from banned addresses")
+	fs.IntVar(&c.TarpitConns, "tarpit-conns", c.TarpitConns, "Keep up to this many connections of clients with refused keys open, trickling bytes to them, instead of closing them")
+	fs.Var(&c.TarpitInterval, "tarpit-interval", "How often to send a byte to connections in the tarpit")
+	fs.IntVar(&c.MaxHandlers, "max-handlers", c.MaxHandlers, "Serve at most this many connections at once, accepting more as they finish (default: unlimited)")
+	fs.BoolVar(&c.RejectWhenBusy, "reject-when-busy", c.RejectWhenBusy, "Close new connections while -max-handlers are served, instead of waiting")
+	fs.Var(&c.MaxConnLifetime, "max-conn-lifetime", "Close connections served for this long (default: never)")
+	fs.StringVar(&c.Admin, "admin", c.Admin, "Serve the list of open connections as JSON over plain HTTP at /conns on this address. Keep it private")
+	fs.BoolVar(&c.LockMemory, "lock-memory", c.LockMemory, "Lock private and session keys into RAM so they are never swapped to disk")
+}
+
+// secureConfig returns the config of the server's connections, with the
+// key pair in the key file, or generated if there is none.
+func (c *serverConfig) secureConfig(generated *secure.KeyPair, logger *slog.Logger) (*secure.Config, error) {
+	keys, err := loadKeys(c.Key, c.Pub)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = generated
+	}
+	config := &secure.Config{
+		Keys:             keys,
+		HandshakeTimeout: c.HandshakeTimeout.Duration,
+		IdleTimeout:      c.IdleTimeout.Duration,
+		ProxyProtocol:    c.ProxyProtocol,
+		CipherSuites:     c.CipherSuites,
+		Noise:            c.Noise,
+		Logger:           logger,
+		TraceFrames:      c.TraceFrames,
+		ReadRateLimit:    c.RateLimit,
+		WriteRateLimit:   c.RateLimit,
+		RateLimitBurst:   c.RateLimitBurst,
+		MaxConns:         c.MaxConns,
+		MaxConnsPerIP:    c.MaxConnsPerIP,
+		TarpitConns:      c.TarpitConns,
+		TarpitInterval:   c.TarpitInterval.Duration,
+		MaxConnLifetime:  c.MaxConnLifetime.Duration,
+		LockMemory:       c.LockMemory,
+	}
+	if config.KeyLogWriter, err = keyLogWriter(); err != nil {
+		return nil, err
+	}
+	if c.PreviousKey != "" {
+		prev, err := loadKeyPair(c.PreviousKey)
+		if err != nil {
+			return nil, err
+		}
+		config.PreviousKeys = []secure.PreviousKey{{Keys: prev, Expires: c.PreviousKeyExpires}}
+	}
+	if c.LockMemory {
+		if err := secure.LockKeyPair(keys); err != nil {
+			return nil, err
+		}
+		for _, prev := range config.PreviousKeys {
+			if err := secure.LockKeyPair(prev.Keys); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.AuthorizedKeys != "" {
+		ak, err := secure.LoadAuthorizedKeys(c.AuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		config.AuthorizedKeys = ak
+	}
+	if c.IPFilter != "" {
+		f, err := secure.LoadIPFilter(c.IPFilter)
+		if err != nil {
+			return nil, err
+		}
+		config.IPFilter = f
+	}
+	if c.RevocationList != "" {
+		rl, err := secure.LoadRevocationList(context.Background(), c.RevocationList)
+		if err != nil {
+			return nil, err
+		}
+		config.RevocationList = rl
+	}
+	return config, nil
+}
+
+// banner returns the banner of the ban settings, or nil if bans are off.
+func (c *serverConfig) banner() *secure.Banner {
+	if c.BanFailures <= 0 {
+		return nil
+	}
+	return &secure.Banner{MaxFailures: c.BanFailures, Window: c.BanWindow.Duration, BanTime: c.BanTime.Duration}
+}
+
+// refreshRevocations refreshes the revocation list of config, if any, every
+// revocation_refresh, until the returned function is called.
+func (c *serverConfig) refreshRevocations(config *secure.Config, logger *slog.Logger) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.RevocationList != nil && c.RevocationRefresh.Duration > 0 {
+		go config.RevocationList.RefreshEvery(ctx, c.RevocationRefresh.Duration, logger)
+	}
+	return cancel
+}
+
+// load reads the TOML file at path into c, leaving fields the file does not
+// set unchanged.
+func (c *serverConfig) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return toml.NewDecoder(f).DisallowUnknownFields().Decode(c)
+}
+
+// logger returns the logger to log to w with, as configured by c.
+func (c *serverConfig) logger(w io.Writer) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: c.LogLevel}
+	if c.TraceFrames {
+		opts.Level = min(c.LogLevel, slog.LevelDebug)
+	}
+	switch c.LogFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", c.LogFormat)
+}
+
+// stringList is a list of strings, set from a comma-separated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+// suiteList is a list of cipher suites, set from a comma-separated flag of
+// their names.
+type suiteList []secure.CipherSuite
+
+// suitesUsage is the usage of the flags that set a suiteList.
+const suitesUsage = "Comma-separated cipher suites to accept, in order of preference: box, xchacha20-poly1305 or aes-256-gcm (default: all, box first)"
+
+func (l *suiteList) String() string {
+	names := make([]string, len(*l))
+	for i, s := range *l {
+		names[i] = s.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *suiteList) Set(s string) error {
+	*l = nil
+	for _, name := range strings.Split(s, ",") {
+		var suite secure.CipherSuite
+		if err := suite.UnmarshalText([]byte(name)); err != nil {
+			return err
+		}
+		*l = append(*l, suite)
+	}
+	return nil
+}
+
+// duration is a time.Duration written as a string such as "10s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d *duration) Set(s string) error {
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+func TestServerConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gochal2.toml")
+	file := `
+listen = [":9000", ":9001"]
+key = "server.key"
+previous_key = "old.key"
+previous_key_expires = 2026-12-01T00:00:00Z
+handshake_timeout = "3s"
+log_level = "debug"
+log_format = "json"
+cipher_suites = ["aes-256-gcm", "box"]
+noise = "XX"
+`
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultServerConfig()
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cfg.flags(fs)
+	if err := cfg.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-key", "other.key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &serverConfig{
+		Listen:             stringList{":9000", ":9001"},
+		Key:                "other.key",
+		PreviousKey:        "old.key",
+		PreviousKeyExpires: time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC),
+		HandshakeTimeout:   duration{3 * time.Second},
+		IdleTimeout:        duration{5 * time.Minute},
+		ShutdownTimeout:    duration{30 * time.Second},
+		RevocationRefresh:  duration{time.Hour},
+		LogLevel:           slog.LevelDebug,
+		LogFormat:          "json",
+		CipherSuites:       suiteList{secure.SuiteAES256GCM, secure.SuiteBox},
+		Noise:              secure.NoiseXX,
+		BanWindow:          duration{secure.DefaultBanWindow},
+		BanTime:            duration{secure.DefaultBanTime},
+		TarpitInterval:     duration{secure.DefaultTarpitInterval},
+		LoadInterval:       duration{time.Second},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("Unexpected result:\nGot:\t\t%+v\nExpected:\t%+v", cfg, want)
+	}
+
+	// Typos in the file are reported rather than ignored.
+	if err := os.WriteFile(path, []byte(`lisen = [":9000"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := defaultServerConfig().load(path); err == nil {
+		t.Fatal("Unexpected result. Loaded an unknown field.")
+	}
+}
+
+func TestServerConfigLogger(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := defaultServerConfig()
+	cfg.LogFormat = "json"
+	logger, err := cfg.logger(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	logger.Info("handshake failed", "remote", "127.0.0.1:1234")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Unexpected error: %v, expected one JSON record in %q", err, buf.String())
+	}
+	if record["msg"] != "handshake failed" || record["remote"] != "127.0.0.1:1234" {
+		t.Fatalf("Unexpected record: %v", record)
+	}
+
+	// Tracing frames logs at debug level, whatever log_level says.
+	buf.Reset()
+	cfg.TraceFrames = true
+	if logger, err = cfg.logger(&buf); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("frame")
+	if buf.Len() == 0 {
+		t.Fatal("Unexpected result. Debug records are dropped despite trace_frames.")
+	}
+
+	cfg.LogFormat = "xml"
+	if _, err := cfg.logger(&buf); err == nil {
+		t.Fatal("Unexpected result. Accepted an unknown log format.")
+	}
+}
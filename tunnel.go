@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/jppunnett/gochal2/secure"
+)
+
+// tunnel forwards the plaintext connections made to a local address through
+// secure connections to a server run with "serve -forward", which forwards
+// them on to its target.
+func tunnel(fs *flag.FlagSet, args []string) {
+	client := clientFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	listenAddr, addr := fs.Arg(0), fs.Arg(1)
+
+	config, err := client.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("forwarding %s to %s", l.Addr(), addr)
+	log.Fatal(secure.ServeTunnel(l, addr, config))
+}